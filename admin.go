@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAddr is the address of the separate admin listener. When it is empty
+// the admin endpoints are served on the public port.
+var adminAddr string
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token. The
+// admin API is disabled entirely when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeError(w, r, http.StatusForbidden, "admin_disabled", "Admin API is disabled")
+			return
+		}
+
+		expected := []byte("Bearer " + adminToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeError(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// registerAdminRoutes adds the admin API, debug endpoints and admin UI.
+func registerAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/conflicts", requireAdmin(conflictsHandler)).Methods("GET")
+	if auditEnabled {
+		r.HandleFunc("/admin/audit", requireAdmin(auditHandler)).Methods("GET")
+	}
+	r.HandleFunc("/admin/status", requireAdmin(statusHandler)).Methods("GET")
+	r.HandleFunc("/admin/stats", requireAdmin(statsHandler)).Methods("GET")
+	r.HandleFunc("/admin/coverage", requireAdmin(coverageHandler)).Methods("GET")
+	if len(selftestCanaries) > 0 {
+		r.HandleFunc("/admin/selftest", requireAdmin(selftestHandler)).Methods("GET")
+	}
+	r.HandleFunc("/admin/refresh", requireAdmin(requireWritable(rejectUpdates(refreshHandler)))).Methods("POST")
+	// GET too, as Kubernetes preStop hooks can only send GET.
+	r.HandleFunc("/admin/drain", requireAdmin(withoutWriteDeadline(drainHandler))).Methods("GET", "POST")
+	r.HandleFunc("/admin/rollback", requireAdmin(requireWritable(rollbackHandler))).Methods("POST")
+	r.HandleFunc("/admin/stage", requireAdmin(requireWritable(rejectUpdates(stageHandler)))).Methods("POST")
+	r.HandleFunc("/admin/staged", requireAdmin(stagedHandler)).Methods("GET")
+	r.HandleFunc("/admin/staged", requireAdmin(requireWritable(discardStagedHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/promote", requireAdmin(requireWritable(promoteHandler))).Methods("POST")
+	r.HandleFunc("/admin/changes", requireAdmin(changesHandler)).Methods("GET")
+	r.HandleFunc("/admin/export", requireAdmin(exportHandler)).Methods("GET")
+	r.HandleFunc("/admin/backup", requireAdmin(backupHandler)).Methods("GET")
+	r.HandleFunc("/admin/restore", requireAdmin(requireWritable(restoreHandler))).Methods("POST")
+	r.HandleFunc("/admin/keys", requireAdmin(listAPIKeysHandler)).Methods("GET")
+	r.HandleFunc("/admin/keys", requireAdmin(requireWritable(createAPIKeyHandler))).Methods("POST")
+	r.HandleFunc("/admin/keys/{id}", requireAdmin(getAPIKeyHandler)).Methods("GET")
+	r.HandleFunc("/admin/keys/{id}", requireAdmin(requireWritable(updateAPIKeyHandler))).Methods("PUT")
+	r.HandleFunc("/admin/keys/{id}", requireAdmin(requireWritable(deleteAPIKeyHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/usage", requireAdmin(usageHandler)).Methods("GET")
+	r.HandleFunc("/admin/overrides", requireAdmin(listOverridesHandler)).Methods("GET")
+	r.HandleFunc("/admin/overrides", requireAdmin(requireWritable(createOverrideHandler))).Methods("POST")
+	r.HandleFunc("/admin/overrides/{id}", requireAdmin(getOverrideHandler)).Methods("GET")
+	r.HandleFunc("/admin/overrides/{id}", requireAdmin(requireWritable(updateOverrideHandler))).Methods("PUT")
+	r.HandleFunc("/admin/overrides/{id}", requireAdmin(requireWritable(deleteOverrideHandler))).Methods("DELETE")
+	r.HandleFunc("/admin/watches", requireAdmin(listWatchesHandler)).Methods("GET")
+	r.HandleFunc("/admin/watches", requireAdmin(requireWritable(createWatchHandler))).Methods("POST")
+	r.HandleFunc("/admin/watches/changes", requireAdmin(watchChangesHandler)).Methods("GET")
+	r.HandleFunc("/admin/watches/{id}", requireAdmin(getWatchHandler)).Methods("GET")
+	r.HandleFunc("/admin/watches/{id}", requireAdmin(requireWritable(deleteWatchHandler))).Methods("DELETE")
+	registerDebugRoutes(r)
+	r.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	r.PathPrefix("/ui/").Handler(uiHandler())
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Lookup analytics are sent to ANALYTICS_URL as batches of JSON lines, which
+// is what ClickHouse inserts with FORMAT JSONEachRow and what most HTTP
+// collectors take. Events carry no IP, neither the caller's nor the looked
+// up one, so traffic can be analysed without handling personal data.
+
+const (
+	analyticsQueueSize = 10000
+	analyticsTimeout   = 10 * time.Second
+)
+
+const (
+	analyticsFound    = "found"
+	analyticsNotFound = "not_found"
+	analyticsInvalid  = "invalid"
+	analyticsError    = "error"
+)
+
+var (
+	analyticsURL           string
+	analyticsBatchSize     int
+	analyticsFlushInterval time.Duration
+	analyticsQueue         chan AnalyticsEvent
+	analyticsClient        = &http.Client{Timeout: analyticsTimeout}
+)
+
+// AnalyticsEvent is a lookup as sent to ANALYTICS_URL.
+type AnalyticsEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Endpoint is the route template, like /lookup/{ip}, never the path.
+	Endpoint       string  `json:"endpoint"`
+	Result         string  `json:"result"`
+	Country        string  `json:"country"`
+	LatencyMS      float64 `json:"latency_ms"`
+	DatasetVersion string  `json:"dataset_version"`
+}
+
+func loadAnalyticsConfig() error {
+	analyticsURL = os.Getenv("ANALYTICS_URL")
+	analyticsBatchSize = envInt("ANALYTICS_BATCH_SIZE", 1000)
+	analyticsFlushInterval = envDuration("ANALYTICS_FLUSH_INTERVAL", 10*time.Second)
+	if analyticsURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(analyticsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid ANALYTICS_URL, expected an http or https URL")
+	}
+	if analyticsBatchSize <= 0 || analyticsFlushInterval <= 0 {
+		return fmt.Errorf("ANALYTICS_BATCH_SIZE and ANALYTICS_FLUSH_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// startAnalyticsSender starts the goroutine that sends the queued events
+// when a batch is full or ANALYTICS_FLUSH_INTERVAL has passed. Delivery is
+// best effort: a batch that fails to send is logged and dropped.
+func startAnalyticsSender() {
+	if analyticsURL == "" {
+		return
+	}
+	analyticsQueue = make(chan AnalyticsEvent, analyticsQueueSize)
+	go func() {
+		ticker := time.NewTicker(analyticsFlushInterval)
+		defer ticker.Stop()
+		batch := make([]AnalyticsEvent, 0, analyticsBatchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := sendAnalytics(batch); err != nil {
+				log.Printf("Error sending %d analytics events: %v", len(batch), err)
+			}
+			batch = batch[:0]
+		}
+		for {
+			select {
+			case e := <-analyticsQueue:
+				batch = append(batch, e)
+				if len(batch) >= analyticsBatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+func sendAnalytics(events []AnalyticsEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	resp, err := analyticsClient.Post(analyticsURL, "application/x-ndjson", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("analytics sink returned %s", resp.Status)
+	}
+	return nil
+}
+
+// recordAnalytics queues an event for a lookup made by the request r that
+// took latency.
+func recordAnalytics(r *http.Request, info *IPInfo, err error, latency time.Duration) {
+	if analyticsQueue == nil || doNotPersist(r.Context()) {
+		return
+	}
+
+	e := AnalyticsEvent{
+		Timestamp:      time.Now().UTC(),
+		Endpoint:       r.URL.Path,
+		LatencyMS:      float64(latency.Microseconds()) / 1000,
+		DatasetVersion: datasetVersion(),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		e.Endpoint, _ = route.GetPathTemplate()
+	}
+	switch {
+	case err == nil && !info.Unknown:
+		e.Result = analyticsFound
+		e.Country = info.Country
+	case err == nil, errors.Is(err, errNotFound):
+		e.Result = analyticsNotFound
+	case errors.Is(err, errInvalidIP):
+		e.Result = analyticsInvalid
+	default:
+		e.Result = analyticsError
+	}
+
+	select {
+	case analyticsQueue <- e:
+	default:
+		// The sink is slower than the traffic; losing events beats
+		// slowing lookups down.
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The countries of the IPs looked up are counted per COUNTRY_ANOMALY_WINDOW.
+// At the end of each window, a country whose share of the window's lookups
+// exceeds its share over the COUNTRY_ANOMALY_BASELINE windows before by
+// COUNTRY_ANOMALY_THRESHOLD is reported through the log and the
+// country.anomaly webhook, so a sudden shift in the geography of the traffic
+// is noticed without watching dashboards. A country is reported again only
+// after its share went back to normal.
+
+// CountryAnomaly is a country whose share of the lookups spiked.
+type CountryAnomaly struct {
+	Country       string    `json:"country"`
+	CountryName   string    `json:"country_name,omitempty"`
+	Lookups       int64     `json:"lookups"`
+	Share         float64   `json:"share"`
+	BaselineShare float64   `json:"baseline_share"`
+	WindowStart   time.Time `json:"window_start"`
+	WindowEnd     time.Time `json:"window_end"`
+}
+
+// CountryAnomalyStatus is the state of the detection, for /admin/stats and
+// /debug/vars.
+type CountryAnomalyStatus struct {
+	Enabled bool   `json:"enabled"`
+	Window  string `json:"window,omitempty"`
+	// Active are the countries whose share is still above their baseline.
+	Active    []CountryAnomaly `json:"active"`
+	Alerts    int64            `json:"alerts"`
+	LastAlert *CountryAnomaly  `json:"last_alert,omitempty"`
+}
+
+// uncountedKey marks the context of lookups the service makes for itself,
+// like warm-up and client country checks, which aren't traffic.
+type uncountedKey struct{}
+
+var (
+	countryAnomalyWindow     time.Duration
+	countryAnomalyBaseline   int
+	countryAnomalyThreshold  float64
+	countryAnomalyMinLookups int64
+
+	// countryTrafficMu guards the counts of the current window, the
+	// baseline windows and the active anomalies.
+	countryTrafficMu     sync.Mutex
+	countryTraffic       = map[string]int64{}
+	countryTrafficStart  time.Time
+	countryBaseline      []map[string]int64
+	countryAnomalies     = map[string]CountryAnomaly{}
+	countryAnomalyAlerts int64
+	countryLastAnomaly   *CountryAnomaly
+)
+
+func loadCountryAnomalyConfig() {
+	countryAnomalyWindow = envDuration("COUNTRY_ANOMALY_WINDOW", 5*time.Minute)
+	countryAnomalyBaseline = envInt("COUNTRY_ANOMALY_BASELINE", 12)
+	countryAnomalyThreshold = envFloat("COUNTRY_ANOMALY_THRESHOLD", 0)
+	countryAnomalyMinLookups = int64(envInt("COUNTRY_ANOMALY_MIN_LOOKUPS", 1000))
+}
+
+func countryAnomaliesEnabled() bool {
+	return countryAnomalyThreshold > 0 && countryAnomalyWindow > 0 && countryAnomalyBaseline > 0
+}
+
+// startCountryAnomalyDetector closes a window every COUNTRY_ANOMALY_WINDOW.
+func startCountryAnomalyDetector() {
+	if !countryAnomaliesEnabled() {
+		return
+	}
+	countryTrafficStart = time.Now().UTC()
+	go func() {
+		ticker := time.NewTicker(countryAnomalyWindow)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			for _, a := range closeCountryWindow(now.UTC()) {
+				log.Printf("Warning: %s made %.1f%% of the lookups from %s to %s, up from %.1f%%", a.Country, 100*a.Share, a.WindowStart.Format(time.RFC3339), a.WindowEnd.Format(time.RFC3339), 100*a.BaselineShare)
+				sendWebhook("country.anomaly", a)
+			}
+		}
+	}()
+}
+
+// withoutCountryTraffic marks ctx so its lookups aren't counted.
+func withoutCountryTraffic(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uncountedKey{}, true)
+}
+
+// recordCountryTraffic counts a lookup that found the country of an IP,
+// whichever endpoint or listener made it. Do-not-persist lookups aren't
+// counted, like they aren't sent to analytics.
+func recordCountryTraffic(ctx context.Context, info *IPInfo) {
+	if !countryAnomaliesEnabled() || info == nil || info.Unknown || info.Country == "" || doNotPersist(ctx) {
+		return
+	}
+	if uncounted, _ := ctx.Value(uncountedKey{}).(bool); uncounted {
+		return
+	}
+	countryTrafficMu.Lock()
+	countryTraffic[info.Country]++
+	countryTrafficMu.Unlock()
+}
+
+// closeCountryWindow compares the shares of the window ending at end to the
+// baseline, moves the window into the baseline and returns the new
+// anomalies. Nothing is reported until the baseline has a full window, nor
+// for a window with fewer than COUNTRY_ANOMALY_MIN_LOOKUPS lookups.
+func closeCountryWindow(end time.Time) []CountryAnomaly {
+	countryTrafficMu.Lock()
+	defer countryTrafficMu.Unlock()
+	window, start := countryTraffic, countryTrafficStart
+	countryTraffic, countryTrafficStart = map[string]int64{}, end
+
+	var total, baselineTotal int64
+	for _, n := range window {
+		total += n
+	}
+	baseline := map[string]int64{}
+	for _, counts := range countryBaseline {
+		for country, n := range counts {
+			baseline[country] += n
+			baselineTotal += n
+		}
+	}
+	countryBaseline = append(countryBaseline, window)
+	if len(countryBaseline) > countryAnomalyBaseline {
+		countryBaseline = countryBaseline[1:]
+	}
+	if total == 0 || baselineTotal == 0 || total < countryAnomalyMinLookups {
+		return nil
+	}
+
+	shares := func(country string) (float64, float64) {
+		return float64(window[country]) / float64(total), float64(baseline[country]) / float64(baselineTotal)
+	}
+	for country := range countryAnomalies {
+		if share, baselineShare := shares(country); share-baselineShare < countryAnomalyThreshold {
+			log.Printf("%s is back to %.1f%% of the lookups", country, 100*share)
+			delete(countryAnomalies, country)
+		}
+	}
+	var anomalies []CountryAnomaly
+	for country, n := range window {
+		share, baselineShare := shares(country)
+		if _, active := countryAnomalies[country]; active || share-baselineShare < countryAnomalyThreshold {
+			continue
+		}
+		a := CountryAnomaly{
+			Country:       country,
+			Lookups:       n,
+			Share:         share,
+			BaselineShare: baselineShare,
+			WindowStart:   start,
+			WindowEnd:     end,
+		}
+		if c := lookupISOCountry(country, ""); c != nil {
+			a.CountryName = c.Name
+		}
+		countryAnomalies[country] = a
+		countryAnomalyAlerts++
+		countryLastAnomaly = &a
+		anomalies = append(anomalies, a)
+	}
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].Share > anomalies[j].Share })
+	return anomalies
+}
+
+func currentCountryAnomalyStatus() CountryAnomalyStatus {
+	status := CountryAnomalyStatus{Enabled: countryAnomaliesEnabled(), Active: []CountryAnomaly{}}
+	if !status.Enabled {
+		return status
+	}
+	status.Window = countryAnomalyWindow.String()
+	countryTrafficMu.Lock()
+	defer countryTrafficMu.Unlock()
+	for _, a := range countryAnomalies {
+		status.Active = append(status.Active, a)
+	}
+	sort.Slice(status.Active, func(i, j int) bool { return status.Active[i].Country < status.Active[j].Country })
+	status.Alerts = countryAnomalyAlerts
+	status.LastAlert = countryLastAnomaly
+	return status
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Client IPs are personal data. Each log sink can truncate them to their
+// network before they are written, keeping enough to tell traffic apart by
+// network without keeping who made which request.
+
+const (
+	defaultAnonymizeV4Bits = 24
+	defaultAnonymizeV6Bits = 48
+)
+
+// ipTruncation keeps the first v4 bits of IPv4 addresses and v6 bits of IPv6
+// ones. A nil *ipTruncation keeps addresses whole.
+type ipTruncation struct {
+	v4, v6 int
+}
+
+var (
+	accessLogAnonymize *ipTruncation
+	auditLogAnonymize  *ipTruncation
+)
+
+func loadAnonymizeConfig() error {
+	var err error
+	if accessLogAnonymize, err = parseIPTruncation("ACCESS_LOG_ANONYMIZE"); err != nil {
+		return err
+	}
+	auditLogAnonymize, err = parseIPTruncation("AUDIT_LOG_ANONYMIZE")
+	return err
+}
+
+// parseIPTruncation reads the environment variable name: false, true for
+// /24 and /48, or the IPv4 and IPv6 prefix lengths as "24,48".
+func parseIPTruncation(name string) (*ipTruncation, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	switch strings.ToLower(v) {
+	case "", "false":
+		return nil, nil
+	case "true":
+		return &ipTruncation{v4: defaultAnonymizeV4Bits, v6: defaultAnonymizeV6Bits}, nil
+	}
+	v4, v6, ok := strings.Cut(v, ",")
+	if ok {
+		t := &ipTruncation{}
+		var err4, err6 error
+		t.v4, err4 = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(v4), "/"))
+		t.v6, err6 = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(v6), "/"))
+		if err4 == nil && err6 == nil && t.v4 >= 0 && t.v4 <= 32 && t.v6 >= 0 && t.v6 <= 128 {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s %q, expected true, false or the IPv4 and IPv6 prefix lengths to keep, like 24,48", name, v)
+}
+
+// apply truncates ip to its network. Values that aren't IPs are returned
+// unchanged.
+func (t *ipTruncation) apply(ip string) string {
+	parsed := net.ParseIP(ip)
+	if t == nil || parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(t.v4, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(t.v6, 128)).String()
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// API keys identify the tenants using the lookup endpoints. Each key can have
+// its own rate limit, daily quota, permitted endpoints and visible fields.
+// Keys are stored hashed; the secret is only shown when the key is created.
+
+const (
+	apiKeyHeader = "X-API-Key"
+	apiKeyPrefix = "ipl_"
+
+	endpointLookup = "lookup"
+	endpointBatch  = "batch"
+	endpointWhois  = "whois"
+	endpointStream = "stream"
+	endpointEnrich = "enrich"
+)
+
+var validEndpoints = []string{endpointLookup, endpointBatch, endpointWhois, endpointStream, endpointEnrich}
+
+type APIKey struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the key, to tell keys apart without the secret.
+	Prefix string `json:"prefix"`
+	// RateLimit is in requests per second, 0 means unlimited.
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+	// DailyQuota is the number of requests per UTC day, 0 means unlimited.
+	DailyQuota int64 `json:"daily_quota"`
+	// Endpoints and Fields are allowlists, empty means everything.
+	Endpoints []string  `json:"endpoints"`
+	Fields    []string  `json:"fields"`
+	Disabled  bool      `json:"disabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiKeyUsage is a key's request count for the current UTC day.
+type apiKeyUsage struct {
+	day   string
+	count int64
+}
+
+var (
+	apiKeysRequired bool
+
+	apiKeysMu     sync.RWMutex
+	apiKeysByHash map[string]*APIKey
+	apiKeyLimiter map[int64]*rate.Limiter
+	apiKeyUsed    map[int64]*apiKeyUsage
+
+	errAPIKeyNotFound = errors.New("API key not found")
+)
+
+type apiKeyCtxKey struct{}
+
+func createAPIKeysTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			key_hash TEXT NOT NULL UNIQUE,
+			prefix TEXT NOT NULL,
+			rate_limit REAL NOT NULL DEFAULT 0,
+			rate_burst INTEGER NOT NULL DEFAULT 0,
+			daily_quota INTEGER NOT NULL DEFAULT 0,
+			endpoints TEXT NOT NULL DEFAULT '',
+			fields TEXT NOT NULL DEFAULT '',
+			disabled BOOLEAN NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create api_keys table: %v", err)
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func scanAPIKey(scan func(...interface{}) error) (*APIKey, string, error) {
+	var k APIKey
+	var hash, endpoints, fields string
+	var createdAt int64
+	err := scan(&k.ID, &k.Name, &hash, &k.Prefix, &k.RateLimit, &k.RateBurst, &k.DailyQuota, &endpoints, &fields, &k.Disabled, &createdAt)
+	if err != nil {
+		return nil, "", err
+	}
+	k.Endpoints = splitList(endpoints)
+	k.Fields = splitList(fields)
+	k.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return &k, hash, nil
+}
+
+const apiKeyColumns = "id, name, key_hash, prefix, rate_limit, rate_burst, daily_quota, endpoints, fields, disabled, created_at"
+
+// loadAPIKeys reads the keys into memory. It runs at startup and after every
+// change made through the admin API.
+func loadAPIKeys() error {
+	var used map[int64]*apiKeyUsage
+	if apiKeyUsed == nil {
+		var err error
+		used, err = loadTodaysUsage()
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Load().Query("SELECT " + apiKeyColumns + " FROM api_keys")
+	if err != nil {
+		return fmt.Errorf("failed to load API keys: %v", err)
+	}
+	defer rows.Close()
+
+	byHash := map[string]*APIKey{}
+	for rows.Next() {
+		k, hash, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return fmt.Errorf("failed to load API keys: %v", err)
+		}
+		byHash[hash] = k
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load API keys: %v", err)
+	}
+
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	apiKeysByHash = byHash
+	// Limiters are rebuilt so changed limits apply right away. Usage is
+	// kept, a key's quota doesn't start over when it is edited.
+	apiKeyLimiter = map[int64]*rate.Limiter{}
+	if apiKeyUsed == nil {
+		apiKeyUsed = used
+	}
+	for _, k := range byHash {
+		if k.RateLimit > 0 {
+			burst := k.RateBurst
+			if burst < 1 {
+				burst = int(k.RateLimit) + 1
+			}
+			apiKeyLimiter[k.ID] = rate.NewLimiter(rate.Limit(k.RateLimit), burst)
+		}
+	}
+	return nil
+}
+
+// requestAPIKey returns the key sent with r in the X-API-Key header or the
+// api_key query parameter.
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// apiKeyFromContext returns the key the request was authenticated with.
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	k, _ := ctx.Value(apiKeyCtxKey{}).(*APIKey)
+	return k
+}
+
+// requireAPIKey checks the request's API key against the key's permitted
+// endpoints, rate limit and daily quota, and records its usage. Requests without a key are let
+// through unless API_KEYS_REQUIRED is set.
+func requireAPIKey(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := requestAPIKey(r)
+		if secret == "" {
+			if apiKeysRequired {
+				writeError(w, r, http.StatusUnauthorized, "api_key_required", "An API key is required")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		var limiter *rate.Limiter
+		apiKeysMu.RLock()
+		k := apiKeysByHash[hashAPIKey(secret)]
+		if k != nil {
+			limiter = apiKeyLimiter[k.ID]
+		}
+		apiKeysMu.RUnlock()
+
+		if k == nil || k.Disabled {
+			writeError(w, r, http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
+			return
+		}
+		if len(k.Endpoints) > 0 && !containsString(k.Endpoints, endpoint) {
+			writeError(w, r, http.StatusForbidden, "endpoint_not_allowed", "This API key can't use this endpoint")
+			return
+		}
+		if limiter != nil && !limiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many requests, try again later")
+			return
+		}
+		if !useAPIKeyQuota(k) {
+			writeError(w, r, http.StatusTooManyRequests, "quota_exceeded", "Daily quota exceeded")
+			return
+		}
+
+		counter := &byteCounter{ResponseWriter: w}
+		next(counter, r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, k)))
+		if !doNotPersist(r.Context()) && !dbReadOnly {
+			recordUsage(k, counter.bytes)
+		}
+	}
+}
+
+// useAPIKeyQuota counts a request against the key's daily quota, returning
+// false when the quota is used up.
+func useAPIKeyQuota(k *APIKey) bool {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	apiKeysMu.Lock()
+	defer apiKeysMu.Unlock()
+	used := apiKeyUsed[k.ID]
+	if used == nil || used.day != day {
+		used = &apiKeyUsage{day: day}
+		apiKeyUsed[k.ID] = used
+	}
+	if k.DailyQuota > 0 && used.count >= k.DailyQuota {
+		return false
+	}
+	used.count++
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleInfo returns info as the request's API key may see it: only the
+// fields on its allowlist, plus the IP itself.
+func visibleInfo(r *http.Request, info *IPInfo) interface{} {
+	k := apiKeyFromContext(r.Context())
+	if k == nil || len(k.Fields) == 0 {
+		return info
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		return info
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return info
+	}
+	visible := map[string]interface{}{"ip": info.IP}
+	for _, field := range k.Fields {
+		if v, ok := all[field]; ok {
+			visible[field] = v
+		}
+	}
+	return visible
+}
+
+// visibleCountry is the country used for GeoJSON geometry, which would give
+// the country away when the key can't see it.
+func visibleCountry(r *http.Request, info *IPInfo) string {
+	k := apiKeyFromContext(r.Context())
+	if k == nil || len(k.Fields) == 0 || containsString(k.Fields, "country") {
+		return info.Country
+	}
+	return ""
+}
+
+// apiKeyRequest is the body of POST and PUT /admin/keys.
+type apiKeyRequest struct {
+	Name       string   `json:"name"`
+	RateLimit  float64  `json:"rate_limit"`
+	RateBurst  int      `json:"rate_burst"`
+	DailyQuota int64    `json:"daily_quota"`
+	Endpoints  []string `json:"endpoints"`
+	Fields     []string `json:"fields"`
+	Disabled   bool     `json:"disabled"`
+}
+
+func (req *apiKeyRequest) validate() error {
+	if strings.TrimSpace(req.Name) == "" {
+		return errors.New("name is required")
+	}
+	if req.RateLimit < 0 || req.RateBurst < 0 || req.DailyQuota < 0 {
+		return errors.New("rate_limit, rate_burst and daily_quota can't be negative")
+	}
+	for _, endpoint := range req.Endpoints {
+		if !containsString(validEndpoints, endpoint) {
+			return fmt.Errorf("unknown endpoint %q, expected one of: %s", endpoint, strings.Join(validEndpoints, ", "))
+		}
+	}
+	return nil
+}
+
+func decodeAPIKeyRequest(w http.ResponseWriter, r *http.Request) (*apiKeyRequest, bool) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Request body must be a JSON object")
+		return nil, false
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Invalid API key: "+err.Error())
+		return nil, false
+	}
+	return &req, true
+}
+
+func getAPIKey(id int64) (*APIKey, error) {
+	k, _, err := scanAPIKey(db.Load().QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = ?", id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, errAPIKeyNotFound
+	}
+	return k, err
+}
+
+func apiKeyID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "api_key_not_found", "API key not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeAPIKeyError maps errors of the key handlers to a response.
+func writeAPIKeyError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errAPIKeyNotFound):
+		writeError(w, r, http.StatusNotFound, "api_key_not_found", "API key not found")
+	case err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		writeError(w, r, http.StatusConflict, "api_key_exists", "An API key with this name already exists")
+	default:
+		logRequest(r, "API key error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+	}
+}
+
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Load().Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, _, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			writeAPIKeyError(w, r, err)
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func getAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+	k, err := getAPIKey(id)
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(k)
+}
+
+// createAPIKeyHandler creates a key and returns its secret, which can't be
+// retrieved later.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAPIKeyRequest(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	result, err := db.Load().Exec(`
+		INSERT INTO api_keys (name, key_hash, prefix, rate_limit, rate_burst, daily_quota, endpoints, fields, disabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, strings.TrimSpace(req.Name), hashAPIKey(secret), secret[:len(apiKeyPrefix)+6], req.RateLimit, req.RateBurst, req.DailyQuota,
+		strings.Join(req.Endpoints, ","), strings.Join(req.Fields, ","), req.Disabled, time.Now().UTC().Unix())
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	id, _ := result.LastInsertId()
+	if err := loadAPIKeys(); err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+
+	k, err := getAPIKey(id)
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	logRequest(r, "Created API key %d (%s)", k.ID, k.Name)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":     secret,
+		"api_key": k,
+	})
+}
+
+// updateAPIKeyHandler replaces the settings of a key. The secret stays the
+// same.
+func updateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeAPIKeyRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Load().Exec(`
+		UPDATE api_keys SET name = ?, rate_limit = ?, rate_burst = ?, daily_quota = ?, endpoints = ?, fields = ?, disabled = ?
+		WHERE id = ?
+	`, strings.TrimSpace(req.Name), req.RateLimit, req.RateBurst, req.DailyQuota, strings.Join(req.Endpoints, ","), strings.Join(req.Fields, ","), req.Disabled, id)
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeAPIKeyError(w, r, errAPIKeyNotFound)
+		return
+	}
+	if err := loadAPIKeys(); err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+
+	k, err := getAPIKey(id)
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	logRequest(r, "Updated API key %d (%s)", k.ID, k.Name)
+	json.NewEncoder(w).Encode(k)
+}
+
+func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := apiKeyID(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Load().Exec("DELETE FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeAPIKeyError(w, r, errAPIKeyNotFound)
+		return
+	}
+	if err := loadAPIKeys(); err != nil {
+		writeAPIKeyError(w, r, err)
+		return
+	}
+
+	logRequest(r, "Deleted API key %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Some datasets (db-ip, IPinfo Lite) may only be used with attribution, so
+// every dataset records where it came from and under which license.
+
+// Provenance describes where a dataset came from.
+type Provenance struct {
+	SourceURL string `json:"source_url,omitempty"`
+	// UpstreamVersion is the ETag or Last-Modified of the downloaded file.
+	UpstreamVersion string `json:"upstream_version,omitempty"`
+	License         string `json:"license,omitempty"`
+	Publisher       string `json:"publisher,omitempty"`
+	Attribution     string `json:"attribution,omitempty"`
+}
+
+var (
+	dataLicense       string
+	dataPublisher     string
+	dataAttribution   string
+	attributionHeader bool
+
+	// activeProvenance is the provenance of the active dataset.
+	activeProvenance atomic.Pointer[Provenance]
+)
+
+func loadAttributionConfig() {
+	dataLicense = os.Getenv("DATA_LICENSE")
+	dataPublisher = os.Getenv("DATA_PUBLISHER")
+	dataAttribution = os.Getenv("DATA_ATTRIBUTION")
+	attributionHeader = envBool("ATTRIBUTION_HEADER", false)
+}
+
+// newProvenance describes a dataset loaded from sourceURL with the
+// configured license details.
+func newProvenance(sourceURL, upstreamVersion string) Provenance {
+	return Provenance{
+		SourceURL:       redactURL(sourceURL),
+		UpstreamVersion: upstreamVersion,
+		License:         dataLicense,
+		Publisher:       dataPublisher,
+		Attribution:     dataAttribution,
+	}
+}
+
+// redactURL drops the credentials and query of u, where data providers put
+// their access tokens.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+func loadProvenance(id int64) (*Provenance, error) {
+	var p Provenance
+	err := db.Load().QueryRow(`
+		SELECT source_url, upstream_version, license, publisher, attribution FROM datasets WHERE id = ?
+	`, id).Scan(&p.SourceURL, &p.UpstreamVersion, &p.License, &p.Publisher, &p.Attribution)
+	if err == sql.ErrNoRows {
+		return &Provenance{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load provenance of dataset %d: %v", id, err)
+	}
+	return &p, nil
+}
+
+// RangeSource tells where the range a lookup matched came from: its provider
+// and the dataset it was loaded with.
+type RangeSource struct {
+	// Name is the source field of the range, set in datasets merged from
+	// several providers.
+	Name           string    `json:"name,omitempty"`
+	DatasetID      int64     `json:"dataset_id"`
+	DatasetVersion string    `json:"dataset_version"`
+	LoadedAt       time.Time `json:"loaded_at"`
+	Provenance
+}
+
+var (
+	// datasetSources caches the part of RangeSource that is the same for
+	// every range of a dataset, by dataset id, and rangeSources the
+	// RangeSource of each source name of the dataset, which are shared by
+	// the answers. Datasets don't change once loaded.
+	datasetSourcesMu sync.Mutex
+	datasetSources   = map[int64]*RangeSource{}
+	rangeSources     = map[rangeSourceKey]*RangeSource{}
+)
+
+type rangeSourceKey struct {
+	datasetID int64
+	name      string
+}
+
+// rangeSource returns the source of a range of the dataset, or nil when the
+// dataset can't be read.
+func rangeSource(datasetID int64, r *RangeRecord) *RangeSource {
+	key := rangeSourceKey{datasetID, r.Source}
+	datasetSourcesMu.Lock()
+	source, ok := rangeSources[key]
+	datasetSourcesMu.Unlock()
+	if ok {
+		return source
+	}
+
+	d, err := datasetSource(datasetID)
+	if err != nil {
+		log.Printf("Error loading the source of dataset %d: %v", datasetID, err)
+		return nil
+	}
+	source = new(RangeSource)
+	*source = *d
+	source.Name = r.Source
+	datasetSourcesMu.Lock()
+	rangeSources[key] = source
+	datasetSourcesMu.Unlock()
+	return source
+}
+
+// datasetSource returns the source of the dataset without a range name. The
+// active dataset's is loaded when it's published, so lookups answered while
+// the database is failing still have it.
+func datasetSource(id int64) (*RangeSource, error) {
+	datasetSourcesMu.Lock()
+	d, ok := datasetSources[id]
+	datasetSourcesMu.Unlock()
+	if ok {
+		return d, nil
+	}
+	d, err := loadDatasetSource(id)
+	if err != nil {
+		return nil, err
+	}
+	datasetSourcesMu.Lock()
+	datasetSources[id] = d
+	datasetSourcesMu.Unlock()
+	return d, nil
+}
+
+func purgeDatasetSources() {
+	datasetSourcesMu.Lock()
+	datasetSources = map[int64]*RangeSource{}
+	rangeSources = map[rangeSourceKey]*RangeSource{}
+	datasetSourcesMu.Unlock()
+}
+
+func loadDatasetSource(id int64) (*RangeSource, error) {
+	d := RangeSource{DatasetID: id}
+	var loadedAt int64
+	err := db.Load().QueryRow(`
+		SELECT version, loaded_at, source_url, upstream_version, license, publisher, attribution FROM datasets WHERE id = ?
+	`, id).Scan(&d.DatasetVersion, &loadedAt, &d.SourceURL, &d.UpstreamVersion, &d.License, &d.Publisher, &d.Attribution)
+	if err != nil {
+		return nil, err
+	}
+	d.LoadedAt = time.Unix(loadedAt, 0).UTC()
+	return &d, nil
+}
+
+func attributionHandler(w http.ResponseWriter, r *http.Request) {
+	p := activeProvenance.Load()
+	if p == nil {
+		p = &Provenance{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dataset_version":  datasetVersion(),
+		"source_url":       p.SourceURL,
+		"upstream_version": p.UpstreamVersion,
+		"license":          p.License,
+		"publisher":        p.Publisher,
+		"attribution":      p.Attribution,
+	})
+}
+
+// attributionMiddleware adds the attribution of the active dataset to every
+// response as X-Data-Attribution.
+func attributionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := activeProvenance.Load(); p != nil && p.Attribution != "" {
+			w.Header().Set("X-Data-Attribution", p.Attribution)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	auditQueueSize = 10000
+	auditBatchSize = 500
+)
+
+type AuditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent"`
+	Endpoint  string    `json:"endpoint"`
+	IP        string    `json:"ip"`
+	Found     bool      `json:"found"`
+}
+
+var (
+	auditEnabled       bool
+	auditRetentionDays int
+	auditQueue         chan AuditEntry
+)
+
+func createAuditTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS audit_log (
+			timestamp INTEGER,
+			client_ip TEXT,
+			user_agent TEXT,
+			endpoint TEXT,
+			ip TEXT,
+			found BOOLEAN
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit_log table: %v", err)
+	}
+
+	_, err = db.Load().Exec(`CREATE INDEX IF NOT EXISTS idx_audit_log_timestamp ON audit_log (timestamp)`)
+	if err != nil {
+		return fmt.Errorf("failed to create audit_log index: %v", err)
+	}
+	return nil
+}
+
+// startAuditWriter starts the goroutine that persists audit entries in
+// batches, so lookups never wait on the SQLite write lock.
+func startAuditWriter() {
+	auditQueue = make(chan AuditEntry, auditQueueSize)
+	go func() {
+		batch := make([]AuditEntry, 0, auditBatchSize)
+		for entry := range auditQueue {
+			batch = append(batch, entry)
+			// Drain whatever else is already queued into the same transaction.
+			for len(batch) < auditBatchSize && len(auditQueue) > 0 {
+				batch = append(batch, <-auditQueue)
+			}
+			if err := writeAuditEntries(batch); err != nil {
+				log.Printf("Error writing audit log: %v", err)
+			}
+			batch = batch[:0]
+		}
+	}()
+}
+
+func writeAuditEntries(entries []AuditEntry) error {
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO audit_log (timestamp, client_ip, user_agent, endpoint, ip, found)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, e := range entries {
+		_, err = stmt.Exec(e.Timestamp.Unix(), e.ClientIP, e.UserAgent, e.Endpoint, e.IP, e.Found)
+		if err != nil {
+			return fmt.Errorf("failed to insert audit entry: %v", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordAudit queues an audit entry for a lookup of ip made by the request r.
+func recordAudit(r *http.Request, ip string, found bool) {
+	if !auditEnabled {
+		return
+	}
+
+	entry := AuditEntry{
+		Timestamp: time.Now().UTC(),
+		ClientIP:  auditLogAnonymize.apply(getClientIP(r)),
+		UserAgent: r.UserAgent(),
+		Endpoint:  r.URL.Path,
+		IP:        ip,
+		Found:     found,
+	}
+
+	select {
+	case auditQueue <- entry:
+	default:
+		log.Printf("Warning: Audit queue is full, dropping entry for %s", ip)
+	}
+}
+
+// pruneAuditLog deletes audit entries older than the retention period.
+func pruneAuditLog() error {
+	if auditRetentionDays <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -auditRetentionDays)
+	result, err := db.Load().Exec("DELETE FROM audit_log WHERE timestamp < ?", cutoff.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to prune audit log: %v", err)
+	}
+
+	n, _ := result.RowsAffected()
+	if n > 0 {
+		log.Printf("Pruned %d audit log entries older than %d days", n, auditRetentionDays)
+	}
+	return nil
+}
+
+// parseTimeParam accepts either a date (2006-01-02) or an RFC 3339 timestamp.
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT timestamp, client_ip, user_agent, endpoint, ip, found
+		FROM audit_log
+		WHERE 1 = 1
+	`
+	var args []interface{}
+
+	params := r.URL.Query()
+	if v := params.Get("ip"); v != "" {
+		query += " AND ip = ?"
+		args = append(args, v)
+	}
+	if v := params.Get("client_ip"); v != "" {
+		// With AUDIT_LOG_ANONYMIZE, an address matches the entries of its
+		// network.
+		query += " AND client_ip = ?"
+		args = append(args, auditLogAnonymize.apply(v))
+	}
+	if v := params.Get("since"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid since")
+			return
+		}
+		query += " AND timestamp >= ?"
+		args = append(args, t.Unix())
+	}
+	if v := params.Get("until"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid until")
+			return
+		}
+		query += " AND timestamp < ?"
+		args = append(args, t.Unix())
+	}
+
+	limit := 100
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid limit")
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY timestamp DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Load().Query(query, args...)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var ts int64
+		if err := rows.Scan(&ts, &e.ClientIP, &e.UserAgent, &e.Endpoint, &e.IP, &e.Found); err != nil {
+			logRequest(r, "Database query error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		e.Timestamp = time.Unix(ts, 0).UTC()
+		entries = append(entries, e)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+	})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rebuilding a node from upstream means downloading and indexing the whole
+// dataset again, and loses API keys, overrides and watches. Backups are
+// consistent copies of the database made with SQLite's online backup API
+// while lookups go on, served by /admin/backup and written every
+// BACKUP_INTERVAL to BACKUP_DIR and/or BACKUP_S3_URL.
+
+const backupFilePrefix = "ip_ranges-"
+
+var (
+	backupInterval time.Duration
+	backupDir      string
+	backupKeep     int
+	backupS3       *s3Location
+)
+
+func loadBackupConfig() error {
+	backupInterval = envDuration("BACKUP_INTERVAL", 0)
+	backupDir = os.Getenv("BACKUP_DIR")
+	backupKeep = envInt("BACKUP_KEEP", 7)
+	if v := os.Getenv("BACKUP_S3_URL"); v != "" {
+		var err error
+		backupS3, err = loadS3Location(v)
+		if err != nil {
+			return err
+		}
+	}
+	if backupInterval > 0 && backupDir == "" && backupS3 == nil {
+		return fmt.Errorf("BACKUP_INTERVAL is set but neither BACKUP_DIR nor BACKUP_S3_URL is")
+	}
+	if backupDir != "" {
+		if err := os.MkdirAll(backupDir, 0755); err != nil {
+			return fmt.Errorf("failed to create BACKUP_DIR: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeBackup copies the database to a temporary file next to it, or in the
+// system temporary directory when it is read-only. The caller removes the
+// file.
+func writeBackup(ctx context.Context) (string, error) {
+	dir := filepath.Dir(dbFile)
+	if dbReadOnly {
+		dir = os.TempDir()
+	}
+	f, err := os.CreateTemp(dir, "backup_*.db")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	f.Close()
+	if err := backupSQLite(ctx, db.Load(), f.Name()); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to back up database: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// checkBackup makes sure the file at path is an intact database with an
+// active dataset, and returns the version of that dataset.
+func checkBackup(path string) (string, error) {
+	backup, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return "", err
+	}
+	defer backup.Close()
+
+	var result string
+	if err := backup.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return "", fmt.Errorf("not a database: %v", err)
+	}
+	if result != "ok" {
+		return "", fmt.Errorf("the database is corrupted: %s", result)
+	}
+	var version string
+	err = backup.QueryRow(`
+		SELECT d.version
+		FROM metadata m JOIN datasets d ON d.id = CAST(m.value AS INTEGER)
+		WHERE m.key = 'active_dataset_id'
+	`).Scan(&version)
+	if err != nil {
+		return "", fmt.Errorf("the database has no active dataset")
+	}
+	return version, nil
+}
+
+// saveBackupFile writes r, a database or a gzipped one, to a temporary file
+// in the data directory. The caller removes the file.
+func saveBackupFile(r io.Reader) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(dbFile), "restore_*.db")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("failed to decompress backup: %v", err)
+		}
+		defer gz.Close()
+		src = gz
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to save backup: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to save backup: %v", err)
+	}
+	return f.Name(), nil
+}
+
+// restoreDatabaseFile replaces the database file with the backup at path
+// before the server opens it, for --restore.
+func restoreDatabaseFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer in.Close()
+	tmp, err := saveBackupFile(in)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	version, err := checkBackup(tmp)
+	if err != nil {
+		return fmt.Errorf("invalid backup %s: %v", path, err)
+	}
+	dst, err := openDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	if err := restoreSQLite(context.Background(), dst, tmp); err != nil {
+		return fmt.Errorf("failed to restore %s: %v", path, err)
+	}
+	log.Printf("Restored the database from %s, dataset %s", path, version)
+	return nil
+}
+
+// restoreDatabase replaces the live database with the checked backup at path
+// and reloads everything lookups keep in memory. It takes the refresh slot so
+// no reload writes to the database meanwhile.
+func restoreDatabase(ctx context.Context, path string) (err error) {
+	if !beginRefresh(refreshTriggerRestore) {
+		return errRefreshInProgress
+	}
+	defer func() { endRefresh(err) }()
+	err = restoreSQLite(ctx, db.Load(), path)
+	if err == nil {
+		err = prepareDatabase()
+	}
+	if err == nil {
+		purgeNegativeCache()
+		purgeLastGoodCache()
+	}
+	return err
+}
+
+// backupHandler streams a consistent copy of the database.
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	path, err := writeBackup(r.Context())
+	if err != nil {
+		logRequest(r, "Backup error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		logRequest(r, "Backup error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer f.Close()
+
+	clearWriteDeadline(w)
+	name := backupFilePrefix + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set(datasetVersionHeader, datasetVersion())
+	if fi, err := f.Stat(); err == nil {
+		w.Header().Set("Content-Length", fmt.Sprint(fi.Size()))
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		logRequest(r, "Error streaming backup: %v", err)
+	}
+}
+
+// restoreHandler replaces the database with the backup in the request body,
+// plain or gzipped.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	clearWriteDeadline(w)
+
+	path, err := saveBackupFile(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Request body must be a database backup")
+		return
+	}
+	defer os.Remove(path)
+	version, err := checkBackup(path)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Invalid backup: "+err.Error())
+		return
+	}
+
+	err = restoreDatabase(r.Context(), path)
+	if err == errRefreshInProgress {
+		writeError(w, r, http.StatusConflict, "refresh_in_progress", "A dataset refresh is in progress, try again later")
+		return
+	} else if err != nil {
+		logRequest(r, "Restore error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	logRequest(r, "Restored the database from a backup, dataset %s", version)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":            "restored",
+		"dataset_version":   datasetVersion(),
+		"active_dataset_id": activeDatasetID.Load(),
+	})
+}
+
+// runScheduledBackup writes a gzipped backup to BACKUP_DIR and BACKUP_S3_URL.
+func runScheduledBackup() error {
+	ctx := context.Background()
+	path, err := writeBackup(ctx)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	name := backupFilePrefix + time.Now().UTC().Format("20060102T150405Z") + ".db.gz"
+	gzPath := path + ".gz"
+	if err := gzipFile(path, gzPath); err != nil {
+		return err
+	}
+	defer os.Remove(gzPath)
+
+	if backupDir != "" {
+		dest := filepath.Join(backupDir, name)
+		if err := copyFile(gzPath, dest); err != nil {
+			return fmt.Errorf("failed to write %s: %v", dest, err)
+		}
+		log.Printf("Backed up the database to %s", dest)
+		if err := pruneBackups(backupDir, backupKeep); err != nil {
+			log.Printf("Error pruning backups: %v", err)
+		}
+	}
+	if backupS3 != nil {
+		if err := backupS3.put(ctx, name, gzPath); err != nil {
+			return fmt.Errorf("failed to upload backup: %v", err)
+		}
+		log.Printf("Backed up the database to %s", backupS3.url(name))
+	}
+	return nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return fmt.Errorf("failed to compress backup: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress backup: %v", err)
+	}
+	return out.Close()
+}
+
+// copyFile copies src to dst through a temporary file, so dst is never seen
+// half written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".backup_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := io.Copy(tmp, in); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// pruneBackups deletes all but the newest keep backups of dir.
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), backupFilePrefix) && strings.HasSuffix(e.Name(), ".db.gz") {
+			names = append(names, e.Name())
+		}
+	}
+	// The names carry the time, so they sort oldest first.
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
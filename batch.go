@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const defaultBatchMaxSize = 1000
+
+var batchMaxSize int
+
+// BatchError takes the place of an IPInfo in batch results for IPs that
+// couldn't be looked up.
+type BatchError struct {
+	IP    string      `json:"ip"`
+	Error ErrorDetail `json:"error"`
+}
+
+// batchLookupHandler looks up a JSON array of IPs and hostnames and returns
+// the results in the same order, repeated IPs being looked up only once.
+func batchLookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkFormat(w, r) {
+		return
+	}
+
+	var ips []string
+	body := http.MaxBytesReader(w, r.Body, int64(batchMaxSize)*256)
+	if err := json.NewDecoder(body).Decode(&ips); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "batch_too_large", "Request body is too large")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Request body must be a JSON array of IP addresses")
+		return
+	}
+	if len(ips) > batchMaxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "batch_too_large", "Too many IPs in one batch, send them as NDJSON to stream them")
+		return
+	}
+	r, ok := withHistoricalDataset(w, r)
+	if !ok {
+		return
+	}
+
+	var hosts []string
+	if batchHostnames {
+		seen := make(map[string]bool)
+		for _, ip := range ips {
+			if _, err := netip.ParseAddr(ip); err != nil && isHostname(ip) && !seen[ip] {
+				seen[ip] = true
+				hosts = append(hosts, ip)
+			}
+		}
+	}
+	resolved := resolveHostnames(r.Context(), hosts)
+
+	// Batches from log pipelines repeat the same IPs over and over; each is
+	// looked up once and its result copied to the other places it appears,
+	// including the addresses of hostnames.
+	type lookup struct {
+		result  interface{}
+		country string
+	}
+	lookups := make(map[string]lookup, len(ips))
+	lookupOnce := func(ip string) lookup {
+		if l, ok := lookups[ip]; ok {
+			return l
+		}
+		var l lookup
+		info, err := lookupForRequest(r, ip)
+		if err != nil {
+			_, code, message := lookupErrorCode(err)
+			l.result = BatchError{IP: ip, Error: ErrorDetail{Code: code, Message: message}}
+		} else {
+			decorateInfo(w, r, info)
+			l.result, l.country = visibleInfo(r, info), visibleCountry(r, info)
+		}
+		lookups[ip] = l
+		return l
+	}
+
+	results := make([]interface{}, len(ips))
+	features := make([]GeoJSONFeature, len(ips))
+	for i, ip := range ips {
+		res, ok := resolved[ip]
+		if !ok {
+			l := lookupOnce(ip)
+			results[i], features[i] = l.result, geoJSONFeature(l.country, l.result)
+			continue
+		}
+
+		// The feature of a hostname is placed at the first of its addresses
+		// with a known country.
+		result := HostnameResult{Hostname: ip, Error: res.err}
+		var country string
+		for _, addr := range res.addrs {
+			l := lookupOnce(addr.String())
+			result.Addresses = append(result.Addresses, l.result)
+			if country == "" {
+				country = l.country
+			}
+		}
+		results[i], features[i] = result, geoJSONFeature(country, result)
+	}
+
+	w.Header().Add("Vary", "Accept")
+	switch format := responseFormat(r); format {
+	case formatGeoJSON:
+		writeGeoJSON(w, GeoJSONFeatureCollection{Type: "FeatureCollection", Features: features})
+	case formatXML, formatMsgpack:
+		writeFormatted(w, http.StatusOK, format, results, "lookups", "lookup")
+	default:
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+// ndjsonContentTypes are the Content-Types of batches streamed as NDJSON.
+var ndjsonContentTypes = map[string]bool{
+	"application/x-ndjson": true,
+	"application/jsonl":    true,
+}
+
+// isNDJSONBatch reports whether r is a batch sent as NDJSON.
+func isNDJSONBatch(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPost && r.URL.Path == "/lookup" && ndjsonContentTypes[mediaType]
+}
+
+// ndjsonBatchHandler looks up a batch of any size sent as NDJSON, an IP per
+// line, and writes a result per line in the same order as the lines arrive.
+// Neither side holds the whole batch: results are flushed whenever the
+// client has nothing more sent yet, and BATCH_MAX_SIZE doesn't apply.
+func ndjsonBatchHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logRequest(r, "Failed to enable full duplex: %v", err)
+	}
+	// The batch lasts as long as the client keeps sending.
+	rc.SetReadDeadline(time.Time{})
+	clearWriteDeadline(w)
+
+	r, ok := withHistoricalDataset(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	br := bufio.NewReaderSize(r.Body, streamMaxMessage)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			enc.Encode(ErrorResponse{Error: ErrorDetail{Code: "invalid_body", Message: "Lines must be shorter than 64KB", RequestID: requestID(r.Context())}})
+			bw.Flush()
+			return
+		}
+		if ip, ok := ndjsonIP(line); ok {
+			if enc.Encode(streamLookup(w, r, ip)) != nil {
+				return
+			}
+		}
+		if err != nil || br.Buffered() == 0 {
+			if bw.Flush() != nil || rc.Flush() != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				logRequest(r, "Batch body error: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// ndjsonIP returns the IP of an NDJSON line, a JSON string or the bare
+// address, and whether the line has one at all.
+func ndjsonIP(line []byte) (string, bool) {
+	s := strings.TrimSpace(string(line))
+	if s == "" {
+		return "", false
+	}
+	var ip string
+	if s[0] == '"' && json.Unmarshal([]byte(s), &ip) == nil {
+		return ip, true
+	}
+	return s, true
+}
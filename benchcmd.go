@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The bench command replays a list of IPs against a running server and
+// reports the latency percentiles, to compare builds before they ship:
+//
+//	ip-lookup bench --url http://localhost:8080 --input ips.txt --concurrency 32
+
+// benchResult is the outcome of one request of the bench command.
+type benchResult struct {
+	latency time.Duration
+	// status is the HTTP status, or 0 when the request failed.
+	status int
+}
+
+func runBenchCommand(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "Server to send the lookups to")
+	input := flags.String("input", "-", "File with one IP per line, - for stdin")
+	concurrency := flags.Int("concurrency", 16, "Number of lookups in flight")
+	duration := flags.Duration("duration", 0, "Replay the IPs over and over for this long (default once)")
+	apiKey := flags.String("api-key", "", "API key sent with every lookup")
+	timeout := flags.Duration("timeout", 10*time.Second, "Timeout of each lookup")
+	flags.Parse(args)
+
+	if *concurrency < 1 {
+		log.Fatalf("Invalid --concurrency %d, expected at least 1", *concurrency)
+	}
+	ips, err := readBenchIPs(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(ips) == 0 {
+		log.Fatalf("No IPs in %s", *input)
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	base := strings.TrimSuffix(*baseURL, "/")
+	var next atomic.Int64
+	deadline := time.Now().Add(*duration)
+	results := make([][]benchResult, *concurrency)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if *duration > 0 {
+					if time.Now().After(deadline) {
+						return
+					}
+				} else if i >= len(ips) {
+					return
+				}
+				results[w] = append(results[w], benchLookup(client, base+"/lookup/"+url.PathEscape(ips[i%len(ips)]), *apiKey))
+			}
+		}()
+	}
+	wg.Wait()
+	printBenchReport(os.Stdout, slices.Concat(results...), time.Since(start))
+}
+
+// readBenchIPs reads the IPs from path, skipping blank lines and lines
+// starting with #.
+func readBenchIPs(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var ips []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		ip := strings.TrimSpace(scanner.Text())
+		if ip != "" && !strings.HasPrefix(ip, "#") {
+			ips = append(ips, ip)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return ips, nil
+}
+
+func benchLookup(client *http.Client, url, apiKey string) benchResult {
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return benchResult{latency: time.Since(start)}
+	}
+	if apiKey != "" {
+		req.Header.Set(apiKeyHeader, apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return benchResult{latency: time.Since(start)}
+	}
+	// The body is read so the connection is reused, and counts towards
+	// the latency.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return benchResult{latency: time.Since(start), status: resp.StatusCode}
+}
+
+// printBenchReport writes the throughput, the count of each status and the
+// latency percentiles.
+func printBenchReport(w io.Writer, results []benchResult, elapsed time.Duration) {
+	statuses := map[int]int{}
+	latencies := make([]time.Duration, len(results))
+	for i, r := range results {
+		statuses[r.status]++
+		latencies[i] = r.latency
+	}
+	slices.Sort(latencies)
+
+	fmt.Fprintf(w, "Requests:   %d in %s, %.0f/s\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		name := "failed"
+		if code != 0 {
+			name = fmt.Sprintf("%d", code)
+		}
+		fmt.Fprintf(w, "  %-8s  %d\n", name, statuses[code])
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Latency:\n")
+	for _, p := range []float64{50, 95, 99} {
+		fmt.Fprintf(w, "  p%-7.0f  %s\n", p, percentile(latencies, p))
+	}
+	fmt.Fprintf(w, "  %-8s  %s\n", "max", latencies[len(latencies)-1])
+}
+
+// percentile returns the nearest-rank percentile p of the sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(rank, 0), len(sorted)-1)]
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// With LOOKUP_ENGINE=bolt lookups of the active dataset are answered from a
+// bbolt file next to the database. Publishing a dataset resolves its
+// overlapping ranges into segments that don't overlap, keyed by their last
+// address, so a lookup is one seek to the first segment ending at or after
+// the address. The file survives restarts, where the memory engine has to
+// load the dataset again, and bbolt needs no cgo.
+
+const boltInsertBatchSize = 10000
+
+var (
+	boltPath  string
+	boltStore *boltRangeStore
+)
+
+var boltMetaBucket = []byte("meta")
+
+// boltRangeStore keeps a bucket per dataset. Keys are the length of the
+// address followed by the last address of the segment, so IPv4 and IPv6
+// segments sort apart; values are the first address followed by the JSON of
+// the winning range.
+type boltRangeStore struct {
+	db *bolt.DB
+
+	mu        sync.RWMutex
+	datasetID int64
+	version   string
+}
+
+func openBoltRangeStore(path string) (*boltRangeStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: dbReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	s := &boltRangeStore{db: db}
+	if !dbReadOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		if meta == nil {
+			return nil
+		}
+		if v := meta.Get([]byte("dataset_id")); len(v) == 8 {
+			s.datasetID = int64(binary.BigEndian.Uint64(v))
+			s.version = string(meta.Get([]byte("version")))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func boltDatasetBucket(datasetID int64) []byte {
+	return []byte("dataset:" + strconv.FormatInt(datasetID, 10))
+}
+
+func (s *boltRangeStore) Dataset() (int64, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.datasetID, s.version
+}
+
+func (s *boltRangeStore) InsertBatch(datasetID int64, segments []rangeSegment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltDatasetBucket(datasetID))
+		if err != nil {
+			return err
+		}
+		// Segments come in key order, so pages can be filled up.
+		b.FillPercent = 1
+		for _, seg := range segments {
+			record, err := json.Marshal(seg.record)
+			if err != nil {
+				return err
+			}
+			key := append([]byte{byte(len(seg.end))}, seg.end...)
+			if err := b.Put(key, append(append([]byte(nil), seg.start...), record...)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRangeStore) SwapDataset(datasetID int64, version string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, uint64(datasetID))
+		if err := meta.Put([]byte("dataset_id"), id); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("version"), []byte(version)); err != nil {
+			return err
+		}
+		keep := boltDatasetBucket(datasetID)
+		var drop [][]byte
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !bytes.Equal(name, boltMetaBucket) && !bytes.Equal(name, keep) {
+				drop = append(drop, append([]byte(nil), name...))
+			}
+			return nil
+		})
+		for _, name := range drop {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.datasetID, s.version = datasetID, version
+	s.mu.Unlock()
+	return nil
+}
+
+// Lookup answers from the file for the dataset it holds and from SQLite for
+// the others, like the new dataset while its copy is being built.
+func (s *boltRangeStore) Lookup(ctx context.Context, datasetID int64, ip []byte) (*RangeRecord, error) {
+	if id, _ := s.Dataset(); id != datasetID {
+		return sqliteStore.Lookup(ctx, datasetID, ip)
+	}
+	var record *RangeRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDatasetBucket(datasetID))
+		if b == nil {
+			return fmt.Errorf("dataset %d is missing from the bolt file", datasetID)
+		}
+		key, value := b.Cursor().Seek(append([]byte{byte(len(ip))}, ip...))
+		if key == nil || int(key[0]) != len(ip) || len(value) < len(ip) || bytes.Compare(value[:len(ip)], ip) > 0 {
+			return nil
+		}
+		record = &RangeRecord{}
+		return json.Unmarshal(value[len(ip):], record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errNotFound
+	}
+	return record, nil
+}
+
+// refreshBoltStore copies the dataset id into the bolt file, unless it is
+// already the one there, and switches lookups to it.
+func refreshBoltStore(id int64) error {
+	if boltStore == nil || id == 0 {
+		return nil
+	}
+	var version string
+	if err := db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", id).Scan(&version); err != nil {
+		return fmt.Errorf("failed to load dataset %d: %v", id, err)
+	}
+	if current, v := boltStore.Dataset(); current == id && v == version {
+		return nil
+	}
+	if dbReadOnly {
+		log.Printf("Warning: %s doesn't hold dataset %d, its lookups go to SQLite", boltPath, id)
+		return nil
+	}
+
+	start := time.Now()
+	n, err := buildDatasetStore(boltStore, id)
+	if err != nil {
+		return fmt.Errorf("failed to copy dataset %d to %s: %v", id, boltPath, err)
+	}
+	if err := boltStore.SwapDataset(id, version); err != nil {
+		return fmt.Errorf("failed to switch %s to dataset %d: %v", boltPath, id, err)
+	}
+	log.Printf("Copied dataset %d to %s (%d segments) in %s", id, boltPath, n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// buildDatasetStore resolves the ranges of the dataset into segments and
+// inserts them into s, returning how many there are.
+func buildDatasetStore(s DatasetStore, datasetID int64) (int, error) {
+	n := 0
+	for _, isIPv6 := range []bool{false, true} {
+		ranges, err := loadMemoryRanges(datasetID, isIPv6)
+		if err != nil {
+			return n, err
+		}
+		segments := flattenRanges(ranges)
+		for len(segments) > 0 {
+			batch := segments[:min(len(segments), boltInsertBatchSize)]
+			if err := s.InsertBatch(datasetID, batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			segments = segments[len(batch):]
+		}
+	}
+	return n, nil
+}
+
+// flattenRanges splits ranges that may overlap into segments that don't,
+// each with the range lookups return for its addresses: the one with the
+// lowest priority, then the first loaded, as in SQLite.
+func flattenRanges(ranges []memoryRange) []rangeSegment {
+	if len(ranges) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(ranges, func(a, b memoryRange) int {
+		return bytes.Compare(a.record.StartIP, b.record.StartIP)
+	})
+
+	// Winners can only change where a range starts or after one ends.
+	var points [][]byte
+	for _, m := range ranges {
+		points = append(points, m.record.StartIP)
+		if next, ok := ipAfter(m.record.EndIP); ok {
+			points = append(points, next)
+		}
+	}
+	slices.SortFunc(points, bytes.Compare)
+	points = slices.CompactFunc(points, bytes.Equal)
+
+	var segments []rangeSegment
+	active := &rangeHeap{}
+	next := 0
+	for i, p := range points {
+		for next < len(ranges) && bytes.Equal(ranges[next].record.StartIP, p) {
+			heap.Push(active, &ranges[next])
+			next++
+		}
+		for active.Len() > 0 && bytes.Compare((*active)[0].record.EndIP, p) < 0 {
+			heap.Pop(active)
+		}
+		if active.Len() == 0 {
+			continue
+		}
+
+		// The last point is where the last range ends, or the last address.
+		end := bytes.Repeat([]byte{0xff}, len(p))
+		if i+1 < len(points) {
+			end, _ = ipBefore(points[i+1])
+		}
+		winner := &(*active)[0].record
+		if last := len(segments) - 1; last >= 0 && segments[last].record == winner {
+			if after, ok := ipAfter(segments[last].end); ok && bytes.Equal(after, p) {
+				segments[last].end = end
+				continue
+			}
+		}
+		segments = append(segments, rangeSegment{start: p, end: end, record: winner})
+	}
+	return segments
+}
+
+// rangeHeap orders the ranges containing the current address by the one
+// lookups return first.
+type rangeHeap []*memoryRange
+
+func (h rangeHeap) Len() int { return len(h) }
+func (h rangeHeap) Less(i, j int) bool {
+	return h[i].priority < h[j].priority || (h[i].priority == h[j].priority && h[i].seq < h[j].seq)
+}
+func (h rangeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rangeHeap) Push(x interface{}) { *h = append(*h, x.(*memoryRange)) }
+func (h *rangeHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A database that fails every query makes each lookup pay for its own error
+// or timeout before falling back. After DB_BREAKER_THRESHOLD consecutive
+// failed queries the breaker opens: lookups of the active dataset skip the
+// database and are answered like a failed one, from the fallback snapshot or
+// recent answers. Every DB_BREAKER_PROBE_INTERVAL a single lookup is let
+// through to probe it, and the first query to succeed closes the breaker.
+
+const (
+	breakerClosed int32 = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[int32]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half_open",
+}
+
+// BreakerStatus is the state of the database circuit breaker.
+type BreakerStatus struct {
+	Enabled             bool       `json:"enabled"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	LastProbeAt         *time.Time `json:"last_probe_at,omitempty"`
+	Trips               int64      `json:"trips"`
+}
+
+var (
+	breakerThreshold     int
+	breakerProbeInterval time.Duration
+
+	breakerState    atomic.Int32
+	breakerFailures atomic.Int64
+	breakerTrips    atomic.Int64
+
+	// breakerMu guards the transitions of the breaker and their times.
+	breakerMu          sync.Mutex
+	breakerOpenedAt    time.Time
+	breakerLastProbeAt time.Time
+
+	lookupsShortCircuited atomic.Int64
+)
+
+func loadBreakerConfig() {
+	breakerThreshold = envInt("DB_BREAKER_THRESHOLD", 5)
+	breakerProbeInterval = envDuration("DB_BREAKER_PROBE_INTERVAL", 10*time.Second)
+}
+
+// allowDBQuery reports whether a lookup may query the database: always while
+// the breaker is closed, and for one probe every DB_BREAKER_PROBE_INTERVAL
+// while it is open.
+func allowDBQuery() bool {
+	if breakerThreshold <= 0 || breakerState.Load() == breakerClosed {
+		return true
+	}
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	if breakerState.Load() == breakerClosed {
+		return true
+	}
+	if time.Since(breakerLastProbeAt) < breakerProbeInterval {
+		return false
+	}
+	// A probe that never reports back, e.g. because its client went away,
+	// is replaced by the next one.
+	breakerState.Store(breakerHalfOpen)
+	breakerLastProbeAt = time.Now()
+	return true
+}
+
+// recordDBQuery accounts for the outcome of a lookup query of the active
+// dataset. Queries cancelled by their client say nothing about the database
+// and are left out.
+func recordDBQuery(ctx context.Context, err error) {
+	if breakerThreshold <= 0 {
+		return
+	}
+	switch {
+	case err == nil || errors.Is(err, errNotFound):
+		if breakerState.Load() == breakerClosed && breakerFailures.Load() == 0 {
+			return
+		}
+		breakerMu.Lock()
+		defer breakerMu.Unlock()
+		if breakerState.Load() != breakerClosed {
+			log.Printf("Database circuit breaker closed after %s", time.Since(breakerOpenedAt).Round(time.Second))
+		}
+		breakerState.Store(breakerClosed)
+		breakerFailures.Store(0)
+	case errors.Is(ctx.Err(), context.Canceled):
+	default:
+		failures := breakerFailures.Add(1)
+		state := breakerState.Load()
+		if state == breakerOpen || state == breakerClosed && failures < int64(breakerThreshold) {
+			return
+		}
+		breakerMu.Lock()
+		defer breakerMu.Unlock()
+		switch breakerState.Load() {
+		case breakerClosed:
+			now := time.Now()
+			breakerOpenedAt, breakerLastProbeAt = now, now
+			breakerTrips.Add(1)
+			log.Printf("Database circuit breaker opened after %d consecutive failed queries: %v", failures, err)
+		case breakerHalfOpen:
+			log.Printf("Database circuit breaker probe failed: %v", err)
+		}
+		breakerState.Store(breakerOpen)
+	}
+}
+
+func currentBreakerStatus() BreakerStatus {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	state := breakerState.Load()
+	status := BreakerStatus{
+		Enabled:             breakerThreshold > 0,
+		State:               breakerStateNames[state],
+		ConsecutiveFailures: breakerFailures.Load(),
+		Trips:               breakerTrips.Load(),
+	}
+	if state != breakerClosed {
+		openedAt, probeAt := breakerOpenedAt.UTC(), breakerLastProbeAt.UTC()
+		status.OpenedAt = &openedAt
+		if probeAt.After(openedAt) {
+			status.LastProbeAt = &probeAt
+		}
+	}
+	return status
+}
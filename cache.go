@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache is a small concurrency-safe map whose entries expire after a fixed
+// TTL. When it reaches maxEntries, expired entries are purged first and then
+// arbitrary entries are evicted to make room.
+type ttlCache[K comparable, V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[K]cacheEntry[V]
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration, maxEntries int) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[K]cacheEntry[V]{},
+	}
+}
+
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *ttlCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Purge removes every entry.
+func (c *ttlCache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[K]cacheEntry[V]{}
+}
+
+func (c *ttlCache[K, V]) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	// Map iteration order is random, which makes this a cheap random eviction.
+	for key := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CountryChange summarizes how the ranges of one country differ between two
+// datasets. A range whose country was reassigned is removed from the old
+// country and added to the new one; Changed counts ranges that kept their
+// bounds and country but changed other attributes (AS, continent, ...).
+type CountryChange struct {
+	Country    string `json:"country"`
+	Added      int64  `json:"added"`
+	Removed    int64  `json:"removed"`
+	Changed    int64  `json:"changed"`
+	IPv4Before int64  `json:"ipv4_addresses_before"`
+	IPv4After  int64  `json:"ipv4_addresses_after"`
+}
+
+type DatasetDiff struct {
+	DatasetID         int64           `json:"dataset_id"`
+	Version           string          `json:"version"`
+	PreviousDatasetID int64           `json:"previous_dataset_id"`
+	PreviousVersion   string          `json:"previous_version"`
+	CreatedAt         time.Time       `json:"created_at"`
+	Added             int64           `json:"added"`
+	Removed           int64           `json:"removed"`
+	Changed           int64           `json:"changed"`
+	Countries         []CountryChange `json:"countries"`
+}
+
+func createChangesTables() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS dataset_diffs (
+			dataset_id INTEGER PRIMARY KEY,
+			version TEXT NOT NULL,
+			previous_dataset_id INTEGER NOT NULL,
+			previous_version TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset_diffs table: %v", err)
+	}
+
+	_, err = db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS dataset_diff_countries (
+			dataset_id INTEGER NOT NULL,
+			country TEXT NOT NULL,
+			added INTEGER NOT NULL,
+			removed INTEGER NOT NULL,
+			changed INTEGER NOT NULL,
+			ipv4_before INTEGER NOT NULL,
+			ipv4_after INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset_diff_countries table: %v", err)
+	}
+
+	_, err = db.Load().Exec(`CREATE INDEX IF NOT EXISTS idx_dataset_diff_countries ON dataset_diff_countries (dataset_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to create dataset_diff_countries index: %v", err)
+	}
+	return nil
+}
+
+// recordDatasetDiff compares the freshly loaded dataset with the one it
+// replaces and stores the per-country summary. It returns nil when there is
+// nothing to compare against.
+func recordDatasetDiff(tx *sql.Tx, previousID, datasetID int64) (*DatasetDiff, error) {
+	diff, err := diffDatasets(tx, previousID, datasetID)
+	if diff == nil || err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO dataset_diffs (dataset_id, version, previous_dataset_id, previous_version, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, diff.DatasetID, diff.Version, diff.PreviousDatasetID, diff.PreviousVersion, diff.CreatedAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert dataset diff: %v", err)
+	}
+	_, err = tx.Exec("DELETE FROM dataset_diff_countries WHERE dataset_id = ?", datasetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clear dataset diff: %v", err)
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO dataset_diff_countries (dataset_id, country, added, removed, changed, ipv4_before, ipv4_after)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, c := range diff.Countries {
+		_, err = stmt.Exec(datasetID, c.Country, c.Added, c.Removed, c.Changed, c.IPv4Before, c.IPv4After)
+		if err != nil {
+			return nil, fmt.Errorf("failed to insert dataset diff: %v", err)
+		}
+	}
+
+	log.Printf("Dataset %d vs %d: %d ranges added, %d removed, %d changed across %d countries",
+		datasetID, previousID, diff.Added, diff.Removed, diff.Changed, len(diff.Countries))
+	return diff, nil
+}
+
+// diffDatasets compares the ranges of datasetID with those of previousID.
+// It returns nil when previousID is 0.
+func diffDatasets(tx *sql.Tx, previousID, datasetID int64) (*DatasetDiff, error) {
+	if previousID == 0 {
+		return nil, nil
+	}
+
+	diff := &DatasetDiff{
+		DatasetID:         datasetID,
+		PreviousDatasetID: previousID,
+		CreatedAt:         time.Now().UTC(),
+		Countries:         []CountryChange{},
+	}
+	err := tx.QueryRow("SELECT version FROM datasets WHERE id = ?", datasetID).Scan(&diff.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dataset %d: %v", datasetID, err)
+	}
+	err = tx.QueryRow("SELECT version FROM datasets WHERE id = ?", previousID).Scan(&diff.PreviousVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dataset %d: %v", previousID, err)
+	}
+
+	changes := map[string]*CountryChange{}
+	change := func(country string) *CountryChange {
+		c, ok := changes[country]
+		if !ok {
+			c = &CountryChange{Country: country}
+			changes[country] = c
+		}
+		return c
+	}
+
+	// Ranges of one dataset without an identical range (same bounds and
+	// country) in the other.
+	const unmatched = `
+		SELECT n.country, COUNT(*)
+		FROM ip_ranges n
+		WHERE n.dataset_id = ? AND NOT EXISTS (
+			SELECT 1 FROM ip_ranges o
+			WHERE o.dataset_id = ? AND o.is_ipv6 = n.is_ipv6 AND o.start_hi = n.start_hi AND o.start_lo = n.start_lo AND o.end_hi = n.end_hi AND o.end_lo = n.end_lo AND o.country = n.country
+		)
+		GROUP BY n.country
+	`
+	err = countByCountry(tx, unmatched, func(country string, n int64) { change(country).Added = n }, datasetID, previousID)
+	if err != nil {
+		return nil, err
+	}
+	err = countByCountry(tx, unmatched, func(country string, n int64) { change(country).Removed = n }, previousID, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	err = countByCountry(tx, `
+		SELECT n.country, COUNT(*)
+		FROM ip_ranges n
+		JOIN ip_ranges o ON o.dataset_id = ? AND o.is_ipv6 = n.is_ipv6 AND o.start_hi = n.start_hi AND o.start_lo = n.start_lo AND o.end_hi = n.end_hi AND o.end_lo = n.end_lo AND o.country = n.country
+		WHERE n.dataset_id = ? AND (
+			n.country_name IS NOT o.country_name OR n.continent IS NOT o.continent OR n.continent_name IS NOT o.continent_name OR
+			n.as_name IS NOT o.as_name OR n.as_domain IS NOT o.as_domain OR n.is_anycast IS NOT o.is_anycast OR
+			n.countries IS NOT o.countries OR n.timezone IS NOT o.timezone OR n.currency IS NOT o.currency
+		)
+		GROUP BY n.country
+	`, func(country string, n int64) { change(country).Changed = n }, previousID, datasetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) > 0 {
+		before, err := ipv4AddressesByCountry(tx, previousID)
+		if err != nil {
+			return nil, err
+		}
+		after, err := ipv4AddressesByCountry(tx, datasetID)
+		if err != nil {
+			return nil, err
+		}
+		for country, c := range changes {
+			c.IPv4Before = before[country]
+			c.IPv4After = after[country]
+		}
+	}
+
+	for _, c := range changes {
+		diff.Countries = append(diff.Countries, *c)
+	}
+	sortCountryChanges(diff.Countries)
+	diff.summarize()
+	return diff, nil
+}
+
+func countByCountry(tx *sql.Tx, query string, fn func(country string, n int64), args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to diff datasets: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var country string
+		var n int64
+		if err := rows.Scan(&country, &n); err != nil {
+			return fmt.Errorf("failed to diff datasets: %v", err)
+		}
+		fn(country, n)
+	}
+	return rows.Err()
+}
+
+// ipv4AddressesByCountry sums the size of every IPv4 range per country.
+// Overlapping ranges are counted twice, which is fine for spotting shifts.
+func ipv4AddressesByCountry(tx *sql.Tx, datasetID int64) (map[string]int64, error) {
+	rows, err := tx.Query("SELECT country, start_ip, end_ip FROM ip_ranges WHERE dataset_id = ? AND is_ipv6 = 0", datasetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count addresses: %v", err)
+	}
+	defer rows.Close()
+
+	totals := map[string]int64{}
+	for rows.Next() {
+		var country string
+		var startIP, endIP []byte
+		if err := rows.Scan(&country, &startIP, &endIP); err != nil {
+			return nil, fmt.Errorf("failed to count addresses: %v", err)
+		}
+		if len(startIP) != 4 || len(endIP) != 4 {
+			continue
+		}
+		totals[country] += int64(binary.BigEndian.Uint32(endIP)) - int64(binary.BigEndian.Uint32(startIP)) + 1
+	}
+	return totals, rows.Err()
+}
+
+// sortCountryChanges puts the countries with the most range changes first.
+func sortCountryChanges(changes []CountryChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		a := changes[i].Added + changes[i].Removed + changes[i].Changed
+		b := changes[j].Added + changes[j].Removed + changes[j].Changed
+		if a != b {
+			return a > b
+		}
+		return changes[i].Country < changes[j].Country
+	})
+}
+
+func (d *DatasetDiff) summarize() {
+	d.Added, d.Removed, d.Changed = 0, 0, 0
+	for _, c := range d.Countries {
+		d.Added += c.Added
+		d.Removed += c.Removed
+		d.Changed += c.Changed
+	}
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit := 10
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid limit")
+			return
+		}
+		limit = n
+	}
+	country := strings.ToUpper(params.Get("country"))
+
+	diffs, err := listDatasetDiffs(limit, country)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes": diffs,
+	})
+}
+
+// listDatasetDiffs returns the most recent diffs, newest first, optionally
+// restricted to a single country.
+func listDatasetDiffs(limit int, country string) ([]DatasetDiff, error) {
+	rows, err := db.Load().Query(`
+		SELECT dataset_id, version, previous_dataset_id, previous_version, created_at
+		FROM dataset_diffs
+		ORDER BY dataset_id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []DatasetDiff{}
+	for rows.Next() {
+		var d DatasetDiff
+		var createdAt int64
+		if err := rows.Scan(&d.DatasetID, &d.Version, &d.PreviousDatasetID, &d.PreviousVersion, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.CreatedAt = time.Unix(createdAt, 0).UTC()
+		diffs = append(diffs, d)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range diffs {
+		query := `
+			SELECT country, added, removed, changed, ipv4_before, ipv4_after
+			FROM dataset_diff_countries
+			WHERE dataset_id = ?
+		`
+		args := []interface{}{diffs[i].DatasetID}
+		if country != "" {
+			query += " AND country = ?"
+			args = append(args, country)
+		}
+
+		rows, err := db.Load().Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		diffs[i].Countries = []CountryChange{}
+		for rows.Next() {
+			var c CountryChange
+			if err := rows.Scan(&c.Country, &c.Added, &c.Removed, &c.Changed, &c.IPv4Before, &c.IPv4After); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			diffs[i].Countries = append(diffs[i].Countries, c)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		sortCountryChanges(diffs[i].Countries)
+		diffs[i].summarize()
+	}
+	return diffs, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// MatchedRange is the dataset range an IP was attributed to. It's shared by
+// the answers of every IP in the range, so it must not be modified.
+type MatchedRange struct {
+	StartIP string `json:"start_ip"`
+	EndIP   string `json:"end_ip"`
+	// CIDR is set when the range is exactly one prefix.
+	CIDR string `json:"cidr,omitempty"`
+	// CIDRs are the prefixes that together cover exactly the range.
+	CIDRs []string `json:"cidrs"`
+
+	start, end netip.Addr
+}
+
+// matchedRanges holds the MatchedRange of recently matched ranges, so
+// lookups in the same range don't format its addresses and CIDRs again. It's
+// indexed by a hash of the range, and a range only replaces the one in its
+// slot, so it needs neither locks nor eviction.
+var matchedRanges [1 << 16]atomic.Pointer[MatchedRange]
+
+func newMatchedRange(startIP, endIP []byte) *MatchedRange {
+	start, _ := netip.AddrFromSlice(startIP)
+	end, _ := netip.AddrFromSlice(endIP)
+	slot := &matchedRanges[rangeHash(start, end)%uint64(len(matchedRanges))]
+	if m := slot.Load(); m != nil && m.start == start && m.end == end {
+		return m
+	}
+
+	m := &MatchedRange{
+		StartIP: start.String(),
+		EndIP:   end.String(),
+		start:   start,
+		end:     end,
+	}
+	m.CIDRs = rangeToCIDRs(startIP, endIP)
+	if len(m.CIDRs) == 1 {
+		m.CIDR = m.CIDRs[0]
+	}
+	slot.Store(m)
+	return m
+}
+
+// rangeHash mixes the addresses of a range into a slot of matchedRanges.
+func rangeHash(start, end netip.Addr) uint64 {
+	s, e := start.As16(), end.As16()
+	h := uint64(start.BitLen())
+	for _, v := range [4]uint64{
+		binary.BigEndian.Uint64(s[:8]), binary.BigEndian.Uint64(s[8:]),
+		binary.BigEndian.Uint64(e[:8]), binary.BigEndian.Uint64(e[8:]),
+	} {
+		h = (h ^ v) * 0x9e3779b97f4a7c15
+		h ^= h >> 29
+	}
+	return h
+}
+
+// networkRange returns the first and last address of network, 4 bytes long
+// for IPv4 like the ranges lookups match.
+func networkRange(network *net.IPNet) ([]byte, []byte) {
+	start := []byte(network.IP)
+	if v4 := network.IP.To4(); v4 != nil {
+		start = v4
+	}
+	mask := network.Mask[len(network.Mask)-len(start):]
+	end := make([]byte, len(start))
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	return start, end
+}
+
+// rangeToCIDRs splits startIP to endIP into the smallest list of prefixes
+// covering exactly that range.
+func rangeToCIDRs(startIP, endIP []byte) []string {
+	if len(startIP) != len(endIP) || (len(startIP) != net.IPv4len && len(startIP) != net.IPv6len) {
+		return nil
+	}
+	width := len(startIP) * 8
+	start, end := uint128FromBytes(startIP), uint128FromBytes(endIP)
+
+	var cidrs []string
+	for start.cmp(end) <= 0 {
+		// The largest block aligned at start that doesn't go past end.
+		hostBits := min(start.trailingZeros(), width)
+		for start.or(lowBits(hostBits)).cmp(end) > 0 {
+			hostBits--
+		}
+		last := start.or(lowBits(hostBits))
+
+		cidrs = append(cidrs, netip.PrefixFrom(start.addr(len(startIP)), width-hostBits).String())
+		if last == lowBits(width) {
+			break
+		}
+		start = last.addOne()
+	}
+	return cidrs
+}
+
+// uint128 is an address as a number, so ranges can be split into prefixes
+// without math/big allocating on every step.
+type uint128 struct {
+	hi, lo uint64
+}
+
+func uint128FromBytes(b []byte) uint128 {
+	if len(b) == net.IPv4len {
+		return uint128{lo: uint64(binary.BigEndian.Uint32(b))}
+	}
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// lowBits returns the number with the n lowest bits set.
+func lowBits(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{lo: 1<<n - 1}
+	case n < 128:
+		return uint128{hi: 1<<(n-64) - 1, lo: ^uint64(0)}
+	}
+	return uint128{hi: ^uint64(0), lo: ^uint64(0)}
+}
+
+func (u uint128) cmp(v uint128) int {
+	if u.hi != v.hi {
+		return cmp.Compare(u.hi, v.hi)
+	}
+	return cmp.Compare(u.lo, v.lo)
+}
+
+func (u uint128) or(v uint128) uint128 {
+	return uint128{u.hi | v.hi, u.lo | v.lo}
+}
+
+func (u uint128) addOne() uint128 {
+	if u.lo == ^uint64(0) {
+		return uint128{u.hi + 1, 0}
+	}
+	return uint128{u.hi, u.lo + 1}
+}
+
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+	return uint128{hi, lo}
+}
+
+func (u uint128) bitLen() int {
+	if u.hi != 0 {
+		return 64 + bits.Len64(u.hi)
+	}
+	return bits.Len64(u.lo)
+}
+
+func (u uint128) trailingZeros() int {
+	if u.lo != 0 {
+		return bits.TrailingZeros64(u.lo)
+	}
+	return 64 + bits.TrailingZeros64(u.hi)
+}
+
+// addr returns u as an address of size bytes.
+func (u uint128) addr(size int) netip.Addr {
+	if size == net.IPv4len {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(u.lo))
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	return netip.AddrFrom16(b)
+}
+
+// parseCIDR reads a CIDR, or a single IP as a /32 or /128.
+func parseCIDR(v string) (*net.IPNet, error) {
+	cidr := strings.TrimSpace(v)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid CIDR %q", v)
+		}
+		if ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q", v)
+	}
+	return network, nil
+}
+
+// ipAfter returns the address following ip, or false for the last one.
+func ipAfter(ip []byte) ([]byte, bool) {
+	next := append([]byte(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// ipBefore returns the address preceding ip, or false for the first one.
+func ipBefore(ip []byte) ([]byte, bool) {
+	prev := append([]byte(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			return prev, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func FuzzRangeToCIDRs(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 4}, []byte{1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 0}, []byte{255, 255, 255, 255})
+	f.Add([]byte{10, 0, 0, 1}, []byte{10, 0, 1, 254})
+	f.Add(make([]byte, 16), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, startIP, endIP []byte) {
+		cidrs := rangeToCIDRs(startIP, endIP)
+		start, okStart := netip.AddrFromSlice(startIP)
+		end, okEnd := netip.AddrFromSlice(endIP)
+		if !okStart || !okEnd || len(startIP) != len(endIP) || start.Compare(end) > 0 {
+			if len(cidrs) != 0 {
+				t.Fatalf("%v - %v isn't a range, got %v", startIP, endIP, cidrs)
+			}
+			return
+		}
+		if len(cidrs) > 2*start.BitLen() {
+			t.Fatalf("%s - %s took %d CIDRs", start, end, len(cidrs))
+		}
+
+		// The prefixes follow each other without gaps from start to end.
+		next := start
+		for i, s := range cidrs {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				t.Fatalf("%s - %s: invalid CIDR %q: %v", start, end, s, err)
+			}
+			if p != p.Masked() {
+				t.Fatalf("%s - %s: %s isn't aligned", start, end, p)
+			}
+			if p.Addr() != next {
+				t.Fatalf("%s - %s: CIDR %d is %s, expected it to start at %s", start, end, i, p, next)
+			}
+			last := lastAddr(p)
+			if last.Compare(end) > 0 {
+				t.Fatalf("%s - %s: %s goes past the end", start, end, p)
+			}
+			// The prefix is the largest one that fits.
+			if wider, err := p.Addr().Prefix(p.Bits() - 1); err == nil && p.Bits() > 0 && wider.Addr() == p.Addr() && lastAddr(wider).Compare(end) <= 0 {
+				t.Fatalf("%s - %s: %s could have been %s", start, end, p, wider)
+			}
+			next = last.Next()
+		}
+		if len(cidrs) == 0 || (next.IsValid() && next != end.Next()) {
+			t.Fatalf("%s - %s: %v stops before the end", start, end, cidrs)
+		}
+	})
+}
+
+// lastAddr returns the highest address of p.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
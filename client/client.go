@@ -0,0 +1,348 @@
+// Package client calls a set of ip-lookup replicas, spreading the lookups
+// over them by consistent hashing, retrying failed ones on the next replica
+// and splitting batches between the replicas that own their IPs.
+//
+//	c, err := client.New([]string{"http://ip-lookup-0:8080", "http://ip-lookup-1:8080"}, client.Options{})
+//	info, err := c.Lookup(ctx, "8.8.8.8")
+//
+// IPs are hashed by their /24 (IPv4) or /48 (IPv6), which usually fall in one
+// range of the dataset, so neighbouring IPs hit the same replica and its
+// caches. Adding or removing a replica only moves the IPs it owns.
+//
+// Client implements geo.Resolver, so it can back geo.Middleware.
+package client
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ashwanthkumar/ip-lookup/geo"
+)
+
+// ErrNotFound is returned when the IP isn't in any known range, or isn't an
+// IP. It is geo.ErrNotFound, so the middleware treats it the same.
+var ErrNotFound = geo.ErrNotFound
+
+const (
+	defaultRetries      = 2
+	defaultBackoff      = 50 * time.Millisecond
+	defaultVirtualNodes = 100
+	defaultBatchSize    = 1000
+)
+
+var defaultHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+// Options configures a Client. The zero value is usable.
+type Options struct {
+	// HTTPClient defaults to a client with a 2 second timeout.
+	HTTPClient *http.Client
+	// APIKey is sent with every request, see the server's API keys.
+	APIKey string
+	// Retries is how many more replicas a failed request is tried on,
+	// default 2. Negative means none.
+	Retries int
+	// Backoff is the wait before the first retry, doubled for every
+	// following one, default 50ms.
+	Backoff time.Duration
+	// VirtualNodes is the number of points each replica has on the hash
+	// ring, default 100. More spread the load more evenly.
+	VirtualNodes int
+	// BatchSize is the largest batch sent to a replica, default 1000 like
+	// the server's BATCH_MAX_SIZE.
+	BatchSize int
+}
+
+// Client looks up IPs on a set of ip-lookup replicas. It is safe for
+// concurrent use.
+type Client struct {
+	nodes []string
+	ring  []ringPoint
+	opts  Options
+}
+
+// ringPoint is one of the points of a replica on the hash ring.
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// Result is the answer for one IP of a batch: Info, or the error it failed
+// with.
+type Result struct {
+	IP   string
+	Info *geo.Info
+	Err  error
+}
+
+// New returns a client for the replicas at the base URLs, e.g.
+// http://ip-lookup-0:8080.
+func New(nodes []string, opts Options) (*Client, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("client: no replicas")
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = defaultHTTPClient
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = defaultVirtualNodes
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	c := &Client{opts: opts}
+	for i, node := range nodes {
+		if _, err := url.Parse(node); err != nil {
+			return nil, fmt.Errorf("client: invalid replica %q: %v", node, err)
+		}
+		c.nodes = append(c.nodes, strings.TrimSuffix(node, "/"))
+		for v := 0; v < opts.VirtualNodes; v++ {
+			c.ring = append(c.ring, ringPoint{hash: hashString(node + "#" + strconv.Itoa(v)), node: i})
+		}
+	}
+	slices.SortFunc(c.ring, func(a, b ringPoint) int {
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.node, b.node))
+	})
+	return c, nil
+}
+
+// Lookup returns the geo information of ip, or ErrNotFound.
+func (c *Client) Lookup(ctx context.Context, ip string) (*geo.Info, error) {
+	var info *geo.Info
+	err := c.tryNodes(ctx, c.owner(ip), func(node string) (bool, error) {
+		resp, err := c.request(ctx, http.MethodGet, node+"/lookup/"+url.PathEscape(ip), nil)
+		if err != nil {
+			return true, err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK:
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest:
+			return false, ErrNotFound
+		default:
+			return retryable(resp.StatusCode), fmt.Errorf("client: lookup of %s on %s failed: %s", ip, node, resp.Status)
+		}
+		info = &geo.Info{}
+		if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+			return true, fmt.Errorf("client: failed to decode lookup response of %s: %v", node, err)
+		}
+		return false, nil
+	})
+	return info, err
+}
+
+// Resolve implements geo.Resolver.
+func (c *Client) Resolve(ctx context.Context, ip string) (*geo.Info, error) {
+	return c.Lookup(ctx, ip)
+}
+
+// LookupBatch looks up ips, sending each replica the ones it owns in batches
+// of at most BatchSize, in parallel. The results are in the order of ips. The
+// error is only set when a whole batch failed, its IPs also carry it.
+func (c *Client) LookupBatch(ctx context.Context, ips []string) ([]Result, error) {
+	results := make([]Result, len(ips))
+	byNode := map[int][]int{}
+	for i, ip := range ips {
+		results[i].IP = ip
+		node := c.owner(ip)
+		byNode[node] = append(byNode[node], i)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for node, indexes := range byNode {
+		for len(indexes) > 0 {
+			chunk := indexes[:min(len(indexes), c.opts.BatchSize)]
+			indexes = indexes[len(chunk):]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := c.batch(ctx, node, chunk, results)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return results, firstErr
+}
+
+// batchItem is an element of a batch response, a lookup or an error.
+type batchItem struct {
+	geo.Info
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// batch looks up the IPs of results at indexes, starting with node.
+func (c *Client) batch(ctx context.Context, node int, indexes []int, results []Result) error {
+	ips := make([]string, len(indexes))
+	for i, index := range indexes {
+		ips[i] = results[index].IP
+	}
+	body, err := json.Marshal(ips)
+	if err != nil {
+		return err
+	}
+
+	err = c.tryNodes(ctx, node, func(base string) (bool, error) {
+		resp, err := c.request(ctx, http.MethodPost, base+"/lookup", body)
+		if err != nil {
+			return true, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return retryable(resp.StatusCode), fmt.Errorf("client: batch on %s failed: %s", base, resp.Status)
+		}
+		var items []batchItem
+		if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+			return true, fmt.Errorf("client: failed to decode batch response of %s: %v", base, err)
+		}
+		if len(items) != len(indexes) {
+			return false, fmt.Errorf("client: batch of %d IPs on %s returned %d results", len(indexes), base, len(items))
+		}
+		for i, item := range items {
+			r := &results[indexes[i]]
+			switch {
+			case item.Error == nil:
+				info := item.Info
+				r.Info = &info
+			case item.Error.Code == "not_found" || item.Error.Code == "invalid_ip":
+				r.Err = ErrNotFound
+			default:
+				r.Err = fmt.Errorf("client: lookup of %s failed: %s", r.IP, item.Error.Message)
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		for _, index := range indexes {
+			results[index].Err = err
+		}
+	}
+	return err
+}
+
+// tryNodes runs attempt on the replica first, and on the next ones while it
+// fails with an error worth retrying.
+func (c *Client) tryNodes(ctx context.Context, first int, attempt func(node string) (retry bool, err error)) error {
+	backoff := c.opts.Backoff
+	var err error
+	for i := 0; i <= c.opts.Retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = attempt(c.nodes[(first+i)%len(c.nodes)])
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *Client) request(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set("X-API-Key", c.opts.APIKey)
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client: %s %s failed: %v", method, url, err)
+	}
+	return resp, nil
+}
+
+// retryable reports whether a request that failed with status may succeed on
+// another replica.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// owner returns the replica owning ip: the first point on the ring at or
+// after the hash of its network.
+func (c *Client) owner(ip string) int {
+	h := hashString(shardKey(ip))
+	i, _ := slices.BinarySearchFunc(c.ring, h, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].node
+}
+
+// shardKey returns the /24 of an IPv4 address or the /48 of an IPv6 one, or
+// ip itself when it doesn't parse.
+func shardKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p.String()
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV-1a spreads similar keys poorly over the high bits, which the
+	// ring is ordered by, so mix them once more.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
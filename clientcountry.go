@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Deployments that must not serve some countries can have the service
+// enforce it itself: CLIENT_COUNTRY_ALLOW and CLIENT_COUNTRY_DENY apply the
+// policy of the geo gate to the clients of every endpoint, which get a 403
+// country_denied when it keeps their country out. X-Forwarded-For is only
+// believed as far as TRUSTED_PROXIES allows: without it the client is the
+// address of the connection, so a header can't pick the country.
+
+var clientCountryPolicy countryPolicy
+
+// probePaths are left out of the policy, as the probes of orchestrators come
+// from addresses without a country.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+}
+
+func loadClientCountryConfig() error {
+	var err error
+	clientCountryPolicy, err = loadCountryPolicy("CLIENT_COUNTRY")
+	return err
+}
+
+// clientCountryMiddleware looks up the client of every request and answers
+// 403 when its country isn't allowed. A client whose lookup fails counts as
+// an unknown country.
+func clientCountryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := policyClientIP(r)
+		country := ""
+		info, err := lookupIP(withoutCountryTraffic(r.Context()), ip)
+		switch {
+		case err == nil:
+			country = info.Country
+		case !errors.Is(err, errNotFound) && !errors.Is(err, errInvalidIP):
+			logRequest(r, "Client country lookup of %s failed: %v", ip, err)
+		}
+		if !clientCountryPolicy.allows(country) {
+			writeError(w, r, http.StatusForbidden, "country_denied", "Access from this country is not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// policyClientIP returns the client the policy applies to: the one found by
+// client detection behind TRUSTED_PROXIES, and otherwise the address of the
+// connection, as every client could set X-Forwarded-For.
+func policyClientIP(r *http.Request) string {
+	if trustedProxies != nil {
+		return getClientIP(r)
+	}
+	chain := clientIPChain(r)
+	return chain[len(chain)-1]
+}
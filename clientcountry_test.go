@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// TestClientCountryIgnoresSpoofedForwardedFor checks that a client of a
+// denied country can't get in by sending the address of another country in
+// X-Forwarded-For, unless it comes through a trusted proxy.
+func TestClientCountryIgnoresSpoofedForwardedFor(t *testing.T) {
+	loadTestDataset(t, []testRange{
+		{netip.MustParseAddr("1.0.0.0"), netip.MustParseAddr("1.0.0.255"), "DE"},
+		{netip.MustParseAddr("2.0.0.0"), netip.MustParseAddr("2.0.0.255"), "US"},
+		{netip.MustParseAddr("3.0.0.0"), netip.MustParseAddr("3.0.0.255"), "FR"},
+	})
+	t.Setenv("CLIENT_COUNTRY_DENY", "DE")
+	if err := loadClientCountryConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		clientCountryPolicy = countryPolicy{}
+		trustedProxies = nil
+	})
+	handler := clientCountryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		trustedProxies  string
+		remoteAddr, xff string
+		want            int
+	}{
+		// A client of a denied country claiming another one.
+		{"", "1.0.0.1:1234", "2.0.0.1", http.StatusForbidden},
+		// A client of an allowed country claiming a denied one.
+		{"", "2.0.0.1:1234", "1.0.0.1", http.StatusOK},
+		// Behind a trusted proxy, the client is the one the proxy adds.
+		{"3.0.0.0/24", "3.0.0.1:1234", "1.0.0.1", http.StatusForbidden},
+		{"3.0.0.0/24", "3.0.0.1:1234", "2.0.0.1", http.StatusOK},
+		// A denied client claiming to be a proxy's client is still itself.
+		{"3.0.0.0/24", "1.0.0.1:1234", "2.0.0.1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Setenv("TRUSTED_PROXIES", tt.trustedProxies)
+		trustedProxies = nil
+		if err := loadTrustedProxies(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/lookup/8.8.8.8", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("X-Forwarded-For", tt.xff)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("TRUSTED_PROXIES %q, from %s for %s: got %d, want %d", tt.trustedProxies, tt.remoteAddr, tt.xff, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// trustedProxies are the proxies, from TRUSTED_PROXIES, whose X-Forwarded-For
+// entries are believed. When it's unset every request is taken to come
+// through a trusted proxy and the first X-Forwarded-For entry is the client.
+var trustedProxies *ipIntervalSet
+
+// forwardingHeaders are shown by verbose auto-detect responses. Only
+// X-Forwarded-For is used to find the client, the others are there to spot a
+// proxy that sets a different one.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Real-IP", "Forwarded", "CF-Connecting-IP", "True-Client-IP"}
+
+// ClientDetection explains how the client IP of a request was found, for
+// ?verbose=true on the auto-detect endpoint.
+type ClientDetection struct {
+	IP         string `json:"ip"`
+	RemoteAddr string `json:"remote_addr"`
+	// Chain is every hop the request passed through, the X-Forwarded-For
+	// entries followed by the connection's address.
+	Chain           []string          `json:"chain"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	UserAgent       string            `json:"user_agent"`
+	ViaTrustedProxy bool              `json:"via_trusted_proxy"`
+}
+
+// loadTrustedProxies reads TRUSTED_PROXIES, a comma separated list of CIDRs,
+// IPs or ranges.
+func loadTrustedProxies() error {
+	v := os.Getenv("TRUSTED_PROXIES")
+	if v == "" {
+		return nil
+	}
+	var intervals []ipInterval
+	for _, s := range strings.Split(v, ",") {
+		in, err := parseIPInterval(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES: %v", err)
+		}
+		intervals = append(intervals, in)
+	}
+	trustedProxies = newIPIntervalSet(intervals)
+	return nil
+}
+
+func isTrustedProxy(ip string) bool {
+	if trustedProxies == nil {
+		return true
+	}
+	return trustedProxies.contains(lookupBytes(net.ParseIP(ip)))
+}
+
+// clientIPChain returns the X-Forwarded-For entries, client first, followed by
+// the address of the connection.
+func clientIPChain(r *http.Request) []string {
+	var chain []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, hop)
+			}
+		}
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	return append(chain, peer)
+}
+
+// detectClientIP picks the client out of the chain: walking back from the
+// connection, it stops at the first address that isn't a trusted proxy.
+func detectClientIP(r *http.Request) (ip string, viaTrustedProxy bool) {
+	chain := clientIPChain(r)
+	i := len(chain) - 1
+	if trustedProxies == nil {
+		i = 0
+	}
+	for i > 0 && isTrustedProxy(chain[i]) {
+		i--
+	}
+	return chain[i], i < len(chain)-1
+}
+
+func getClientIP(r *http.Request) string {
+	ip, _ := detectClientIP(r)
+	return ip
+}
+
+func newClientDetection(r *http.Request) *ClientDetection {
+	d := &ClientDetection{
+		RemoteAddr: r.RemoteAddr,
+		Chain:      clientIPChain(r),
+		UserAgent:  r.UserAgent(),
+	}
+	d.IP, d.ViaTrustedProxy = detectClientIP(r)
+	for _, name := range forwardingHeaders {
+		if v := r.Header.Values(name); len(v) > 0 {
+			if d.Headers == nil {
+				d.Headers = map[string]string{}
+			}
+			d.Headers[name] = strings.Join(v, ", ")
+		}
+	}
+	return d
+}
+
+func wantsVerbose(r *http.Request) bool {
+	b, err := strconv.ParseBool(r.URL.Query().Get("verbose"))
+	return err == nil && b
+}
+
+// writeVerboseLookupError is writeLookupError with the client detection next
+// to the error, as the lookup usually fails because the wrong address was
+// picked.
+func writeVerboseLookupError(w http.ResponseWriter, r *http.Request, err error, client *ClientDetection) {
+	if !errors.Is(err, errNotFound) && !errors.Is(err, errInvalidIP) {
+		writeLookupError(w, r, err)
+		return
+	}
+	status, code, message := lookupErrorCode(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		ErrorResponse
+		Client *ClientDetection `json:"client"`
+	}{
+		ErrorResponse: ErrorResponse{Error: ErrorDetail{Code: code, Message: message, RequestID: requestID(r.Context())}},
+		Client:        client,
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math"
+)
+
+// The confidence of an answer, from 0 to 100, tells how far its attribution
+// can be trusted for decisions where a wrong country matters. Small ranges
+// are usually assigned to a single network and located precisely, while a /8
+// is a guess for millions of addresses, so confidence grows with the prefix
+// length the range is worth: from 30 at a /8 (IPv4) or /16 (IPv6) to 100 at a
+// /24 or /48. In datasets merged with SOURCE_PRIORITY, ranges of less trusted
+// sources lose up to half of that, those of unlisted sources the most.
+// Answers of pinned responses and overrides alone are set by the operator and
+// always score 100.
+
+// rangeConfidence returns the confidence of an answer from the range r.
+func rangeConfidence(r *RangeRecord) int {
+	// The size of the range is one more than the difference of its
+	// addresses, which overflows for the whole IPv6 space.
+	size := uint128FromBytes(r.EndIP).sub(uint128FromBytes(r.StartIP)).addOne()
+	sizeBits := size.bitLen()
+	if size == (uint128{}) {
+		sizeBits = 129
+	}
+	// The prefix length of a range of the same size.
+	prefix := float64(len(r.StartIP)*8 - (sizeBits - 1))
+
+	widest, narrowest := 8.0, 24.0
+	if len(r.StartIP) == 16 {
+		widest, narrowest = 16, 48
+	}
+	specificity := math.Min(math.Max((prefix-widest)/(narrowest-widest), 0), 1)
+
+	return int(math.Round(100 * (0.3 + 0.7*specificity) * sourceConfidence(r.Source)))
+}
+
+// sourceConfidence weighs the source of a range by its rank in
+// SOURCE_PRIORITY, from 1 for the first to 0.5 for an unlisted one.
+func sourceConfidence(source string) float64 {
+	if len(sourcePriority) == 0 || source == "" {
+		return 1
+	}
+	rank := len(sourcePriority)
+	for i, s := range sourcePriority {
+		if s == source {
+			rank = i
+			break
+		}
+	}
+	return 1 - 0.5*float64(rank)/float64(len(sourcePriority))
+}
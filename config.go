@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envBool reads a boolean environment variable, returning def when unset.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid value %q for %s: expected a boolean", v, name)
+	}
+	return b
+}
+
+// envInt reads an integer environment variable, returning def when unset.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid value %q for %s: expected an integer", v, name)
+	}
+	return n
+}
+
+// envFloat reads a floating point environment variable, returning def when unset.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Fatalf("Invalid value %q for %s: expected a number", v, name)
+	}
+	return f
+}
+
+// envDuration reads a duration environment variable such as "30s" or "24h",
+// returning def when unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid value %q for %s: expected a duration like 30s or 24h", v, name)
+	}
+	return d
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	policyFirstWins      = "first"
+	policyLongestPrefix  = "longest_prefix"
+	policySourcePriority = "source_priority"
+
+	// maxLoggedConflicts caps how many individual conflicts are written to the
+	// log on every load; the full list is available via /admin/conflicts.
+	maxLoggedConflicts = 10
+
+	sizeRankMantissaBits = 52
+)
+
+type Conflict struct {
+	StartIP          string `json:"start_ip"`
+	EndIP            string `json:"end_ip"`
+	CountryName      string `json:"country_name"`
+	OtherStartIP     string `json:"other_start_ip"`
+	OtherEndIP       string `json:"other_end_ip"`
+	OtherCountryName string `json:"other_country_name"`
+	WinnerStartIP    string `json:"winner_start_ip"`
+	WinnerEndIP      string `json:"winner_end_ip"`
+	IsIPv6           bool   `json:"is_ipv6"`
+}
+
+func isValidConflictPolicy(policy string) bool {
+	switch policy {
+	case policyFirstWins, policyLongestPrefix, policySourcePriority:
+		return true
+	}
+	return false
+}
+
+// rangePriority returns the priority of a range under the configured conflict
+// policy. Lookups pick the matching range with the lowest priority, so a
+// lower value wins.
+func rangePriority(startIP, endIP []byte, source string, seq int64) int64 {
+	switch conflictPolicy {
+	case policyLongestPrefix:
+		return rangeSizeRank(startIP, endIP)
+	case policySourcePriority:
+		for i, s := range sourcePriority {
+			if s == source {
+				return int64(i)
+			}
+		}
+		return int64(len(sourcePriority))
+	default:
+		return seq
+	}
+}
+
+// rangeSizeRank maps the size of a range to an int64 that orders ranges from
+// the most to the least specific. IPv6 ranges can be far larger than an int64,
+// so the rank is the bit length of the size followed by its 52 most
+// significant bits, much like a float. It's exact for every IPv4 range.
+func rangeSizeRank(startIP, endIP []byte) int64 {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(endIP), new(big.Int).SetBytes(startIP))
+	bits := size.BitLen()
+	if bits > sizeRankMantissaBits {
+		size.Rsh(size, uint(bits-sizeRankMantissaBits))
+	}
+	return int64(bits)<<sizeRankMantissaBits | size.Int64()
+}
+
+type storedRange struct {
+	rowID            int64
+	startIP          []byte
+	endIP            []byte
+	startHi, startLo int64
+	endHi, endLo     int64
+	countryName      string
+	priority         int64
+}
+
+// startsAfter reports whether r starts after o ends, comparing their integer
+// addresses.
+func (r *storedRange) startsAfter(o *storedRange) bool {
+	return r.startHi > o.endHi || r.startHi == o.endHi && r.startLo > o.endLo
+}
+
+// detectConflicts sweeps the ranges of a freshly loaded dataset in start order
+// and records every pair of overlapping ranges that disagree on the country.
+func detectConflicts(tx *sql.Tx, datasetID int64) error {
+	stmt, err := tx.Prepare(`
+		INSERT INTO conflicts (dataset_id, start_ip, end_ip, country_name, other_start_ip, other_end_ip, other_country_name, winner_start_ip, winner_end_ip, is_ipv6)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+
+	total := 0
+	for _, isIPv6 := range []bool{false, true} {
+		rows, err := tx.Query(`
+			SELECT rowid, start_ip, end_ip, start_hi, start_lo, end_hi, end_lo, country_name, priority
+			FROM ip_ranges
+			WHERE dataset_id = ? AND is_ipv6 = ?
+			ORDER BY start_hi, start_lo, end_hi DESC, end_lo DESC
+		`, datasetID, isIPv6)
+		if err != nil {
+			return fmt.Errorf("failed to query ranges: %v", err)
+		}
+
+		var conflicts []Conflict
+		// open are the ranges seen so far that may still overlap the next
+		// ones: those ending at or after the start of the last range.
+		var open []storedRange
+		for rows.Next() {
+			var cur storedRange
+			if err := rows.Scan(&cur.rowID, &cur.startIP, &cur.endIP, &cur.startHi, &cur.startLo, &cur.endHi, &cur.endLo, &cur.countryName, &cur.priority); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan range: %v", err)
+			}
+
+			stillOpen := open[:0]
+			for _, o := range open {
+				if cur.startsAfter(&o) {
+					continue
+				}
+				stillOpen = append(stillOpen, o)
+				if cur.countryName == o.countryName {
+					continue
+				}
+				// Lookups break ties on the priority with the rowid, so
+				// the range loaded first wins.
+				winner := o
+				if cur.priority < o.priority || cur.priority == o.priority && cur.rowID < o.rowID {
+					winner = cur
+				}
+				conflicts = append(conflicts, Conflict{
+					StartIP:          net.IP(o.startIP).String(),
+					EndIP:            net.IP(o.endIP).String(),
+					CountryName:      o.countryName,
+					OtherStartIP:     net.IP(cur.startIP).String(),
+					OtherEndIP:       net.IP(cur.endIP).String(),
+					OtherCountryName: cur.countryName,
+					WinnerStartIP:    net.IP(winner.startIP).String(),
+					WinnerEndIP:      net.IP(winner.endIP).String(),
+					IsIPv6:           isIPv6,
+				})
+			}
+			open = append(stillOpen, cur)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read ranges: %v", err)
+		}
+
+		for _, c := range conflicts {
+			if total < maxLoggedConflicts {
+				log.Printf("Warning: Conflicting ranges %s - %s (%s) and %s - %s (%s), %s - %s wins",
+					c.StartIP, c.EndIP, c.CountryName, c.OtherStartIP, c.OtherEndIP, c.OtherCountryName, c.WinnerStartIP, c.WinnerEndIP)
+			}
+			total++
+
+			_, err = stmt.Exec(datasetID, c.StartIP, c.EndIP, c.CountryName, c.OtherStartIP, c.OtherEndIP, c.OtherCountryName, c.WinnerStartIP, c.WinnerEndIP, c.IsIPv6)
+			if err != nil {
+				return fmt.Errorf("failed to insert conflict: %v", err)
+			}
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Found %d conflicting range overlaps, resolved using the %q policy", total, conflictPolicy)
+	}
+	return nil
+}
+
+func conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	var total int
+	err := db.Load().QueryRow("SELECT COUNT(*) FROM conflicts WHERE dataset_id = ?", activeDatasetID.Load()).Scan(&total)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	rows, err := db.Load().Query(`
+		SELECT start_ip, end_ip, country_name, other_start_ip, other_end_ip, other_country_name, winner_start_ip, winner_end_ip, is_ipv6
+		FROM conflicts
+		WHERE dataset_id = ?
+		ORDER BY rowid
+		LIMIT ?
+	`, activeDatasetID.Load(), limit)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	conflicts := []Conflict{}
+	for rows.Next() {
+		var c Conflict
+		if err := rows.Scan(&c.StartIP, &c.EndIP, &c.CountryName, &c.OtherStartIP, &c.OtherEndIP, &c.OtherCountryName, &c.WinnerStartIP, &c.WinnerEndIP, &c.IsIPv6); err != nil {
+			logRequest(r, "Database query error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		conflicts = append(conflicts, c)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"policy":    conflictPolicy,
+		"total":     total,
+		"conflicts": conflicts,
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestConflictWinnerOfEqualPriorityIsTheLookupResult checks that of two
+// overlapping ranges with the same priority, /admin/conflicts names the one
+// lookups return: the range loaded first.
+func TestConflictWinnerOfEqualPriorityIsTheLookupResult(t *testing.T) {
+	policy := conflictPolicy
+	conflictPolicy = policyLongestPrefix
+	t.Cleanup(func() { conflictPolicy = policy })
+
+	// Both ranges are a /24 wide, so they have the same priority. The one
+	// loaded first starts after the other. Conflicts are told apart by the
+	// country name, which writeTestCSV doesn't write.
+	openTestDatabase(t)
+	path := filepath.Join(t.TempDir(), "dataset.csv")
+	csv := "start_ip,end_ip,country,country_name\n" +
+		"1.0.0.128,1.0.1.127,DE,Germany\n" +
+		"1.0.0.0,1.0.0.255,FR,France\n"
+	if err := os.WriteFile(path, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loadTestCSV(t, path)
+
+	info, err := lookupIP(context.Background(), "1.0.0.200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Country != "DE" {
+		t.Fatalf("1.0.0.200 resolved to %s, expected DE of the range loaded first", info.Country)
+	}
+
+	w := httptest.NewRecorder()
+	conflictsHandler(w, httptest.NewRequest("GET", "/admin/conflicts", nil))
+	var resp struct {
+		Conflicts []Conflict `json:"conflicts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(resp.Conflicts) != 1 {
+		t.Fatalf("got %d conflicts, expected 1: %+v", len(resp.Conflicts), resp.Conflicts)
+	}
+	if c := resp.Conflicts[0]; c.WinnerStartIP != info.Range.StartIP || c.WinnerEndIP != info.Range.EndIP {
+		t.Errorf("conflict names %s - %s the winner, lookups return %s - %s", c.WinnerStartIP, c.WinnerEndIP, info.Range.StartIP, info.Range.EndIP)
+	}
+}
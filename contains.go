@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+)
+
+// POST /contains answers which of a list of IPs fall inside which of a list
+// of CIDRs, for network teams checking addresses against their allocations
+// next to the geo data.
+
+// ContainsRequest is the body of POST /contains.
+type ContainsRequest struct {
+	CIDRs []string `json:"cidrs"`
+	IPs   []string `json:"ips"`
+}
+
+// ContainsIP are the CIDRs an IP is in, most specific first.
+type ContainsIP struct {
+	IP    string   `json:"ip"`
+	CIDRs []string `json:"cidrs"`
+}
+
+// ContainsCIDR are the IPs a CIDR contains, in request order.
+type ContainsCIDR struct {
+	CIDR string   `json:"cidr"`
+	IPs  []string `json:"ips"`
+}
+
+// ContainsResponse is the answer of POST /contains.
+type ContainsResponse struct {
+	IPs   []ContainsIP   `json:"ips"`
+	CIDRs []ContainsCIDR `json:"cidrs"`
+}
+
+// cidrIndex finds the CIDRs containing an IP with a binary search. CIDRs
+// either nest or don't overlap, so those containing an IP are the most
+// specific one starting at or before it and the CIDRs enclosing that one.
+type cidrIndex struct {
+	cidrs []indexedCIDR
+}
+
+type indexedCIDR struct {
+	ipInterval
+	// pos is the position of the CIDR in the request.
+	pos int
+	// parent is the index of the most specific CIDR enclosing this one, or
+	// -1.
+	parent int
+}
+
+// newCIDRIndex indexes networks, which may repeat.
+func newCIDRIndex(networks []netip.Prefix) *cidrIndex {
+	idx := &cidrIndex{}
+	for i, p := range networks {
+		start, end := prefixRange(p)
+		idx.cidrs = append(idx.cidrs, indexedCIDR{ipInterval: ipInterval{start, end}, pos: i})
+	}
+	// Enclosing CIDRs come before those they enclose.
+	sort.SliceStable(idx.cidrs, func(i, j int) bool {
+		a, b := idx.cidrs[i], idx.cidrs[j]
+		if len(a.start) != len(b.start) {
+			return len(a.start) < len(b.start)
+		}
+		if c := bytes.Compare(a.start, b.start); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(a.end, b.end) > 0
+	})
+	var open []int
+	for i := range idx.cidrs {
+		c := &idx.cidrs[i]
+		for len(open) > 0 && !idx.encloses(open[len(open)-1], c.ipInterval) {
+			open = open[:len(open)-1]
+		}
+		c.parent = -1
+		if len(open) > 0 {
+			c.parent = open[len(open)-1]
+		}
+		open = append(open, i)
+	}
+	return idx
+}
+
+func (idx *cidrIndex) encloses(i int, in ipInterval) bool {
+	c := idx.cidrs[i]
+	return len(c.start) == len(in.start) && bytes.Compare(c.start, in.start) <= 0 && bytes.Compare(in.end, c.end) <= 0
+}
+
+// containing returns the request positions of the CIDRs containing ip, most
+// specific first.
+func (idx *cidrIndex) containing(ip []byte) []int {
+	i := sort.Search(len(idx.cidrs), func(i int) bool {
+		c := idx.cidrs[i]
+		if len(c.start) != len(ip) {
+			return len(c.start) > len(ip)
+		}
+		return bytes.Compare(c.start, ip) > 0
+	}) - 1
+	var positions []int
+	for ; i >= 0; i = idx.cidrs[i].parent {
+		if idx.encloses(i, ipInterval{ip, ip}) {
+			positions = append(positions, idx.cidrs[i].pos)
+		}
+	}
+	return positions
+}
+
+// prefixRange returns the first and last address of p.
+func prefixRange(p netip.Prefix) ([]byte, []byte) {
+	start := p.Masked().Addr().AsSlice()
+	end := append([]byte(nil), start...)
+	for bit := p.Bits(); bit < len(end)*8; bit++ {
+		end[bit/8] |= 0x80 >> (bit % 8)
+	}
+	return start, end
+}
+
+func containsHandler(w http.ResponseWriter, r *http.Request) {
+	var req ContainsRequest
+	body := http.MaxBytesReader(w, r.Body, int64(batchMaxSize)*2*256)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, "batch_too_large", "Request body is too large")
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "invalid_body", `Request body must be a JSON object with "cidrs" and "ips" arrays`)
+		return
+	}
+	if len(req.CIDRs) > batchMaxSize || len(req.IPs) > batchMaxSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "batch_too_large", fmt.Sprintf("At most %d CIDRs and %d IPs per request", batchMaxSize, batchMaxSize))
+		return
+	}
+
+	networks := make([]netip.Prefix, len(req.CIDRs))
+	cidrs := make([]ContainsCIDR, len(req.CIDRs))
+	for i, v := range req.CIDRs {
+		network, err := parseCIDR(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_body", fmt.Sprintf("Invalid CIDR %q", v))
+			return
+		}
+		ones, _ := network.Mask.Size()
+		addr, _ := netip.AddrFromSlice(network.IP)
+		networks[i] = netip.PrefixFrom(addr.Unmap(), ones)
+		cidrs[i] = ContainsCIDR{CIDR: network.String(), IPs: []string{}}
+	}
+	idx := newCIDRIndex(networks)
+
+	ips := make([]ContainsIP, len(req.IPs))
+	for i, v := range req.IPs {
+		addr, err := netip.ParseAddr(v)
+		if err != nil || addr.Zone() != "" {
+			writeError(w, r, http.StatusBadRequest, "invalid_ip", fmt.Sprintf("Invalid IP address %q", v))
+			return
+		}
+		ips[i] = ContainsIP{IP: v, CIDRs: []string{}}
+		for _, pos := range idx.containing(addr.Unmap().AsSlice()) {
+			ips[i].CIDRs = append(ips[i].CIDRs, cidrs[pos].CIDR)
+			cidrs[pos].IPs = append(cidrs[pos].IPs, v)
+		}
+	}
+
+	json.NewEncoder(w).Encode(ContainsResponse{IPs: ips, CIDRs: cidrs})
+}
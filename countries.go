@@ -0,0 +1,206 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The ISO 3166-1 table used to normalize countries. It lives in
+// assets/iso3166.csv (alpha2, alpha3, numeric, name, continent, calling_code,
+// tld, aliases), where name is the canonical name, continent is the GeoNames
+// continent code and aliases, separated by |, are the other names feeds use
+// for the country.
+//
+//go:embed assets/iso3166.csv
+var iso3166CSV string
+
+// ISOCountry is a row of the ISO 3166-1 table.
+type ISOCountry struct {
+	Alpha2    string
+	Alpha3    string
+	Numeric   string
+	Name      string
+	Continent string
+	// CallingCode is the international dialing prefix without the +.
+	CallingCode string
+	TLD         string
+}
+
+var continentNames = map[string]string{
+	"AF": "Africa",
+	"AN": "Antarctica",
+	"AS": "Asia",
+	"EU": "Europe",
+	"NA": "North America",
+	"OC": "Oceania",
+	"SA": "South America",
+}
+
+var isoCountries, isoCountryNames = mustParseISO3166(iso3166CSV)
+
+// normalizeCountries rewrites the country codes and names of the upstream data
+// to the ISO table while loading it. Feeds disagree on names, "Korea,
+// Republic of" in one and "South Korea" in the next, which breaks joins on
+// them downstream.
+var normalizeCountries bool
+
+// mustParseISO3166 returns the table by alpha-2 and alpha-3 code, and by
+// country name key for every name and alias.
+func mustParseISO3166(data string) (map[string]*ISOCountry, map[string]*ISOCountry) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		log.Fatalf("Failed to parse ISO 3166 table: %v", err)
+	}
+
+	byCode := make(map[string]*ISOCountry, 2*len(records))
+	byName := make(map[string]*ISOCountry, 3*len(records))
+	for _, record := range records[1:] {
+		c := &ISOCountry{
+			Alpha2:      record[0],
+			Alpha3:      record[1],
+			Numeric:     record[2],
+			Name:        record[3],
+			Continent:   record[4],
+			CallingCode: record[5],
+			TLD:         record[6],
+		}
+		if _, ok := continentNames[c.Continent]; !ok {
+			log.Fatalf("Invalid continent %q for %s in ISO 3166 table", c.Continent, c.Alpha2)
+		}
+		byCode[c.Alpha2] = c
+		byCode[c.Alpha3] = c
+		for _, name := range append([]string{c.Name}, strings.Split(record[7], "|")...) {
+			if key := countryNameKey(name); key != "" {
+				if other, ok := byName[key]; ok && other != c {
+					log.Fatalf("Country name %q is used by both %s and %s in the ISO 3166 table", name, other.Alpha2, c.Alpha2)
+				}
+				byName[key] = c
+			}
+		}
+	}
+	return byCode, byName
+}
+
+var countryNameFolds = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "å", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "í", "i", "ñ", "n",
+	"ó", "o", "ô", "o", "ö", "o", "ü", "u", "ç", "c",
+	"&", " and ",
+)
+
+// countryNameKey reduces a country name to lowercase words without accents
+// or punctuation, so spelling differences in case, "&" vs "and" or "St." vs
+// "Saint" don't matter.
+func countryNameKey(name string) string {
+	name = countryNameFolds.Replace(strings.ToLower(name))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return r
+		case r == '\'' || r == '’':
+			return -1
+		}
+		return ' '
+	}, name)
+	words := strings.Fields(name)
+	if len(words) > 0 && words[0] == "the" {
+		words = words[1:]
+	}
+	for i, word := range words {
+		if word == "st" {
+			words[i] = "saint"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// lookupISOCountry finds the country by alpha-2 or alpha-3 code, or failing
+// that by name.
+func lookupISOCountry(code, name string) *ISOCountry {
+	if c, ok := isoCountries[strings.ToUpper(strings.TrimSpace(code))]; ok {
+		return c
+	}
+	if c, ok := isoCountryNames[countryNameKey(name)]; ok {
+		return c
+	}
+	return nil
+}
+
+// normalizeCountry rewrites the country of r to its alpha-2 code and
+// canonical name. An alpha-3 code or a known name is enough to find the
+// country; codes the table doesn't know, like EU, are kept as they are.
+func normalizeCountry(r *IPRange) {
+	if !normalizeCountries {
+		return
+	}
+	if c := lookupISOCountry(r.Country, r.CountryName); c != nil {
+		r.Country = c.Alpha2
+		r.CountryName = c.Name
+	} else {
+		r.Country = strings.ToUpper(strings.TrimSpace(r.Country))
+	}
+
+	for i, country := range r.Countries {
+		if c, ok := isoCountries[strings.ToUpper(strings.TrimSpace(country))]; ok {
+			r.Countries[i] = c.Alpha2
+		}
+	}
+}
+
+// applyISOCodes adds the alpha-3 and numeric codes of the country to info and,
+// unless normalization is off, its canonical name, which covers overrides and
+// data loaded before normalization. Sources without continents get the one of
+// the country, so responses have the same shape whatever the data came from.
+func applyISOCodes(info *IPInfo) {
+	c, ok := isoCountries[strings.ToUpper(info.Country)]
+	if ok && len(info.Country) == 2 {
+		info.CountryAlpha3 = c.Alpha3
+		info.CountryNumeric = c.Numeric
+		if normalizeCountries {
+			info.CountryName = c.Name
+		}
+		if info.Continent == "" {
+			info.Continent = c.Continent
+			info.ContinentName = ""
+		}
+	}
+	if info.ContinentName == "" {
+		info.ContinentName = continentNames[strings.ToUpper(info.Continent)]
+	}
+}
+
+// wantsExtended reports whether the request asked for the convenience fields
+// of the country with ?extended=true.
+func wantsExtended(r *http.Request) bool {
+	b, err := strconv.ParseBool(r.URL.Query().Get("extended"))
+	return err == nil && b
+}
+
+// applyExtendedFields adds the flag emoji, calling code and TLD of the
+// country, which front ends would otherwise each keep a table for.
+func applyExtendedFields(info *IPInfo) {
+	c, ok := isoCountries[info.Country]
+	if !ok || len(info.Country) != 2 {
+		return
+	}
+	info.Flag = flagEmoji(c.Alpha2)
+	if c.CallingCode != "" {
+		info.CallingCode = "+" + c.CallingCode
+	}
+	info.TLD = c.TLD
+}
+
+// flagEmoji spells the alpha-2 code in regional indicator symbols, which
+// render as the country's flag.
+func flagEmoji(alpha2 string) string {
+	var b strings.Builder
+	for _, r := range alpha2 {
+		b.WriteRune(0x1F1E6 + r - 'A')
+	}
+	return b.String()
+}
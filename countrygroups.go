@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// euMembers lists the ISO 3166-1 alpha-2 codes of the European Union member states.
+var euMembers = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "HR": true, "CY": true, "CZ": true, "DK": true,
+	"EE": true, "FI": true, "FR": true, "DE": true, "GR": true, "HU": true, "IE": true,
+	"IT": true, "LV": true, "LT": true, "LU": true, "MT": true, "NL": true, "PL": true,
+	"PT": true, "RO": true, "SK": true, "SI": true, "ES": true, "SE": true,
+}
+
+var (
+	sanctionedCountries map[string]bool
+	// countryGroups maps a group name to the set of country codes in it.
+	countryGroups map[string]map[string]bool
+)
+
+// parseCountryList parses a comma separated list of country codes.
+func parseCountryList(v string) map[string]bool {
+	countries := map[string]bool{}
+	for _, code := range strings.Split(v, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			countries[code] = true
+		}
+	}
+	return countries
+}
+
+// expandCountries returns the set of countries named by items, which are
+// country codes or the names of COUNTRY_GROUPS.
+func expandCountries(items []string) (map[string]bool, error) {
+	countries := map[string]bool{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if group, ok := countryGroups[item]; ok {
+			for code := range group {
+				countries[code] = true
+			}
+			continue
+		}
+		if len(item) != 2 {
+			return nil, fmt.Errorf("%q is neither a country code nor a country group", item)
+		}
+		countries[strings.ToUpper(item)] = true
+	}
+	return countries, nil
+}
+
+// parseCountryGroups parses group definitions of the form
+// "name:CC,CC;other:CC,CC".
+func parseCountryGroups(v string) (map[string]map[string]bool, error) {
+	groups := map[string]map[string]bool{}
+	for _, def := range strings.Split(v, ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		name, countries, ok := strings.Cut(def, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid country group %q, expected name:CC,CC", def)
+		}
+		groups[name] = parseCountryList(countries)
+	}
+	return groups, nil
+}
+
+// applyCountryFlags sets the derived membership flags for the resolved country.
+func applyCountryFlags(info *IPInfo) {
+	if info.Country == "" {
+		return
+	}
+	code := strings.ToUpper(info.Country)
+
+	info.IsEU = euMembers[code]
+	info.IsSanctioned = sanctionedCountries[code]
+
+	var groups []string
+	for name, members := range countryGroups {
+		if members[code] {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	info.Groups = groups
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// CountryMetadata is supplemental per-country data used when the dataset
+// doesn't carry it on the range itself.
+type CountryMetadata struct {
+	Timezone string
+	Currency string
+}
+
+var countryMetadata map[string]CountryMetadata
+
+// loadCountryMetadata reads a CSV file with a header row containing the
+// columns country, timezone and currency, e.g.
+//
+//	country,timezone,currency
+//	IN,Asia/Kolkata,INR
+func loadCountryMetadata(path string) (map[string]CountryMetadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of %s: %v", path, err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	countryCol, ok := columns["country"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no country column", path)
+	}
+	timezoneCol, hasTimezone := columns["timezone"]
+	currencyCol, hasCurrency := columns["currency"]
+
+	metadata := map[string]CountryMetadata{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+
+		var meta CountryMetadata
+		if hasTimezone {
+			meta.Timezone = record[timezoneCol]
+		}
+		if hasCurrency {
+			meta.Currency = record[currencyCol]
+		}
+		metadata[strings.ToUpper(record[countryCol])] = meta
+	}
+
+	return metadata, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /countries counts the ranges and addresses attributed to each country
+// in the active dataset, or the one of ?date, to sanity-check the upstream
+// data after a refresh: a country losing half its addresses overnight is more
+// likely a broken feed than a change in the world.
+
+// CountryStats are the ranges and addresses of a country in a dataset, or of
+// the ranges without one.
+type CountryStats struct {
+	Country       string `json:"country,omitempty"`
+	CountryName   string `json:"country_name,omitempty"`
+	Ranges        int64  `json:"ranges"`
+	IPv4Addresses uint64 `json:"ipv4_addresses"`
+	// IPv6Addresses is a decimal string, as it easily exceeds the numbers
+	// JSON parsers hold exactly.
+	IPv6Addresses string `json:"ipv6_addresses"`
+
+	ipv6 *big.Int
+}
+
+// datasetCountryStats are the stats of every country of a dataset.
+type datasetCountryStats struct {
+	datasetID int64
+	version   string
+	countries []*CountryStats
+	// unattributed are the ranges without a country.
+	unattributed *CountryStats
+}
+
+var (
+	// countryStatsCache holds the stats last computed, which stay valid as
+	// long as their dataset is the one asked for.
+	countryStatsMu    sync.Mutex
+	countryStatsCache *datasetCountryStats
+)
+
+// countryStatsFor returns the stats of the dataset the lookups of ctx use.
+func countryStatsFor(ctx context.Context) (*datasetCountryStats, error) {
+	id, version := activeDatasetID.Load(), datasetVersion()
+	if d := datasetFromContext(ctx); d != nil {
+		id, version = d.ID, d.Version
+	}
+
+	countryStatsMu.Lock()
+	defer countryStatsMu.Unlock()
+	if countryStatsCache != nil && countryStatsCache.datasetID == id {
+		return countryStatsCache, nil
+	}
+	stats, err := computeCountryStats(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	stats.version = version
+	countryStatsCache = stats
+	return stats, nil
+}
+
+func computeCountryStats(ctx context.Context, datasetID int64) (*datasetCountryStats, error) {
+	rows, err := db.Load().QueryContext(ctx, "SELECT country, country_name, start_ip, end_ip FROM ip_ranges WHERE dataset_id = ?", datasetID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count countries: %v", err)
+	}
+	defer rows.Close()
+
+	byCountry := map[string]*CountryStats{}
+	var start, end []byte
+	for rows.Next() {
+		var country, name string
+		if err := rows.Scan(&country, &name, &start, &end); err != nil {
+			return nil, fmt.Errorf("failed to count countries: %v", err)
+		}
+		s := byCountry[country]
+		if s == nil {
+			s = &CountryStats{Country: country, CountryName: name, ipv6: new(big.Int)}
+			if c := lookupISOCountry(country, ""); c != nil {
+				s.CountryName = c.Name
+			}
+			byCountry[country] = s
+		}
+		s.Ranges++
+		switch len(start) {
+		case 4:
+			s.IPv4Addresses += uint64(binary.BigEndian.Uint32(end)-binary.BigEndian.Uint32(start)) + 1
+		case 16:
+			n := new(big.Int).SetBytes(end)
+			n.Sub(n, new(big.Int).SetBytes(start))
+			s.ipv6.Add(s.ipv6, n.Add(n, big.NewInt(1)))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to count countries: %v", err)
+	}
+
+	stats := &datasetCountryStats{datasetID: datasetID, countries: []*CountryStats{}}
+	for country, s := range byCountry {
+		s.IPv6Addresses = s.ipv6.String()
+		if country == "" {
+			stats.unattributed = s
+			continue
+		}
+		stats.countries = append(stats.countries, s)
+	}
+	sort.Slice(stats.countries, func(i, j int) bool { return stats.countries[i].Country < stats.countries[j].Country })
+	return stats, nil
+}
+
+// find returns the stats of the country with the code, alpha-2 or alpha-3,
+// or the name, or nil.
+func (d *datasetCountryStats) find(query string) *CountryStats {
+	code := strings.ToUpper(strings.TrimSpace(query))
+	if c := lookupISOCountry(query, query); c != nil {
+		code = c.Alpha2
+	}
+	for _, s := range d.countries {
+		if s.Country == code {
+			return s
+		}
+	}
+	return nil
+}
+
+func countriesHandler(w http.ResponseWriter, r *http.Request) {
+	r, ok := withHistoricalDataset(w, r)
+	if !ok {
+		return
+	}
+	stats, err := countryStatsFor(r.Context())
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"dataset_id":      stats.datasetID,
+		"dataset_version": stats.version,
+		"countries":       stats.countries,
+	}
+	if stats.unattributed != nil {
+		resp["unattributed"] = stats.unattributed
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func countryHandler(w http.ResponseWriter, r *http.Request) {
+	r, ok := withHistoricalDataset(w, r)
+	if !ok {
+		return
+	}
+	stats, err := countryStatsFor(r.Context())
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	query := mux.Vars(r)["country"]
+	s := stats.find(query)
+	if s == nil {
+		writeError(w, r, http.StatusNotFound, "country_not_found", fmt.Sprintf("No ranges of %s in the dataset", query))
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		*CountryStats
+		DatasetID      int64  `json:"dataset_id"`
+		DatasetVersion string `json:"dataset_version"`
+	}{s, stats.datasetID, stats.version})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// GET /admin/coverage reports how much of the address space the ranges of a
+// dataset cover, and the largest gaps they leave. A partial upstream file
+// still loads, so after each load the coverage is compared with that of the
+// previous dataset, and a drop of more than COVERAGE_DROP_THRESHOLD of the
+// public IPv4 space is logged and sent as a coverage.dropped webhook.
+
+const (
+	defaultCoverageGaps = 10
+	maxCoverageGaps     = 100
+)
+
+// coverageSpace is a part of the address space coverage is reported for.
+// Reserved are its special purpose ranges, which no dataset is expected to
+// cover.
+type coverageSpace struct {
+	name     string
+	prefix   netip.Prefix
+	reserved []netip.Prefix
+	gaps     bool
+}
+
+var (
+	ipv4Space = coverageSpace{
+		prefix: netip.MustParsePrefix("0.0.0.0/0"),
+		reserved: mustParsePrefixes(
+			"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+			"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24",
+			"203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		),
+		gaps: true,
+	}
+	ipv6Space = coverageSpace{
+		name:     "Global unicast",
+		prefix:   netip.MustParsePrefix("2000::/3"),
+		reserved: mustParsePrefixes("2001:db8::/32"),
+		gaps:     true,
+	}
+	// ipv6Allocations are the blocks IANA allocated to the regional
+	// registries, where nearly all assigned IPv6 addresses are.
+	ipv6Allocations = []coverageSpace{
+		{name: "APNIC", prefix: netip.MustParsePrefix("2400::/12")},
+		{name: "ARIN", prefix: netip.MustParsePrefix("2600::/12")},
+		{name: "LACNIC", prefix: netip.MustParsePrefix("2800::/12")},
+		{name: "RIPE NCC", prefix: netip.MustParsePrefix("2a00::/12")},
+		{name: "AFRINIC", prefix: netip.MustParsePrefix("2c00::/12")},
+	}
+
+	coverageDropThreshold float64
+
+	// coverageReports are computed once per dataset, whose ranges never
+	// change.
+	coverageMu      sync.Mutex
+	coverageReports = map[int64]*CoverageReport{}
+)
+
+func mustParsePrefixes(prefixes ...string) []netip.Prefix {
+	list := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		list[i] = netip.MustParsePrefix(p)
+	}
+	return list
+}
+
+func loadCoverageConfig() {
+	coverageDropThreshold = envFloat("COVERAGE_DROP_THRESHOLD", 0.01)
+}
+
+// CoverageReport is the coverage of the ranges of a dataset.
+type CoverageReport struct {
+	DatasetID       int64           `json:"dataset_id"`
+	DatasetVersion  string          `json:"dataset_version"`
+	IPv4            SpaceCoverage   `json:"ipv4"`
+	IPv6            SpaceCoverage   `json:"ipv6"`
+	IPv6Allocations []SpaceCoverage `json:"ipv6_allocations"`
+}
+
+// SpaceCoverage is the coverage of a part of the address space.
+type SpaceCoverage struct {
+	Space            string   `json:"space"`
+	Name             string   `json:"name,omitempty"`
+	Addresses        *big.Int `json:"addresses"`
+	CoveredAddresses *big.Int `json:"covered_addresses"`
+	Fraction         float64  `json:"fraction"`
+	// PublicFraction leaves the special purpose ranges out of the space.
+	PublicFraction float64       `json:"public_fraction"`
+	LargestGaps    []CoverageGap `json:"largest_gaps,omitempty"`
+}
+
+// CoverageGap is a range of public addresses no range covers.
+type CoverageGap struct {
+	StartIP   string   `json:"start_ip"`
+	EndIP     string   `json:"end_ip"`
+	CIDRs     []string `json:"cidrs"`
+	Addresses *big.Int `json:"addresses"`
+}
+
+func prefixInterval(p netip.Prefix) ipInterval {
+	start, end := prefixRange(p)
+	return ipInterval{start, end}
+}
+
+// intervalSize is the number of addresses of in.
+func intervalSize(in ipInterval) *big.Int {
+	n := new(big.Int).Sub(new(big.Int).SetBytes(in.end), new(big.Int).SetBytes(in.start))
+	return n.Add(n, big.NewInt(1))
+}
+
+// sumSizes is the number of addresses of intervals, which don't overlap.
+func sumSizes(intervals []ipInterval) *big.Int {
+	total := new(big.Int)
+	for _, in := range intervals {
+		total.Add(total, intervalSize(in))
+	}
+	return total
+}
+
+// clip returns the parts of intervals inside space.
+func clip(intervals []ipInterval, space ipInterval) []ipInterval {
+	var clipped []ipInterval
+	for _, in := range intervals {
+		if bytes.Compare(in.end, space.start) < 0 || bytes.Compare(in.start, space.end) > 0 {
+			continue
+		}
+		start, end := in.start, in.end
+		if bytes.Compare(start, space.start) < 0 {
+			start = space.start
+		}
+		if bytes.Compare(end, space.end) > 0 {
+			end = space.end
+		}
+		clipped = append(clipped, ipInterval{start, end})
+	}
+	return clipped
+}
+
+func fraction(n, d *big.Int) float64 {
+	if d.Sign() == 0 {
+		return 0
+	}
+	f, _ := new(big.Rat).SetFrac(n, d).Float64()
+	return f
+}
+
+// spaceCoverage measures how much of space the merged ranges cover, and
+// finds the largest gaps outside the reserved ranges.
+func spaceCoverage(space coverageSpace, ranges []ipInterval) SpaceCoverage {
+	bounds := prefixInterval(space.prefix)
+	covered := clip(ranges, bounds)
+	c := SpaceCoverage{
+		Space:            space.prefix.String(),
+		Name:             space.name,
+		Addresses:        intervalSize(bounds),
+		CoveredAddresses: sumSizes(covered),
+	}
+	c.Fraction = fraction(c.CoveredAddresses, c.Addresses)
+
+	// The gaps are what neither the ranges nor the reserved ranges cover.
+	var reserved []ipInterval
+	for _, p := range space.reserved {
+		reserved = append(reserved, prefixInterval(p))
+	}
+	known := mergeIntervals(append(append([]ipInterval(nil), covered...), reserved...))
+	var gaps []ipInterval
+	next, more := bounds.start, true
+	for _, in := range known {
+		if bytes.Compare(in.start, next) > 0 {
+			end, _ := ipBefore(in.start)
+			gaps = append(gaps, ipInterval{next, end})
+		}
+		if next, more = ipAfter(in.end); !more {
+			break
+		}
+	}
+	if more && bytes.Compare(next, bounds.end) <= 0 {
+		gaps = append(gaps, ipInterval{next, bounds.end})
+	}
+
+	public := new(big.Int).Sub(c.Addresses, sumSizes(mergeIntervals(reserved)))
+	c.PublicFraction = fraction(new(big.Int).Sub(public, sumSizes(gaps)), public)
+
+	if space.gaps {
+		sort.SliceStable(gaps, func(i, j int) bool {
+			return intervalSize(gaps[i]).Cmp(intervalSize(gaps[j])) > 0
+		})
+		if len(gaps) > maxCoverageGaps {
+			gaps = gaps[:maxCoverageGaps]
+		}
+		c.LargestGaps = []CoverageGap{}
+		for _, g := range gaps {
+			m := newMatchedRange(g.start, g.end)
+			c.LargestGaps = append(c.LargestGaps, CoverageGap{StartIP: m.StartIP, EndIP: m.EndIP, CIDRs: m.CIDRs, Addresses: intervalSize(g)})
+		}
+	}
+	return c
+}
+
+// datasetRanges returns the merged ranges of a dataset of one address family.
+func datasetRanges(ctx context.Context, datasetID int64, ipv6 bool) ([]ipInterval, error) {
+	rows, err := db.Load().QueryContext(ctx, "SELECT start_ip, end_ip FROM ip_ranges WHERE dataset_id = ? AND is_ipv6 = ? ORDER BY start_hi, start_lo", datasetID, ipv6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ranges of dataset %d: %v", datasetID, err)
+	}
+	defer rows.Close()
+
+	var ranges []ipInterval
+	for rows.Next() {
+		var start, end []byte
+		if err := rows.Scan(&start, &end); err != nil {
+			return nil, fmt.Errorf("failed to load ranges of dataset %d: %v", datasetID, err)
+		}
+		ranges = append(ranges, ipInterval{start, end})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load ranges of dataset %d: %v", datasetID, err)
+	}
+	return mergeIntervals(ranges), nil
+}
+
+// datasetCoverage returns the coverage report of a dataset, or sql.ErrNoRows
+// if there is no such dataset.
+func datasetCoverage(ctx context.Context, datasetID int64) (*CoverageReport, error) {
+	coverageMu.Lock()
+	report, ok := coverageReports[datasetID]
+	coverageMu.Unlock()
+	if ok {
+		return report, nil
+	}
+
+	report = &CoverageReport{DatasetID: datasetID}
+	err := db.Load().QueryRowContext(ctx, "SELECT version FROM datasets WHERE id = ?", datasetID).Scan(&report.DatasetVersion)
+	if err != nil {
+		return nil, err
+	}
+	v4, err := datasetRanges(ctx, datasetID, false)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := datasetRanges(ctx, datasetID, true)
+	if err != nil {
+		return nil, err
+	}
+	report.IPv4 = spaceCoverage(ipv4Space, v4)
+	report.IPv6 = spaceCoverage(ipv6Space, v6)
+	report.IPv6Allocations = []SpaceCoverage{}
+	for _, space := range ipv6Allocations {
+		report.IPv6Allocations = append(report.IPv6Allocations, spaceCoverage(space, v6))
+	}
+
+	coverageMu.Lock()
+	defer coverageMu.Unlock()
+	// Reports of deleted datasets are dropped along the way.
+	if len(coverageReports) >= 8 {
+		clear(coverageReports)
+	}
+	coverageReports[datasetID] = report
+	return report, nil
+}
+
+// checkCoverageDrop compares the coverage of a newly active dataset with
+// that of the previous one.
+func checkCoverageDrop(previousID, datasetID int64) error {
+	if previousID == 0 || coverageDropThreshold <= 0 {
+		return nil
+	}
+	previous, err := datasetCoverage(context.Background(), previousID)
+	if err != nil {
+		return err
+	}
+	current, err := datasetCoverage(context.Background(), datasetID)
+	if err != nil {
+		return err
+	}
+	drop := previous.IPv4.PublicFraction - current.IPv4.PublicFraction
+	if drop <= coverageDropThreshold {
+		return nil
+	}
+	log.Printf("Warning: dataset %d covers %.2f%% of the public IPv4 space, down from %.2f%% in dataset %d",
+		datasetID, current.IPv4.PublicFraction*100, previous.IPv4.PublicFraction*100, previousID)
+	sendWebhook("coverage.dropped", map[string]interface{}{
+		"dataset_id":               datasetID,
+		"dataset_version":          current.DatasetVersion,
+		"public_fraction":          current.IPv4.PublicFraction,
+		"previous_dataset_id":      previousID,
+		"previous_dataset_version": previous.DatasetVersion,
+		"previous_public_fraction": previous.IPv4.PublicFraction,
+		"largest_gaps":             trimGaps(current.IPv4.LargestGaps, defaultCoverageGaps),
+	})
+	return nil
+}
+
+func trimGaps(gaps []CoverageGap, n int) []CoverageGap {
+	if len(gaps) > n {
+		return gaps[:n]
+	}
+	return gaps
+}
+
+// coverageHandler reports the coverage of a dataset, the active one unless
+// ?dataset is given, with the ?gaps largest gaps (default 10, at most 100).
+func coverageHandler(w http.ResponseWriter, r *http.Request) {
+	id := activeDatasetID.Load()
+	if v := r.URL.Query().Get("dataset"); v != "" {
+		var err error
+		id, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid dataset")
+			return
+		}
+	}
+	gaps := defaultCoverageGaps
+	if v := r.URL.Query().Get("gaps"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxCoverageGaps {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", fmt.Sprintf("Invalid gaps, expected 0 to %d", maxCoverageGaps))
+			return
+		}
+		gaps = n
+	}
+
+	report, err := datasetCoverage(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, "dataset_not_found", "Dataset not found")
+		return
+	} else if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	trimmed := *report
+	trimmed.IPv4.LargestGaps = trimGaps(report.IPv4.LargestGaps, gaps)
+	trimmed.IPv6.LargestGaps = trimGaps(report.IPv6.LargestGaps, gaps)
+	json.NewEncoder(w).Encode(trimmed)
+}
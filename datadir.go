@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The database lives in DATA_DIR, data by default, unless DB_PATH names it.
+// With DB_READ_ONLY it is opened read-only, for a database built elsewhere
+// and mounted into the container, and nothing updates it: no downloads, no
+// schema changes, and no admin endpoint that writes.
+
+var (
+	dataDir = "data"
+	dbFile  = filepath.Join(dataDir, "ip_ranges.db")
+
+	dbReadOnly bool
+)
+
+func loadDataDirConfig() {
+	if v := os.Getenv("DATA_DIR"); v != "" {
+		dataDir = v
+	}
+	dbFile = os.Getenv("DB_PATH")
+	if dbFile == "" {
+		dbFile = filepath.Join(dataDir, "ip_ranges.db")
+	}
+	dbReadOnly = envBool("DB_READ_ONLY", false)
+}
+
+// checkReadOnlyConfig rejects the settings that need to write to a read-only
+// database.
+func checkReadOnlyConfig(restorePath string) error {
+	if !dbReadOnly {
+		return nil
+	}
+	switch {
+	case restorePath != "":
+		return fmt.Errorf("--restore can't replace a read-only database")
+	case auditEnabled:
+		return fmt.Errorf("AUDIT_LOG can't be used with a read-only database")
+	case os.Getenv("TRANSLATIONS_FILE") != "":
+		return fmt.Errorf("TRANSLATIONS_FILE can't be imported into a read-only database")
+	}
+	return nil
+}
+
+// prepareDataDir creates the directory of the database, or checks that the
+// database exists when it is read-only.
+func prepareDataDir() error {
+	if dbReadOnly {
+		if _, err := os.Stat(dbFile); err != nil {
+			return fmt.Errorf("DB_READ_ONLY is set but the database can't be read: %v", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dbFile), 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %v", err)
+	}
+	return nil
+}
+
+// databaseDSN is the data source name dbFile is opened with.
+func databaseDSN() string {
+	if dbReadOnly {
+		return "file:" + dbFile + "?mode=ro"
+	}
+	return dbFile
+}
+
+// requireWritable rejects requests that would write to a read-only database.
+func requireWritable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dbReadOnly {
+			writeError(w, r, http.StatusConflict, "read_only", "The database is read-only")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Every load of the upstream data is stored as a separate dataset. Lookups
+// only see the active one, which makes a refresh an atomic switch and lets us
+// roll back to the dataset that was active before it.
+
+type Dataset struct {
+	ID          int64     `json:"id"`
+	Version     string    `json:"version"`
+	LoadedAt    time.Time `json:"loaded_at"`
+	RowCount    int64     `json:"row_count"`
+	SkippedRows int64     `json:"skipped_rows"`
+	Active      bool      `json:"active"`
+	Staged      bool      `json:"staged,omitempty"`
+	Provenance
+}
+
+var activeDatasetID atomic.Int64
+
+var errNoPreviousDataset = errors.New("no previous dataset to roll back to")
+
+func createDatasetsTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS datasets (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version TEXT NOT NULL,
+			loaded_at INTEGER NOT NULL,
+			row_count INTEGER NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create datasets table: %v", err)
+	}
+
+	for _, column := range []string{"source_url", "upstream_version", "license", "publisher", "attribution"} {
+		err = addColumnIfMissing("datasets", column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+	err = addColumnIfMissing("datasets", "skipped_rows", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	return adoptLegacyRanges()
+}
+
+// adoptLegacyRanges turns ranges loaded before datasets existed into a
+// dataset, so upgrading doesn't leave the service without data.
+func adoptLegacyRanges() error {
+	var hasLegacy bool
+	err := db.Load().QueryRow("SELECT EXISTS (SELECT 1 FROM ip_ranges WHERE dataset_id IS NULL)").Scan(&hasLegacy)
+	if err != nil {
+		return fmt.Errorf("failed to check for legacy ranges: %v", err)
+	}
+	if !hasLegacy {
+		return nil
+	}
+
+	version, err := getLastUpdateDate()
+	if err != nil {
+		return fmt.Errorf("failed to get last update date: %v", err)
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	id, err := createDataset(tx, version, Provenance{})
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE ip_ranges SET dataset_id = ? WHERE dataset_id IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to adopt legacy ranges: %v", err)
+	}
+	_, err = tx.Exec("UPDATE conflicts SET dataset_id = ? WHERE dataset_id IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("failed to adopt legacy conflicts: %v", err)
+	}
+	err = finishDataset(tx, id)
+	if err != nil {
+		return err
+	}
+	err = setActiveDataset(tx, id)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Adopted existing ranges as dataset %d", id)
+	return tx.Commit()
+}
+
+// loadActiveDataset reads the active dataset from the metadata table at startup.
+func loadActiveDataset() error {
+	// A restored database may reuse the ids of other datasets.
+	purgeDatasetSources()
+	var id int64
+	var version string
+	err := db.Load().QueryRow(`
+		SELECT d.id, d.version
+		FROM metadata m JOIN datasets d ON d.id = CAST(m.value AS INTEGER)
+		WHERE m.key = 'active_dataset_id'
+	`).Scan(&id, &version)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to load active dataset: %v", err)
+	}
+
+	p, err := loadProvenance(id)
+	if err != nil {
+		return err
+	}
+	if _, err := datasetSource(id); err != nil {
+		return fmt.Errorf("failed to load the source of dataset %d: %v", id, err)
+	}
+
+	activeDatasetID.Store(id)
+	currentDatasetVersion.Store(version)
+	activeProvenance.Store(p)
+	return nil
+}
+
+// createDataset registers a new, not yet active, dataset.
+func createDataset(tx *sql.Tx, version string, p Provenance) (int64, error) {
+	result, err := tx.Exec(`
+		INSERT INTO datasets (version, loaded_at, source_url, upstream_version, license, publisher, attribution)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, version, time.Now().UTC().Unix(), p.SourceURL, p.UpstreamVersion, p.License, p.Publisher, p.Attribution)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create dataset: %v", err)
+	}
+	return result.LastInsertId()
+}
+
+// finishDataset records the number of ranges loaded into a dataset.
+func finishDataset(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(`
+		UPDATE datasets SET row_count = (SELECT COUNT(*) FROM ip_ranges WHERE dataset_id = ?) WHERE id = ?
+	`, id, id)
+	if err != nil {
+		return fmt.Errorf("failed to count dataset rows: %v", err)
+	}
+	return nil
+}
+
+func setActiveDataset(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('active_dataset_id', ?)", id)
+	if err != nil {
+		return fmt.Errorf("failed to set active dataset: %v", err)
+	}
+	return nil
+}
+
+// activateDataset switches lookups to the dataset id and deletes every
+// dataset except it and the one it replaces, which is kept for rollback.
+// A staged dataset other than id is deleted as well.
+func activateDataset(tx *sql.Tx, id int64) error {
+	previous := activeDatasetID.Load()
+
+	err := discardStagedDataset(tx, id)
+	if err != nil {
+		return err
+	}
+	err = setActiveDataset(tx, id)
+	if err != nil {
+		return err
+	}
+
+	// Beyond the previous dataset, only those within DATASET_RETENTION_DAYS
+	// are kept for historical lookups.
+	cutoff := datasetRetentionCutoff()
+	for _, table := range []string{"ip_ranges", "ip_ranges_v4", "conflicts"} {
+		_, err = tx.Exec(fmt.Sprintf(`
+			DELETE FROM %s WHERE dataset_id IS NULL OR dataset_id NOT IN (
+				SELECT id FROM datasets WHERE id IN (?, ?) OR loaded_at >= ?
+			)
+		`, table), id, previous, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to delete old datasets from %s: %v", table, err)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM datasets WHERE id NOT IN (?, ?) AND loaded_at < ?", id, previous, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to delete old datasets: %v", err)
+	}
+	return nil
+}
+
+// publishDataset makes a committed activation visible to lookups.
+func publishDataset(id int64) error {
+	var version string
+	err := db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", id).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to load dataset %d: %v", id, err)
+	}
+	p, err := loadProvenance(id)
+	if err != nil {
+		return err
+	}
+	if _, err := datasetSource(id); err != nil {
+		return fmt.Errorf("failed to load the source of dataset %d: %v", id, err)
+	}
+	// With the memory and bolt engines lookups switch to the new dataset
+	// with their copy of it, so it is built before the dataset is made
+	// active.
+	if err := refreshMemorySnapshot(id); err != nil {
+		return err
+	}
+	if err := refreshBoltStore(id); err != nil {
+		return err
+	}
+	activeDatasetID.Store(id)
+	currentDatasetVersion.Store(version)
+	activeProvenance.Store(p)
+	purgeNegativeCache()
+	purgeLastGoodCache()
+	return nil
+}
+
+// rollbackDataset switches back to the dataset that was active before the
+// current one.
+func rollbackDataset() (int64, error) {
+	var previous int64
+	err := db.Load().QueryRow("SELECT COALESCE(MAX(id), 0) FROM datasets WHERE id < ?", activeDatasetID.Load()).Scan(&previous)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find previous dataset: %v", err)
+	}
+	if previous == 0 {
+		return 0, errNoPreviousDataset
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = setActiveDataset(tx, previous)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	err = publishDataset(previous)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Rolled back to dataset %d", previous)
+	return previous, nil
+}
+
+const datasetColumns = "id, version, loaded_at, row_count, skipped_rows, source_url, upstream_version, license, publisher, attribution"
+
+func scanDataset(row interface{ Scan(...interface{}) error }, staged int64) (Dataset, error) {
+	var d Dataset
+	var loadedAt int64
+	if err := row.Scan(&d.ID, &d.Version, &loadedAt, &d.RowCount, &d.SkippedRows, &d.SourceURL, &d.UpstreamVersion, &d.License, &d.Publisher, &d.Attribution); err != nil {
+		return d, err
+	}
+	d.LoadedAt = time.Unix(loadedAt, 0).UTC()
+	d.Active = d.ID == activeDatasetID.Load()
+	d.Staged = d.ID == staged
+	return d, nil
+}
+
+func listDatasets() ([]Dataset, error) {
+	staged, err := stagedDatasetID(db.Load())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Load().Query("SELECT " + datasetColumns + " FROM datasets ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	datasets := []Dataset{}
+	for rows.Next() {
+		d, err := scanDataset(rows, staged)
+		if err != nil {
+			return nil, err
+		}
+		datasets = append(datasets, d)
+	}
+	return datasets, rows.Err()
+}
+
+func datasetByID(id int64) (*Dataset, error) {
+	staged, err := stagedDatasetID(db.Load())
+	if err != nil {
+		return nil, err
+	}
+	d, err := scanDataset(db.Load().QueryRow("SELECT "+datasetColumns+" FROM datasets WHERE id = ?", id), staged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dataset %d: %v", id, err)
+	}
+	return &d, nil
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	lastUpdate, err := getLastUpdateDate()
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	datasets, err := listDatasets()
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	lists, err := listNetworkLists()
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	database := currentDatabaseStatus()
+	database.Path, database.ReadOnly = dbFile, dbReadOnly
+	database.SchemaVersion, err = schemaVersion(db.Load())
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	breaker := currentBreakerStatus()
+	database.Breaker = &breaker
+	database.SizeBytes, database.FreeBytes, err = databaseSize()
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	rateLimits, err := listRateLimits()
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	canRollback := false
+	for _, d := range datasets {
+		if d.ID < activeDatasetID.Load() {
+			canRollback = true
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dataset_version":   datasetVersion(),
+		"active_dataset_id": activeDatasetID.Load(),
+		"last_update_date":  lastUpdate,
+		"can_rollback":      canRollback,
+		"refresh":           currentRefreshStatus(),
+		"datasets":          datasets,
+		"network_lists":     lists,
+		"rate_limits":       rateLimits,
+		"database":          database,
+	})
+}
+
+// refreshHandler reloads the upstream data even if it was already loaded
+// today, unless ?force=false asks for the check of the daily schedule.
+func refreshHandler(w http.ResponseWriter, r *http.Request) {
+	force := true
+	if v := r.URL.Query().Get("force"); v != "" {
+		var err error
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid force, expected true or false")
+			return
+		}
+	}
+	if !beginRefresh(refreshTriggerManual) {
+		writeError(w, r, http.StatusConflict, "refresh_in_progress", "A refresh is already in progress")
+		return
+	}
+
+	logRequest(r, "Manual refresh requested (force=%t)", force)
+	go func() {
+		var err error
+		defer func() { endRefresh(err) }()
+		if force {
+			err = reloadIPRanges(time.Now().UTC().Format("2006-01-02"))
+		} else {
+			err = updateIPRangesIfNeeded()
+		}
+		if err != nil {
+			log.Printf("Error during manual refresh: %v", err)
+		}
+		updateNetworkLists(force)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "refreshing"})
+}
+
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := rollbackDataset()
+	if errors.Is(err, errNoPreviousDataset) {
+		writeError(w, r, http.StatusConflict, "no_previous_dataset", "No previous dataset to roll back to")
+		return
+	} else if err != nil {
+		logRequest(r, "Rollback error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_dataset_id": id,
+		"dataset_version":   datasetVersion(),
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+func init() {
+	expvar.Publish("lookups", expvar.Func(func() interface{} { return lookupStats() }))
+	expvar.Publish("dataset", expvar.Func(func() interface{} {
+		return map[string]interface{}{
+			"id":      activeDatasetID.Load(),
+			"version": datasetVersion(),
+		}
+	}))
+	expvar.Publish("refresh", expvar.Func(func() interface{} { return currentRefreshStatus() }))
+	expvar.Publish("country_anomalies", expvar.Func(func() interface{} { return currentCountryAnomalyStatus() }))
+}
+
+// registerDebugRoutes serves the runtime profiles of net/http/pprof and the
+// expvar counters under /debug, behind the admin token.
+func registerDebugRoutes(r *mux.Router) {
+	r.HandleFunc("/debug/vars", requireAdmin(expvar.Handler().ServeHTTP)).Methods("GET")
+	r.HandleFunc("/debug/pprof/", requireAdmin(pprof.Index)).Methods("GET")
+	r.HandleFunc("/debug/pprof/cmdline", requireAdmin(pprof.Cmdline)).Methods("GET")
+	r.HandleFunc("/debug/pprof/profile", requireAdmin(withoutWriteDeadline(pprof.Profile))).Methods("GET")
+	r.HandleFunc("/debug/pprof/symbol", requireAdmin(pprof.Symbol)).Methods("GET", "POST")
+	r.HandleFunc("/debug/pprof/trace", requireAdmin(withoutWriteDeadline(pprof.Trace))).Methods("GET")
+	// heap, goroutine, allocs, block, mutex and threadcreate.
+	r.HandleFunc("/debug/pprof/{profile}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		pprof.Handler(mux.Vars(r)["profile"]).ServeHTTP(w, r)
+	})).Methods("GET")
+}
+
+// withoutWriteDeadline lets profiles run for longer than WRITE_TIMEOUT.
+func withoutWriteDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clearWriteDeadline(w)
+		next(w, r)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// When SQLite fails (corruption, a stuck lock, a full disk) lookups fall back
+// to what is still known: the in-memory snapshot of the active dataset if
+// FALLBACK_SNAPSHOT is enabled, then recent answers. Only when neither has
+// the IP do clients get a 503, and a repair of the database is attempted in
+// the background.
+
+const (
+	lastGoodCacheSize = 100000
+	dbRetryAfter      = 30 * time.Second
+)
+
+var errUnavailable = errors.New("Lookups are temporarily unavailable")
+
+var (
+	// lastGoodCache keeps recent answers of the active dataset. It is purged
+	// whenever another dataset becomes active.
+	lastGoodCache *ttlCache[netip.Addr, *RangeRecord]
+
+	fallbackSnapshotEnabled bool
+
+	dbRepairInterval time.Duration
+	dbRepairRunning  atomic.Bool
+	lastDBRepair     atomic.Int64
+
+	lookupsDegraded atomic.Int64
+)
+
+func loadDegradedConfig() {
+	if ttl := envDuration("LAST_GOOD_CACHE_TTL", time.Hour); ttl > 0 {
+		lastGoodCache = newTTLCache[netip.Addr, *RangeRecord](ttl, lastGoodCacheSize)
+	}
+	fallbackSnapshotEnabled = envBool("FALLBACK_SNAPSHOT", false)
+	dbRepairInterval = envDuration("DB_REPAIR_INTERVAL", 5*time.Minute)
+}
+
+func cacheLastGood(ip netip.Addr, r *RangeRecord) {
+	if lastGoodCache != nil {
+		lastGoodCache.Set(ip, r)
+	}
+}
+
+func purgeLastGoodCache() {
+	if lastGoodCache != nil {
+		lastGoodCache.Purge()
+	}
+}
+
+// degradedLookup answers a lookup the database failed, or returns
+// errUnavailable.
+func degradedLookup(ctx context.Context, ip netip.Addr, ipBytes []byte) (*RangeRecord, error) {
+	if !doNotPersist(ctx) {
+		lookupsDegraded.Add(1)
+	}
+	return fallbackLookup(ctx, ip, ipBytes)
+}
+
+// fallbackLookup answers from the fallback snapshot or recent answers, or
+// returns errUnavailable.
+func fallbackLookup(ctx context.Context, ip netip.Addr, ipBytes []byte) (*RangeRecord, error) {
+	if s := memorySnapshot.Load(); s != nil {
+		r, err := s.Lookup(ctx, s.datasetID, ipBytes)
+		if err == nil || errors.Is(err, errNotFound) {
+			return r, err
+		}
+	}
+	if lastGoodCache != nil {
+		if r, ok := lastGoodCache.Get(ip); ok {
+			return r, nil
+		}
+	}
+	return nil, errUnavailable
+}
+
+// scheduleDBRepair checks the database after a failed query, at most once
+// every DB_REPAIR_INTERVAL.
+func scheduleDBRepair() {
+	last := lastDBRepair.Load()
+	if time.Since(time.Unix(0, last)) < dbRepairInterval {
+		return
+	}
+	if !lastDBRepair.CompareAndSwap(last, time.Now().UnixNano()) || !dbRepairRunning.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer dbRepairRunning.Store(false)
+		if err := repairDatabase("quick_check"); err != nil {
+			log.Printf("Error repairing database: %v", err)
+		}
+	}()
+}
+
+// checkDatabase runs one of SQLite's integrity checks, quick_check or the
+// slower integrity_check that also verifies the indexes match the tables.
+func checkDatabase(check string) (bool, error) {
+	var result string
+	err := db.Load().QueryRow("PRAGMA " + check).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	recordIntegrityCheck(result == "ok")
+	return result == "ok", nil
+}
+
+// repairDatabase rebuilds the indexes of a corrupted database, which is where
+// corruption usually is, and reloads the dataset if that isn't enough. A
+// database that can't even be checked, e.g. because it is locked, is left
+// alone, as is one that mustn't be written because updates are disabled.
+func repairDatabase(check string) (err error) {
+	ok, err := checkDatabase(check)
+	if err != nil {
+		return fmt.Errorf("failed to check database: %v", err)
+	}
+	if ok {
+		log.Println("Database integrity check passed")
+		return nil
+	}
+	if updatesDisabled() {
+		return fmt.Errorf("database is corrupted but updates are disabled, lookups stay degraded")
+	}
+
+	log.Println("Database is corrupted, rebuilding indexes...")
+	_, err = db.Load().Exec("REINDEX")
+	if err != nil {
+		log.Printf("Error rebuilding indexes: %v", err)
+	} else if ok, err = checkDatabase(check); err == nil && ok {
+		log.Println("Database repaired")
+		return nil
+	}
+
+	log.Println("Database is still corrupted, reloading the dataset...")
+	if !beginRefresh(refreshTriggerRepair) {
+		return errRefreshInProgress
+	}
+	defer func() { endRefresh(err) }()
+	return reloadIPRanges(time.Now().UTC().Format("2006-01-02"))
+}
+
+// healthHandler reports whether lookups can be answered: ok, degraded when
+// the database fails but the fallback snapshot is loaded, or 503.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() {
+		writeError(w, r, http.StatusServiceUnavailable, "draining", "Server is shutting down")
+		return
+	}
+	status := "ok"
+	var found int
+	err := db.Load().QueryRowContext(r.Context(), "SELECT COUNT(*) FROM (SELECT 1 FROM ip_ranges WHERE dataset_id = ? LIMIT 1)", activeDatasetID.Load()).Scan(&found)
+	switch {
+	case err != nil:
+		logRequest(r, "Health check query error: %v", err)
+		scheduleDBRepair()
+		if memorySnapshot.Load() == nil {
+			writeUnavailable(w, r, "Database is unavailable")
+			return
+		}
+		status = "degraded"
+	case found == 0:
+		writeUnavailable(w, r, "No dataset loaded yet")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":          status,
+		"dataset_version": datasetVersion(),
+	})
+}
+
+func writeUnavailable(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(dbRetryAfter.Seconds())))
+	writeError(w, r, http.StatusServiceUnavailable, "unavailable", message)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	downloadTimeout             time.Duration
+	downloadMaxSize             int64
+	downloadMaxUncompressedSize int64
+	downloadRetries             int
+	downloadClient              *http.Client
+
+	// dataHeader is sent with every request for IP_DATA_URL.
+	dataHeader http.Header
+)
+
+// loadDownloadConfig sets up the client used to fetch the upstream data.
+// Without limits a hung upstream would stall the refresh forever, and a
+// malicious or corrupt file could fill the disk.
+func loadDownloadConfig() error {
+	downloadTimeout = envDuration("DOWNLOAD_TIMEOUT", 30*time.Minute)
+	downloadMaxSize = int64(envInt("DOWNLOAD_MAX_SIZE_MB", 1024)) << 20
+	downloadMaxUncompressedSize = int64(envInt("DOWNLOAD_MAX_UNCOMPRESSED_SIZE_MB", 8192)) << 20
+	downloadRetries = envInt("DOWNLOAD_RETRIES", 3)
+	downloadMaxRetryAfter = envDuration("DOWNLOAD_MAX_RETRY_AFTER", 5*time.Minute)
+
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply unless DATA_PROXY_URL
+	// names a proxy explicitly, which may also be a socks5:// one.
+	proxy := http.ProxyFromEnvironment
+	if v := os.Getenv("DATA_PROXY_URL"); v != "" {
+		proxyURL, err := url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("invalid DATA_PROXY_URL: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("invalid DATA_PROXY_URL scheme %q, expected http, https, socks5 or socks5h", proxyURL.Scheme)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig, err := downloadTLSConfig(os.Getenv("DATA_CA_BUNDLE"))
+	if err != nil {
+		return err
+	}
+
+	dataHeader, err = loadDataHeader()
+	if err != nil {
+		return err
+	}
+
+	downloadClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: envDuration("DOWNLOAD_HEADER_TIMEOUT", time.Minute),
+		},
+	}
+	return nil
+}
+
+// loadDataHeader builds the headers for IP_DATA_URL from DATA_HEADERS
+// ("Name: value;Name: value") and at most one of DATA_AUTH_TOKEN (a bearer
+// token) and DATA_BASIC_AUTH_USER/DATA_BASIC_AUTH_PASSWORD.
+func loadDataHeader() (http.Header, error) {
+	header := http.Header{}
+	for _, def := range strings.Split(os.Getenv("DATA_HEADERS"), ";") {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(def, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid DATA_HEADERS entry %q, expected Name: value", def)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+
+	token := os.Getenv("DATA_AUTH_TOKEN")
+	user := os.Getenv("DATA_BASIC_AUTH_USER")
+	if token != "" && user != "" {
+		return nil, fmt.Errorf("DATA_AUTH_TOKEN and DATA_BASIC_AUTH_USER can't both be set")
+	}
+	if (token != "" || user != "") && header.Get("Authorization") != "" {
+		return nil, fmt.Errorf("DATA_HEADERS sets Authorization, which DATA_AUTH_TOKEN or DATA_BASIC_AUTH_USER would replace")
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if user != "" {
+		credentials := user + ":" + os.Getenv("DATA_BASIC_AUTH_PASSWORD")
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	return header, nil
+}
+
+// downloadTLSConfig trusts the certificates in the PEM file at caBundle in
+// addition to the system roots, e.g. for a TLS intercepting proxy with a
+// private CA.
+func downloadTLSConfig(caBundle string) (*tls.Config, error) {
+	if caBundle == "" {
+		return nil, nil
+	}
+
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DATA_CA_BUNDLE: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in DATA_CA_BUNDLE %s", caBundle)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// downloaded describes a file fetched by downloadFile.
+type downloaded struct {
+	// validator is the ETag or Last-Modified of the file.
+	validator   string
+	contentType string
+	// quotaReset is when the provider renews a quota the download used up.
+	quotaReset time.Time
+}
+
+// download fetches url into dst, sending header with every request, and
+// returns the ETag or Last-Modified of the file. Interrupted transfers are
+// retried up to DOWNLOAD_RETRIES times, resuming with a Range request when
+// the server supports it and the file hasn't changed in the meantime. A rate
+// limited download is retried when the server asks to wait at most
+// DOWNLOAD_MAX_RETRY_AFTER, see RateLimit.
+func download(url string, header http.Header, dst *os.File) (string, error) {
+	d, err := downloadFile(url, header, dst)
+	return d.validator, err
+}
+
+// downloadFile is download returning the Content-Type of the file as well.
+func downloadFile(url string, header http.Header, dst *os.File) (downloaded, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+
+	host := downloadHost(url)
+	if err := checkRateLimit(host); err != nil {
+		return downloaded{}, err
+	}
+
+	var d downloaded
+	for attempt := 0; ; attempt++ {
+		retry, err := downloadAttempt(ctx, url, header, dst, &d)
+		if err == nil {
+			recordDownloadSuccess(host, d.quotaReset)
+			return d, nil
+		}
+
+		wait := time.Duration(attempt+1) * 2 * time.Second
+		var limited *rateLimitError
+		if errors.As(err, &limited) {
+			wait = recordRateLimit(host, limited)
+			deadline, _ := ctx.Deadline()
+			retry = wait <= downloadMaxRetryAfter && time.Now().Add(wait).Before(deadline)
+		}
+		if !retry || attempt >= downloadRetries || ctx.Err() != nil {
+			return downloaded{}, err
+		}
+
+		log.Printf("Download failed (%v), retrying in %s...", err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return downloaded{}, fmt.Errorf("download timed out after %s: %v", downloadTimeout, err)
+		}
+	}
+}
+
+// downloadAttempt appends the rest of url to dst. d.validator is the ETag or
+// Last-Modified of the file being downloaded, used with If-Range so a resumed
+// download never mixes two versions of the file.
+func downloadAttempt(ctx context.Context, url string, header http.Header, dst *os.File, d *downloaded) (bool, error) {
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if offset > 0 && d.validator != "" {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", d.validator)
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	limited := rateLimitResponse(resp)
+	switch {
+	case limited != nil:
+		return true, limited
+	case resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return false, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		log.Printf("Resuming download at %d bytes", offset)
+	case resp.StatusCode == http.StatusOK:
+		// A full response, either the first attempt or the server couldn't
+		// resume, so start over.
+		if err := restartDownload(dst); err != nil {
+			return false, err
+		}
+		offset = 0
+		d.validator = resumeValidator(resp)
+		d.contentType = resp.Header.Get("Content-Type")
+		d.quotaReset = quotaReset(resp.Header)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if err := restartDownload(dst); err != nil {
+			return false, err
+		}
+		return true, fmt.Errorf("server rejected resuming at %d bytes", offset)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	n, err := io.Copy(dst, io.LimitReader(resp.Body, downloadMaxSize-offset+1))
+	if offset+n > downloadMaxSize {
+		return false, fmt.Errorf("download is larger than DOWNLOAD_MAX_SIZE_MB (%d MB)", downloadMaxSize>>20)
+	}
+	if err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+func restartDownload(dst *os.File) error {
+	if err := dst.Truncate(0); err != nil {
+		return err
+	}
+	_, err := dst.Seek(0, io.SeekStart)
+	return err
+}
+
+// resumeValidator returns the strong ETag or Last-Modified of resp, which
+// If-Range accepts. Without one a download can't be resumed safely.
+func resumeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Endpoints of the lookup server can be turned off with DISABLED_ENDPOINTS,
+// for deployments where / is reserved for a status page or the server must
+// not tell callers where they are. A disabled endpoint isn't routed at all,
+// so it answers like a path that never existed.
+
+const (
+	routeAutoDetect  = "auto-detect"
+	routeLookup      = "lookup"
+	routeBatch       = "batch"
+	routeStream      = "stream"
+	routeEnrich      = "enrich"
+	routeWhois       = "whois"
+	routeTorExits    = "tor-exits"
+	routeForwardAuth = "forward-auth"
+	routeSigningKey  = "signing-key"
+	routeHealthz     = "healthz"
+	routeLivez       = "livez"
+	routeAttribution = "attribution"
+	routeCountries   = "countries"
+	routeContains    = "contains"
+	routeVersion     = "version"
+)
+
+var routeNames = []string{routeAutoDetect, routeLookup, routeBatch, routeStream, routeEnrich, routeWhois, routeTorExits, routeForwardAuth, routeSigningKey, routeHealthz, routeLivez, routeAttribution, routeCountries, routeContains, routeVersion}
+
+// disabledEndpoints are the endpoints the lookup server doesn't serve. A
+// separate admin server, see ADMIN_ADDR, still serves them to the admin UI.
+var disabledEndpoints = map[string]bool{}
+
+// loadDisabledEndpoints reads DISABLED_ENDPOINTS, a comma separated list of
+// routeNames.
+func loadDisabledEndpoints() error {
+	for _, name := range strings.Split(os.Getenv("DISABLED_ENDPOINTS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(routeNames, name) {
+			return fmt.Errorf("invalid DISABLED_ENDPOINTS: unknown endpoint %q, expected one of %s", name, strings.Join(routeNames, ", "))
+		}
+		disabledEndpoints[name] = true
+	}
+	return nil
+}
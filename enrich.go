@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// POST /enrich adds geo columns to a Parquet or Arrow IPC file, for data sets
+// far too large to look up row by row over HTTP. The file is sent as the
+// request body and comes back in the same format with the new columns.
+
+const (
+	contentTypeParquet     = "application/vnd.apache.parquet"
+	contentTypeArrowStream = "application/vnd.apache.arrow.stream"
+	contentTypeArrowFile   = "application/vnd.apache.arrow.file"
+
+	// enrichChunkRows is how many Parquet rows are enriched at a time.
+	enrichChunkRows = 10000
+	// enrichCacheSize bounds the answers remembered within one file.
+	enrichCacheSize = 100000
+)
+
+var enrichMaxBytes int64
+
+// enrichColumn is a column added to enriched files.
+type enrichColumn struct {
+	field string
+	value func(info *IPInfo) string
+}
+
+var enrichColumns = []enrichColumn{
+	{"country", func(info *IPInfo) string { return info.Country }},
+	{"country_name", func(info *IPInfo) string { return info.CountryName }},
+	{"continent", func(info *IPInfo) string { return info.Continent }},
+	{"continent_name", func(info *IPInfo) string { return info.ContinentName }},
+	{"as_name", func(info *IPInfo) string { return info.ASName }},
+	{"as_domain", func(info *IPInfo) string { return info.ASDomain }},
+}
+
+// invalidFileError is returned for uploads that can't be enriched, before any
+// of the response has been written.
+type invalidFileError struct{ msg string }
+
+func (e invalidFileError) Error() string { return e.msg }
+
+func invalidFile(format string, args ...interface{}) error {
+	return invalidFileError{fmt.Sprintf(format, args...)}
+}
+
+// enricher looks up the IPs of one file.
+type enricher struct {
+	ctx      context.Context
+	ipColumn string
+	prefix   string
+	columns  []enrichColumn
+	cache    map[string]*IPInfo
+	rows     int64
+	found    int64
+}
+
+func newEnricher(r *http.Request) *enricher {
+	ipColumn := r.URL.Query().Get("ip_column")
+	if ipColumn == "" {
+		ipColumn = "ip"
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !r.URL.Query().Has("prefix") {
+		prefix = "geo_"
+	}
+
+	// Keys limited to some fields only get those columns.
+	var columns []enrichColumn
+	k := apiKeyFromContext(r.Context())
+	for _, c := range enrichColumns {
+		if k == nil || len(k.Fields) == 0 || containsString(k.Fields, c.field) {
+			columns = append(columns, c)
+		}
+	}
+	return newFileEnricher(r.Context(), ipColumn, prefix, columns)
+}
+
+func newFileEnricher(ctx context.Context, ipColumn, prefix string, columns []enrichColumn) *enricher {
+	return &enricher{
+		ctx:      ctx,
+		ipColumn: ipColumn,
+		prefix:   prefix,
+		columns:  columns,
+		cache:    map[string]*IPInfo{},
+	}
+}
+
+// checkColumns makes sure the file has the IP column and none of the columns
+// that are about to be added.
+func (e *enricher) checkColumns(names []string) (int, error) {
+	ipIndex := -1
+	for i, name := range names {
+		if name == e.ipColumn {
+			ipIndex = i
+		}
+		for _, c := range e.columns {
+			if name == e.prefix+c.field {
+				return 0, invalidFile("The file already has a %s column, choose another prefix", name)
+			}
+		}
+	}
+	if ipIndex < 0 {
+		return 0, invalidFile("The file has no %s column, set ip_column", e.ipColumn)
+	}
+	return ipIndex, nil
+}
+
+// lookup returns the geo information for ip, or nil when there is none.
+func (e *enricher) lookup(ip string) *IPInfo {
+	e.rows++
+	info, ok := e.cache[ip]
+	if !ok {
+		info, _ = lookupIP(e.ctx, ip)
+		if len(e.cache) >= enrichCacheSize {
+			e.cache = map[string]*IPInfo{}
+		}
+		e.cache[ip] = info
+	}
+	if info != nil {
+		e.found++
+	}
+	return info
+}
+
+func enrichHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if mediaType != contentTypeParquet && mediaType != contentTypeArrowStream && mediaType != contentTypeArrowFile {
+		writeError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Content-Type must be "+contentTypeParquet+", "+contentTypeArrowStream+" or "+contentTypeArrowFile)
+		return
+	}
+
+	// Large files take long to upload and to enrich. Arrow streams are
+	// read while the result is already being written.
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.EnableFullDuplex()
+	clearWriteDeadline(w)
+
+	body := http.MaxBytesReader(w, r.Body, enrichMaxBytes)
+	out := &byteCounter{ResponseWriter: w}
+	e := newEnricher(r)
+	start := time.Now()
+
+	var err error
+	switch mediaType {
+	case contentTypeParquet:
+		err = enrichParquet(out, body, e)
+	case contentTypeArrowStream:
+		err = enrichArrowStream(out, body, e)
+	case contentTypeArrowFile:
+		err = enrichArrowFile(out, body, e)
+	}
+
+	var invalid invalidFileError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, "file_too_large", "The file is larger than ENRICH_MAX_BYTES")
+	case errors.As(err, &invalid):
+		writeError(w, r, http.StatusBadRequest, "invalid_file", invalid.msg)
+	case err != nil && out.bytes > 0:
+		// Part of the file was sent already, the client sees it truncated.
+		logRequest(r, "Enrich error after %d bytes: %v", out.bytes, err)
+	case err != nil:
+		logRequest(r, "Enrich error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+	default:
+		logRequest(r, "Enriched %d rows, %d found, in %s", e.rows, e.found, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// spoolUpload copies the body to a temporary file, for formats that are
+// read from the end. The caller removes it with removeTemp.
+func spoolUpload(body io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp("", "ip-lookup-enrich-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		removeTemp(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// enrichParquet enriches files with a flat schema, the usual shape of
+// tables exported by Spark, Hive and the like.
+func enrichParquet(w http.ResponseWriter, body io.Reader, e *enricher) (err error) {
+	f, err := spoolUpload(body)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(f)
+
+	// parquet-go panics on some malformed files.
+	written := false
+	defer func() {
+		if p := recover(); p != nil {
+			if written {
+				err = fmt.Errorf("failed to enrich Parquet file: %v", p)
+			} else {
+				err = invalidFile("Invalid Parquet file")
+			}
+		}
+	}()
+
+	pf, err := local.NewLocalFileReader(f.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open Parquet file: %v", err)
+	}
+	defer pf.Close()
+	pr, err := reader.NewParquetColumnReader(pf, 4)
+	if err != nil {
+		return invalidFile("Invalid Parquet file")
+	}
+	defer pr.ReadStop()
+
+	schema := pr.SchemaHandler
+	names := make([]string, 0, len(schema.SchemaElements)-1)
+	metadata := make([]string, 0, len(schema.SchemaElements)-1+len(e.columns))
+	for i, el := range schema.SchemaElements[1:] {
+		if el.GetNumChildren() > 0 || el.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED {
+			return invalidFile("Column %s is nested or repeated, only flat files are supported", schema.Infos[i+1].ExName)
+		}
+		name := schema.Infos[i+1].ExName
+		if strings.ContainsAny(name, ",=") {
+			return invalidFile("Column names can't contain , or =")
+		}
+		names = append(names, name)
+		metadata = append(metadata, parquetColumnMetadata(name, el))
+	}
+	ipIndex, err := e.checkColumns(names)
+	if err != nil {
+		return err
+	}
+	if el := schema.SchemaElements[ipIndex+1]; el.GetType() != parquet.Type_BYTE_ARRAY {
+		return invalidFile("Column %s must be a string", e.ipColumn)
+	}
+	for _, c := range e.columns {
+		metadata = append(metadata, "name="+e.prefix+c.field+", type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL")
+	}
+
+	w.Header().Set("Content-Type", contentTypeParquet)
+	pw, err := writer.NewCSVWriterFromWriter(metadata, w, 4)
+	if err != nil {
+		return fmt.Errorf("failed to create Parquet writer: %v", err)
+	}
+	written = true
+
+	total := pr.GetNumRows()
+	for done := int64(0); done < total; done += enrichChunkRows {
+		n := total - done
+		if n > enrichChunkRows {
+			n = enrichChunkRows
+		}
+		columns := make([][]interface{}, len(names))
+		for i := range names {
+			columns[i], _, _, err = pr.ReadColumnByIndex(int64(i), n)
+			if err != nil {
+				return fmt.Errorf("failed to read column %s: %v", names[i], err)
+			}
+		}
+
+		for row := int64(0); row < n; row++ {
+			rec := make([]interface{}, 0, len(names)+len(e.columns))
+			for i := range names {
+				rec = append(rec, columns[i][row])
+			}
+			ip, _ := columns[ipIndex][row].(string)
+			info := e.lookup(ip)
+			for _, c := range e.columns {
+				if info == nil {
+					rec = append(rec, nil)
+				} else {
+					rec = append(rec, c.value(info))
+				}
+			}
+			if err := pw.Write(rec); err != nil {
+				return fmt.Errorf("failed to write Parquet row: %v", err)
+			}
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("failed to finish Parquet file: %v", err)
+	}
+	return nil
+}
+
+// parquetColumnMetadata describes a column the way parquet-go's CSV writer
+// takes it.
+func parquetColumnMetadata(name string, el *parquet.SchemaElement) string {
+	md := fmt.Sprintf("name=%s, type=%s, repetitiontype=%s", name, el.GetType(), el.GetRepetitionType())
+	if el.IsSetConvertedType() {
+		md += fmt.Sprintf(", convertedtype=%s", el.GetConvertedType())
+	}
+	if el.IsSetTypeLength() {
+		md += fmt.Sprintf(", length=%d", el.GetTypeLength())
+	}
+	if el.IsSetScale() {
+		md += fmt.Sprintf(", scale=%d", el.GetScale())
+	}
+	if el.IsSetPrecision() {
+		md += fmt.Sprintf(", precision=%d", el.GetPrecision())
+	}
+	return md
+}
+
+// enrichedArrowSchema returns the schema with the geo columns added, and the
+// index of the IP column.
+func enrichedArrowSchema(schema *arrow.Schema, e *enricher) (*arrow.Schema, int, error) {
+	fields := schema.Fields()
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+	ipIndex, err := e.checkColumns(names)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fields[ipIndex].Type.ID() != arrow.STRING {
+		return nil, 0, invalidFile("Column %s must be a string", e.ipColumn)
+	}
+	for _, c := range e.columns {
+		fields = append(fields, arrow.Field{Name: e.prefix + c.field, Type: arrow.BinaryTypes.String, Nullable: true})
+	}
+	md := schema.Metadata()
+	return arrow.NewSchema(fields, &md), ipIndex, nil
+}
+
+// enrichArrowRecord returns rec with the geo columns added. The caller
+// releases it.
+func enrichArrowRecord(schema *arrow.Schema, rec array.Record, ipIndex int, e *enricher) array.Record {
+	ips := rec.Column(ipIndex).(*array.String)
+	builders := make([]*array.StringBuilder, len(e.columns))
+	for i := range builders {
+		builders[i] = array.NewStringBuilder(memory.DefaultAllocator)
+		defer builders[i].Release()
+	}
+
+	for row := 0; row < ips.Len(); row++ {
+		var info *IPInfo
+		if ips.IsValid(row) {
+			info = e.lookup(ips.Value(row))
+		} else {
+			e.rows++
+		}
+		for i, c := range e.columns {
+			if info == nil {
+				builders[i].AppendNull()
+			} else {
+				builders[i].Append(c.value(info))
+			}
+		}
+	}
+
+	columns := append([]array.Interface{}, rec.Columns()...)
+	added := make([]array.Interface, len(builders))
+	for i, b := range builders {
+		added[i] = b.NewArray()
+		defer added[i].Release()
+	}
+	return array.NewRecord(schema, append(columns, added...), rec.NumRows())
+}
+
+func enrichArrowStream(w http.ResponseWriter, body io.Reader, e *enricher) error {
+	rdr, err := ipc.NewReader(body)
+	if err != nil {
+		return invalidFile("Invalid Arrow stream: %v", err)
+	}
+	defer rdr.Release()
+
+	schema, ipIndex, err := enrichedArrowSchema(rdr.Schema(), e)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", contentTypeArrowStream)
+	aw := ipc.NewWriter(w, ipc.WithSchema(schema))
+	for rdr.Next() {
+		rec := enrichArrowRecord(schema, rdr.Record(), ipIndex, e)
+		err := aw.Write(rec)
+		rec.Release()
+		if err != nil {
+			return fmt.Errorf("failed to write Arrow record: %v", err)
+		}
+	}
+	if err := rdr.Err(); err != nil {
+		return fmt.Errorf("failed to read Arrow stream: %v", err)
+	}
+	return aw.Close()
+}
+
+func enrichArrowFile(w http.ResponseWriter, body io.Reader, e *enricher) error {
+	f, err := spoolUpload(body)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(f)
+
+	rdr, err := ipc.NewFileReader(f)
+	if err != nil {
+		return invalidFile("Invalid Arrow file: %v", err)
+	}
+	defer rdr.Close()
+
+	schema, ipIndex, err := enrichedArrowSchema(rdr.Schema(), e)
+	if err != nil {
+		return err
+	}
+
+	// The file format ends with a footer pointing back into the file, so
+	// it is built on disk before it is sent.
+	out, err := os.CreateTemp("", "ip-lookup-enriched-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer removeTemp(out)
+
+	aw, err := ipc.NewFileWriter(out, ipc.WithSchema(schema))
+	if err != nil {
+		return fmt.Errorf("failed to create Arrow writer: %v", err)
+	}
+	for i := 0; i < rdr.NumRecords(); i++ {
+		in, err := rdr.Record(i)
+		if err != nil {
+			return invalidFile("Invalid Arrow file: %v", err)
+		}
+		rec := enrichArrowRecord(schema, in, ipIndex, e)
+		err = aw.Write(rec)
+		rec.Release()
+		if err != nil {
+			return fmt.Errorf("failed to write Arrow record: %v", err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return fmt.Errorf("failed to finish Arrow file: %v", err)
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind Arrow file: %v", err)
+	}
+	w.Header().Set("Content-Type", contentTypeArrowFile)
+	_, err = io.Copy(w, out)
+	return err
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The enrich command adds geo data to CSV and NDJSON files offline, from the
+// dataset the server downloaded, so batch jobs (Spark, Hadoop, plain cron)
+// don't need a running server or their own copy of the lookup logic:
+//
+//	ip-lookup enrich --input events.csv --ip-column client_ip --output events-geo.csv
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	// enrichCommandChunk is how many rows a worker enriches at a time.
+	enrichCommandChunk = 1000
+)
+
+func runEnrichCommand(args []string) {
+	flags := flag.NewFlagSet("enrich", flag.ExitOnError)
+	input := flags.String("input", "-", "CSV or NDJSON file to enrich, - for stdin")
+	output := flags.String("output", "-", "File to write the enriched rows to, - for stdout")
+	format := flags.String("format", "", "Input format, csv or ndjson (default from the input file extension, else csv)")
+	ipColumn := flags.String("ip-column", "ip", "CSV column, or JSONPath for NDJSON, holding the IP")
+	prefix := flags.String("prefix", "geo_", "Prefix of the columns added to CSV files")
+	field := flags.String("field", "geo", "Field the lookup result is added under in NDJSON files")
+	workers := flags.Int("workers", runtime.NumCPU(), "Number of parallel lookup workers")
+	dbPath := flags.String("db", dbFile, "Database downloaded by the server")
+	flags.Parse(args)
+
+	if *format == "" {
+		*format = formatCSV
+		switch strings.ToLower(filepath.Ext(*input)) {
+		case ".ndjson", ".jsonl", ".json":
+			*format = formatNDJSON
+		}
+	}
+	if *format != formatCSV && *format != formatNDJSON {
+		log.Fatalf("Invalid --format %q, expected %s or %s", *format, formatCSV, formatNDJSON)
+	}
+	if *workers < 1 {
+		log.Fatalf("Invalid --workers %d, expected at least 1", *workers)
+	}
+
+	err := loadLookupConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = openEnrichDatabase(*dbPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Load().Close()
+
+	in := os.Stdin
+	if *input != "-" {
+		in, err = os.Open(*input)
+		if err != nil {
+			log.Fatalf("Failed to open input: %v", err)
+		}
+		defer in.Close()
+	}
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create output: %v", err)
+		}
+	}
+	bw := bufio.NewWriterSize(out, 1<<20)
+
+	start := time.Now()
+	pool := newEnrichPool(*workers, func() *enricher {
+		return newFileEnricher(context.Background(), *ipColumn, *prefix, enrichColumns)
+	})
+	var rows int64
+	if *format == formatNDJSON {
+		rows, err = enrichNDJSON(in, bw, pool, *ipColumn, *field)
+	} else {
+		rows, err = enrichCSV(in, bw, pool, *ipColumn, *prefix)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Fatalf("Failed to enrich %s: %v", *input, err)
+	}
+	log.Printf("Enriched %d rows (%d found) in %s with %d workers", rows, pool.found(), time.Since(start).Round(time.Millisecond), *workers)
+}
+
+// openEnrichDatabase opens the server's database and loads its active
+// dataset. The database isn't created, an empty one would find nothing.
+func openEnrichDatabase(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("no database at %s, start the server once to download the dataset or set --db: %v", path, err)
+	}
+	conn, err := openDatabase(path)
+	if err != nil {
+		return err
+	}
+	db.Store(conn)
+	sqliteStore = newSQLiteRangeStore(conn)
+	rangeStore = sqliteStore
+	err = loadActiveDataset()
+	if err != nil {
+		return err
+	}
+	if activeDatasetID.Load() == 0 {
+		return fmt.Errorf("%s has no active dataset", path)
+	}
+	err = createOverridesTable()
+	if err != nil {
+		return err
+	}
+	err = loadOverrides()
+	if err != nil {
+		return err
+	}
+	err = createNetworkListTables()
+	if err != nil {
+		return err
+	}
+	err = loadThreatFeedConfig()
+	if err != nil {
+		return err
+	}
+	err = loadNetworkLists()
+	if err != nil {
+		return err
+	}
+	err = createTorExitsTables()
+	if err != nil {
+		return err
+	}
+	err = loadTorExits()
+	if err != nil {
+		return err
+	}
+	log.Printf("Enriching with dataset %s", datasetVersion())
+	return nil
+}
+
+// enrichPool enriches chunks of rows on parallel workers, each with its own
+// enricher, and writes the chunks in the order they were added.
+type enrichPool struct {
+	jobs      chan *enrichJob
+	order     chan *enrichJob
+	done      chan error
+	enrichers []*enricher
+}
+
+type enrichJob struct {
+	run   func(e *enricher)
+	write func() error
+	ready chan struct{}
+}
+
+func newEnrichPool(workers int, newEnricher func() *enricher) *enrichPool {
+	p := &enrichPool{
+		jobs:  make(chan *enrichJob),
+		order: make(chan *enrichJob, 2*workers),
+		done:  make(chan error, 1),
+	}
+	for i := 0; i < workers; i++ {
+		e := newEnricher()
+		p.enrichers = append(p.enrichers, e)
+		go func() {
+			for job := range p.jobs {
+				job.run(e)
+				close(job.ready)
+			}
+		}()
+	}
+	go func() {
+		var err error
+		for job := range p.order {
+			<-job.ready
+			if err == nil {
+				err = job.write()
+			}
+		}
+		p.done <- err
+	}()
+	return p
+}
+
+// add queues a chunk. It blocks while too many chunks are waiting to be
+// written, which bounds memory use however large the input is.
+func (p *enrichPool) add(run func(e *enricher), write func() error) {
+	job := &enrichJob{run: run, write: write, ready: make(chan struct{})}
+	p.order <- job
+	p.jobs <- job
+}
+
+// wait returns once every chunk has been written, with the first write error.
+func (p *enrichPool) wait() error {
+	close(p.jobs)
+	close(p.order)
+	return <-p.done
+}
+
+// found returns how many IPs were found, once the pool is done.
+func (p *enrichPool) found() int64 {
+	var n int64
+	for _, e := range p.enrichers {
+		n += e.found
+	}
+	return n
+}
+
+// enrichCSV copies a CSV file with a header row to w, adding the geo columns
+// to every row.
+func enrichCSV(r io.Reader, w io.Writer, pool *enrichPool, ipColumn, prefix string) (int64, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return 0, pool.wait()
+	} else if err != nil {
+		pool.wait()
+		return 0, fmt.Errorf("failed to read header: %v", err)
+	}
+	ipIndex, err := newFileEnricher(context.Background(), ipColumn, prefix, enrichColumns).checkColumns(header)
+	if err != nil {
+		pool.wait()
+		return 0, err
+	}
+
+	cw := csv.NewWriter(w)
+	for _, c := range enrichColumns {
+		header = append(header, prefix+c.field)
+	}
+	cw.Write(header)
+
+	var rows int64
+	var readErr error
+	for readErr == nil {
+		chunk := make([][]string, 0, enrichCommandChunk)
+		for len(chunk) < enrichCommandChunk {
+			record, err := cr.Read()
+			if err != nil {
+				readErr = err
+				break
+			}
+			chunk = append(chunk, record)
+		}
+		rows += int64(len(chunk))
+		pool.add(func(e *enricher) {
+			for i, record := range chunk {
+				info := e.lookup(record[ipIndex])
+				for _, c := range e.columns {
+					value := ""
+					if info != nil {
+						value = c.value(info)
+					}
+					record = append(record, value)
+				}
+				chunk[i] = record
+			}
+		}, func() error {
+			cw.WriteAll(chunk)
+			return cw.Error()
+		})
+	}
+	err = pool.wait()
+	if readErr != io.EOF {
+		return rows, fmt.Errorf("failed to read row: %v", readErr)
+	}
+	return rows, err
+}
+
+// enrichNDJSON copies newline delimited JSON objects to w, adding the lookup
+// result under field like the Kafka enricher does. Lines that aren't JSON
+// objects are copied unchanged.
+func enrichNDJSON(r io.Reader, w io.Writer, pool *enrichPool, ipField, field string) (int64, error) {
+	if !strings.HasPrefix(ipField, "$") {
+		ipField = "$." + ipField
+	}
+	ipPath, err := parseJSONPath(ipField)
+	if err != nil {
+		pool.wait()
+		return 0, fmt.Errorf("invalid --ip-column: %v", err)
+	}
+
+	br := bufio.NewReaderSize(r, 1<<20)
+	var rows int64
+	var readErr error
+	for readErr == nil {
+		chunk := make([][]byte, 0, enrichCommandChunk)
+		for len(chunk) < enrichCommandChunk {
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				readErr = err
+			}
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				chunk = append(chunk, line)
+			}
+			if err != nil {
+				break
+			}
+		}
+		start := rows
+		rows += int64(len(chunk))
+		pool.add(func(e *enricher) {
+			for i, line := range chunk {
+				enriched, err := enrichJSONObject(line, ipPath, field, e.lookup)
+				if err != nil {
+					log.Printf("Warning: Copying row %d unchanged: %v", start+int64(i)+1, err)
+					continue
+				}
+				chunk[i] = enriched
+			}
+		}, func() error {
+			for _, line := range chunk {
+				w.Write(line)
+				if _, err := w.Write([]byte{'\n'}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	err = pool.wait()
+	if readErr != io.EOF {
+		return rows, fmt.Errorf("failed to read line: %v", readErr)
+	}
+	return rows, err
+}
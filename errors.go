@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/ashwanthkumar/ip-lookup/hooks"
+)
+
+var (
+	errInvalidIP = errors.New("Invalid IP address")
+	errNotFound  = errors.New("IP not found in any range")
+	errInternal  = errors.New("Internal server error")
+	errTimeout   = errors.New("Request timed out")
+)
+
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// writeError writes the error envelope used by every endpoint, in JSON unless
+// the request negotiated XML or MessagePack. code is a stable machine readable
+// identifier, message is meant for humans.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	detail := ErrorDetail{
+		Code:      code,
+		Message:   message,
+		RequestID: requestID(r.Context()),
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch format := responseFormat(r); format {
+	case formatXML:
+		writeFormatted(w, status, format, detail, "error", "")
+	case formatMsgpack:
+		writeFormatted(w, status, format, ErrorResponse{Error: detail}, "", "")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ErrorResponse{Error: detail})
+	}
+}
+
+// writeLookupError maps the errors returned by lookupIP to a status code.
+func writeLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, message := lookupErrorCode(err)
+	if errors.Is(err, errUnavailable) {
+		writeUnavailable(w, r, message)
+		return
+	}
+	writeError(w, r, status, code, message)
+}
+
+func lookupErrorCode(err error) (int, string, string) {
+	var denial *hooks.Denial
+	switch {
+	case errors.As(err, &denial):
+		status, code := denial.Status, denial.Code
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		if code == "" {
+			code = "denied"
+		}
+		return status, code, denial.Message
+	case errors.Is(err, errInvalidIP):
+		return http.StatusBadRequest, "invalid_ip", err.Error()
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound, "not_found", err.Error()
+	case errors.Is(err, errUnavailable):
+		return http.StatusServiceUnavailable, "unavailable", err.Error()
+	case errors.Is(err, errTimeout):
+		return http.StatusServiceUnavailable, "timeout", err.Error()
+	default:
+		return http.StatusInternalServerError, "internal_error", errInternal.Error()
+	}
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "route_not_found", "No such endpoint")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In follower mode (PRIMARY_URL) an instance copies the compiled datasets of
+// a primary from its /admin/export endpoint instead of downloading the
+// upstream data, so only the primary talks to the data provider and every
+// follower serves exactly what the primary serves.
+
+var (
+	primaryURL           string
+	primaryToken         string
+	followerSyncInterval time.Duration
+	remoteClient         = &http.Client{Timeout: 30 * time.Second}
+)
+
+// exportedRange is a range as written by /admin/export: the upstream format
+// plus the priority the primary resolved overlapping ranges with.
+type exportedRange struct {
+	IPRange
+	Priority *int64 `json:"priority,omitempty"`
+}
+
+func loadFollowerConfig() {
+	primaryURL = strings.TrimRight(os.Getenv("PRIMARY_URL"), "/")
+	primaryToken = os.Getenv("PRIMARY_TOKEN")
+	followerSyncInterval = envDuration("FOLLOWER_SYNC_INTERVAL", 5*time.Minute)
+}
+
+func isFollower() bool {
+	return primaryURL != ""
+}
+
+func remoteHeader(token string) http.Header {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header
+}
+
+// remoteStatus fetches the active dataset of the instance at baseURL. Its ID
+// is 0 when the instance has no dataset yet.
+func remoteStatus(baseURL, token string) (Dataset, error) {
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/admin/status", nil)
+	if err != nil {
+		return Dataset{}, err
+	}
+	req.Header = remoteHeader(token)
+
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return Dataset{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Dataset{}, fmt.Errorf("%s returned %s", baseURL, resp.Status)
+	}
+
+	var status struct {
+		ActiveDatasetID int64     `json:"active_dataset_id"`
+		DatasetVersion  string    `json:"dataset_version"`
+		Datasets        []Dataset `json:"datasets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return Dataset{}, fmt.Errorf("failed to decode status of %s: %v", baseURL, err)
+	}
+	for _, d := range status.Datasets {
+		if d.ID == status.ActiveDatasetID {
+			return d, nil
+		}
+	}
+	return Dataset{ID: status.ActiveDatasetID, Version: status.DatasetVersion}, nil
+}
+
+// copyRemoteDataset loads the dataset d of the instance at baseURL, keeping
+// its version and provenance, and makes it the active one.
+func copyRemoteDataset(baseURL, token string, d Dataset) error {
+	log.Printf("Copying dataset %d (%s) from %s...", d.ID, d.Version, baseURL)
+	compressedFile, err := os.CreateTemp("", "ip_ranges_*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(compressedFile.Name())
+	defer compressedFile.Close()
+
+	// Ask for the dataset by id, so a refresh on the other side in the
+	// meantime can't hand us a different dataset under this version.
+	_, err = download(fmt.Sprintf("%s/admin/export?dataset=%d", baseURL, d.ID), remoteHeader(token), compressedFile)
+	if err != nil {
+		return fmt.Errorf("failed to download dataset: %v", err)
+	}
+
+	err = loadIPRangesFile(d.Version, d.Provenance, compressedFile, "json-gz", "")
+	if err != nil {
+		return fmt.Errorf("failed to load dataset: %v", err)
+	}
+	return nil
+}
+
+func getPrimaryDatasetID() (int64, error) {
+	var value string
+	err := db.Load().QueryRow("SELECT value FROM metadata WHERE key = 'primary_dataset_id'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func setPrimaryDatasetID(id int64) error {
+	_, err := db.Load().Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('primary_dataset_id', ?)", id)
+	return err
+}
+
+// syncFromPrimary copies the primary's active dataset when it differs from
+// the one copied last time, or always when force is set.
+func syncFromPrimary(force bool) error {
+	d, err := remoteStatus(primaryURL, primaryToken)
+	if err != nil {
+		return fmt.Errorf("failed to get primary status: %v", err)
+	}
+	id := d.ID
+	if id == 0 {
+		log.Println("Primary has no dataset yet. Skipping sync.")
+		return nil
+	}
+
+	current, err := getPrimaryDatasetID()
+	if err != nil {
+		return fmt.Errorf("failed to get primary dataset id: %v", err)
+	}
+	if id == current && !force {
+		log.Println("Data is up to date with the primary. Skipping sync.")
+		return nil
+	}
+
+	err = copyRemoteDataset(primaryURL, primaryToken, d)
+	if err != nil {
+		return fmt.Errorf("failed to copy dataset from primary: %v", err)
+	}
+
+	err = setPrimaryDatasetID(id)
+	if err != nil {
+		return fmt.Errorf("failed to set primary dataset id: %v", err)
+	}
+	err = setLastUpdateDate(time.Now().UTC().Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("failed to set last update date: %v", err)
+	}
+	return nil
+}
+
+// exportHandler streams a dataset, the active one unless ?dataset is given,
+// as gzipped JSON lines in the upstream format.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	id := activeDatasetID.Load()
+	if v := r.URL.Query().Get("dataset"); v != "" {
+		var err error
+		id, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid dataset")
+			return
+		}
+	}
+
+	var version string
+	err := db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", id).Scan(&version)
+	if err == sql.ErrNoRows {
+		writeError(w, r, http.StatusNotFound, "dataset_not_found", "Dataset not found")
+		return
+	} else if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	rows, err := db.Load().QueryContext(r.Context(), `
+		SELECT start_ip, end_ip, country, country_name, continent, continent_name, as_name, as_domain, source, priority, is_anycast, countries, timezone, currency
+		FROM ip_ranges
+		WHERE dataset_id = ?
+		ORDER BY rowid
+	`, id)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	clearWriteDeadline(w)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"ip_ranges_%d.json.gz\"", id))
+	w.Header().Set(datasetIDHeader, strconv.FormatInt(id, 10))
+	w.Header().Set(datasetVersionHeader, version)
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	for rows.Next() {
+		var e exportedRange
+		var startIP, endIP []byte
+		var countries string
+		var priority int64
+		err := rows.Scan(&startIP, &endIP, &e.Country, &e.CountryName, &e.Continent, &e.ContinentName, &e.ASName, &e.ASDomain, &e.Source, &priority, &e.IsAnycast, &countries, &e.Timezone, &e.Currency)
+		if err != nil {
+			// The response has started, so all we can do is cut it short,
+			// which fails the follower's gzip check.
+			logRequest(r, "Export error: %v", err)
+			return
+		}
+		e.StartIP = net.IP(startIP).String()
+		e.EndIP = net.IP(endIP).String()
+		if countries != "" {
+			e.Countries = strings.Split(countries, ",")
+		}
+		e.Priority = &priority
+		if err := enc.Encode(e); err != nil {
+			logRequest(r, "Export error: %v", err)
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logRequest(r, "Export error: %v", err)
+		return
+	}
+	gz.Close()
+}
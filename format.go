@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	formatJSON    = "json"
+	formatGeoJSON = "geojson"
+	formatXML     = "xml"
+	formatMsgpack = "msgpack"
+)
+
+// acceptFormats maps the media types of the Accept header to formats.
+var acceptFormats = map[string]string{
+	"application/json":        formatJSON,
+	"application/geo+json":    formatGeoJSON,
+	"application/xml":         formatXML,
+	"text/xml":                formatXML,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+}
+
+var formatContentTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatXML:     "application/xml; charset=utf-8",
+	formatMsgpack: "application/msgpack",
+}
+
+// responseFormat returns the format requested with ?format=, or else with the
+// Accept header, defaulting to JSON.
+func responseFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	return negotiateFormat(r.Header.Get("Accept"))
+}
+
+// negotiateFormat returns the format of accept with the highest quality,
+// the first of them on a tie. Browsers list application/xml below text/html,
+// which no endpoint serves, so they get JSON like before.
+func negotiateFormat(accept string) string {
+	if accept == "" || strings.Contains(accept, "text/html") {
+		return formatJSON
+	}
+	best, bestQ := formatJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		format, ok := acceptFormats[strings.ToLower(strings.TrimSpace(mediaType))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// checkFormat rejects unknown ?format= values before any work is done.
+func checkFormat(w http.ResponseWriter, r *http.Request) bool {
+	switch responseFormat(r) {
+	case formatJSON, formatGeoJSON, formatXML, formatMsgpack:
+		return true
+	}
+	writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid format, expected json, geojson, xml or msgpack")
+	return false
+}
+
+// writeFormatted writes v with status in format, JSON unless it is XML or
+// MessagePack. In XML, root is the name of the document element and item
+// that of the elements of a top-level array.
+func writeFormatted(w http.ResponseWriter, status int, format string, v interface{}, root, item string) error {
+	if _, ok := formatContentTypes[format]; !ok {
+		format = formatJSON
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(status)
+	switch format {
+	case formatXML:
+		return writeXML(w, root, item, v)
+	case formatMsgpack:
+		return writeMsgpack(w, v)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// writeMsgpack writes v as it would be written to JSON, with the same keys,
+// nulls and strings, integers staying integers.
+func writeMsgpack(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+	enc := msgpack.NewEncoder(w)
+	enc.SetSortMapKeys(true)
+	return enc.Encode(msgpackNumbers(value))
+}
+
+// msgpackNumbers replaces the json.Numbers of v by integers where they are
+// whole and floats otherwise.
+func msgpackNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = msgpackNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = msgpackNumbers(e)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(t.String(), 10, 64); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// writeXML writes v as it would be written to JSON, with the same names:
+// objects become an element per key, arrays repeat an element per value,
+// named item at the top and "item" below, and nulls are empty elements with
+// nil="true".
+func writeXML(w io.Writer, root, item string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if err := jsonToXML(dec, enc, root, item); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// jsonToXML converts the next JSON value of dec to the element name.
+func jsonToXML(dec *json.Decoder, enc *xml.Encoder, name, item string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch t := tok.(type) {
+	case json.Delim:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for dec.More() {
+			child := item
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				child = key.(string)
+			}
+			if err := jsonToXML(dec, enc, child, "item"); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	case nil:
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "nil"}, Value: "true"}}
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+	default:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(xml.CharData(fmt.Sprint(t))); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
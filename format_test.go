@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestLookupNegotiatesContentType(t *testing.T) {
+	loadTestDataset(t, []testRange{
+		{netip.MustParseAddr("1.0.0.0"), netip.MustParseAddr("1.0.0.255"), "DE"},
+	})
+
+	tests := []struct {
+		accept, format, want string
+	}{
+		{"", "", "application/json"},
+		{"application/json", "", "application/json"},
+		{"text/html, */*", "", "application/json"},
+		{"application/xml", "", "application/xml; charset=utf-8"},
+		{"application/msgpack", "", "application/msgpack"},
+		{"application/xml", "json", "application/json"},
+	}
+	for _, tt := range tests {
+		target := "/lookup/1.0.0.1"
+		if tt.format != "" {
+			target += "?format=" + tt.format
+		}
+		r := httptest.NewRequest("GET", target, nil)
+		r = mux.SetURLVars(r, map[string]string{"ip": "1.0.0.1"})
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		lookupHandler(w, r)
+		if w.Code != 200 {
+			t.Errorf("Accept %q, format %q: got %d: %s", tt.accept, tt.format, w.Code, w.Body.String())
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("Accept %q, format %q: Content-Type is %q, want %q", tt.accept, tt.format, got, tt.want)
+		}
+	}
+}
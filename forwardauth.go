@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The geo gate implements the forward auth contract of Traefik (ForwardAuth)
+// and Caddy (forward_auth): the proxy asks GET /forward-auth before serving a
+// request, and lets it through on a 2xx. The client's country is returned in
+// X-Geo-Country for the proxy to copy to the upstream request.
+
+const geoCountryHeader = "X-Geo-Country"
+
+var geoGate countryPolicy
+
+// countryPolicy lets countries in or keeps them out.
+type countryPolicy struct {
+	allow map[string]bool
+	deny  map[string]bool
+	// allowUnknown decides about clients whose country isn't known.
+	allowUnknown bool
+}
+
+// loadCountryPolicy reads the policy from prefix_ALLOW, prefix_DENY and
+// prefix_ALLOW_UNKNOWN. Both lists accept country codes and the names of
+// COUNTRY_GROUPS, so it must run after those are parsed.
+func loadCountryPolicy(prefix string) (countryPolicy, error) {
+	var p countryPolicy
+	var err error
+	p.allow, err = expandCountries(strings.Split(os.Getenv(prefix+"_ALLOW"), ","))
+	if err != nil {
+		return p, fmt.Errorf("invalid %s_ALLOW: %v", prefix, err)
+	}
+	p.deny, err = expandCountries(strings.Split(os.Getenv(prefix+"_DENY"), ","))
+	if err != nil {
+		return p, fmt.Errorf("invalid %s_DENY: %v", prefix, err)
+	}
+	// With an allowlist only the listed countries get in, unknown ones included.
+	p.allowUnknown = envBool(prefix+"_ALLOW_UNKNOWN", len(p.allow) == 0)
+	return p, nil
+}
+
+// enabled reports whether the policy keeps anyone out.
+func (p countryPolicy) enabled() bool {
+	return len(p.allow) > 0 || len(p.deny) > 0 || !p.allowUnknown
+}
+
+// allows applies the policy to a country, "" when it isn't known.
+func (p countryPolicy) allows(country string) bool {
+	if country == "" {
+		return p.allowUnknown
+	}
+	country = strings.ToUpper(country)
+	if p.deny[country] {
+		return false
+	}
+	return len(p.allow) == 0 || p.allow[country]
+}
+
+func loadGeoGateConfig() error {
+	var err error
+	geoGate, err = loadCountryPolicy("GEO_GATE")
+	return err
+}
+
+// forwardedClientIP returns the last address in X-Forwarded-For, the one the
+// proxy itself added. Earlier entries come from the client and can't be trusted.
+func forwardedClientIP(r *http.Request) string {
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return ""
+	}
+	hops := strings.Split(xff[len(xff)-1], ",")
+	return strings.TrimSpace(hops[len(hops)-1])
+}
+
+func forwardAuthHandler(w http.ResponseWriter, r *http.Request) {
+	ip := forwardedClientIP(r)
+	if ip == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid_ip", "X-Forwarded-For is missing")
+		return
+	}
+
+	info, err := lookupIP(r.Context(), ip)
+	recordLookup(r, ip, err)
+	if err != nil && !errors.Is(err, errNotFound) {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	country := ""
+	if info != nil {
+		country = info.Country
+		w.Header().Set(geoCountryHeader, country)
+	}
+	if !geoGate.allows(country) {
+		logRequest(r, "Geo gate denied %s (%s) access to %s%s", ip, country, r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Uri"))
+		writeError(w, r, http.StatusForbidden, "country_denied", "Access from this country is not allowed")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,24 @@
+// Package echogeo adapts the geo middleware to the echo framework.
+//
+//	e := echo.New()
+//	e.Use(echogeo.Middleware(geo.Options{Resolver: &geo.Client{BaseURL: "http://ip-lookup:8080"}}))
+//	e.GET("/", func(c echo.Context) error {
+//		info, _ := echogeo.FromContext(c)
+//		...
+//	})
+package echogeo
+
+import (
+	"github.com/ashwanthkumar/ip-lookup/geo"
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware returns geo.Middleware as an echo middleware.
+func Middleware(opts geo.Options) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(geo.Middleware(opts))
+}
+
+// FromContext returns the geo information stored for the request.
+func FromContext(c echo.Context) (*geo.Info, bool) {
+	return geo.FromContext(c.Request().Context())
+}
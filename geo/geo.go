@@ -0,0 +1,231 @@
+// Package geo provides net/http middleware that resolves the country of the
+// calling client through an ip-lookup service and makes it available to
+// downstream handlers, optionally denying requests by country.
+//
+//	resolver := &geo.Client{BaseURL: "http://ip-lookup:8080"}
+//	handler := geo.Middleware(geo.Options{
+//		Resolver:      resolver,
+//		DenyCountries: []string{"KP"},
+//	})(mux)
+//
+// Handlers read the result with geo.FromContext(r.Context()).
+package geo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderCountry   = "X-Geo-Country"
+	HeaderContinent = "X-Geo-Continent"
+)
+
+// ErrNotFound is returned by a Resolver when the IP isn't in any known range.
+var ErrNotFound = errors.New("geo: IP not found")
+
+// Info is the subset of the ip-lookup response the middleware exposes.
+type Info struct {
+	IP            string `json:"ip"`
+	Country       string `json:"country"`
+	CountryName   string `json:"country_name"`
+	Continent     string `json:"continent"`
+	ContinentName string `json:"continent_name"`
+	ASName        string `json:"as_name"`
+	ASDomain      string `json:"as_domain"`
+	IsEU          bool   `json:"is_eu"`
+	Range         *Range `json:"range,omitempty"`
+}
+
+// Range is the block of addresses the attribution in Info applies to. Every
+// IP in it resolves to the same Info, so callers can cache by range.
+type Range struct {
+	StartIP string   `json:"start_ip"`
+	EndIP   string   `json:"end_ip"`
+	CIDRs   []string `json:"cidrs"`
+}
+
+// Resolver resolves an IP to its geo information. Client implements it
+// against a running ip-lookup service; an in-process dataset can be plugged
+// in by implementing it directly.
+type Resolver interface {
+	Resolve(ctx context.Context, ip string) (*Info, error)
+}
+
+// Client resolves IPs by calling the /lookup endpoint of an ip-lookup service.
+type Client struct {
+	// BaseURL of the service, e.g. http://ip-lookup:8080.
+	BaseURL string
+	// HTTPClient defaults to a client with a 2 second timeout.
+	HTTPClient *http.Client
+}
+
+var defaultHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+func (c *Client) Resolve(ctx context.Context, ip string) (*Info, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+
+	endpoint := strings.TrimSuffix(c.BaseURL, "/") + "/lookup/" + url.PathEscape(ip)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("geo: lookup of %s failed: %v", ip, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("geo: lookup of %s failed: %s", ip, resp.Status)
+	}
+
+	var info Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("geo: failed to decode lookup response: %v", err)
+	}
+	return &info, nil
+}
+
+// Options configures Middleware.
+type Options struct {
+	Resolver Resolver
+
+	// ClientIP extracts the client address from the request. The default
+	// takes the first X-Forwarded-For entry and falls back to RemoteAddr,
+	// which is only safe behind a proxy that overwrites the header.
+	ClientIP func(r *http.Request) string
+
+	// SetHeaders adds X-Geo-Country and X-Geo-Continent to the request
+	// before passing it on, for handlers (or upstreams) that read headers.
+	SetHeaders bool
+
+	// AllowCountries, when non-empty, only lets requests from these ISO
+	// country codes through. DenyCountries blocks the listed codes.
+	AllowCountries []string
+	DenyCountries  []string
+
+	// FailClosed rejects requests whose country can't be determined when an
+	// allow or deny list is configured. By default they are let through.
+	FailClosed bool
+
+	// Denied writes the response for blocked requests. Defaults to a plain
+	// 403 Forbidden.
+	Denied http.Handler
+
+	// OnError is called when the resolver fails for reasons other than
+	// ErrNotFound.
+	OnError func(r *http.Request, err error)
+}
+
+type contextKey struct{}
+
+// FromContext returns the geo information Middleware stored for the request.
+func FromContext(ctx context.Context) (*Info, bool) {
+	info, ok := ctx.Value(contextKey{}).(*Info)
+	return info, ok && info != nil
+}
+
+// NewContext returns a copy of ctx carrying info.
+func NewContext(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// Middleware resolves the client's country once per request and stores it in
+// the request context.
+func Middleware(opts Options) func(http.Handler) http.Handler {
+	if opts.Resolver == nil {
+		panic("geo: Options.Resolver is required")
+	}
+	clientIP := opts.ClientIP
+	if clientIP == nil {
+		clientIP = DefaultClientIP
+	}
+	denied := opts.Denied
+	if denied == nil {
+		denied = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+	allow := countrySet(opts.AllowCountries)
+	deny := countrySet(opts.DenyCountries)
+	filtering := len(allow) > 0 || len(deny) > 0
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, err := opts.Resolver.Resolve(r.Context(), clientIP(r))
+			if err != nil {
+				info = nil
+				if !errors.Is(err, ErrNotFound) && opts.OnError != nil {
+					opts.OnError(r, err)
+				}
+			}
+
+			if filtering {
+				if info == nil {
+					if opts.FailClosed {
+						denied.ServeHTTP(w, r)
+						return
+					}
+				} else {
+					country := strings.ToUpper(info.Country)
+					if deny[country] || (len(allow) > 0 && !allow[country]) {
+						denied.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			if opts.SetHeaders {
+				r.Header.Del(HeaderCountry)
+				r.Header.Del(HeaderContinent)
+				if info != nil {
+					r.Header.Set(HeaderCountry, info.Country)
+					r.Header.Set(HeaderContinent, info.Continent)
+				}
+			}
+
+			if info != nil {
+				r = r.WithContext(NewContext(r.Context(), info))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DefaultClientIP returns the first X-Forwarded-For address, or the host part
+// of RemoteAddr.
+func DefaultClientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := map[string]bool{}
+	for _, code := range codes {
+		set[strings.ToUpper(strings.TrimSpace(code))] = true
+	}
+	return set
+}
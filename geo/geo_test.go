@@ -0,0 +1,160 @@
+package geo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeService serves /lookup/{ip} from a map of IPs to countries, like an
+// ip-lookup service holding those IPs only.
+func fakeService(t *testing.T, countries map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := r.URL.Path[len("/lookup/"):]
+		country, ok := countries[ip]
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(Info{IP: ip, Country: country, Continent: "EU"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serve runs req through the middleware and returns the response and the
+// request the next handler got, nil if it wasn't called.
+func serve(opts Options, req *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+	var got *http.Request
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})
+	w := httptest.NewRecorder()
+	Middleware(opts)(next).ServeHTTP(w, req)
+	return w, got
+}
+
+func TestDefaultClientIP(t *testing.T) {
+	tests := []struct {
+		xff, remoteAddr, want string
+	}{
+		{"", "1.2.3.4:5678", "1.2.3.4"},
+		{"", "[2001:db8::1]:5678", "2001:db8::1"},
+		{"", "1.2.3.4", "1.2.3.4"},
+		{"5.6.7.8", "1.2.3.4:5678", "5.6.7.8"},
+		{" 5.6.7.8 , 9.9.9.9", "1.2.3.4:5678", "5.6.7.8"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := DefaultClientIP(r); got != tt.want {
+			t.Errorf("DefaultClientIP(X-Forwarded-For %q, RemoteAddr %q) = %q, want %q", tt.xff, tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestMiddlewareStoresCountry(t *testing.T) {
+	srv := fakeService(t, map[string]string{"1.2.3.4": "DE"})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "1.2.3.4:5678"
+	// Headers sent by the client must not survive.
+	req.Header.Set(HeaderCountry, "US")
+
+	w, got := serve(Options{Resolver: &Client{BaseURL: srv.URL}, SetHeaders: true}, req)
+	if got == nil {
+		t.Fatalf("request wasn't passed on, got %d", w.Code)
+	}
+	info, ok := FromContext(got.Context())
+	if !ok || info.Country != "DE" {
+		t.Errorf("context holds %+v, %v, want DE", info, ok)
+	}
+	if c := got.Header.Get(HeaderCountry); c != "DE" {
+		t.Errorf("%s = %q, want DE", HeaderCountry, c)
+	}
+	if c := got.Header.Get(HeaderContinent); c != "EU" {
+		t.Errorf("%s = %q, want EU", HeaderContinent, c)
+	}
+
+	// An IP the service doesn't know passes without a country or headers.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "9.9.9.9:5678"
+	req.Header.Set(HeaderCountry, "US")
+	_, got = serve(Options{Resolver: &Client{BaseURL: srv.URL}, SetHeaders: true}, req)
+	if got == nil {
+		t.Fatal("request of an unknown IP wasn't passed on")
+	}
+	if info, ok := FromContext(got.Context()); ok {
+		t.Errorf("context holds %+v for an unknown IP", info)
+	}
+	if c := got.Header.Get(HeaderCountry); c != "" {
+		t.Errorf("%s = %q for an unknown IP, want none", HeaderCountry, c)
+	}
+}
+
+func TestMiddlewareDeniesByCountry(t *testing.T) {
+	srv := fakeService(t, map[string]string{"1.2.3.4": "KP", "5.6.7.8": "DE"})
+	tests := []struct {
+		name   string
+		opts   Options
+		ip     string
+		denied bool
+	}{
+		{"denied country", Options{DenyCountries: []string{"kp"}}, "1.2.3.4", true},
+		{"other country", Options{DenyCountries: []string{"KP"}}, "5.6.7.8", false},
+		{"allowed country", Options{AllowCountries: []string{"DE"}}, "5.6.7.8", false},
+		{"not allowed country", Options{AllowCountries: []string{"DE"}}, "1.2.3.4", true},
+		{"unknown IP", Options{AllowCountries: []string{"DE"}}, "9.9.9.9", false},
+		{"unknown IP failing closed", Options{AllowCountries: []string{"DE"}, FailClosed: true}, "9.9.9.9", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Resolver = &Client{BaseURL: srv.URL}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.ip + ":5678"
+			w, got := serve(tt.opts, req)
+			if tt.denied && (got != nil || w.Code != http.StatusForbidden) {
+				t.Errorf("%s got %d and was passed on: %v, want 403", tt.ip, w.Code, got != nil)
+			}
+			if !tt.denied && got == nil {
+				t.Errorf("%s got %d, want it passed on", tt.ip, w.Code)
+			}
+		})
+	}
+}
+
+func TestMiddlewareWhenServiceIsDown(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	down := srv.URL
+	srv.Close()
+
+	for _, failClosed := range []bool{false, true} {
+		var errs []error
+		opts := Options{
+			Resolver:      &Client{BaseURL: down},
+			DenyCountries: []string{"KP"},
+			FailClosed:    failClosed,
+			OnError:       func(r *http.Request, err error) { errs = append(errs, err) },
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		w, got := serve(opts, req)
+		if len(errs) != 1 {
+			t.Errorf("FailClosed %v: OnError called with %v, want one error", failClosed, errs)
+		}
+		if failClosed && (got != nil || w.Code != http.StatusForbidden) {
+			t.Errorf("FailClosed: got %d and was passed on: %v, want 403", w.Code, got != nil)
+		}
+		if !failClosed {
+			if got == nil {
+				t.Fatalf("got %d, want the request passed on", w.Code)
+			}
+			if info, ok := FromContext(got.Context()); ok {
+				t.Errorf("context holds %+v while the service is down", info)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Package gingeo adapts the geo middleware to the gin framework.
+//
+//	r := gin.New()
+//	r.Use(gingeo.Middleware(geo.Options{Resolver: &geo.Client{BaseURL: "http://ip-lookup:8080"}}))
+//	r.GET("/", func(c *gin.Context) {
+//		info, _ := gingeo.FromContext(c)
+//		...
+//	})
+package gingeo
+
+import (
+	"net/http"
+
+	"github.com/ashwanthkumar/ip-lookup/geo"
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware returns geo.Middleware as a gin middleware. Requests the
+// middleware denies are aborted, so the handlers after it don't run.
+func Middleware(opts geo.Options) gin.HandlerFunc {
+	mw := geo.Middleware(opts)
+	return func(c *gin.Context) {
+		passed := false
+		mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			passed = true
+			c.Request = r
+			c.Next()
+		})).ServeHTTP(c.Writer, c.Request)
+		if !passed {
+			c.Abort()
+		}
+	}
+}
+
+// FromContext returns the geo information stored for the request.
+func FromContext(c *gin.Context) (*geo.Info, bool) {
+	return geo.FromContext(c.Request.Context())
+}
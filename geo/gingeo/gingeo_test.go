@@ -0,0 +1,47 @@
+package gingeo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ashwanthkumar/ip-lookup/geo"
+	"github.com/gin-gonic/gin"
+)
+
+type staticResolver map[string]string
+
+func (s staticResolver) Resolve(ctx context.Context, ip string) (*geo.Info, error) {
+	country, ok := s[ip]
+	if !ok {
+		return nil, geo.ErrNotFound
+	}
+	return &geo.Info{IP: ip, Country: country}, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware(geo.Options{
+		Resolver:      staticResolver{"1.2.3.4": "KP", "5.6.7.8": "DE"},
+		DenyCountries: []string{"KP"},
+	}))
+	r.GET("/", func(c *gin.Context) {
+		info, _ := FromContext(c)
+		c.String(http.StatusOK, info.Country)
+	})
+
+	for ip, want := range map[string]int{"1.2.3.4": http.StatusForbidden, "5.6.7.8": http.StatusOK} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":5678"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s got %d, want %d", ip, w.Code, want)
+		}
+		if want == http.StatusOK && w.Body.String() != "DE" {
+			t.Errorf("%s got body %q, want the country DE", ip, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Country centroids used to place lookup results on a map. The table lives in
+// assets/country_centroids.csv (country, latitude, longitude).
+//
+//go:embed assets/country_centroids.csv
+var countryCentroidsCSV string
+
+var countryCentroids = mustParseCentroids(countryCentroidsCSV)
+
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type       string        `json:"type"`
+	Geometry   *GeoJSONPoint `json:"geometry"`
+	Properties interface{}   `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+func mustParseCentroids(data string) map[string][2]float64 {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		log.Fatalf("Failed to parse country centroids: %v", err)
+	}
+
+	centroids := make(map[string][2]float64, len(records))
+	for _, record := range records[1:] {
+		lat, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			log.Fatalf("Invalid latitude for %s in country centroids: %v", record[0], err)
+		}
+		lon, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			log.Fatalf("Invalid longitude for %s in country centroids: %v", record[0], err)
+		}
+		centroids[record[0]] = [2]float64{lon, lat}
+	}
+	return centroids
+}
+
+// geoJSONFeature places info at the centroid of its country. Results without
+// a known country get a null geometry, which GeoJSON allows.
+func geoJSONFeature(country string, properties interface{}) GeoJSONFeature {
+	feature := GeoJSONFeature{Type: "Feature", Properties: properties}
+	if coords, ok := countryCentroids[strings.ToUpper(country)]; ok {
+		feature.Geometry = &GeoJSONPoint{Type: "Point", Coordinates: coords}
+	}
+	return feature
+}
+
+func writeGeoJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+)
+
+// In proxy mode the service sits in front of UPSTREAM_URL and adds the
+// client's country and continent to every request it forwards, so apps get
+// geo context without calling the API.
+
+const geoContinentHeader = "X-Geo-Continent"
+
+var (
+	upstreamURL *url.URL
+	proxyAddr   string
+	// proxyTrustForwarded takes the client from the last X-Forwarded-For
+	// entry, for when another proxy is in front of this one.
+	proxyTrustForwarded bool
+)
+
+func loadGeoProxyConfig() error {
+	v := os.Getenv("UPSTREAM_URL")
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid UPSTREAM_URL %q, expected an http or https URL", v)
+	}
+	upstreamURL = u
+	proxyAddr = os.Getenv("PROXY_ADDR")
+	if proxyAddr == "" {
+		proxyAddr = ":8000"
+	}
+	proxyTrustForwarded = envBool("PROXY_TRUST_FORWARDED_FOR", false)
+	return nil
+}
+
+func proxyClientIP(r *http.Request) string {
+	if proxyTrustForwarded {
+		if ip := forwardedClientIP(r); ip != "" {
+			return ip
+		}
+	}
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
+
+// newGeoProxy returns the reverse proxy to upstreamURL. Lookup failures don't
+// stop the request, it is forwarded without the geo headers.
+func newGeoProxy() http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstreamURL)
+			if proxyTrustForwarded {
+				pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			}
+			pr.SetXForwarded()
+
+			// Never pass on geo headers sent by the client.
+			pr.Out.Header.Del(geoCountryHeader)
+			pr.Out.Header.Del(geoContinentHeader)
+
+			ctx := pr.In.Context()
+			if requestTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+				defer cancel()
+			}
+			ip := proxyClientIP(pr.In)
+			info, err := lookupIP(ctx, ip)
+			if err != nil {
+				if !errors.Is(err, errNotFound) && !errors.Is(err, errInvalidIP) {
+					logRequest(pr.In, "Proxy lookup of %s failed: %v", ip, err)
+				}
+				return
+			}
+			pr.Out.Header.Set(geoCountryHeader, info.Country)
+			pr.Out.Header.Set(geoContinentHeader, info.Continent)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logRequest(r, "Upstream error: %v", err)
+			writeError(w, r, http.StatusBadGateway, "upstream_error", "Upstream request failed")
+		},
+	}
+	return requestIDMiddleware(accessLogMiddleware(proxy))
+}
+
+// startGeoProxy serves the proxy on PROXY_ADDR when UPSTREAM_URL is set.
+func startGeoProxy() {
+	if upstreamURL == nil {
+		return
+	}
+	ln, err := listen(listenerProxy, proxyAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", proxyAddr, err)
+	}
+	go func() {
+		log.Printf("Proxying %s to %s", listenerName(ln), upstreamURL.Redacted())
+		serve(newServer(proxyAddr, newGeoProxy()), ln)
+	}()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Datasets younger than DATASET_RETENTION_DAYS are kept on disk after newer
+// ones replace them, so /lookup/{ip}?date=2024-01-15 can answer where an IP
+// was on that day from the dataset that was active then.
+
+var datasetRetentionDays int
+
+type historicalDatasetCtxKey struct{}
+
+// historicalDataset is the dataset a request pinned with ?date.
+type historicalDataset struct {
+	ID      int64
+	Version string
+}
+
+// datasetRetentionCutoff returns the loaded_at before which datasets other
+// than the active and previous ones are deleted.
+func datasetRetentionCutoff() int64 {
+	if datasetRetentionDays <= 0 {
+		return time.Now().Unix() + 1
+	}
+	return time.Now().AddDate(0, 0, -datasetRetentionDays).Unix()
+}
+
+// datasetAt returns the dataset that was active at t: the last one loaded at
+// or before it.
+func datasetAt(ctx context.Context, t time.Time) (*historicalDataset, error) {
+	var d historicalDataset
+	err := db.Load().QueryRowContext(ctx, `
+		SELECT id, version FROM datasets
+		WHERE loaded_at <= ? AND row_count > 0
+			AND id NOT IN (SELECT CAST(value AS INTEGER) FROM metadata WHERE key = 'staged_dataset_id')
+		ORDER BY loaded_at DESC, id DESC
+		LIMIT 1
+	`, t.Unix()).Scan(&d.ID, &d.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find dataset at %s: %v", t.Format(time.RFC3339), err)
+	}
+	return &d, nil
+}
+
+// datasetFromContext returns the dataset pinned by withHistoricalDataset.
+func datasetFromContext(ctx context.Context) *historicalDataset {
+	d, _ := ctx.Value(historicalDatasetCtxKey{}).(*historicalDataset)
+	return d
+}
+
+// withHistoricalDataset pins the lookups of r to the dataset that was active
+// on its ?date, which is a day (read as its end, UTC) or an RFC 3339 time.
+// Without ?date r is returned as is. It writes the error and returns false
+// when the date is invalid or predates every dataset kept.
+func withHistoricalDataset(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	v := r.URL.Query().Get("date")
+	if v == "" {
+		return r, true
+	}
+	t, err := parseTimeParam(v)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid date, expected YYYY-MM-DD or RFC 3339")
+		return nil, false
+	}
+	if len(v) == len("2006-01-02") {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	d, err := datasetAt(r.Context(), t)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return nil, false
+	}
+	if d == nil {
+		writeError(w, r, http.StatusNotFound, "dataset_not_found", "No dataset kept on disk was active at that date")
+		return nil, false
+	}
+	w.Header().Set(datasetIDHeader, strconv.FormatInt(d.ID, 10))
+	w.Header().Set(datasetVersionHeader, d.Version)
+	return r.WithContext(context.WithValue(r.Context(), historicalDatasetCtxKey{}, d)), true
+}
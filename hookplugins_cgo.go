@@ -0,0 +1,12 @@
+//go:build !purego
+
+package main
+
+import "plugin"
+
+// openHookPlugin loads a Go plugin, which registers its hooks in its init
+// functions.
+func openHookPlugin(path string) error {
+	_, err := plugin.Open(path)
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build purego
+
+package main
+
+import "errors"
+
+// openHookPlugin fails: Go plugins need cgo, and are built against the
+// toolchain of a cgo build.
+func openHookPlugin(path string) error {
+	return errors.New("hook plugins need a server built with cgo, this one is built with the purego tag")
+}
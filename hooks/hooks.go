@@ -0,0 +1,164 @@
+// Package hooks lets deployments add their own logic to the lookups of an
+// ip-lookup server without forking its handlers. Hooks are registered from
+// the init function of a Go plugin the server loads with HOOK_PLUGINS:
+//
+//	package main
+//
+//	import (
+//		"strings"
+//
+//		"github.com/ashwanthkumar/ip-lookup/hooks"
+//	)
+//
+//	func init() {
+//		hooks.RegisterPreLookup("internal-ranges", func(l *hooks.Lookup) error {
+//			if strings.HasPrefix(l.IP, "10.") {
+//				return &hooks.Denial{Status: 403, Code: "internal_ip", Message: "Internal addresses can't be looked up"}
+//			}
+//			return nil
+//		})
+//		hooks.RegisterPostLookup("sales-region", func(l *hooks.Lookup, r hooks.Result) (map[string]interface{}, error) {
+//			return map[string]interface{}{"sales_region": regionOf(r.Country)}, nil
+//		})
+//	}
+//
+// built with go build -buildmode=plugin against the same version of this
+// module as the server.
+package hooks
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Lookup is a lookup of an IP made for an HTTP request.
+type Lookup struct {
+	// IP is the address to look up. Pre-lookup hooks may rewrite it.
+	IP string
+	// Request is the request the lookup is made for.
+	Request *http.Request
+}
+
+// Result is what the lookup found.
+type Result struct {
+	IP           string
+	Country      string
+	Continent    string
+	ASN          uint32
+	ASName       string
+	ASDomain     string
+	IsAnycast    bool
+	IsDatacenter bool
+	IsVPN        bool
+	IsTor        bool
+	RiskScore    int
+	// Unknown marks answers for IPs that aren't in any range.
+	Unknown bool
+}
+
+// PreLookup runs before the IP of l is looked up. It may rewrite l.IP, or
+// stop the lookup by returning an error: a *Denial is sent to the client as
+// is, any other error as an internal error.
+type PreLookup func(l *Lookup) error
+
+// PostLookup runs after a successful lookup and returns fields to add to the
+// response. They can't replace the fields the server sets.
+type PostLookup func(l *Lookup, r Result) (map[string]interface{}, error)
+
+// Denial is the error a PreLookup returns to reject a lookup with Status,
+// and Code and Message in the body like the server's own errors. Status
+// defaults to 403 and Code to "denied".
+type Denial struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("lookup denied: %s", d.Message)
+}
+
+type namedPreLookup struct {
+	name string
+	hook PreLookup
+}
+
+type namedPostLookup struct {
+	name string
+	hook PostLookup
+}
+
+var (
+	mu          sync.RWMutex
+	preLookups  []namedPreLookup
+	postLookups []namedPostLookup
+)
+
+// RegisterPreLookup adds a hook run before every lookup, after the ones
+// registered before it.
+func RegisterPreLookup(name string, hook PreLookup) {
+	mu.Lock()
+	defer mu.Unlock()
+	preLookups = append(preLookups, namedPreLookup{name, hook})
+}
+
+// RegisterPostLookup adds a hook run after every successful lookup, after
+// the ones registered before it.
+func RegisterPostLookup(name string, hook PostLookup) {
+	mu.Lock()
+	defer mu.Unlock()
+	postLookups = append(postLookups, namedPostLookup{name, hook})
+}
+
+// Registered returns the names of the pre-lookup and post-lookup hooks.
+func Registered() (pre, post []string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, h := range preLookups {
+		pre = append(pre, h.name)
+	}
+	for _, h := range postLookups {
+		post = append(post, h.name)
+	}
+	return pre, post
+}
+
+// RunPreLookup runs the pre-lookup hooks on l in order, stopping at the
+// first that fails.
+func RunPreLookup(l *Lookup) error {
+	mu.RLock()
+	hooks := preLookups
+	mu.RUnlock()
+	for _, h := range hooks {
+		if err := h.hook(l); err != nil {
+			if _, ok := err.(*Denial); ok {
+				return err
+			}
+			return fmt.Errorf("pre-lookup hook %s: %v", h.name, err)
+		}
+	}
+	return nil
+}
+
+// RunPostLookup runs the post-lookup hooks on l and r in order and returns
+// the fields they add, those of later hooks replacing those of earlier ones.
+func RunPostLookup(l *Lookup, r Result) (map[string]interface{}, error) {
+	mu.RLock()
+	hooks := postLookups
+	mu.RUnlock()
+	var fields map[string]interface{}
+	for _, h := range hooks {
+		added, err := h.hook(l, r)
+		if err != nil {
+			return nil, fmt.Errorf("post-lookup hook %s: %v", h.name, err)
+		}
+		for k, v := range added {
+			if fields == nil {
+				fields = map[string]interface{}{}
+			}
+			fields[k] = v
+		}
+	}
+	return fields, nil
+}
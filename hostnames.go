@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batches may mix hostnames with IPs. The hostnames are resolved before any
+// lookup, BATCH_RESOLVE_WORKERS at a time, each within
+// HOSTNAME_RESOLVE_TIMEOUT, and every address they resolve to is looked up
+// like an IP of the batch.
+
+var (
+	batchHostnames         bool
+	batchResolveWorkers    int
+	hostnameResolveTimeout time.Duration
+)
+
+// HostnameResult takes the place of an IPInfo in batch results for
+// hostnames: the lookup of each address it resolved to, or why it couldn't
+// be resolved.
+type HostnameResult struct {
+	Hostname  string        `json:"hostname"`
+	Addresses []interface{} `json:"addresses,omitempty"`
+	Error     *ErrorDetail  `json:"error,omitempty"`
+}
+
+// resolution is the outcome of resolving a hostname.
+type resolution struct {
+	addrs []netip.Addr
+	err   *ErrorDetail
+}
+
+func loadHostnameConfig() {
+	batchHostnames = envBool("BATCH_HOSTNAMES", true)
+	batchResolveWorkers = envInt("BATCH_RESOLVE_WORKERS", 16)
+	if batchResolveWorkers < 1 {
+		batchResolveWorkers = 1
+	}
+	hostnameResolveTimeout = envDuration("HOSTNAME_RESOLVE_TIMEOUT", 2*time.Second)
+}
+
+// isHostname reports whether s is a valid DNS name that can't be mistaken
+// for a malformed IP, which has a numeric last label.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	labels := strings.Split(s, ".")
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	last := labels[len(labels)-1]
+	return strings.Trim(last, "0123456789") != ""
+}
+
+// resolveHostnames resolves hosts with a pool of BATCH_RESOLVE_WORKERS
+// goroutines and returns the outcome of each. Hostnames not resolved by the
+// time ctx is done fail with resolve_timeout.
+func resolveHostnames(ctx context.Context, hosts []string) map[string]resolution {
+	results := make(map[string]resolution, len(hosts))
+	var mu sync.Mutex
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(batchResolveWorkers, len(hosts)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queue {
+				res := resolveHostname(ctx, host)
+				mu.Lock()
+				results[host] = res
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, host := range hosts {
+		queue <- host
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// resolveHostname returns the distinct addresses of host, in the order the
+// resolver returned them.
+func resolveHostname(ctx context.Context, host string) resolution {
+	ctx, cancel := context.WithTimeout(ctx, hostnameResolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(addrs) == 0, errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return resolution{err: &ErrorDetail{Code: "host_not_found", Message: "Hostname has no addresses"}}
+	case ctx.Err() != nil, errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		return resolution{err: &ErrorDetail{Code: "resolve_timeout", Message: "Hostname didn't resolve in time"}}
+	case err != nil:
+		return resolution{err: &ErrorDetail{Code: "resolve_failed", Message: "Hostname couldn't be resolved"}}
+	}
+
+	var res resolution
+	seen := make(map[netip.Addr]bool, len(addrs))
+	for _, addr := range addrs {
+		addr = addr.Unmap().WithZone("")
+		if !seen[addr] {
+			seen[addr] = true
+			res.addrs = append(res.addrs, addr)
+		}
+	}
+	return res
+}
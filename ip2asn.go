@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// iptoasn.com publishes which autonomous system announces each range, with
+// the name of the organization running it, as a free TSV. Loaded next to the
+// main dataset, it adds asn and org to lookups, which tell residential ISPs
+// from cloud providers where the country can't.
+
+// ip2asnKind is the name of the ip2asn data among the network lists.
+const ip2asnKind = "ip2asn"
+
+var (
+	ip2asnURL string
+
+	// asnRanges is replaced as a whole, so lookups read it without locking.
+	asnRanges atomic.Pointer[asnRangeSet]
+)
+
+// asnRange is a range of the ip2asn data, 4 bytes long for IPv4 and 16 for
+// IPv6.
+type asnRange struct {
+	start, end []byte
+	asn        uint32
+	org        string
+}
+
+// asnRangeSet holds the ip2asn ranges sorted by start. They don't overlap.
+type asnRangeSet struct {
+	v4, v6 []asnRange
+}
+
+func loadIP2ASNConfig() error {
+	ip2asnURL = os.Getenv("IP2ASN_URL")
+	if ip2asnURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(ip2asnURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid IP2ASN_URL %q, expected an http or https URL", ip2asnURL)
+	}
+	return nil
+}
+
+func createASNRangesTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS asn_ranges (
+			start_ip BLOB NOT NULL,
+			end_ip BLOB NOT NULL,
+			asn INTEGER NOT NULL,
+			org TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create asn_ranges table: %v", err)
+	}
+	return nil
+}
+
+// prepareIP2ASN drops the ip2asn ranges when IP2ASN_URL is no longer set, and
+// reads them into memory.
+func prepareIP2ASN() error {
+	if ip2asnURL == "" && !dbReadOnly {
+		if _, err := db.Load().Exec("DELETE FROM asn_ranges"); err != nil {
+			return fmt.Errorf("failed to drop ip2asn ranges: %v", err)
+		}
+		if _, err := db.Load().Exec("DELETE FROM network_lists WHERE kind = ?", ip2asnKind); err != nil {
+			return fmt.Errorf("failed to drop ip2asn ranges: %v", err)
+		}
+	}
+	return loadASNRanges()
+}
+
+// loadASNRanges reads the stored ip2asn ranges into memory.
+func loadASNRanges() error {
+	rows, err := db.Load().Query("SELECT start_ip, end_ip, asn, org FROM asn_ranges ORDER BY LENGTH(start_ip), start_ip")
+	if err != nil {
+		return fmt.Errorf("failed to load ip2asn ranges: %v", err)
+	}
+	defer rows.Close()
+
+	set := &asnRangeSet{}
+	for rows.Next() {
+		var r asnRange
+		if err := rows.Scan(&r.start, &r.end, &r.asn, &r.org); err != nil {
+			return fmt.Errorf("failed to load ip2asn ranges: %v", err)
+		}
+		if len(r.start) == net.IPv4len {
+			set.v4 = append(set.v4, r)
+		} else {
+			set.v6 = append(set.v6, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load ip2asn ranges: %v", err)
+	}
+	asnRanges.Store(set)
+	return nil
+}
+
+// applyASN sets the autonomous system and organization announcing ip, in the
+// length lookups use.
+func applyASN(info *IPInfo, ip []byte) {
+	set := asnRanges.Load()
+	if set == nil {
+		return
+	}
+	list := set.v6
+	if len(ip) == net.IPv4len {
+		list = set.v4
+	}
+	i := sort.Search(len(list), func(i int) bool { return bytes.Compare(list[i].start, ip) > 0 })
+	if i > 0 && bytes.Compare(ip, list[i-1].end) <= 0 {
+		info.ASN = list[i-1].asn
+		info.Org = list[i-1].org
+	}
+}
+
+// updateIP2ASN downloads the ip2asn data unless it was already updated today
+// and force isn't set. On failure the previous data is kept.
+func updateIP2ASN(force bool) error {
+	if ip2asnURL == "" {
+		return nil
+	}
+	var updatedAt int64
+	err := db.Load().QueryRow("SELECT updated_at FROM network_lists WHERE kind = ? AND url = ?", ip2asnKind, ip2asnURL).Scan(&updatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to check the ip2asn data: %v", err)
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	if !force && err == nil && time.Unix(updatedAt, 0).UTC().Format("2006-01-02") == today {
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "ip2asn_*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := download(ip2asnURL, nil, f); err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ranges, skipped, err := parseIP2ASN(f)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM asn_ranges"); err != nil {
+		return fmt.Errorf("failed to delete old ranges: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO asn_ranges (start_ip, end_ip, asn, org) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, r := range ranges {
+		if _, err := stmt.Exec(r.start, r.end, r.asn, r.org); err != nil {
+			return fmt.Errorf("failed to insert range: %v", err)
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO network_lists (kind, url, entries, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind) DO UPDATE SET url = excluded.url, entries = excluded.entries, updated_at = excluded.updated_at
+	`, ip2asnKind, ip2asnURL, len(ranges), time.Now().UTC().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record list: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	log.Printf("Loaded %d ip2asn ranges, skipped %d invalid lines", len(ranges), skipped)
+	return loadASNRanges()
+}
+
+// parseIP2ASN reads the ip2asn TSV, optionally gzipped: start IP, end IP,
+// AS number, country and AS description per line. Ranges of AS 0 aren't
+// routed and are left out.
+func parseIP2ASN(r io.Reader) ([]asnRange, int, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decompress: %v", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(io.LimitReader(gz, downloadMaxUncompressedSize))
+	}
+
+	var ranges []asnRange
+	skipped := 0
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			skipped++
+			continue
+		}
+		start, end := lookupBytes(net.ParseIP(fields[0])), lookupBytes(net.ParseIP(fields[1]))
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if start == nil || end == nil || len(start) != len(end) || bytes.Compare(start, end) > 0 || err != nil {
+			skipped++
+			continue
+		}
+		if asn == 0 {
+			continue
+		}
+		ranges = append(ranges, asnRange{start: start, end: end, asn: uint32(asn), org: strings.TrimSpace(fields[4])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read ip2asn data: %v", err)
+	}
+	if len(ranges) == 0 {
+		return nil, 0, fmt.Errorf("no ranges in the ip2asn data, %d invalid lines", skipped)
+	}
+	return ranges, skipped, nil
+}
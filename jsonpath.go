@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is either a field name or, when isIndex is set, an array index.
+type jsonPathStep struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses the subset of JSONPath needed to point at a single
+// value: "$.client.ip", "$.hops[0].addr" or "$['remote-addr']".
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(path), "$")
+	if !ok {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+
+	var steps []jsonPathStep
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSONPath %q has an empty field name", path)
+			}
+			steps = append(steps, jsonPathStep{field: rest[:end]})
+			rest = rest[end:]
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end == -1 {
+				return nil, fmt.Errorf("JSONPath %q has an unterminated ['", path)
+			}
+			steps = append(steps, jsonPathStep{field: rest[2:end]})
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("JSONPath %q has an unterminated [", path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an invalid index %q", path, rest[1:end])
+			}
+			steps = append(steps, jsonPathStep{index: index, isIndex: true})
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q is invalid near %q", path, rest)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("JSONPath %q doesn't select a field", path)
+	}
+	return steps, nil
+}
+
+// evalJSONPath walks a document decoded by encoding/json along steps.
+func evalJSONPath(doc interface{}, steps []jsonPathStep) (interface{}, bool) {
+	cur := doc
+	for _, step := range steps {
+		if step.isIndex {
+			arr, ok := cur.([]interface{})
+			if !ok || step.index >= len(arr) {
+				return nil, false
+			}
+			cur = arr[step.index]
+			continue
+		}
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = obj[step.field]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
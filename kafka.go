@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaRetryDelay is how long the consumer waits before retrying after the
+// brokers fail, so an outage doesn't turn into a hot loop.
+const kafkaRetryDelay = 5 * time.Second
+
+type kafkaConfig struct {
+	brokers     []string
+	inputTopic  string
+	outputTopic string
+	groupID     string
+	ipPath      []jsonPathStep
+	outputField string
+}
+
+// loadKafkaConfig returns nil when KAFKA_BROKERS isn't set, i.e. the
+// enrichment consumer is disabled.
+func loadKafkaConfig() (*kafkaConfig, error) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		return nil, nil
+	}
+
+	cfg := &kafkaConfig{
+		inputTopic:  os.Getenv("KAFKA_INPUT_TOPIC"),
+		outputTopic: os.Getenv("KAFKA_OUTPUT_TOPIC"),
+		groupID:     os.Getenv("KAFKA_GROUP_ID"),
+		outputField: os.Getenv("KAFKA_OUTPUT_FIELD"),
+	}
+	for _, broker := range strings.Split(brokers, ",") {
+		cfg.brokers = append(cfg.brokers, strings.TrimSpace(broker))
+	}
+	if cfg.inputTopic == "" || cfg.outputTopic == "" {
+		return nil, fmt.Errorf("KAFKA_INPUT_TOPIC and KAFKA_OUTPUT_TOPIC are required when KAFKA_BROKERS is set")
+	}
+	if cfg.groupID == "" {
+		cfg.groupID = "ip-lookup"
+	}
+	if cfg.outputField == "" {
+		cfg.outputField = "geo"
+	}
+
+	ipField := os.Getenv("KAFKA_IP_FIELD")
+	if ipField == "" {
+		ipField = "$.ip"
+	}
+	var err error
+	cfg.ipPath, err = parseJSONPath(ipField)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KAFKA_IP_FIELD: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// runKafkaEnricher consumes JSON messages from the input topic, adds the geo
+// data for the IP found at the configured path and produces the result to the
+// output topic. Offsets are only committed once the enriched message has been
+// written, so a crash leads to redelivery rather than loss.
+func runKafkaEnricher(ctx context.Context, cfg *kafkaConfig) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: cfg.brokers,
+		Topic:   cfg.inputTopic,
+		GroupID: cfg.groupID,
+	})
+	defer reader.Close()
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.brokers...),
+		Topic:        cfg.outputTopic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	log.Printf("Enriching Kafka messages from %s into %s", cfg.inputTopic, cfg.outputTopic)
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error reading from Kafka: %v", err)
+			time.Sleep(kafkaRetryDelay)
+			continue
+		}
+
+		out := kafka.Message{
+			Key:     msg.Key,
+			Value:   enrichKafkaMessage(ctx, cfg, msg.Value),
+			Headers: msg.Headers,
+		}
+		for {
+			err = writer.WriteMessages(ctx, out)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			log.Printf("Error writing to Kafka topic %s: %v", cfg.outputTopic, err)
+			time.Sleep(kafkaRetryDelay)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			log.Printf("Error committing Kafka offset %d: %v", msg.Offset, err)
+		}
+	}
+}
+
+// enrichKafkaMessage returns the message with the geo data added under the
+// output field. Messages that aren't JSON objects are passed through as-is,
+// and the output field is null when the IP is missing or unknown.
+func enrichKafkaMessage(ctx context.Context, cfg *kafkaConfig, value []byte) []byte {
+	enriched, err := enrichJSONObject(value, cfg.ipPath, cfg.outputField, func(ip string) *IPInfo {
+		info, err := lookupIP(ctx, ip)
+		if err != nil && !errors.Is(err, errNotFound) && !errors.Is(err, errInvalidIP) {
+			log.Printf("Error enriching %s: %v", ip, err)
+		}
+		return info
+	})
+	if err != nil {
+		log.Printf("Warning: Passing through Kafka message: %v", err)
+		return value
+	}
+	return enriched
+}
+
+// enrichJSONObject adds the result of lookup for the IP found at ipPath to a
+// JSON object, under outputField.
+func enrichJSONObject(value []byte, ipPath []jsonPathStep, outputField string, lookup func(ip string) *IPInfo) ([]byte, error) {
+	var doc map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	// Keep numbers as-is so large integers survive the round trip.
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("not a JSON object: %v", err)
+	}
+
+	var info *IPInfo
+	if raw, ok := evalJSONPath(doc, ipPath); ok {
+		if ip, ok := raw.(string); ok {
+			info = lookup(ip)
+		}
+	}
+	doc[outputField] = info
+
+	enriched, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode enriched object: %v", err)
+	}
+	return enriched, nil
+}
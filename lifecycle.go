@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Orchestrators like Kubernetes need three things from the process: a
+// liveness check that fails when it's stuck, so it is restarted, a way to
+// stop sending it traffic before it's stopped (a preStop hook calling
+// /admin/drain), and in-flight requests finishing on SIGTERM.
+
+var (
+	// livezRefreshTimeout is how long a dataset refresh may run before
+	// /livez reports the process as wedged, 0 for never.
+	livezRefreshTimeout time.Duration
+	// drainDelay is how long /admin/drain waits before returning, for the
+	// load balancers to stop sending requests.
+	drainDelay      time.Duration
+	shutdownTimeout time.Duration
+
+	// draining is set once the process is going away: /healthz fails and
+	// connections are no longer kept alive.
+	draining atomic.Bool
+
+	serversMu sync.Mutex
+	servers   []*http.Server
+
+	// shutdownDone is closed when the servers have finished shutting down.
+	shutdownDone = make(chan struct{})
+)
+
+func loadLifecycleConfig() {
+	livezRefreshTimeout = envDuration("LIVEZ_REFRESH_TIMEOUT", 2*time.Hour)
+	drainDelay = envDuration("DRAIN_DELAY", 15*time.Second)
+	shutdownTimeout = envDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+}
+
+// trackServer keeps srv to be drained and shut down with the others.
+func trackServer(srv *http.Server) *http.Server {
+	serversMu.Lock()
+	servers = append(servers, srv)
+	serversMu.Unlock()
+	return srv
+}
+
+// serve serves ln until srv is shut down. Any other error exits.
+func serve(srv *http.Server, ln net.Listener) {
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	log.Fatal(err)
+}
+
+// startDraining fails the readiness check and closes connections after their
+// current request, so clients reconnect to another instance.
+func startDraining() {
+	if draining.Swap(true) {
+		return
+	}
+	log.Printf("Draining, /healthz now fails")
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	for _, srv := range servers {
+		srv.SetKeepAlivesEnabled(false)
+	}
+}
+
+// handleShutdownSignals shuts the servers down gracefully on SIGTERM or
+// SIGINT: they stop accepting connections and wait up to SHUTDOWN_TIMEOUT
+// for the requests in flight.
+func handleShutdownSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		startDraining()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		serversMu.Lock()
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := srv.Shutdown(ctx); err != nil {
+					log.Printf("Error shutting down %s: %v", srv.Addr, err)
+				}
+			}()
+		}
+		serversMu.Unlock()
+		wg.Wait()
+		close(shutdownDone)
+	}()
+}
+
+// livezHandler reports whether the process is alive. Unlike /healthz it
+// doesn't check the database, whose failures are handled without a restart,
+// only that the dataset refresh isn't stuck.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	status := currentRefreshStatus()
+	if livezRefreshTimeout > 0 && status.InProgress && status.StartedAt != nil {
+		if running := time.Since(*status.StartedAt); running > livezRefreshTimeout {
+			message := fmt.Sprintf("Dataset refresh has been running for %s, longer than LIVEZ_REFRESH_TIMEOUT", running.Round(time.Second))
+			writeError(w, r, http.StatusServiceUnavailable, "refresh_wedged", message)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// drainHandler starts draining and returns after DRAIN_DELAY, so a preStop
+// hook calling it holds back the SIGTERM until the load balancers have
+// noticed the failing readiness check.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	startDraining()
+	select {
+	case <-time.After(drainDelay):
+	case <-r.Context().Done():
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Listeners are TCP addresses like ":8080", Unix domain sockets written as
+// "unix:/run/ip-lookup.sock", or sockets passed in by systemd socket
+// activation, for deployments behind a local reverse proxy that shouldn't
+// expose a TCP port.
+
+const (
+	listenerHTTP  = "http"
+	listenerAdmin = "admin"
+	listenerProxy = "proxy"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes, after stdin,
+// stdout and stderr.
+const sdListenFDsStart = 3
+
+var (
+	// listenAddr is where lookups are served, LISTEN_ADDR.
+	listenAddr string
+
+	unixSocketMode  os.FileMode
+	unixSocketGroup string
+
+	// activatedListeners are the sockets systemd passed, by listener. A
+	// socket named "admin" or "proxy" with FileDescriptorName= serves that
+	// listener, the first one with any other name serves lookups.
+	activatedListeners = map[string]net.Listener{}
+)
+
+func loadListenConfig() error {
+	listenAddr = os.Getenv("LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = ":8080"
+	}
+	v := os.Getenv("UNIX_SOCKET_MODE")
+	if v == "" {
+		v = "0660"
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid UNIX_SOCKET_MODE %q, expected octal permissions like 0660", v)
+	}
+	unixSocketMode = os.FileMode(mode)
+	unixSocketGroup = os.Getenv("UNIX_SOCKET_GROUP")
+	return loadActivatedListeners()
+}
+
+// loadActivatedListeners takes over the sockets from LISTEN_FDS when they are
+// meant for this process, as sd_listen_fds does.
+func loadActivatedListeners() error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Children, like the enrich command, must not take the sockets too.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to use socket %d passed by systemd: %v", sdListenFDsStart+i, err)
+		}
+		if name != listenerAdmin && name != listenerProxy {
+			name = listenerHTTP
+		}
+		if _, ok := activatedListeners[name]; ok {
+			ln.Close()
+			log.Printf("Ignoring extra %s socket passed by systemd", name)
+			continue
+		}
+		activatedListeners[name] = ln
+	}
+	return nil
+}
+
+// listen returns the socket systemd passed for the listener, or else listens
+// on addr.
+func listen(listener, addr string) (net.Listener, error) {
+	if ln, ok := activatedListeners[listener]; ok {
+		return ln, nil
+	}
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a previous run would fail the listen.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, unixSocketMode)
+	if err == nil && unixSocketGroup != "" {
+		err = chownGroup(path, unixSocketGroup)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set permissions of %s: %v", path, err)
+	}
+	return ln, nil
+}
+
+// chownGroup gives path to the group with that name or id.
+func chownGroup(path, group string) error {
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, -1, gid)
+}
+
+// listenerName describes ln for the logs.
+func listenerName(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return "unix:" + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testCountries are valid ISO codes, so normalization keeps them as they are.
+var testCountries = []string{"US", "DE", "IN", "BR", "JP", "AU", "FR", "ZA"}
+
+// testRange is a range of a test dataset and the country it resolves to.
+type testRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+func (r testRange) contains(ip netip.Addr) bool {
+	return r.start.Compare(ip) <= 0 && ip.Compare(r.end) <= 0
+}
+
+// loadTestDataset makes a fresh database holding the ranges as the active
+// dataset.
+func loadTestDataset(tb testing.TB, ranges []testRange) {
+	tb.Helper()
+	openTestDatabase(tb)
+	loadTestCSV(tb, writeTestCSV(tb, ranges))
+}
+
+// openTestDatabase makes a fresh, empty database the lookups use.
+func openTestDatabase(tb testing.TB) {
+	tb.Helper()
+	log.SetOutput(io.Discard)
+	tb.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	conn, err := openDatabase(filepath.Join(tb.TempDir(), "ip-lookup.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	db.Store(conn)
+	sqliteStore = newSQLiteRangeStore(conn)
+	rangeStore = sqliteStore
+	activeDatasetID.Store(0)
+	if err := prepareDatabase(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// writeTestCSV writes the ranges as a CSV dataset. IPv4 ranges are written as
+// IPv4-mapped IPv6 every now and then, as providers do.
+func writeTestCSV(tb testing.TB, ranges []testRange) string {
+	tb.Helper()
+	var csv strings.Builder
+	csv.WriteString("start_ip,end_ip,country\n")
+	for i, r := range ranges {
+		start, end := r.start.String(), r.end.String()
+		if r.start.Is4() && i%3 == 0 {
+			start, end = mappedString(r.start), mappedString(r.end)
+		}
+		fmt.Fprintf(&csv, "%s,%s,%s\n", start, end, r.country)
+	}
+	path := filepath.Join(tb.TempDir(), "dataset.csv")
+	if err := os.WriteFile(path, []byte(csv.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// loadTestCSV loads a CSV dataset and makes it the active one.
+func loadTestCSV(tb testing.TB, path string) {
+	tb.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	if err := loadIPRangesFile("test", Provenance{}, f, "csv", ""); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// mappedString writes an IPv4 address as IPv4-mapped IPv6.
+func mappedString(ip netip.Addr) string {
+	return "::ffff:" + ip.String()
+}
+
+// randomRanges returns n disjoint ranges, covering the lowest and the highest
+// address, with gaps of random size between them.
+func randomRanges(rng *rand.Rand, n int, ipv6 bool) []testRange {
+	width := 4
+	if ipv6 {
+		width = 16
+	}
+	seen := map[netip.Addr]bool{}
+	points := []netip.Addr{randomAddr(rng, width, 0x00), randomAddr(rng, width, 0xff)}
+	for _, p := range points {
+		seen[p] = true
+	}
+	for len(points) < 2*n {
+		var p netip.Addr
+		if len(points)%4 == 0 {
+			// Next to an earlier point, for ranges of a single address and
+			// ranges without a gap between them.
+			p = points[rng.IntN(len(points))].Next()
+			if !p.IsValid() {
+				continue
+			}
+		} else {
+			p = randomAddr(rng, width, -1)
+		}
+		if !seen[p] {
+			seen[p] = true
+			points = append(points, p)
+		}
+	}
+	slices.SortFunc(points, netip.Addr.Compare)
+
+	ranges := make([]testRange, n)
+	for i := range ranges {
+		ranges[i] = testRange{points[2*i], points[2*i+1], testCountries[rng.IntN(len(testCountries))]}
+	}
+	return ranges
+}
+
+// randomAddr returns a random address, or the lowest or highest one when fill
+// is 0x00 or 0xff.
+func randomAddr(rng *rand.Rand, width int, fill int) netip.Addr {
+	b := make([]byte, 16)
+	if fill >= 0 {
+		for i := range b {
+			b[i] = byte(fill)
+		}
+	} else {
+		binary.BigEndian.PutUint64(b[:8], rng.Uint64())
+		binary.BigEndian.PutUint64(b[8:], rng.Uint64())
+	}
+	addr, _ := netip.AddrFromSlice(b[:width])
+	return addr
+}
+
+// probes are the addresses of r worth looking up: its bounds, their
+// neighbours inside the range and a few random ones.
+func probes(rng *rand.Rand, r testRange) []netip.Addr {
+	ips := []netip.Addr{r.start, r.end}
+	if r.start != r.end {
+		ips = append(ips, r.start.Next(), r.end.Prev())
+	}
+	start, end := r.start.As16(), r.end.As16()
+	lo, hi := binary.BigEndian.Uint64(start[8:]), binary.BigEndian.Uint64(end[8:])
+	if start == end || !bytes.Equal(start[:8], end[:8]) || hi-lo < 2 {
+		return ips
+	}
+	for i := 0; i < 3; i++ {
+		b := start
+		binary.BigEndian.PutUint64(b[8:], lo+1+rng.Uint64N(hi-lo-1))
+		ip := netip.AddrFrom16(b)
+		if r.start.Is4() {
+			ip = ip.Unmap()
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func TestEveryIPInRangeResolvesToItsCountry(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	ranges := append(randomRanges(rng, 300, false), randomRanges(rng, 300, true)...)
+	loadTestDataset(t, ranges)
+	ctx := context.Background()
+
+	for i, r := range ranges {
+		for _, ip := range probes(rng, r) {
+			queries := []string{ip.String()}
+			if ip.Is4() {
+				queries = append(queries, mappedString(ip))
+			}
+			for _, q := range queries {
+				info, err := lookupIP(ctx, q)
+				if err != nil {
+					t.Fatalf("lookup of %s in %s - %s failed: %v", q, r.start, r.end, err)
+				}
+				if info.Country != r.country {
+					t.Errorf("%s resolved to %s, expected %s of %s - %s", q, info.Country, r.country, r.start, r.end)
+				}
+				if info.Range.StartIP != r.start.String() || info.Range.EndIP != r.end.String() {
+					t.Errorf("%s matched %s - %s, expected %s - %s", q, info.Range.StartIP, info.Range.EndIP, r.start, r.end)
+				}
+			}
+		}
+
+		// The addresses just outside the range are in the neighbouring
+		// range or in no range.
+		for _, ip := range []netip.Addr{r.start.Prev(), r.end.Next()} {
+			if !ip.IsValid() || (i > 0 && ranges[i-1].contains(ip)) || (i+1 < len(ranges) && ranges[i+1].contains(ip)) {
+				continue
+			}
+			if info, err := lookupIP(ctx, ip.String()); !errors.Is(err, errNotFound) {
+				t.Errorf("%s outside of %s - %s resolved to %+v, %v", ip, r.start, r.end, info, err)
+			}
+		}
+	}
+}
+
+func TestMemoryStoreAgreesWithSQLite(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	ranges := append(randomRanges(rng, 200, false), randomRanges(rng, 200, true)...)
+	// Ranges overlapping the others, which the priorities have to settle.
+	for i := 0; i < 50; i++ {
+		j := rng.IntN(len(ranges) - 2)
+		r := ranges[j]
+		if next := ranges[j+rng.IntN(3)]; next.end.Is4() == r.end.Is4() {
+			r.end = next.end
+		}
+		r.country = testCountries[rng.IntN(len(testCountries))]
+		ranges = append(ranges, r)
+	}
+	// Ranges spanning several /8s, over the ones above.
+	ranges = append(ranges,
+		testRange{netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("9.8.7.6"), "US"},
+		testRange{netip.MustParseAddr("5.0.0.0"), netip.MustParseAddr("200.0.0.0"), "JP"},
+	)
+	loadTestDataset(t, ranges)
+	memory, err := loadMemoryRangeStore(activeDatasetID.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, r := range ranges {
+		ips := append(probes(rng, r), r.start.Prev(), r.end.Next())
+		if r.start.Is4() {
+			// The bounds of the /8s the range spans.
+			for octet := int(r.start.As4()[0]); octet <= int(r.end.As4()[0]); octet++ {
+				ips = append(ips, netip.AddrFrom4([4]byte{byte(octet)}), netip.AddrFrom4([4]byte{byte(octet), 0xff, 0xff, 0xff}))
+			}
+		}
+		for _, ip := range ips {
+			if !ip.IsValid() {
+				continue
+			}
+			want, wantErr := sqliteStore.Lookup(ctx, activeDatasetID.Load(), ip.AsSlice())
+			got, gotErr := memory.Lookup(ctx, activeDatasetID.Load(), ip.AsSlice())
+			if !errors.Is(gotErr, wantErr) && (wantErr != nil || gotErr != nil) {
+				t.Fatalf("%s: memory store returned %v, SQLite %v", ip, gotErr, wantErr)
+			}
+			if want == nil {
+				continue
+			}
+			if !bytes.Equal(got.StartIP, want.StartIP) || !bytes.Equal(got.EndIP, want.EndIP) || got.Country != want.Country {
+				t.Errorf("%s: memory store matched %v - %v %s, SQLite %v - %v %s", ip, got.StartIP, got.EndIP, got.Country, want.StartIP, want.EndIP, want.Country)
+			}
+		}
+	}
+}
+
+// TestMemoryLookupsOnlyAllocateTheAnswer checks that with the memory engine
+// a lookup allocates its answer and the address, but neither copies the range
+// nor formats it again.
+func TestMemoryLookupsOnlyAllocateTheAnswer(t *testing.T) {
+	rng := rand.New(rand.NewPCG(13, 14))
+	ranges := append(randomRanges(rng, 100, false), randomRanges(rng, 100, true)...)
+	loadTestDataset(t, ranges)
+	memory, err := loadMemoryRangeStore(activeDatasetID.Load())
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := lookupEngine
+	lookupEngine = lookupEngineMemory
+	memorySnapshot.Store(memory)
+	t.Cleanup(func() {
+		lookupEngine = engine
+		memorySnapshot.Store(nil)
+	})
+	ctx := context.Background()
+
+	for _, ip := range []string{ranges[0].start.String(), ranges[150].end.String()} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := lookupIP(ctx, ip); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > 2 {
+			t.Errorf("lookup of %s allocates %v times, expected at most 2", ip, allocs)
+		}
+	}
+}
+
+func FuzzLookupIP(f *testing.F) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	ranges := append(randomRanges(rng, 50, false), randomRanges(rng, 50, true)...)
+	loadTestDataset(f, ranges)
+	for _, seed := range []string{
+		"1.2.3.4", "::ffff:1.2.3.4", "0.0.0.0", "255.255.255.255", "::", "::ffff:0.0.0.0",
+		"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "2001:db8::1", "fe80::1%eth0", "1.2.3.04",
+		"1.2.3", "::ffff:1.2.3.4.5", "[::1]", " 1.2.3.4", "",
+	} {
+		f.Add(seed)
+	}
+	ctx := context.Background()
+
+	f.Fuzz(func(t *testing.T, s string) {
+		info, err := lookupIP(ctx, s)
+		addr, parseErr := netip.ParseAddr(s)
+		if parseErr != nil || addr.Zone() != "" {
+			if !errors.Is(err, errInvalidIP) {
+				t.Fatalf("lookup of %q returned %+v, %v, expected an invalid IP", s, info, err)
+			}
+			return
+		}
+		addr = addr.Unmap()
+
+		var want *testRange
+		for i := range ranges {
+			if ranges[i].contains(addr) {
+				want = &ranges[i]
+				break
+			}
+		}
+		if want == nil {
+			if !errors.Is(err, errNotFound) {
+				t.Fatalf("lookup of %q returned %+v, %v, expected not found", s, info, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("lookup of %q failed: %v", s, err)
+		}
+		if info.IP != s || info.Country != want.country || info.Range.StartIP != want.start.String() {
+			t.Fatalf("lookup of %q returned %s in %s, expected %s in %s", s, info.Country, info.Range.StartIP, want.country, want.start)
+		}
+	})
+}
+
+// benchmarkLookups looks up addresses of the ranges, round robin.
+func benchmarkLookups(b *testing.B, ranges []testRange) {
+	rng := rand.New(rand.NewPCG(9, 10))
+	var ips []string
+	for _, r := range ranges {
+		for _, ip := range probes(rng, r) {
+			ips = append(ips, ip.String())
+		}
+	}
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := lookupIP(ctx, ips[i%len(ips)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookupSQLite(b *testing.B) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	ranges := append(randomRanges(rng, 5000, false), randomRanges(rng, 1000, true)...)
+	loadTestDataset(b, ranges)
+	benchmarkLookups(b, ranges)
+}
+
+func BenchmarkLookupMemory(b *testing.B) {
+	rng := rand.New(rand.NewPCG(7, 8))
+	ranges := append(randomRanges(rng, 5000, false), randomRanges(rng, 1000, true)...)
+	loadTestDataset(b, ranges)
+	memory, err := loadMemoryRangeStore(activeDatasetID.Load())
+	if err != nil {
+		b.Fatal(err)
+	}
+	rangeStore = memory
+	benchmarkLookups(b, ranges)
+}
+
+func BenchmarkLoadIPRangesFile(b *testing.B) {
+	rng := rand.New(rand.NewPCG(11, 12))
+	ranges := append(randomRanges(rng, 10000, false), randomRanges(rng, 2000, true)...)
+	openTestDatabase(b)
+	path := writeTestCSV(b, ranges)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loadTestCSV(b, path)
+	}
+	b.ReportMetric(float64(len(ranges))*float64(b.N)/b.Elapsed().Seconds(), "ranges/s")
+}
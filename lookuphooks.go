@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ashwanthkumar/ip-lookup/hooks"
+)
+
+// Deployments add their own logic to lookups with the hooks package: Go
+// plugins listed in HOOK_PLUGINS register pre-lookup hooks, which can rewrite
+// the IP or deny the lookup, and post-lookup hooks, which add fields to the
+// result. They run for the lookups of HTTP requests, not for enrichment.
+
+// loadHookPlugins opens the plugins of HOOK_PLUGINS, which register their
+// hooks as they are loaded.
+func loadHookPlugins() error {
+	v := os.Getenv("HOOK_PLUGINS")
+	if v == "" {
+		return nil
+	}
+	for _, path := range strings.Split(v, ",") {
+		path = strings.TrimSpace(path)
+		if err := openHookPlugin(path); err != nil {
+			return fmt.Errorf("failed to load hook plugin %s: %v", path, err)
+		}
+	}
+	pre, post := hooks.Registered()
+	log.Printf("Loaded %d pre-lookup hooks %v and %d post-lookup hooks %v", len(pre), pre, len(post), post)
+	return nil
+}
+
+// runPreLookupHooks returns the IP to look up for ip once the pre-lookup
+// hooks had their say.
+func runPreLookupHooks(r *http.Request, ip string) (string, error) {
+	l := &hooks.Lookup{IP: ip, Request: r}
+	err := hooks.RunPreLookup(l)
+	var denial *hooks.Denial
+	if err != nil && !errors.As(err, &denial) {
+		logRequest(r, "Error running hooks: %v", err)
+		return "", errInternal
+	}
+	return l.IP, err
+}
+
+// runPostLookupHooks adds the fields of the post-lookup hooks to info.
+func runPostLookupHooks(r *http.Request, info *IPInfo) error {
+	fields, err := hooks.RunPostLookup(&hooks.Lookup{IP: info.IP, Request: r}, hooks.Result{
+		IP:           info.IP,
+		Country:      info.Country,
+		Continent:    info.Continent,
+		ASN:          info.ASN,
+		ASName:       info.ASName,
+		ASDomain:     info.ASDomain,
+		IsAnycast:    info.IsAnycast,
+		IsDatacenter: info.IsDatacenter,
+		IsVPN:        info.IsVPN,
+		IsTor:        info.IsTor,
+		RiskScore:    info.RiskScore,
+		Unknown:      info.Unknown,
+	})
+	if err != nil {
+		logRequest(r, "Error running hooks: %v", err)
+		return errInternal
+	}
+	info.HookFields = fields
+	return nil
+}
+
+// appendHookFields adds the hook fields to b, the JSON object of an IPInfo,
+// in the order of their names. Those the object already has are left out.
+func appendHookFields(b []byte, fields map[string]interface{}) ([]byte, error) {
+	var existing map[string]json.RawMessage
+	if err := json.Unmarshal(b, &existing); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if _, ok := existing[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.Write(b[:bytes.LastIndexByte(b, '}')])
+	for _, name := range names {
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(fields[name])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
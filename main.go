@@ -1,105 +1,611 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/robfig/cron/v3"
 )
 
-const (
-	dbFile = "data/ip_ranges.db"
-)
-
 var (
-	dataURL string
-	db      *sql.DB
+	dataURL        string
+	adminToken     string
+	conflictPolicy string
+	sourcePriority []string
+	// db is replaced when DB_WATCH reopens the database.
+	db atomic.Pointer[sql.DB]
+
+	// currentDatasetVersion caches the version of the active dataset, which
+	// is the date it was loaded.
+	currentDatasetVersion atomic.Value
 )
 
 type IPRange struct {
-	StartIP       string `json:"start_ip"`
-	EndIP         string `json:"end_ip"`
-	Country       string `json:"country"`
-	CountryName   string `json:"country_name"`
-	Continent     string `json:"continent"`
-	ContinentName string `json:"continent_name"`
-	ASN           string `json:"asn"`
-	ASName        string `json:"as_name"`
-	ASDomain      string `json:"as_domain"`
+	StartIP       string   `json:"start_ip"`
+	EndIP         string   `json:"end_ip"`
+	Country       string   `json:"country"`
+	CountryName   string   `json:"country_name"`
+	Continent     string   `json:"continent"`
+	ContinentName string   `json:"continent_name"`
+	ASN           string   `json:"asn"`
+	ASName        string   `json:"as_name"`
+	ASDomain      string   `json:"as_domain"`
+	Source        string   `json:"source"`
+	IsAnycast     bool     `json:"is_anycast"`
+	Countries     []string `json:"countries"`
+	Timezone      string   `json:"timezone"`
+	Currency      string   `json:"currency"`
 }
 
 type IPInfo struct {
-	IP            string `json:"ip"`
-	CountryName   string `json:"country_name"`
-	ContinentName string `json:"continent_name"`
-	ASName        string `json:"as_name"`
-	ASDomain      string `json:"as_domain"`
+	IP             string   `json:"ip"`
+	Country        string   `json:"country,omitempty"`
+	CountryName    string   `json:"country_name"`
+	CountryAlpha3  string   `json:"country_alpha3,omitempty"`
+	CountryNumeric string   `json:"country_numeric,omitempty"`
+	Continent      string   `json:"continent,omitempty"`
+	ContinentName  string   `json:"continent_name"`
+	Resolution     string   `json:"resolution"`
+	ASName         string   `json:"as_name"`
+	ASDomain       string   `json:"as_domain"`
+	ASN            uint32   `json:"asn,omitempty"`
+	Org            string   `json:"org,omitempty"`
+	IsAnycast      bool     `json:"is_anycast"`
+	Countries      []string `json:"countries,omitempty"`
+	Timezone       string   `json:"timezone,omitempty"`
+	Currency       string   `json:"currency,omitempty"`
+	Hostname       string   `json:"hostname,omitempty"`
+	// Flag, CallingCode and TLD are added with ?extended=true.
+	Flag         string   `json:"flag,omitempty"`
+	CallingCode  string   `json:"calling_code,omitempty"`
+	TLD          string   `json:"tld,omitempty"`
+	IsEU         bool     `json:"is_eu"`
+	IsSanctioned bool     `json:"is_sanctioned"`
+	IsDatacenter bool     `json:"is_datacenter"`
+	IsVPN        bool     `json:"is_vpn"`
+	IsTor        bool     `json:"is_tor"`
+	ThreatFeeds  []string `json:"threat_feeds,omitempty"`
+	RiskScore    int      `json:"risk_score"`
+	// Confidence is how far the attribution can be trusted, from 0 to 100.
+	Confidence int `json:"confidence"`
+	// Action, Score and Rule are the decision of RULES_FILE.
+	Action string        `json:"action,omitempty"`
+	Score  *int          `json:"score,omitempty"`
+	Rule   string        `json:"rule,omitempty"`
+	Groups []string      `json:"groups,omitempty"`
+	Range  *MatchedRange `json:"range,omitempty"`
+	// Tunnel is set when the IPv4 address embedded in a 6to4 or Teredo
+	// address was looked up instead.
+	Tunnel *TunnelInfo `json:"tunnel,omitempty"`
+	// Source is where the matched range came from. Answers made up by an
+	// override alone have none.
+	Source *RangeSource `json:"source,omitempty"`
+	// Labels and Override are set when an override matched the IP.
+	Labels   []string `json:"labels,omitempty"`
+	Override bool     `json:"override,omitempty"`
+	// Pinned marks the fixed responses of PINNED_RESPONSES_FILE.
+	Pinned bool `json:"pinned,omitempty"`
+	// Unknown marks placeholder answers for IPs that aren't in any range,
+	// returned instead of a 404 depending on NOT_FOUND_POLICY.
+	Unknown bool `json:"unknown,omitempty"`
+	// Client is how the auto-detect endpoint found the IP, with ?verbose=true.
+	Client *ClientDetection `json:"client,omitempty"`
+	// HookFields are the fields added by post-lookup hooks.
+	HookFields map[string]interface{} `json:"-"`
 }
 
 func main() {
-	// Ensure the data directory exists
-	err := os.MkdirAll(filepath.Dir(dbFile), 0755)
+	loadDataDirConfig()
+	if len(os.Args) > 1 && os.Args[1] == "enrich" {
+		runEnrichCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBenchCommand(os.Args[2:])
+		return
+	}
+	restorePath := flag.String("restore", "", "Replace the database with this backup, plain or gzipped, before starting")
+	forceUpdate := flag.Bool("force-update", envBool("FORCE_UPDATE", false), "Load the upstream data at startup even if it was already loaded today")
+	validateConfig := flag.Bool("validate-config", false, "Check the configuration, the data URL, the data directory, the database and authentication, then exit")
+	flag.Parse()
+	if *validateConfig {
+		os.Exit(runConfigValidation(*restorePath, *forceUpdate))
+	}
+
+	err := prepareDataDir()
 	if err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+		log.Fatal(err)
 	}
 
-	dataURL = os.Getenv("IP_DATA_URL")
-	if dataURL == "" {
-		log.Fatal("IP_DATA_URL environment variable is not set")
+	if errs := loadConfig(*restorePath, *forceUpdate); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Configuration error: %v", err)
+		}
+		log.Fatalf("Found %d configuration errors, run with --validate-config for a full check", len(errs))
+	}
+
+	if *restorePath != "" {
+		err = restoreDatabaseFile(*restorePath)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	db, err = sql.Open("sqlite3", dbFile)
+	if !dbReadOnly {
+		seedPath = os.Getenv("SEED_DB_PATH")
+	}
+	seeded, err := copySeedDatabase()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
-	err = createTable()
+	conn, err := openDatabase(databaseDSN())
 	if err != nil {
 		log.Fatal(err)
 	}
+	db.Store(conn)
+	// The database is replaced when DB_WATCH reopens it.
+	defer func() { db.Load().Close() }()
+	sqliteStore = newSQLiteRangeStore(conn)
+	rangeStore = sqliteStore
+	if lookupEngine == lookupEngineBolt {
+		boltStore, err = openBoltRangeStore(boltPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rangeStore = boltStore
+	}
 
-	err = updateIPRangesIfNeeded()
+	err = prepareDatabase()
 	if err != nil {
-		log.Printf("Error during initial data load: %v", err)
+		log.Fatal(err)
+	}
+	startUsageWriter()
+	if !seeded {
+		seeded, err = loadSeedSnapshot()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	c := cron.New(cron.WithLocation(time.UTC))
-	_, err = c.AddFunc("30 0 * * *", func() {
-		log.Println("Starting scheduled update check...")
-		err := updateIPRangesIfNeeded()
+	whoisEnabled = envBool("WHOIS_ENABLED", false)
+	if whoisEnabled {
+		initWhois()
+	}
+
+	initReverseDNS()
+
+	if auditEnabled {
+		startAuditWriter()
+	}
+	startAnalyticsSender()
+	startCountryAnomalyDetector()
+
+	checkDatabaseAtStartup()
+
+	initialRefresh := refreshIfNeeded
+	if *forceUpdate {
+		log.Println("Forcing an update of the data at startup")
+		initialRefresh = forceRefresh
+	}
+	if dbReadOnly {
+		log.Printf("Serving the read-only database %s, updates are disabled", dbFile)
+	} else if serveOnly {
+		log.Printf("Serving %s, updates are disabled", dbFile)
+	} else if seeded {
+		// Serve the seed right away and catch up with upstream in the background.
+		go func() {
+			err := initialRefresh(refreshTriggerStartup)
+			if err != nil {
+				log.Printf("Error during initial data load: %v", err)
+			}
+		}()
+	} else {
+		err = initialRefresh(refreshTriggerStartup)
 		if err != nil {
-			log.Printf("Error during scheduled update: %v", err)
+			log.Printf("Error during initial data load: %v", err)
 		}
-		log.Println("Scheduled update check completed.")
-	})
+	}
+	warmUp()
+
+	if !updatesDisabled() {
+		startTorExitUpdater()
+		startUpstreamPoller()
+	}
+	err = startDatabaseWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	schedule := "30 0 * * *"
+	if isFollower() {
+		schedule = "@every " + followerSyncInterval.String()
+		log.Printf("Following %s, syncing every %s", primaryURL, followerSyncInterval)
+	}
+
+	c := cron.New(cron.WithLocation(time.UTC))
+	if !updatesDisabled() {
+		_, err = c.AddFunc(schedule, func() {
+			if delay := peerRefreshDelay(); delay > 0 {
+				log.Printf("Waiting %s before the scheduled update check...", delay.Round(time.Second))
+				time.Sleep(delay)
+			}
+			log.Println("Starting scheduled update check...")
+			err := refreshIfNeeded(refreshTriggerSchedule)
+			if err != nil {
+				log.Printf("Error during scheduled update: %v", err)
+			}
+			log.Println("Scheduled update check completed.")
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if backupInterval > 0 {
+		_, err = c.AddFunc("@every "+backupInterval.String(), func() {
+			if err := runScheduledBackup(); err != nil {
+				log.Printf("Error backing up database: %v", err)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if auditEnabled {
+		_, err = c.AddFunc("@hourly", func() {
+			if err := pruneAuditLog(); err != nil {
+				log.Printf("Error pruning audit log: %v", err)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	c.Start()
 
+	kafkaCfg, err := loadKafkaConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if kafkaCfg != nil {
+		go runKafkaEnricher(context.Background(), kafkaCfg)
+	}
+
+	syslogCfg, err := loadSyslogConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if syslogCfg != nil {
+		err = startSyslogListeners(syslogCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r := newRouter()
+	registerLookupRoutes(r, disabledEndpoints)
+	adminRouter := r
+	if adminAddr != "" {
+		adminRouter = newRouter()
+		// The admin UI searches with /lookup, so lookups are served here too.
+		registerLookupRoutes(adminRouter, nil)
+	}
+	registerAdminRoutes(adminRouter)
+
+	if adminAddr != "" {
+		ln, err := listen(listenerAdmin, adminAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", adminAddr, err)
+		}
+		go func() {
+			log.Printf("Admin server is running on %s", listenerName(ln))
+			serve(newServer(adminAddr, adminRouter), ln)
+		}()
+	}
+
+	startGeoProxy()
+
+	ln, err := listen(listenerHTTP, listenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", listenAddr, err)
+	}
+	handleShutdownSignals()
+	log.Printf("Server is running on %s", listenerName(ln))
+	serve(newServer(listenAddr, r), ln)
+	<-shutdownDone
+	log.Printf("Server stopped")
+}
+
+// loadConfig reads the configuration of the server from the environment. It
+// goes on past invalid settings and returns all of their errors, so they can
+// be fixed at once.
+func loadConfig(restorePath string, forceUpdate bool) []error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	loadFollowerConfig()
+	dataURL = os.Getenv("IP_DATA_URL")
+	loadServeOnlyConfig()
+	if dataURL == "" && !isFollower() && !updatesDisabled() {
+		errs = append(errs, errors.New("IP_DATA_URL is not set, set it to the URL of the upstream data, PRIMARY_URL to follow another instance, or SERVE_ONLY=true to serve the database as is"))
+	}
+
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	adminAddr = os.Getenv("ADMIN_ADDR")
+	check(loadListenConfig())
+	check(loadDisabledEndpoints())
+	loadLifecycleConfig()
+	loadPeerConfig()
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	batchMaxSize = envInt("BATCH_MAX_SIZE", defaultBatchMaxSize)
+	loadHostnameConfig()
+	enrichMaxBytes = int64(envInt("ENRICH_MAX_BYTES", 10<<30))
+	datasetRetentionDays = envInt("DATASET_RETENTION_DAYS", 0)
+	refreshRequirePromotion = envBool("REFRESH_REQUIRE_PROMOTION", false)
+	normalizeCountries = envBool("NORMALIZE_COUNTRIES", true)
+	check(loadDataFormatConfig())
+	check(loadDownloadConfig())
+	loadDegradedConfig()
+	loadBreakerConfig()
+	check(loadLookupEngineConfig())
+	loadMaintenanceConfig()
+	loadCoverageConfig()
+	loadCountryAnomalyConfig()
+	check(loadBackupConfig())
+	loadTimeoutConfig()
+	loadWarmupConfig()
+	loadPollConfig()
+	check(loadSelftestConfig())
+	loadAttributionConfig()
+	check(loadGeoProxyConfig())
+	check(loadNotFoundConfig())
+
+	check(loadLookupConfig())
+	check(loadGeoGateConfig())
+	check(loadClientCountryConfig())
+	check(loadTrustedProxies())
+
+	conflictPolicy = os.Getenv("CONFLICT_POLICY")
+	if conflictPolicy == "" {
+		conflictPolicy = policyLongestPrefix
+	}
+	if !isValidConflictPolicy(conflictPolicy) {
+		errs = append(errs, fmt.Errorf("invalid CONFLICT_POLICY %q, expected one of: %s, %s, %s", conflictPolicy, policyFirstWins, policyLongestPrefix, policySourcePriority))
+	}
+	if v := os.Getenv("SOURCE_PRIORITY"); v != "" {
+		for _, source := range strings.Split(v, ",") {
+			sourcePriority = append(sourcePriority, strings.TrimSpace(source))
+		}
+	}
+
+	check(loadNetworkListConfig())
+	loadTorExitConfig()
+	auditEnabled = envBool("AUDIT_LOG", false)
+	auditRetentionDays = envInt("AUDIT_RETENTION_DAYS", 90)
+	allowDoNotPersist = envBool("ALLOW_DO_NOT_PERSIST", false)
+	check(loadAnalyticsConfig())
+	check(loadAnonymizeConfig())
+	check(checkReadOnlyConfig(restorePath))
+	check(checkServeOnlyConfig(forceUpdate))
+	apiKeysRequired = envBool("API_KEYS_REQUIRED", false)
+	check(loadSigningConfig())
+	check(loadHookPlugins())
+
+	return errs
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", autoDetectHandler).Methods("GET")
-	r.HandleFunc("/lookup/{ip}", lookupHandler).Methods("GET")
+	r.Use(requestIDMiddleware, doNotPersistMiddleware, accessLogMiddleware, datasetVersionMiddleware)
+	if clientCountryPolicy.enabled() {
+		r.Use(clientCountryMiddleware)
+	}
+	if attributionHeader {
+		r.Use(attributionMiddleware)
+	}
+	if signingAlgorithm != "" {
+		r.Use(signingMiddleware)
+	}
+	var notFound, methodNotAllowed http.Handler = http.HandlerFunc(notFoundHandler), methodNotAllowedHandler(r)
+	if clientCountryPolicy.enabled() {
+		notFound, methodNotAllowed = clientCountryMiddleware(notFound), clientCountryMiddleware(methodNotAllowed)
+	}
+	r.NotFoundHandler = requestIDMiddleware(accessLogMiddleware(datasetVersionMiddleware(notFound)))
+	r.MethodNotAllowedHandler = requestIDMiddleware(accessLogMiddleware(datasetVersionMiddleware(methodNotAllowed)))
+	return r
+}
 
-	log.Println("Server is running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+// registerLookupRoutes adds the lookup endpoints to r, except the disabled
+// ones.
+func registerLookupRoutes(r *mux.Router, disabled map[string]bool) {
+	// HEAD is answered like GET without the body, so lookups double as
+	// existence checks.
+	if !disabled[routeAutoDetect] {
+		r.HandleFunc("/", requireAPIKey(endpointLookup, withTimeout(autoDetectHandler))).Methods("GET", "HEAD")
+	}
+	if !disabled[routeBatch] {
+		// NDJSON batches are streamed, each lookup with its own timeout.
+		r.HandleFunc("/lookup", requireAPIKey(endpointBatch, ndjsonBatchHandler)).Methods("POST").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return isNDJSONBatch(r)
+		})
+		r.HandleFunc("/lookup", requireAPIKey(endpointBatch, withTimeout(batchLookupHandler))).Methods("POST")
+	}
+	if !disabled[routeLookup] {
+		r.HandleFunc("/lookup/{ip}", requireAPIKey(endpointLookup, withTimeout(lookupHandler))).Methods("GET", "HEAD")
+	}
+	if !disabled[routeStream] {
+		r.HandleFunc("/stream", requireAPIKey(endpointStream, websocketStreamHandler)).Methods("GET")
+		r.HandleFunc("/stream", requireAPIKey(endpointStream, sseStreamHandler)).Methods("POST")
+	}
+	if !disabled[routeEnrich] {
+		r.HandleFunc("/enrich", requireAPIKey(endpointEnrich, enrichHandler)).Methods("POST")
+	}
+	if whoisEnabled && !disabled[routeWhois] {
+		r.HandleFunc("/whois/{ip}", requireAPIKey(endpointWhois, withTimeout(whoisHandler))).Methods("GET", "HEAD")
+	}
+	if torExitsEnabled && !disabled[routeTorExits] {
+		r.HandleFunc("/tor-exits", requireAPIKey(endpointLookup, withTimeout(torExitsHandler))).Methods("GET", "HEAD")
+	}
+	if !disabled[routeForwardAuth] {
+		r.HandleFunc("/forward-auth", withTimeout(forwardAuthHandler)).Methods("GET", "HEAD")
+	}
+	if !disabled[routeSigningKey] {
+		r.HandleFunc("/signing-key", signingKeyHandler).Methods("GET", "HEAD")
+	}
+	if !disabled[routeHealthz] {
+		r.HandleFunc("/healthz", healthHandler).Methods("GET", "HEAD")
+	}
+	if !disabled[routeLivez] {
+		r.HandleFunc("/livez", livezHandler).Methods("GET", "HEAD")
+	}
+	if !disabled[routeAttribution] {
+		r.HandleFunc("/attribution", attributionHandler).Methods("GET", "HEAD")
+	}
+	if !disabled[routeCountries] {
+		r.HandleFunc("/countries", requireAPIKey(endpointLookup, withTimeout(countriesHandler))).Methods("GET", "HEAD")
+		r.HandleFunc("/countries/{country}", requireAPIKey(endpointLookup, withTimeout(countryHandler))).Methods("GET", "HEAD")
+	}
+	if !disabled[routeVersion] {
+		r.HandleFunc("/version", versionHandler).Methods("GET", "HEAD")
+	}
+	if !disabled[routeContains] {
+		r.HandleFunc("/contains", requireAPIKey(endpointBatch, withTimeout(containsHandler))).Methods("POST")
+	}
+}
+
+// prepareDatabase creates the tables, migrates them to the latest schema
+// version and loads what lookups keep in memory. It runs at startup and
+// after a restore replaced the database.
+func prepareDatabase() error {
+	err := createTables()
+	if err != nil {
+		return err
+	}
+	err = migrateDatabase()
+	if err != nil {
+		return err
+	}
+	err = loadActiveDataset()
+	if err != nil {
+		return err
+	}
+	err = refreshMemorySnapshot(activeDatasetID.Load())
+	if err != nil {
+		return err
+	}
+	err = refreshBoltStore(activeDatasetID.Load())
+	if err != nil {
+		return err
+	}
+	err = loadOverrides()
+	if err != nil {
+		return err
+	}
+	err = pruneNetworkLists()
+	if err != nil {
+		return err
+	}
+	err = loadNetworkLists()
+	if err != nil {
+		return err
+	}
+	err = prepareIP2ASN()
+	if err != nil {
+		return err
+	}
+	err = loadTorExits()
+	if err != nil {
+		return err
+	}
+	err = loadAPIKeys()
+	if err != nil {
+		return err
+	}
+	if path := os.Getenv("TRANSLATIONS_FILE"); path != "" {
+		err = importTranslations(path)
+		if err != nil {
+			return fmt.Errorf("failed to import translations: %v", err)
+		}
+	}
+	return loadTranslations()
+}
+
+// createTables creates the tables of the baseline schema, which migrations
+// then change.
+func createTables() error {
+	err := createTable()
+	if err != nil {
+		return err
+	}
+	err = createDatasetsTable()
+	if err != nil {
+		return err
+	}
+	err = createChangesTables()
+	if err != nil {
+		return err
+	}
+	err = createAPIKeysTable()
+	if err != nil {
+		return err
+	}
+	err = createUsageTable()
+	if err != nil {
+		return err
+	}
+	err = createOverridesTable()
+	if err != nil {
+		return err
+	}
+	err = createWatchesTables()
+	if err != nil {
+		return err
+	}
+	err = createNetworkListTables()
+	if err != nil {
+		return err
+	}
+	err = createASNRangesTable()
+	if err != nil {
+		return err
+	}
+	err = createTorExitsTables()
+	if err != nil {
+		return err
+	}
+	err = createTranslationsTable()
+	if err != nil {
+		return err
+	}
+	if auditEnabled {
+		err = createAuditTable()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func createTable() error {
-	_, err := db.Exec(`
+	_, err := db.Load().Exec(`
 		CREATE TABLE IF NOT EXISTS ip_ranges (
 			start_ip BLOB,
 			end_ip BLOB,
@@ -114,7 +620,39 @@ func createTable() error {
 		return fmt.Errorf("failed to create ip_ranges table: %v", err)
 	}
 
-	_, err = db.Exec(`
+	err = addColumnIfMissing("ip_ranges", "source", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing("ip_ranges", "priority", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing("ip_ranges", "is_anycast", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing("ip_ranges", "countries", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{"country", "continent", "timezone", "currency"} {
+		err = addColumnIfMissing("ip_ranges", column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = addColumnIfMissing("ip_ranges", "dataset_id", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Load().Exec(`
 		CREATE TABLE IF NOT EXISTS metadata (
 			key TEXT PRIMARY KEY,
 			value TEXT
@@ -124,17 +662,78 @@ func createTable() error {
 		return fmt.Errorf("failed to create metadata table: %v", err)
 	}
 
-	_, err = db.Exec(`
-		CREATE INDEX IF NOT EXISTS idx_ip_range ON ip_ranges (start_ip, end_ip, is_ipv6)
+	// Ranges are indexed on their integer addresses by the migrations.
+	_, err = db.Load().Exec("DROP INDEX IF EXISTS idx_ip_range")
+	if err != nil {
+		return fmt.Errorf("failed to drop index: %v", err)
+	}
+
+	_, err = db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS conflicts (
+			start_ip TEXT,
+			end_ip TEXT,
+			country_name TEXT,
+			other_start_ip TEXT,
+			other_end_ip TEXT,
+			other_country_name TEXT,
+			winner_start_ip TEXT,
+			winner_end_ip TEXT,
+			is_ipv6 BOOLEAN
+		)
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to create index: %v", err)
+		return fmt.Errorf("failed to create conflicts table: %v", err)
+	}
+
+	err = addColumnIfMissing("conflicts", "dataset_id", "INTEGER")
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older versions pick up new columns without being recreated.
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Load().Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to inspect %s table: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+
+	_, err = db.Load().Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %v", column, table, err)
+	}
+	return nil
+}
+
 func updateIPRangesIfNeeded() error {
+	if isFollower() {
+		return syncFromPrimary(false)
+	}
+
 	lastUpdate, err := getLastUpdateDate()
 	if err != nil {
 		return fmt.Errorf("failed to get last update date: %v", err)
@@ -146,86 +745,172 @@ func updateIPRangesIfNeeded() error {
 		return nil
 	}
 
+	// With REFRESH_REQUIRE_PROMOTION the new data waits in the staging area
+	// for POST /admin/promote, unless there is nothing to serve yet.
+	if refreshRequirePromotion && activeDatasetID.Load() != 0 {
+		err = stageIPRanges(currentDate)
+		if err != nil {
+			return fmt.Errorf("failed to stage IP ranges: %v", err)
+		}
+		err = setLastUpdateDate(currentDate)
+		if err != nil {
+			return fmt.Errorf("failed to set last update date: %v", err)
+		}
+		return nil
+	}
+
+	if copyFromPeers(currentDate) {
+		err = setLastUpdateDate(currentDate)
+		if err != nil {
+			return fmt.Errorf("failed to set last update date: %v", err)
+		}
+		return nil
+	}
+
+	return reloadIPRanges(currentDate)
+}
+
+// reloadIPRanges unconditionally loads the upstream data as the dataset for date.
+func reloadIPRanges(date string) error {
+	if isFollower() {
+		return syncFromPrimary(true)
+	}
+
 	log.Println("Updating IP ranges data...")
-	err = updateIPRanges()
+	err := updateIPRanges(date)
 	if err != nil {
 		return fmt.Errorf("failed to update IP ranges: %v", err)
 	}
 
-	err = setLastUpdateDate(currentDate)
+	err = setLastUpdateDate(date)
 	if err != nil {
 		return fmt.Errorf("failed to set last update date: %v", err)
 	}
 
+	if err := maintainDatabase(); err != nil {
+		log.Printf("Error maintaining database: %v", err)
+	}
+
 	return nil
 }
 
-func updateIPRanges() error {
+// updateIPRanges loads the upstream data into a new dataset tagged with
+// version and makes it the active one.
+func updateIPRanges(version string) error {
 	log.Println("Downloading new IP ranges data...")
-	resp, err := http.Get(dataURL)
+	compressedFile, err := os.CreateTemp("", "ip_ranges_*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(compressedFile.Name())
+	defer compressedFile.Close()
+
+	d, err := downloadFile(dataURL, dataHeader, compressedFile)
 	if err != nil {
 		return fmt.Errorf("failed to download data: %v", err)
 	}
-	defer resp.Body.Close()
 
-	gzReader, err := gzip.NewReader(resp.Body)
+	return loadIPRangesFile(version, newProvenance(dataURL, d.validator), compressedFile, dataFormat, d.contentType)
+}
+
+// loadIPRangesFile loads a dataset file in the given format, see
+// insertDataset, into a new dataset tagged with version and provenance p and
+// makes it the active one.
+func loadIPRangesFile(version string, p Provenance, file *os.File, format, contentType string) error {
+	log.Println("Loading new data into database...")
+	tx, err := db.Load().Begin()
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %v", err)
+		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
-	defer gzReader.Close()
+	defer tx.Rollback()
 
-	tmpFile, err := os.CreateTemp("", "ip_ranges_*.json")
+	datasetID, err := insertDataset(tx, version, p, file, format, contentType)
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+		return err
+	}
+	previousID := activeDatasetID.Load()
+	diff, err := recordDatasetDiff(tx, previousID, datasetID)
+	if err != nil {
+		return err
+	}
+	err = activateDataset(tx, datasetID)
+	if err != nil {
+		return err
 	}
-	defer os.Remove(tmpFile.Name())
 
-	_, err = io.Copy(tmpFile, gzReader)
+	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("failed to write to temp file: %v", err)
+		return fmt.Errorf("failed to commit transaction: %v", err)
 	}
 
-	_, err = tmpFile.Seek(0, 0)
+	err = publishDataset(datasetID)
 	if err != nil {
-		return fmt.Errorf("failed to seek temp file: %v", err)
+		return err
+	}
+	if diff != nil {
+		sendWebhook("dataset.changed", diff)
+	}
+	if err := detectWatchChanges(previousID, datasetID); err != nil {
+		log.Printf("Error checking watches: %v", err)
+	}
+	if err := checkCoverageDrop(previousID, datasetID); err != nil {
+		log.Printf("Error checking coverage: %v", err)
 	}
 
-	log.Println("Loading new data into database...")
-	tx, err := db.Begin()
+	log.Printf("Database updated successfully, dataset %d is now active.", datasetID)
+	return nil
+}
+
+// insertDataset loads a dataset file, possibly gzipped, into a new, not yet
+// active, dataset and checks it for overlapping ranges. format names its
+// parser, or is empty to detect it, see datasetParsers.
+func insertDataset(tx *sql.Tx, version string, p Provenance, file *os.File, format, contentType string) (int64, error) {
+	f, cleanup, err := openDatasetFile(file)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %v", err)
+		return 0, err
 	}
-	defer tx.Rollback()
+	defer cleanup()
+	parser, err := detectDatasetParser(f, format, contentType)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Parsing the data as %s...", parser.name)
 
-	_, err = tx.Exec("DELETE FROM ip_ranges")
+	datasetID, err := createDataset(tx, version, p)
 	if err != nil {
-		return fmt.Errorf("failed to clear existing data: %v", err)
+		return 0, err
 	}
 
 	stmt, err := tx.Prepare(`
-		INSERT INTO ip_ranges (start_ip, end_ip, country_name, continent_name, as_name, as_domain, is_ipv6)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO ip_ranges (dataset_id, start_ip, end_ip, start_hi, start_lo, end_hi, end_lo, country, country_name, continent, continent_name, as_name, as_domain, is_ipv6, source, priority, is_anycast, countries, timezone, currency)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %v", err)
+		return 0, fmt.Errorf("failed to prepare statement: %v", err)
 	}
 	defer stmt.Close()
+	stmtV4, err := tx.Prepare(`
+		INSERT INTO ip_ranges_v4 (dataset_id, dataset_id_max, start_v4, end_v4, start_ip, end_ip)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmtV4.Close()
 
-	decoder := json.NewDecoder(tmpFile)
-	for decoder.More() {
-		var ipRange IPRange
-		if err := decoder.Decode(&ipRange); err != nil {
-			return fmt.Errorf("failed to decode JSON: %v", err)
-		}
-
+	var seq int64
+	sink := &rangeSink{budget: dataErrorBudget}
+	sink.insert = func(ipRange exportedRange) error {
 		startIP := net.ParseIP(ipRange.StartIP)
 		endIP := net.ParseIP(ipRange.EndIP)
 		if startIP == nil || endIP == nil {
-			log.Printf("Warning: Invalid IP range %s - %s", ipRange.StartIP, ipRange.EndIP)
-			continue
+			return &recordError{fmt.Errorf("invalid IP range %q - %q", ipRange.StartIP, ipRange.EndIP)}
 		}
 
 		isIPv6 := startIP.To4() == nil
+		if (endIP.To4() == nil) != isIPv6 {
+			return &recordError{fmt.Errorf("IP range %s - %s mixes IPv4 and IPv6", ipRange.StartIP, ipRange.EndIP)}
+		}
 		var startIPBytes, endIPBytes []byte
 		if isIPv6 {
 			startIPBytes = startIP.To16()
@@ -234,25 +919,65 @@ func updateIPRanges() error {
 			startIPBytes = startIP.To4()
 			endIPBytes = endIP.To4()
 		}
+		if bytes.Compare(startIPBytes, endIPBytes) > 0 {
+			return &recordError{fmt.Errorf("IP range %s - %s ends before it starts", ipRange.StartIP, ipRange.EndIP)}
+		}
+
+		normalizeCountry(&ipRange.IPRange)
 
-		_, err = stmt.Exec(startIPBytes, endIPBytes, ipRange.CountryName, ipRange.ContinentName, ipRange.ASName, ipRange.ASDomain, isIPv6)
+		seq++
+		priority := rangePriority(startIPBytes, endIPBytes, ipRange.Source, seq)
+		if ipRange.Priority != nil {
+			priority = *ipRange.Priority
+		}
+
+		// Multi-country ranges are announced from several locations, which is
+		// what anycast looks like from a geolocation point of view.
+		isAnycast := ipRange.IsAnycast || len(ipRange.Countries) > 1
+		countries := strings.Join(ipRange.Countries, ",")
+
+		startHi, startLo := ipIntegers(startIPBytes)
+		endHi, endLo := ipIntegers(endIPBytes)
+		_, err := stmt.Exec(datasetID, startIPBytes, endIPBytes, startHi, startLo, endHi, endLo, ipRange.Country, ipRange.CountryName, ipRange.Continent, ipRange.ContinentName, ipRange.ASName, ipRange.ASDomain, isIPv6, ipRange.Source, priority, isAnycast, countries, ipRange.Timezone, ipRange.Currency)
 		if err != nil {
 			return fmt.Errorf("failed to insert data: %v", err)
 		}
+		if !isIPv6 {
+			_, err = stmtV4.Exec(datasetID, datasetID, v4Coordinate(startIPBytes), v4Coordinate(endIPBytes), startIPBytes, endIPBytes)
+			if err != nil {
+				return fmt.Errorf("failed to index data: %v", err)
+			}
+		}
+		return nil
+	}
+	err = parser.parse(f, sink)
+	if err == nil {
+		err = sink.finish()
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE datasets SET skipped_rows = ? WHERE id = ?", sink.skipped, datasetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record skipped rows: %v", err)
 	}
 
-	err = tx.Commit()
+	log.Println("Checking for overlapping ranges...")
+	err = detectConflicts(tx, datasetID)
 	if err != nil {
-		return fmt.Errorf("failed to commit transaction: %v", err)
+		return 0, fmt.Errorf("failed to detect conflicts: %v", err)
 	}
 
-	log.Println("Database updated successfully.")
-	return nil
+	err = finishDataset(tx, datasetID)
+	if err != nil {
+		return 0, err
+	}
+	return datasetID, nil
 }
 
 func getLastUpdateDate() (string, error) {
 	var lastUpdateStr string
-	err := db.QueryRow("SELECT value FROM metadata WHERE key = 'last_update_date'").Scan(&lastUpdateStr)
+	err := db.Load().QueryRow("SELECT value FROM metadata WHERE key = 'last_update_date'").Scan(&lastUpdateStr)
 	if err == sql.ErrNoRows {
 		return "", nil // Return empty string if no update has been performed yet
 	} else if err != nil {
@@ -262,72 +987,259 @@ func getLastUpdateDate() (string, error) {
 }
 
 func setLastUpdateDate(date string) error {
-	_, err := db.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('last_update_date', ?)", date)
+	_, err := db.Load().Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('last_update_date', ?)", date)
 	return err
 }
 
+// datasetVersion returns the version of the dataset currently being served.
+func datasetVersion() string {
+	v, _ := currentDatasetVersion.Load().(string)
+	return v
+}
+
 func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkFormat(w, r) {
+		return
+	}
+
 	vars := mux.Vars(r)
 	ipStr := vars["ip"]
 
-	info, err := lookupIP(ipStr)
+	r, ok := withHistoricalDataset(w, r)
+	if !ok {
+		return
+	}
+
+	info, err := lookupForRequest(r, ipStr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeLookupError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(info)
+	writeInfo(w, r, info)
 }
 
 func autoDetectHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkFormat(w, r) {
+		return
+	}
+
 	ip := getClientIP(r)
+	var client *ClientDetection
+	if wantsVerbose(r) {
+		client = newClientDetection(r)
+	}
 
-	info, err := lookupIP(ip)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	info, err := lookupForRequest(r, ip)
+	if err != nil && client != nil {
+		writeVerboseLookupError(w, r, err, client)
+		return
+	} else if err != nil {
+		writeLookupError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(info)
+	info.Client = client
+	writeInfo(w, r, info)
 }
 
-func lookupIP(ipStr string) (*IPInfo, error) {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return nil, fmt.Errorf("Invalid IP address")
+// writeInfo applies the per-request enrichments to info and writes it out.
+func writeInfo(w http.ResponseWriter, r *http.Request, info *IPInfo) {
+	decorateInfo(w, r, info)
+	w.Header().Add("Vary", "Accept")
+	switch format := responseFormat(r); format {
+	case formatGeoJSON:
+		writeGeoJSON(w, geoJSONFeature(visibleCountry(r, info), visibleInfo(r, info)))
+	case formatXML, formatMsgpack:
+		writeFormatted(w, http.StatusOK, format, visibleInfo(r, info), "lookup", "")
+	default:
+		w.Header().Set("Content-Type", formatContentTypes[formatJSON])
+		json.NewEncoder(w).Encode(visibleInfo(r, info))
 	}
+}
 
-	isIPv6 := ip.To4() == nil
-	var ipBytes []byte
-	if isIPv6 {
-		ipBytes = ip.To16()
-	} else {
-		ipBytes = ip.To4()
+// decorateInfo applies the enrichments that depend on the request rather
+// than on the dataset.
+func decorateInfo(w http.ResponseWriter, r *http.Request, info *IPInfo) {
+	localize(w, r, info)
+	if wantsExtended(r) {
+		applyExtendedFields(info)
+	}
+	if wantsReverseDNS(r) {
+		info.Hostname = reverseLookup(r.Context(), info.IP)
 	}
+}
 
-	var info IPInfo
-	err := db.QueryRow(`
-		SELECT ?, country_name, continent_name, as_name, as_domain
-		FROM ip_ranges
-		WHERE ? BETWEEN start_ip AND end_ip AND is_ipv6 = ?
-		LIMIT 1
-	`, ipStr, ipBytes, isIPv6).Scan(&info.IP, &info.CountryName, &info.ContinentName, &info.ASName, &info.ASDomain)
+// loadLookupConfig reads the settings lookupIP depends on, which the server
+// and the enrich command share.
+func loadLookupConfig() error {
+	var err error
+	if path := os.Getenv("COUNTRY_METADATA_FILE"); path != "" {
+		countryMetadata, err = loadCountryMetadata(path)
+		if err != nil {
+			return fmt.Errorf("failed to load country metadata: %v", err)
+		}
+		log.Printf("Loaded metadata for %d countries from %s", len(countryMetadata), path)
+	}
 
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("IP not found in any range")
-	} else if err != nil {
-		log.Println("Database query error:", err)
-		return nil, fmt.Errorf("Internal server error")
+	if path := os.Getenv("OVERRIDES_FILE"); path != "" {
+		fileOverrides, err = loadOverridesFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load overrides: %v", err)
+		}
+		log.Printf("Loaded %d overrides from %s", len(fileOverrides), path)
 	}
 
-	return &info, nil
+	resolveTunneledIPv4 = envBool("RESOLVE_TUNNELED_IPV4", true)
+	sanctionedCountries = parseCountryList(os.Getenv("SANCTIONED_COUNTRIES"))
+	countryGroups, err = parseCountryGroups(os.Getenv("COUNTRY_GROUPS"))
+	if err != nil {
+		return fmt.Errorf("invalid COUNTRY_GROUPS: %v", err)
+	}
+
+	if path := os.Getenv("RULES_FILE"); path != "" {
+		lookupRules, err = loadRules(path)
+		if err != nil {
+			return fmt.Errorf("failed to load rules: %v", err)
+		}
+		log.Printf("Loaded %d rules from %s", len(lookupRules.rules), path)
+	}
+
+	if path := os.Getenv("PINNED_RESPONSES_FILE"); path != "" {
+		pinnedResponses, err = loadPinnedResponses(path)
+		if err != nil {
+			return fmt.Errorf("failed to load pinned responses: %v", err)
+		}
+		log.Printf("Warning: %d IPs or CIDRs of %s get pinned responses, whatever the dataset says", len(pinnedResponses), path)
+	}
+	return nil
 }
 
-func getClientIP(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip != "" {
-		return strings.TrimSpace(strings.Split(ip, ",")[0])
+func lookupIP(ctx context.Context, ipStr string) (*IPInfo, error) {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil || addr.Zone() != "" {
+		return nil, errInvalidIP
+	}
+	// IPv4-mapped IPv6 addresses are looked up as IPv4, like net.IP.To4.
+	addr = addr.Unmap()
+	ipBytes := addr.AsSlice()
+	if p := matchPinned(ipBytes); p != nil {
+		info := p.info(ipStr)
+		recordCountryTraffic(ctx, info)
+		return info, nil
+	}
+	if v4, kind, ok := tunneledIPv4(addr); ok && resolveTunneledIPv4 {
+		return lookupTunneled(ctx, ipStr, v4, kind)
+	}
+
+	// The caches and the degraded fallback only hold the active dataset, so
+	// historical lookups go straight to SQLite. With the memory engine the
+	// active dataset is answered from its snapshot, which needs neither.
+	historical := datasetFromContext(ctx)
+	snapshot := activeSnapshot()
+	store, datasetID := rangeStore, activeDatasetID.Load()
+	switch {
+	case historical != nil:
+		store, datasetID = sqliteStore, historical.ID
+	case snapshot != nil:
+		store, datasetID = snapshot, snapshot.datasetID
+	}
+	cached := historical == nil && snapshot == nil
+	persist := !doNotPersist(ctx)
+
+	override := matchOverride(net.IP(ipBytes))
+	if override == nil && cached && isNegativelyCached(addr) {
+		return nil, errNotFound
 	}
-	ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-	return ip
+
+	var r *RangeRecord
+	shortCircuited := false
+	switch {
+	case cached && !allowDBQuery():
+		// The database keeps failing, so it isn't even asked.
+		shortCircuited = true
+		if persist {
+			lookupsShortCircuited.Add(1)
+		}
+		r, err = fallbackLookup(ctx, addr, ipBytes)
+	case cached:
+		r, err = lookupWithinBudget(ctx, store, datasetID, ipBytes)
+		recordDBQuery(ctx, err)
+	default:
+		r, err = store.Lookup(ctx, datasetID, ipBytes)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Printf("[%s] Lookup timed out: %v", requestID(ctx), err)
+		return nil, errTimeout
+	}
+	if errors.Is(err, errOverBudget) {
+		r, err = fallbackLookup(ctx, addr, ipBytes)
+	}
+	if err != nil && !errors.Is(err, errNotFound) && ctx.Err() == nil && cached && !shortCircuited {
+		log.Printf("[%s] Database query error: %v", requestID(ctx), err)
+		scheduleDBRepair()
+		r, err = degradedLookup(ctx, addr, ipBytes)
+	}
+	fromDataset := err == nil
+	if errors.Is(err, errNotFound) && override != nil {
+		// The override alone is the answer.
+		start, end := networkRange(override.network)
+		r, err = &RangeRecord{StartIP: start, EndIP: end}, nil
+	} else if errors.Is(err, errNotFound) {
+		if cached && persist {
+			cacheNotFound(addr)
+		}
+		return nil, errNotFound
+	} else if errors.Is(err, errUnavailable) {
+		return nil, err
+	} else if err != nil {
+		log.Printf("[%s] Database query error: %v", requestID(ctx), err)
+		return nil, errInternal
+	}
+	if cached && persist {
+		cacheLastGood(addr, r)
+	}
+
+	info := IPInfo{
+		IP:            ipStr,
+		Country:       r.Country,
+		CountryName:   r.CountryName,
+		Continent:     r.Continent,
+		ContinentName: r.ContinentName,
+		ASName:        r.ASName,
+		ASDomain:      r.ASDomain,
+		IsAnycast:     r.IsAnycast,
+		Countries:     r.Countries,
+		Timezone:      r.Timezone,
+		Currency:      r.Currency,
+		Range:         newMatchedRange(r.StartIP, r.EndIP),
+	}
+	info.Confidence = 100
+	if fromDataset {
+		info.Source = rangeSource(datasetID, r)
+		info.Confidence = rangeConfidence(r)
+	}
+	if override != nil {
+		applyOverride(&info, r, override)
+	}
+
+	// Fall back to the supplemental mapping for whatever the dataset didn't provide.
+	if meta, ok := countryMetadata[info.Country]; ok {
+		if info.Timezone == "" {
+			info.Timezone = meta.Timezone
+		}
+		if info.Currency == "" {
+			info.Currency = meta.Currency
+		}
+	}
+
+	applyISOCodes(&info)
+	applyResolution(&info)
+	applyCountryFlags(&info)
+	applyNetworkFlags(&info, ipBytes)
+	applyASN(&info, ipBytes)
+	applyRules(&info)
+
+	recordCountryTraffic(ctx, &info)
+	return &info, nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Every refresh writes a whole dataset and deletes an old one, which leaves
+// free pages scattered through the file. SQLite reuses them, but the file
+// never shrinks and the query planner's statistics go stale, so the database
+// is analyzed after every reload and vacuumed once enough of it is free.
+
+// DatabaseStatus is the state of the SQLite file reported by /admin/status.
+type DatabaseStatus struct {
+	Path               string         `json:"path"`
+	ReadOnly           bool           `json:"read_only"`
+	SchemaVersion      int            `json:"schema_version"`
+	SizeBytes          int64          `json:"size_bytes"`
+	FreeBytes          int64          `json:"free_bytes"`
+	MaxSizeBytes       int64          `json:"max_size_bytes,omitempty"`
+	LastVacuumAt       *time.Time     `json:"last_vacuum_at,omitempty"`
+	LastAnalyzeAt      *time.Time     `json:"last_analyze_at,omitempty"`
+	IntegrityCheckedAt *time.Time     `json:"integrity_checked_at,omitempty"`
+	IntegrityOK        *bool          `json:"integrity_ok,omitempty"`
+	Breaker            *BreakerStatus `json:"breaker,omitempty"`
+}
+
+var (
+	dbVacuumEnabled   bool
+	dbVacuumFreeRatio float64
+	dbIntegrityCheck  bool
+	dbMaxSize         int64
+
+	dbStatusMu sync.Mutex
+	dbStatus   DatabaseStatus
+)
+
+func loadMaintenanceConfig() {
+	dbVacuumEnabled = envBool("DB_VACUUM", true)
+	dbVacuumFreeRatio = envFloat("DB_VACUUM_FREE_RATIO", 0.25)
+	dbIntegrityCheck = envBool("DB_INTEGRITY_CHECK", true)
+	dbMaxSize = int64(envInt("DB_MAX_SIZE_MB", 0)) << 20
+}
+
+// databaseSize returns the size of the database and how much of it is free
+// pages.
+func databaseSize() (int64, int64, error) {
+	var pageSize, pages, free int64
+	for pragma, v := range map[string]*int64{"page_size": &pageSize, "page_count": &pages, "freelist_count": &free} {
+		if err := db.Load().QueryRow("PRAGMA " + pragma).Scan(v); err != nil {
+			return 0, 0, fmt.Errorf("failed to read %s: %v", pragma, err)
+		}
+	}
+	return pages * pageSize, free * pageSize, nil
+}
+
+// maintainDatabase runs after every reload: it updates the statistics the
+// query planner uses, vacuums when at least DB_VACUUM_FREE_RATIO of the file
+// is free pages, and checks the size against DB_MAX_SIZE_MB.
+func maintainDatabase() error {
+	if _, err := db.Load().Exec("ANALYZE"); err != nil {
+		return fmt.Errorf("failed to analyze database: %v", err)
+	}
+	now := time.Now().UTC()
+	dbStatusMu.Lock()
+	dbStatus.LastAnalyzeAt = &now
+	dbStatusMu.Unlock()
+
+	size, free, err := databaseSize()
+	if err != nil {
+		return err
+	}
+	if dbVacuumEnabled && size > 0 && float64(free)/float64(size) >= dbVacuumFreeRatio {
+		log.Printf("Vacuuming database, %.0f%% of %d MB is free...", 100*float64(free)/float64(size), size>>20)
+		start := time.Now()
+		if _, err := db.Load().Exec("VACUUM"); err != nil {
+			return fmt.Errorf("failed to vacuum database: %v", err)
+		}
+		now := time.Now().UTC()
+		dbStatusMu.Lock()
+		dbStatus.LastVacuumAt = &now
+		dbStatusMu.Unlock()
+		log.Printf("Vacuumed database in %s", time.Since(start).Round(time.Millisecond))
+	}
+	return checkDatabaseSize()
+}
+
+// checkDatabaseSize alerts through the log and the webhook when the database
+// is larger than DB_MAX_SIZE_MB.
+func checkDatabaseSize() error {
+	size, free, err := databaseSize()
+	if err != nil {
+		return err
+	}
+	dbStatusMu.Lock()
+	dbStatus.SizeBytes = size
+	dbStatus.FreeBytes = free
+	dbStatus.MaxSizeBytes = dbMaxSize
+	dbStatusMu.Unlock()
+
+	if dbMaxSize > 0 && size > dbMaxSize {
+		log.Printf("Warning: database is %d MB, more than DB_MAX_SIZE_MB (%d MB)", size>>20, dbMaxSize>>20)
+		sendWebhook("database.size_exceeded", map[string]interface{}{
+			"size_bytes":     size,
+			"free_bytes":     free,
+			"max_size_bytes": dbMaxSize,
+		})
+	}
+	return nil
+}
+
+func recordIntegrityCheck(ok bool) {
+	now := time.Now().UTC()
+	dbStatusMu.Lock()
+	dbStatus.IntegrityCheckedAt = &now
+	dbStatus.IntegrityOK = &ok
+	dbStatusMu.Unlock()
+}
+
+// checkDatabaseAtStartup runs the full integrity check, repairing or
+// reloading the dataset from upstream when the database is corrupted.
+func checkDatabaseAtStartup() {
+	if dbIntegrityCheck {
+		log.Println("Checking database integrity...")
+		if err := repairDatabase("integrity_check"); err != nil {
+			log.Printf("Error repairing database: %v", err)
+		}
+	}
+	if err := checkDatabaseSize(); err != nil {
+		log.Printf("Error checking database size: %v", err)
+	}
+}
+
+func currentDatabaseStatus() DatabaseStatus {
+	dbStatusMu.Lock()
+	defer dbStatusMu.Unlock()
+	return dbStatus
+}
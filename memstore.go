@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// memoryRange is a range read for a memoryRangeStore or the bolt engine.
+type memoryRange struct {
+	record   RangeRecord
+	priority int64
+	seq      int
+}
+
+// memoryRangeStore holds one dataset in memory as the segments of
+// flattenRanges, which don't overlap, so a lookup is one binary search. IPv4
+// segments are partitioned by their first octet and split where they cross
+// into the next /8, so a lookup only searches the segments of its /8, which
+// matters for city-level datasets with millions of them. The pieces of a
+// split segment share its range. A new dataset changes every partition, so
+// the store is built and swapped as a whole.
+type memoryRangeStore struct {
+	datasetID int64
+	v4        [256][]rangeSegment
+	v6        []rangeSegment
+	// ranges is the number of ranges loaded.
+	ranges int
+}
+
+// loadMemoryRangeStore reads the ranges of a dataset into memory.
+func loadMemoryRangeStore(datasetID int64) (*memoryRangeStore, error) {
+	s := &memoryRangeStore{datasetID: datasetID}
+	v4, err := loadMemoryRanges(datasetID, false)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := loadMemoryRanges(datasetID, true)
+	if err != nil {
+		return nil, err
+	}
+	s.ranges = len(v4) + len(v6)
+
+	for _, seg := range flattenRanges(v4) {
+		for octet := int(seg.start[0]); octet <= int(seg.end[0]); octet++ {
+			piece := seg
+			if octet > int(seg.start[0]) {
+				piece.start = []byte{byte(octet), 0, 0, 0}
+			}
+			if octet < int(seg.end[0]) {
+				piece.end = []byte{byte(octet), 0xff, 0xff, 0xff}
+			}
+			s.v4[octet] = append(s.v4[octet], piece)
+		}
+	}
+	s.v6 = flattenRanges(v6)
+	return s, nil
+}
+
+func loadMemoryRanges(datasetID int64, isIPv6 bool) ([]memoryRange, error) {
+	rows, err := db.Load().Query(`
+		SELECT start_ip, end_ip, country, country_name, continent, continent_name, as_name, as_domain, is_anycast, countries, timezone, currency, COALESCE(source, ''), priority
+		FROM ip_ranges
+		WHERE dataset_id = ? AND is_ipv6 = ?
+		ORDER BY rowid
+	`, datasetID, isIPv6)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ranges: %v", err)
+	}
+	defer rows.Close()
+
+	var ranges []memoryRange
+	for rows.Next() {
+		var m memoryRange
+		var countries string
+		err := rows.Scan(&m.record.StartIP, &m.record.EndIP, &m.record.Country, &m.record.CountryName, &m.record.Continent, &m.record.ContinentName, &m.record.ASName, &m.record.ASDomain, &m.record.IsAnycast, &countries, &m.record.Timezone, &m.record.Currency, &m.record.Source, &m.priority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read range: %v", err)
+		}
+		if countries != "" {
+			m.record.Countries = strings.Split(countries, ",")
+		}
+		m.seq = len(ranges)
+		ranges = append(ranges, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read ranges: %v", err)
+	}
+
+	return ranges, nil
+}
+
+func (s *memoryRangeStore) Lookup(ctx context.Context, datasetID int64, ip []byte) (*RangeRecord, error) {
+	if datasetID != s.datasetID {
+		return nil, fmt.Errorf("dataset %d is not in memory, dataset %d is", datasetID, s.datasetID)
+	}
+
+	segments := s.v6
+	if len(ip) == 4 {
+		segments = s.v4[ip[0]]
+	}
+
+	// The first segment ending at or after ip is the only one that can
+	// contain it.
+	i := sort.Search(len(segments), func(i int) bool {
+		return bytes.Compare(segments[i].end, ip) >= 0
+	})
+	if i == len(segments) || bytes.Compare(segments[i].start, ip) > 0 {
+		return nil, errNotFound
+	}
+
+	return segments[i].record, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// routeMethods are the methods tried against the routes to build the Allow
+// header.
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// allowedMethods returns the methods router serves for the path of req,
+// including OPTIONS, or nil when no route has the path.
+func allowedMethods(router *mux.Router, req *http.Request) []string {
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := req.Clone(req.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return append(allowed, http.MethodOptions)
+}
+
+// methodNotAllowedHandler answers requests whose path exists but not with
+// their method. OPTIONS gets the Allow header and no body, anything else a
+// 405 with the Allow header, where gorilla would reply with an empty 405.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r)
+		if allowed == nil {
+			notFoundHandler(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Method "+r.Method+" is not allowed, use "+strings.Join(allowed, ", "))
+	})
+}
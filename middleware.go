@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds incoming request IDs so a caller can't make us
+// echo arbitrarily large headers or flood the logs.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware reuses the caller's X-Request-ID (so a request can be
+// followed across the proxy chain) or generates a new one, and echoes it back
+// on the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID assigned to the request carried by ctx.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequest logs a message prefixed with the ID of the request r.
+func logRequest(r *http.Request, format string, args ...interface{}) {
+	log.Printf("[%s] %s", requestID(r.Context()), fmt.Sprintf(format, args...))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Hijack is needed for WebSocket upgrades, which don't use
+// http.ResponseController.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	s.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(s.ResponseWriter).Hijack()
+}
+
+// accessLogMiddleware logs one line per request. It must run inside
+// requestIDMiddleware so the line carries the request ID.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if doNotPersist(r.Context()) {
+			return
+		}
+		logRequest(r, "%s %s %d %s %s", r.Method, r.URL.Path, rec.status, accessLogAnonymize.apply(getClientIP(r)), time.Since(start))
+	})
+}
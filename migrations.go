@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Changes to the schema, like new columns, ship as SQL files in migrations/,
+// named after their version: 0002_add_city.sql. At startup the migrations
+// newer than the schema_version of the metadata table are applied in order,
+// each in a transaction with the version it brings the database to, so an
+// upgrade neither needs manual changes to the database nor a reload of the
+// data.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a file of migrations/.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations are sorted by version, which runs from 1 without gaps.
+var migrations = mustLoadMigrations()
+
+// migrationSteps are the parts of migrations SQL can't express, by version.
+// They run after the file, in its transaction.
+var migrationSteps = map[int]func(tx *sql.Tx) error{
+	3: fillRangeIntegers,
+}
+
+func mustLoadMigrations() []migration {
+	list, err := loadMigrations()
+	if err != nil {
+		panic(err)
+	}
+	return list
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var list []migration
+	for _, e := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration name %s, expected NNNN_name.sql", e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{version: version, name: name, sql: string(b)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].version < list[j].version
+	})
+	for i, m := range list {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+	return list, nil
+}
+
+// latestSchemaVersion is the version of the schema this server migrates to.
+func latestSchemaVersion() int {
+	return len(migrations)
+}
+
+// schemaVersion returns the version of the schema of conn, 0 for databases
+// that predate migrations.
+func schemaVersion(conn *sql.DB) (int, error) {
+	var v string
+	err := conn.QueryRow("SELECT value FROM metadata WHERE key = 'schema_version'").Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", v)
+	}
+	return version, nil
+}
+
+// migrateDatabase applies the migrations the database doesn't have yet. A
+// database migrated by a newer server is left alone, as migrations only add
+// to the schema or drop indexes older servers create again.
+func migrateDatabase() error {
+	version, err := schemaVersion(db.Load())
+	if err != nil {
+		return err
+	}
+	latest := latestSchemaVersion()
+	switch {
+	case version > latest:
+		log.Printf("Database schema version %d is newer than this server's %d, continuing", version, latest)
+		return nil
+	case version == latest:
+		return nil
+	case dbReadOnly:
+		return fmt.Errorf("database schema version %d is older than %d, start once without DB_READ_ONLY to migrate it", version, latest)
+	}
+
+	for _, m := range migrations[version:] {
+		err := applyMigration(m)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied schema migration %d (%s)", m.version, m.name)
+	}
+	return nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(m.sql)
+	if err != nil {
+		return fmt.Errorf("failed to apply schema migration %d (%s): %v", m.version, m.name, err)
+	}
+	if step, ok := migrationSteps[m.version]; ok {
+		err = step(tx)
+		if err != nil {
+			return fmt.Errorf("failed to apply schema migration %d (%s): %v", m.version, m.name, err)
+		}
+	}
+	_, err = tx.Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES ('schema_version', ?)", strconv.Itoa(m.version))
+	if err != nil {
+		return fmt.Errorf("failed to set schema version: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
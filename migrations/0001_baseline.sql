@@ -0,0 +1,3 @@
+-- The tables of the baseline schema are created by the server before
+-- migrations run, so databases created before schema versions existed and
+-- new ones both start from here. Later migrations change them.
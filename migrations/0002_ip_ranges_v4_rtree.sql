@@ -0,0 +1,39 @@
+-- IPv4 lookups are answered from an R*Tree of the ranges, indexed by
+-- dataset and by the range's addresses as integers, so finding the ranges
+-- containing an address is a search of the tree instead of a scan of the
+-- ranges starting before it. rtree_i32 stores 32-bit signed coordinates, so
+-- the addresses are shifted by 2^31. The addresses are kept as they are in
+-- ip_ranges too, which lookups join on: the rowids of ip_ranges change when
+-- the database is vacuumed.
+CREATE VIRTUAL TABLE ip_ranges_v4 USING rtree_i32(
+	id,
+	dataset_id, dataset_id_max,
+	start_v4, end_v4,
+	+start_ip BLOB,
+	+end_ip BLOB
+);
+
+-- The server adds the ranges of new datasets, those already loaded are
+-- added here. hex() turns the 4 bytes of an address into 8 hex digits,
+-- each shifted into place.
+INSERT INTO ip_ranges_v4 (dataset_id, dataset_id_max, start_v4, end_v4, start_ip, end_ip)
+SELECT dataset_id, dataset_id,
+	(((instr('0123456789ABCDEF', substr(hex(start_ip), 1, 1)) - 1) << 28)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 2, 1)) - 1) << 24)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 3, 1)) - 1) << 20)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 4, 1)) - 1) << 16)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 5, 1)) - 1) << 12)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 6, 1)) - 1) << 8)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 7, 1)) - 1) << 4)
+	| ((instr('0123456789ABCDEF', substr(hex(start_ip), 8, 1)) - 1) << 0)) - 2147483648,
+	(((instr('0123456789ABCDEF', substr(hex(end_ip), 1, 1)) - 1) << 28)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 2, 1)) - 1) << 24)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 3, 1)) - 1) << 20)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 4, 1)) - 1) << 16)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 5, 1)) - 1) << 12)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 6, 1)) - 1) << 8)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 7, 1)) - 1) << 4)
+	| ((instr('0123456789ABCDEF', substr(hex(end_ip), 8, 1)) - 1) << 0)) - 2147483648,
+	start_ip, end_ip
+FROM ip_ranges
+WHERE dataset_id IS NOT NULL AND is_ipv6 = 0 AND length(start_ip) = 4 AND length(end_ip) = 4;
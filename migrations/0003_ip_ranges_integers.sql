@@ -0,0 +1,11 @@
+-- The addresses of ranges are also stored as integers, compared numerically
+-- instead of as bytes: an IPv4 address in the _lo column with 0 in the _hi
+-- one, and an IPv6 address as its two 64-bit halves, each with its top bit
+-- flipped so that signed integers order like the addresses. The server fills
+-- them for the ranges already loaded after this file.
+ALTER TABLE ip_ranges ADD COLUMN start_hi INTEGER;
+ALTER TABLE ip_ranges ADD COLUMN start_lo INTEGER;
+ALTER TABLE ip_ranges ADD COLUMN end_hi INTEGER;
+ALTER TABLE ip_ranges ADD COLUMN end_lo INTEGER;
+
+CREATE INDEX idx_ip_range_dataset_int ON ip_ranges (dataset_id, is_ipv6, start_hi, start_lo);
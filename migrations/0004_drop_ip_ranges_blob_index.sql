@@ -0,0 +1,5 @@
+-- Ranges are compared on their integer addresses, so the index on the
+-- addresses as bytes isn't used by any query anymore and only slows down
+-- loads. The columns stay: the memory and bolt engines, exports and answers
+-- read the addresses as bytes. An older server creates the index again.
+DROP INDEX IF EXISTS idx_ip_range_dataset;
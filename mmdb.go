@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+)
+
+// MaxMind DB files, the format of GeoLite2 and of the mmdb downloads of
+// ipinfo and others, are a binary tree over the bits of the address whose
+// leaves point at records in a data section. Walking the whole tree yields
+// every network with its record, which is all loading a dataset needs, so the
+// format is read here rather than with a reader library built for lookups.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMetadataMaxSize is how far from the end of the file the metadata
+// starts at most.
+const mmdbMetadataMaxSize = 128 << 10
+
+// Data section types.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+func isMMDB(f *datasetFile) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	n := min(fi.Size(), mmdbMetadataMaxSize)
+	tail := make([]byte, n)
+	if _, err := f.ReadAt(tail, fi.Size()-n); err != nil {
+		return false
+	}
+	return bytes.Contains(tail, mmdbMetadataMarker)
+}
+
+// parseMMDBRanges reads every network of a MaxMind DB file. Records in the
+// ipinfo layout (country, as_name, ... at the top level) and in the GeoLite2
+// one (country.iso_code, autonomous_system_organization, ...) are understood.
+func parseMMDBRanges(f *datasetFile, sink *rangeSink) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat temp file: %v", err)
+	}
+	buf := make([]byte, fi.Size())
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("failed to read temp file: %v", err)
+	}
+	db, err := openMMDB(buf)
+	if err != nil {
+		return err
+	}
+
+	// Many networks share a record, so each one is only decoded once.
+	records := map[uint]IPRange{}
+	sink.unit = "network"
+	var n int64
+	return db.networks(func(network *net.IPNet, offset uint) error {
+		n++
+		r, ok := records[offset]
+		if !ok {
+			record, _, err := db.data.decode(offset)
+			if err != nil {
+				return sink.skip(n, fmt.Errorf("invalid record for %s: %v", network, err))
+			}
+			r = mmdbRange(record)
+			records[offset] = r
+		}
+		start, end := networkRange(network)
+		r.StartIP, r.EndIP = net.IP(start).String(), net.IP(end).String()
+		return sink.add(n, exportedRange{IPRange: r})
+	})
+}
+
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+}
+
+func openMMDB(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file")
+	}
+	metadata, _, err := mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %v", err)
+	}
+	m, _ := metadata.(map[string]interface{})
+	uintField := func(name string) uint {
+		v, _ := m[name].(uint64)
+		return uint(v)
+	}
+
+	r := &mmdbReader{
+		nodeCount:  uintField("node_count"),
+		recordSize: uintField("record_size"),
+		ipVersion:  uintField("ip_version"),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind DB IP version %d", r.ipVersion)
+	}
+	// The data section follows the tree and 16 zero bytes.
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("invalid MaxMind DB node count %d", r.nodeCount)
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf[treeSize+16 : i]}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// networks calls fn with every network that has a record, and the offset of
+// the record in the data section. IPv6 trees map IPv4 to ::/96 and alias it
+// elsewhere (::ffff:0:0/96, 2002::/16), so IPv4 networks are only reported
+// once, as IPv4.
+func (r *mmdbReader) networks(fn func(network *net.IPNet, offset uint) error) error {
+	bits := 32
+	ipv4Node := uint(0)
+	if r.ipVersion == 6 {
+		bits = 128
+		for depth := 0; depth < 96 && ipv4Node < r.nodeCount; depth++ {
+			ipv4Node = r.record(ipv4Node, 0)
+		}
+	}
+
+	var walk func(node uint, ip [16]byte, depth int) error
+	walk = func(node uint, ip [16]byte, depth int) error {
+		if depth >= bits {
+			return fmt.Errorf("invalid MaxMind DB search tree")
+		}
+		for bit := uint(0); bit < 2; bit++ {
+			if bit == 1 {
+				ip[depth/8] |= 0x80 >> (depth % 8)
+			}
+			record := r.record(node, bit)
+			switch {
+			case record < r.nodeCount:
+				if r.ipVersion == 6 && record == ipv4Node && (depth+1 != 96 || !isZero(ip[:12])) {
+					continue
+				}
+				if err := walk(record, ip, depth+1); err != nil {
+					return err
+				}
+			case record == r.nodeCount:
+				// No data for this network.
+			default:
+				offset := record - r.nodeCount - 16
+				network := &net.IPNet{IP: net.IP(ip[:bits/8]), Mask: net.CIDRMask(depth+1, bits)}
+				if bits == 128 && depth+1 >= 96 && isZero(ip[:12]) {
+					network = &net.IPNet{IP: net.IP(ip[12:16]), Mask: net.CIDRMask(depth+1-96, 32)}
+				}
+				if err := fn(network, offset); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(0, [16]byte{}, 0)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mmdbDecoder decodes values of a data section, which pointers are relative
+// to.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode returns the value at offset and the offset following it.
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d mmdbDecoder) decodeDepth(offset uint, depth int) (interface{}, uint, error) {
+	// Maps and arrays nest, and pointers can loop in a corrupt file.
+	if depth > 64 {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, fmt.Errorf("offset %d out of range", offset)
+	}
+	ctrl := d.buf[offset]
+	offset++
+	kind := uint(ctrl >> 5)
+
+	if kind == mmdbPointer {
+		b, err := d.bytes(offset, uint(ctrl>>3&3)+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		next := offset + uint(len(b))
+		v := uint(ctrl & 7)
+		var target uint
+		switch len(b) {
+		case 1:
+			target = v<<8 | uint(b[0])
+		case 2:
+			target = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			target = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decodeDepth(target, depth+1)
+		return value, next, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, fmt.Errorf("offset %d out of range", offset)
+		}
+		kind = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := d.bytes(offset, size-28)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += uint(len(b))
+		var n uint
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[size-29] + n
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]interface{}, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at %d is not a string", offset)
+			}
+			value, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbEndMarker, mmdbContainer:
+		return nil, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		// Shorter values are sign extended from their first byte.
+		if size > 0 && size < 4 && b[0]&0x80 != 0 {
+			n |= ^uint32(0) << (8 * size)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+func (d mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, fmt.Errorf("offset %d out of range", offset+n)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// mmdbRange maps a record to the fields of a range.
+func mmdbRange(record interface{}) IPRange {
+	var r IPRange
+	r.Country = mmdbStringAt(record, "country")
+	r.CountryName = mmdbStringAt(record, "country_name")
+	r.Continent = mmdbStringAt(record, "continent")
+	r.ContinentName = mmdbStringAt(record, "continent_name")
+	r.ASN = mmdbStringAt(record, "asn")
+	r.ASName = mmdbStringAt(record, "as_name")
+	r.ASDomain = mmdbStringAt(record, "as_domain")
+	r.Timezone = mmdbStringAt(record, "timezone")
+
+	// GeoLite2 nests the names, and IPs only registered to a country have
+	// no country of their own.
+	country := "country"
+	if _, ok := mmdbValueAt(record, country).(map[string]interface{}); !ok {
+		country = "registered_country"
+	}
+	if r.Country == "" {
+		r.Country = mmdbStringAt(record, country, "iso_code")
+	}
+	if r.CountryName == "" {
+		r.CountryName = mmdbStringAt(record, country, "names", "en")
+	}
+	if r.Continent == "" {
+		r.Continent = mmdbStringAt(record, "continent", "code")
+	}
+	if r.ContinentName == "" {
+		r.ContinentName = mmdbStringAt(record, "continent", "names", "en")
+	}
+	if r.Timezone == "" {
+		r.Timezone = mmdbStringAt(record, "location", "time_zone")
+	}
+	if n, ok := mmdbValueAt(record, "autonomous_system_number").(uint64); ok && r.ASN == "" {
+		r.ASN = fmt.Sprintf("AS%d", n)
+	}
+	if r.ASName == "" {
+		r.ASName = mmdbStringAt(record, "autonomous_system_organization")
+	}
+	anycast, _ := mmdbValueAt(record, "traits", "is_anycast").(bool)
+	r.IsAnycast, _ = mmdbValueAt(record, "is_anycast").(bool)
+	r.IsAnycast = r.IsAnycast || anycast
+	return r
+}
+
+func mmdbValueAt(v interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func mmdbStringAt(v interface{}, path ...string) string {
+	s, _ := mmdbValueAt(v, path...).(string)
+	return s
+}
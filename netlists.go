@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Network lists are optional datasets of datacenter, VPN and Tor exit ranges,
+// downloaded next to the main dataset, that flag lookups with is_datacenter,
+// is_vpn and is_tor for fraud scoring.
+
+const (
+	networkDatacenter = "datacenter"
+	networkVPN        = "vpn"
+	networkTor        = "tor"
+)
+
+// networkListEnv maps each kind of list to the variable with its URL.
+var networkListEnv = map[string]string{
+	networkDatacenter: "DATACENTER_RANGES_URL",
+	networkVPN:        "VPN_RANGES_URL",
+	networkTor:        "TOR_RANGES_URL",
+}
+
+// NetworkList is the state of one list, as shown by /admin/status.
+type NetworkList struct {
+	Kind      string     `json:"kind"`
+	URL       string     `json:"url"`
+	Entries   int64      `json:"entries"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+var (
+	networkListURLs = map[string]string{}
+
+	// networkLists is replaced as a whole, so lookups read it without
+	// locking.
+	networkLists atomic.Pointer[networkListSet]
+)
+
+// networkListSet is the lists loaded, by kind.
+type networkListSet struct {
+	lists map[string]*ipIntervalSet
+	// feeds are the threat feeds loaded, sorted.
+	feeds []string
+}
+
+// ipInterval is a range of addresses, 4 bytes long for IPv4 and 16 for IPv6.
+type ipInterval struct {
+	start, end []byte
+}
+
+// ipIntervalSet is a set of addresses held as sorted, non-overlapping
+// intervals, which answers membership with a binary search.
+type ipIntervalSet struct {
+	v4, v6 []ipInterval
+}
+
+// newIPIntervalSet merges intervals, which may overlap, into a set.
+func newIPIntervalSet(intervals []ipInterval) *ipIntervalSet {
+	s := &ipIntervalSet{}
+	for _, in := range intervals {
+		if len(in.start) == net.IPv4len {
+			s.v4 = append(s.v4, in)
+		} else {
+			s.v6 = append(s.v6, in)
+		}
+	}
+	s.v4 = mergeIntervals(s.v4)
+	s.v6 = mergeIntervals(s.v6)
+	return s
+}
+
+func mergeIntervals(list []ipInterval) []ipInterval {
+	sort.Slice(list, func(i, j int) bool { return bytes.Compare(list[i].start, list[j].start) < 0 })
+	var merged []ipInterval
+	for _, in := range list {
+		if n := len(merged); n > 0 && bytes.Compare(in.start, merged[n-1].end) <= 0 {
+			if bytes.Compare(in.end, merged[n-1].end) > 0 {
+				merged[n-1].end = in.end
+			}
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// contains reports whether ip, in the length lookups use, is in the set.
+func (s *ipIntervalSet) contains(ip []byte) bool {
+	if s == nil {
+		return false
+	}
+	list := s.v6
+	if len(ip) == net.IPv4len {
+		list = s.v4
+	}
+	i := sort.Search(len(list), func(i int) bool { return bytes.Compare(list[i].start, ip) > 0 })
+	return i > 0 && bytes.Compare(ip, list[i-1].end) <= 0
+}
+
+// parseIPInterval parses a CIDR, a single IP or a start-end range.
+func parseIPInterval(v string) (ipInterval, error) {
+	if strings.Contains(v, "/") {
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return ipInterval{}, fmt.Errorf("invalid CIDR %q", v)
+		}
+		start, end := networkRange(network)
+		return ipInterval{start, end}, nil
+	}
+	startStr, endStr, isRange := strings.Cut(v, "-")
+	if !isRange {
+		endStr = startStr
+	}
+	start, end := lookupBytes(net.ParseIP(strings.TrimSpace(startStr))), lookupBytes(net.ParseIP(strings.TrimSpace(endStr)))
+	if start == nil || end == nil || len(start) != len(end) || bytes.Compare(start, end) > 0 {
+		return ipInterval{}, fmt.Errorf("invalid IP or range %q", v)
+	}
+	return ipInterval{start, end}, nil
+}
+
+// lookupBytes returns ip in the length lookups use: 4 bytes for IPv4.
+func lookupBytes(ip net.IP) []byte {
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// loadNetworkListConfig reads the URL of each list and the threat feeds.
+func loadNetworkListConfig() error {
+	for kind, env := range networkListEnv {
+		v := os.Getenv(env)
+		if v == "" {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid %s %q, expected an http or https URL", env, v)
+		}
+		networkListURLs[kind] = v
+	}
+	if err := loadIP2ASNConfig(); err != nil {
+		return err
+	}
+	return loadThreatFeedConfig()
+}
+
+// pruneNetworkLists drops the lists whose URL was removed, so they stop
+// flagging lookups. A read-only database keeps them.
+func pruneNetworkLists() error {
+	if dbReadOnly {
+		return nil
+	}
+	rows, err := db.Load().Query("SELECT DISTINCT kind FROM network_ranges")
+	if err != nil {
+		return fmt.Errorf("failed to load network lists: %v", err)
+	}
+	var stale []string
+	for rows.Next() {
+		var kind string
+		if err := rows.Scan(&kind); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to load network lists: %v", err)
+		}
+		if _, ok := networkListURLs[kind]; !ok {
+			stale = append(stale, kind)
+		}
+	}
+	rows.Close()
+	for _, kind := range stale {
+		if _, err := db.Load().Exec("DELETE FROM network_ranges WHERE kind = ?", kind); err != nil {
+			return fmt.Errorf("failed to drop %s ranges: %v", kind, err)
+		}
+		if _, err := db.Load().Exec("DELETE FROM network_lists WHERE kind = ?", kind); err != nil {
+			return fmt.Errorf("failed to drop %s ranges: %v", kind, err)
+		}
+		log.Printf("Dropped the %s list, it is no longer configured", kind)
+	}
+	return nil
+}
+
+func createNetworkListTables() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS network_ranges (
+			kind TEXT NOT NULL,
+			start_ip BLOB NOT NULL,
+			end_ip BLOB NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create network_ranges table: %v", err)
+	}
+	_, err = db.Load().Exec("CREATE INDEX IF NOT EXISTS idx_network_ranges_kind ON network_ranges(kind)")
+	if err != nil {
+		return fmt.Errorf("failed to create network_ranges index: %v", err)
+	}
+	_, err = db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS network_lists (
+			kind TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			entries INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create network_lists table: %v", err)
+	}
+	return nil
+}
+
+// loadNetworkLists reads every stored list into memory.
+func loadNetworkLists() error {
+	rows, err := db.Load().Query("SELECT kind, start_ip, end_ip FROM network_ranges")
+	if err != nil {
+		return fmt.Errorf("failed to load network lists: %v", err)
+	}
+	defer rows.Close()
+
+	intervals := map[string][]ipInterval{}
+	for rows.Next() {
+		var kind string
+		var in ipInterval
+		if err := rows.Scan(&kind, &in.start, &in.end); err != nil {
+			return fmt.Errorf("failed to load network lists: %v", err)
+		}
+		intervals[kind] = append(intervals[kind], in)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load network lists: %v", err)
+	}
+
+	lists := map[string]*ipIntervalSet{}
+	var feeds []string
+	for kind, list := range intervals {
+		lists[kind] = newIPIntervalSet(list)
+		if name, ok := strings.CutPrefix(kind, threatFeedPrefix); ok {
+			feeds = append(feeds, name)
+		}
+	}
+	sort.Strings(feeds)
+	networkLists.Store(&networkListSet{lists: lists, feeds: feeds})
+	return nil
+}
+
+// applyNetworkFlags sets the flags of the lists ip, in the length lookups
+// use, is on.
+func applyNetworkFlags(info *IPInfo, ip []byte) {
+	lists := networkLists.Load()
+	if lists == nil {
+		lists = &networkListSet{}
+	}
+	info.IsDatacenter = lists.lists[networkDatacenter].contains(ip)
+	info.IsVPN = lists.lists[networkVPN].contains(ip)
+	info.IsTor = lists.lists[networkTor].contains(ip) || isTorExit(ip)
+	applyThreatFeeds(info, ip, lists)
+}
+
+// updateNetworkLists downloads the lists that weren't updated today, or all
+// of them when force is set. A list that fails to load keeps its previous
+// version.
+func updateNetworkLists(force bool) {
+	today := time.Now().UTC().Format("2006-01-02")
+	for kind, listURL := range networkListURLs {
+		var updatedAt int64
+		err := db.Load().QueryRow("SELECT updated_at FROM network_lists WHERE kind = ? AND url = ?", kind, listURL).Scan(&updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error checking the %s list: %v", kind, err)
+			continue
+		}
+		if !force && err == nil && time.Unix(updatedAt, 0).UTC().Format("2006-01-02") == today {
+			continue
+		}
+		if err := updateNetworkList(kind, listURL); err != nil {
+			log.Printf("Error updating the %s list: %v", kind, err)
+		}
+	}
+	if err := loadNetworkLists(); err != nil {
+		log.Printf("Error loading network lists: %v", err)
+	}
+	if err := updateIP2ASN(force); err != nil {
+		log.Printf("Error updating the ip2asn data: %v", err)
+	}
+}
+
+func updateNetworkList(kind, listURL string) error {
+	f, err := os.CreateTemp("", "network_list_*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := download(listURL, networkListHeader, f); err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	intervals, skipped, err := parseNetworkList(f)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM network_ranges WHERE kind = ?", kind); err != nil {
+		return fmt.Errorf("failed to delete old ranges: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO network_ranges (kind, start_ip, end_ip) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, in := range intervals {
+		if _, err := stmt.Exec(kind, in.start, in.end); err != nil {
+			return fmt.Errorf("failed to insert range: %v", err)
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO network_lists (kind, url, entries, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kind) DO UPDATE SET url = excluded.url, entries = excluded.entries, updated_at = excluded.updated_at
+	`, kind, listURL, len(intervals), time.Now().UTC().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record list: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	log.Printf("Loaded %d %s ranges, skipped %d invalid lines", len(intervals), kind, skipped)
+	return nil
+}
+
+// parseNetworkList reads a list with one CIDR, IP or start-end range per
+// line, optionally gzipped. Anything after the first whitespace or comma and
+// lines starting with # are ignored. STIX bundles and TAXII envelopes are
+// recognized by their leading {.
+func parseNetworkList(r io.Reader) ([]ipInterval, int, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decompress: %v", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(io.LimitReader(gz, downloadMaxUncompressedSize))
+	}
+	if isJSONObject(br) {
+		return parseSTIX(br)
+	}
+
+	var intervals []ipInterval
+	skipped := 0
+	scanner := bufio.NewScanner(br)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t,#;"); i >= 0 {
+			line = line[:i]
+		}
+		in, err := parseIPInterval(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		intervals = append(intervals, in)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read list: %v", err)
+	}
+	if len(intervals) == 0 {
+		return nil, 0, fmt.Errorf("no ranges in the list, %d invalid lines", skipped)
+	}
+	return intervals, skipped, nil
+}
+
+// listNetworkLists returns the state of the configured lists.
+func listNetworkLists() ([]NetworkList, error) {
+	lists := []NetworkList{}
+	for kind, listURL := range networkListURLs {
+		l := NetworkList{Kind: kind, URL: listURL}
+		if u, err := url.Parse(listURL); err == nil {
+			l.URL = u.Redacted()
+		}
+		var updatedAt int64
+		err := db.Load().QueryRow("SELECT entries, updated_at FROM network_lists WHERE kind = ?", kind).Scan(&l.Entries, &updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load network lists: %v", err)
+		}
+		if err == nil {
+			t := time.Unix(updatedAt, 0).UTC()
+			l.UpdatedAt = &t
+		}
+		lists = append(lists, l)
+	}
+	if ip2asnURL != "" {
+		l := NetworkList{Kind: ip2asnKind, URL: ip2asnURL}
+		if u, err := url.Parse(ip2asnURL); err == nil {
+			l.URL = u.Redacted()
+		}
+		var updatedAt int64
+		err := db.Load().QueryRow("SELECT entries, updated_at FROM network_lists WHERE kind = ?", ip2asnKind).Scan(&l.Entries, &updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load network lists: %v", err)
+		}
+		if err == nil {
+			t := time.Unix(updatedAt, 0).UTC()
+			l.UpdatedAt = &t
+		}
+		lists = append(lists, l)
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].Kind < lists[j].Kind })
+
+	if torExitsEnabled {
+		l := NetworkList{Kind: "tor_exits", URL: torExitListURL}
+		var updatedAt int64
+		err := db.Load().QueryRow("SELECT exits, updated_at FROM tor_exits_updates WHERE id = 1").Scan(&l.Entries, &updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to load Tor exits: %v", err)
+		}
+		if err == nil {
+			t := time.Unix(updatedAt, 0).UTC()
+			l.UpdatedAt = &t
+		}
+		lists = append(lists, l)
+	}
+	return lists, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	notFoundPolicy404      = "404"
+	notFoundPolicyEmpty    = "empty"
+	notFoundPolicyFallback = "fallback"
+
+	negativeCacheSize = 100000
+)
+
+var (
+	notFoundPolicy  string
+	notFoundCountry string
+
+	// negativeCache remembers IPs that aren't in the active dataset, so
+	// repeated lookups of unroutable addresses don't hit the database. It is
+	// purged whenever another dataset becomes active.
+	negativeCache *ttlCache[netip.Addr, struct{}]
+)
+
+func loadNotFoundConfig() error {
+	notFoundPolicy = os.Getenv("NOT_FOUND_POLICY")
+	if notFoundPolicy == "" {
+		notFoundPolicy = notFoundPolicy404
+	}
+	switch notFoundPolicy {
+	case notFoundPolicy404, notFoundPolicyEmpty, notFoundPolicyFallback:
+	default:
+		return fmt.Errorf("invalid NOT_FOUND_POLICY %q, expected one of: %s, %s, %s", notFoundPolicy, notFoundPolicy404, notFoundPolicyEmpty, notFoundPolicyFallback)
+	}
+
+	notFoundCountry = strings.ToUpper(os.Getenv("NOT_FOUND_COUNTRY"))
+	if notFoundCountry == "" {
+		notFoundCountry = "ZZ"
+	}
+
+	if ttl := envDuration("NEGATIVE_CACHE_TTL", 5*time.Minute); ttl > 0 {
+		negativeCache = newTTLCache[netip.Addr, struct{}](ttl, negativeCacheSize)
+	}
+	return nil
+}
+
+func isNegativelyCached(ip netip.Addr) bool {
+	if negativeCache == nil {
+		return false
+	}
+	_, ok := negativeCache.Get(ip)
+	return ok
+}
+
+func cacheNotFound(ip netip.Addr) {
+	if negativeCache != nil {
+		negativeCache.Set(ip, struct{}{})
+	}
+}
+
+func purgeNegativeCache() {
+	if negativeCache != nil {
+		negativeCache.Purge()
+	}
+}
+
+// lookupForRequest looks up ip for an HTTP response, running the hooks of
+// HOOK_PLUGINS before and after the lookup.
+func lookupForRequest(r *http.Request, ip string) (*IPInfo, error) {
+	ip, err := runPreLookupHooks(r, ip)
+	if err != nil {
+		return nil, err
+	}
+	info, err := lookupOrPlaceholder(r, ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := runPostLookupHooks(r, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// lookupOrPlaceholder looks up ip, accounting for the lookup and applying
+// NOT_FOUND_POLICY to public IPs that aren't in any range.
+func lookupOrPlaceholder(r *http.Request, ip string) (*IPInfo, error) {
+	start := time.Now()
+	info, err := lookupIP(r.Context(), ip)
+	latency := time.Since(start)
+	recordLookup(r, ip, err)
+	if !errors.Is(err, errNotFound) || notFoundPolicy == notFoundPolicy404 || !isPublicIP(net.ParseIP(ip)) {
+		recordAnalytics(r, info, err, latency)
+		return info, err
+	}
+
+	info = &IPInfo{IP: ip, Unknown: true}
+	if notFoundPolicy == notFoundPolicyFallback {
+		info.Country = notFoundCountry
+		info.CountryName = "Unknown"
+	}
+	applyResolution(info)
+	recordAnalytics(r, info, nil, latency)
+	return info, nil
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
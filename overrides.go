@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Overrides are CIDRs whose country, continent and labels always win over the
+// dataset, to attribute corporate egress ranges and VPN exits correctly
+// whatever the public data says. They come from OVERRIDES_FILE and from the
+// admin API, and apply to lookups as soon as they are changed.
+
+const (
+	overrideSourceFile = "file"
+	overrideSourceAPI  = "api"
+)
+
+type Override struct {
+	// ID is set for overrides managed with the admin API.
+	ID            int64    `json:"id,omitempty"`
+	CIDR          string   `json:"cidr"`
+	Country       string   `json:"country,omitempty"`
+	CountryName   string   `json:"country_name,omitempty"`
+	Continent     string   `json:"continent,omitempty"`
+	ContinentName string   `json:"continent_name,omitempty"`
+	Labels        []string `json:"labels"`
+	Source        string   `json:"source"`
+
+	network *net.IPNet
+}
+
+var (
+	fileOverrides []*Override
+
+	// overrides are sorted most specific first, so the first match wins.
+	// The list is replaced as a whole, so lookups read it without locking.
+	overrides atomic.Pointer[[]*Override]
+
+	errOverrideNotFound = errors.New("override not found")
+)
+
+func createOverridesTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS overrides (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			cidr TEXT NOT NULL UNIQUE,
+			country TEXT NOT NULL DEFAULT '',
+			country_name TEXT NOT NULL DEFAULT '',
+			continent TEXT NOT NULL DEFAULT '',
+			continent_name TEXT NOT NULL DEFAULT '',
+			labels TEXT NOT NULL DEFAULT ''
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create overrides table: %v", err)
+	}
+	return nil
+}
+
+// normalize validates o and puts its fields in canonical form.
+func (o *Override) normalize() error {
+	network, err := parseCIDR(o.CIDR)
+	if err != nil {
+		return err
+	}
+	o.CIDR = network.String()
+	o.network = network
+
+	o.Country = strings.ToUpper(strings.TrimSpace(o.Country))
+	o.Continent = strings.ToUpper(strings.TrimSpace(o.Continent))
+	o.CountryName = strings.TrimSpace(o.CountryName)
+	o.ContinentName = strings.TrimSpace(o.ContinentName)
+	if o.Country != "" && len(o.Country) != 2 {
+		return fmt.Errorf("invalid country %q, expected a two letter code", o.Country)
+	}
+	if o.Continent != "" && len(o.Continent) != 2 {
+		return fmt.Errorf("invalid continent %q, expected a two letter code", o.Continent)
+	}
+	labels := []string{}
+	for _, label := range o.Labels {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	o.Labels = labels
+	if o.Country == "" && o.Continent == "" && len(o.Labels) == 0 {
+		return errors.New("an override needs a country, a continent or labels")
+	}
+	return nil
+}
+
+// loadOverridesFile reads a CSV file with a header row containing the column
+// cidr and any of country, country_name, continent, continent_name and
+// labels, the latter separated by "|", e.g.
+//
+//	cidr,country,labels
+//	203.0.113.0/24,DE,corporate|egress
+func loadOverridesFile(path string) ([]*Override, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of %s: %v", path, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["cidr"]; !ok {
+		return nil, fmt.Errorf("%s has no cidr column", path)
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	var list []*Override
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		o := &Override{
+			CIDR:          column(record, "cidr"),
+			Country:       column(record, "country"),
+			CountryName:   column(record, "country_name"),
+			Continent:     column(record, "continent"),
+			ContinentName: column(record, "continent_name"),
+			Labels:        strings.Split(column(record, "labels"), "|"),
+			Source:        overrideSourceFile,
+		}
+		if err := o.normalize(); err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		list = append(list, o)
+	}
+	return list, nil
+}
+
+func scanOverride(scan func(...interface{}) error) (*Override, error) {
+	o := &Override{Source: overrideSourceAPI}
+	var labels string
+	err := scan(&o.ID, &o.CIDR, &o.Country, &o.CountryName, &o.Continent, &o.ContinentName, &labels)
+	if err != nil {
+		return nil, err
+	}
+	o.Labels = splitList(labels)
+	_, o.network, err = net.ParseCIDR(o.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q of override %d", o.CIDR, o.ID)
+	}
+	return o, nil
+}
+
+const overrideColumns = "id, cidr, country, country_name, continent, continent_name, labels"
+
+// loadOverrides combines the overrides of the database with those of
+// OVERRIDES_FILE. It runs at startup and after every change made through the
+// admin API. An override of the API wins over one of the file for the same
+// CIDR.
+func loadOverrides() error {
+	rows, err := db.Load().Query("SELECT " + overrideColumns + " FROM overrides")
+	if err != nil {
+		return fmt.Errorf("failed to load overrides: %v", err)
+	}
+	defer rows.Close()
+
+	var list []*Override
+	seen := map[string]bool{}
+	for rows.Next() {
+		o, err := scanOverride(rows.Scan)
+		if err != nil {
+			return fmt.Errorf("failed to load overrides: %v", err)
+		}
+		list = append(list, o)
+		seen[o.CIDR] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load overrides: %v", err)
+	}
+	for _, o := range fileOverrides {
+		if !seen[o.CIDR] {
+			list = append(list, o)
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		ones, _ := list[i].network.Mask.Size()
+		otherOnes, _ := list[j].network.Mask.Size()
+		return ones > otherOnes
+	})
+
+	overrides.Store(&list)
+	return nil
+}
+
+// matchOverride returns the most specific override containing ip, or nil.
+func matchOverride(ip net.IP) *Override {
+	list := overrides.Load()
+	if list == nil {
+		return nil
+	}
+	for _, o := range *list {
+		if o.network.Contains(ip) {
+			return o
+		}
+	}
+	return nil
+}
+
+// applyOverride puts the fields of o over those of the dataset. The matched
+// range shrinks to the part of the dataset range the override covers, which
+// is where the answer is the same for every IP.
+func applyOverride(info *IPInfo, r *RangeRecord, o *Override) {
+	if o.Country != "" && o.Country != info.Country {
+		info.Country = o.Country
+		info.CountryName = ""
+		info.Countries = nil
+		info.IsAnycast = false
+		// The dataset's are for the other country, let the metadata fill them.
+		info.Timezone = ""
+		info.Currency = ""
+	}
+	if o.CountryName != "" {
+		info.CountryName = o.CountryName
+	}
+	if o.Continent != "" && o.Continent != info.Continent {
+		info.Continent = o.Continent
+		info.ContinentName = ""
+	}
+	if o.ContinentName != "" {
+		info.ContinentName = o.ContinentName
+	}
+	info.Labels = o.Labels
+	info.Override = true
+
+	start, end := networkRange(o.network)
+	if len(r.StartIP) == len(start) {
+		if bytes.Compare(r.StartIP, start) > 0 {
+			start = r.StartIP
+		}
+		if bytes.Compare(r.EndIP, end) < 0 {
+			end = r.EndIP
+		}
+	}
+	info.Range = newMatchedRange(start, end)
+}
+
+// overrideRequest is the body of POST and PUT /admin/overrides.
+type overrideRequest struct {
+	CIDR          string   `json:"cidr"`
+	Country       string   `json:"country"`
+	CountryName   string   `json:"country_name"`
+	Continent     string   `json:"continent"`
+	ContinentName string   `json:"continent_name"`
+	Labels        []string `json:"labels"`
+}
+
+func decodeOverrideRequest(w http.ResponseWriter, r *http.Request) (*Override, bool) {
+	var req overrideRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Request body must be a JSON object")
+		return nil, false
+	}
+	o := &Override{
+		CIDR:          req.CIDR,
+		Country:       req.Country,
+		CountryName:   req.CountryName,
+		Continent:     req.Continent,
+		ContinentName: req.ContinentName,
+		Labels:        req.Labels,
+		Source:        overrideSourceAPI,
+	}
+	if err := o.normalize(); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Invalid override: "+err.Error())
+		return nil, false
+	}
+	return o, true
+}
+
+func getOverride(id int64) (*Override, error) {
+	o, err := scanOverride(db.Load().QueryRow("SELECT "+overrideColumns+" FROM overrides WHERE id = ?", id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, errOverrideNotFound
+	}
+	return o, err
+}
+
+func overrideID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "override_not_found", "Override not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeOverrideError maps errors of the override handlers to a response.
+func writeOverrideError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errOverrideNotFound):
+		writeError(w, r, http.StatusNotFound, "override_not_found", "Override not found")
+	case err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		writeError(w, r, http.StatusConflict, "override_exists", "An override for this CIDR already exists")
+	default:
+		logRequest(r, "Override error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+	}
+}
+
+// listOverridesHandler lists every override in effect, those of
+// OVERRIDES_FILE included, most specific first.
+func listOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	list := []*Override{}
+	if l := overrides.Load(); l != nil && *l != nil {
+		list = *l
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"overrides": list})
+}
+
+func getOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := overrideID(w, r)
+	if !ok {
+		return
+	}
+	o, err := getOverride(id)
+	if err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(o)
+}
+
+func createOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := decodeOverrideRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Load().Exec(`
+		INSERT INTO overrides (cidr, country, country_name, continent, continent_name, labels)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, o.CIDR, o.Country, o.CountryName, o.Continent, o.ContinentName, strings.Join(o.Labels, ","))
+	if err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+	o.ID, _ = result.LastInsertId()
+	if err := loadOverrides(); err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+
+	logRequest(r, "Created override %d for %s", o.ID, o.CIDR)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func updateOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := overrideID(w, r)
+	if !ok {
+		return
+	}
+	o, ok := decodeOverrideRequest(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Load().Exec(`
+		UPDATE overrides SET cidr = ?, country = ?, country_name = ?, continent = ?, continent_name = ?, labels = ?
+		WHERE id = ?
+	`, o.CIDR, o.Country, o.CountryName, o.Continent, o.ContinentName, strings.Join(o.Labels, ","), id)
+	if err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeOverrideError(w, r, errOverrideNotFound)
+		return
+	}
+	if err := loadOverrides(); err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+
+	o.ID = id
+	logRequest(r, "Updated override %d for %s", o.ID, o.CIDR)
+	json.NewEncoder(w).Encode(o)
+}
+
+func deleteOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := overrideID(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Load().Exec("DELETE FROM overrides WHERE id = ?", id)
+	if err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeOverrideError(w, r, errOverrideNotFound)
+		return
+	}
+	if err := loadOverrides(); err != nil {
+		writeOverrideError(w, r, err)
+		return
+	}
+
+	logRequest(r, "Deleted override %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Providers publish their ranges in different formats. Each one is a
+// datasetParser in datasetParsers, and the format of a file comes from
+// DATA_FORMAT, its magic bytes or the Content-Type it was served with, so
+// supporting a new provider means adding a parser here and nothing else.
+
+// datasetFile is a decompressed dataset file about to be parsed.
+type datasetFile struct {
+	*os.File
+	// head is the start of the file, for detecting its format.
+	head []byte
+	// gzipped is set when the file was decompressed.
+	gzipped bool
+}
+
+// datasetParser reads the ranges of one file format.
+type datasetParser struct {
+	name string
+	// contentTypes are the media types the format is served as.
+	contentTypes []string
+	// magic recognizes the format with certainty from the file itself.
+	magic func(f *datasetFile) bool
+	// sniff guesses the format from the file when its Content-Type doesn't
+	// tell.
+	sniff func(f *datasetFile) bool
+	// parse hands every range in f to sink, and the records it can't read
+	// as well.
+	parse func(f *datasetFile, sink *rangeSink) error
+}
+
+var datasetParsers = []*datasetParser{
+	{
+		name:  "mmdb",
+		magic: isMMDB,
+		parse: parseMMDBRanges,
+	},
+	{
+		name:  "json-gz",
+		magic: func(f *datasetFile) bool { return f.gzipped && isJSON(f.head) },
+		parse: parseJSONRanges,
+	},
+	{
+		name:         "ndjson",
+		contentTypes: []string{"application/x-ndjson", "application/jsonl", "application/json"},
+		magic:        func(f *datasetFile) bool { return isJSON(f.head) },
+		parse:        parseJSONRanges,
+	},
+	{
+		name:         "tsv",
+		contentTypes: []string{"text/tab-separated-values"},
+		sniff:        func(f *datasetFile) bool { return strings.Contains(firstLine(f.head), "\t") },
+		parse:        func(f *datasetFile, sink *rangeSink) error { return parseDelimitedRanges(f, '\t', sink) },
+	},
+	{
+		name:         "csv",
+		contentTypes: []string{"text/csv"},
+		sniff:        func(f *datasetFile) bool { return strings.Contains(firstLine(f.head), ",") },
+		parse:        func(f *datasetFile, sink *rangeSink) error { return parseDelimitedRanges(f, ',', sink) },
+	},
+}
+
+var (
+	// dataFormat is the DATA_FORMAT of IP_DATA_URL, empty to detect it.
+	dataFormat string
+	// dataErrorBudget is how many invalid records a load skips before
+	// failing.
+	dataErrorBudget errorBudget
+)
+
+func loadDataFormatConfig() error {
+	var err error
+	dataErrorBudget, err = parseErrorBudget(os.Getenv("DATA_ERROR_BUDGET"))
+	if err != nil {
+		return err
+	}
+
+	dataFormat = strings.ToLower(os.Getenv("DATA_FORMAT"))
+	if dataFormat == "auto" {
+		dataFormat = ""
+	}
+	if dataFormat != "" && datasetParserByName(dataFormat) == nil {
+		names := make([]string, len(datasetParsers))
+		for i, p := range datasetParsers {
+			names[i] = p.name
+		}
+		return fmt.Errorf("invalid DATA_FORMAT %q, expected auto, %s", dataFormat, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func datasetParserByName(name string) *datasetParser {
+	for _, p := range datasetParsers {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// detectDatasetParser returns the parser for f, which was served as
+// contentType. format names the parser to use instead, if set.
+func detectDatasetParser(f *datasetFile, format, contentType string) (*datasetParser, error) {
+	if format != "" {
+		p := datasetParserByName(format)
+		if p == nil {
+			return nil, fmt.Errorf("unknown dataset format %q", format)
+		}
+		return p, nil
+	}
+	// Magic bytes go first, as servers often send files as
+	// application/octet-stream or whatever the extension suggests.
+	for _, p := range datasetParsers {
+		if p.magic != nil && p.magic(f) {
+			return p, nil
+		}
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		for _, p := range datasetParsers {
+			for _, t := range p.contentTypes {
+				if t == mediaType {
+					return p, nil
+				}
+			}
+		}
+	}
+	for _, p := range datasetParsers {
+		if p.sniff != nil && p.sniff(f) {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unrecognized dataset format, set DATA_FORMAT")
+}
+
+// openDatasetFile returns the contents of file, decompressing it into a
+// temporary file when it is gzipped. The caller closes and removes it with
+// the returned function.
+func openDatasetFile(file *os.File) (*datasetFile, func(), error) {
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to seek temp file: %v", err)
+	}
+	magic := make([]byte, 2)
+	n, _ := io.ReadFull(file, magic)
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to seek temp file: %v", err)
+	}
+
+	f := &datasetFile{File: file}
+	cleanup := func() {}
+	if n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %v", err)
+		}
+		defer gzReader.Close()
+
+		tmpFile, err := os.CreateTemp("", "ip_ranges_*")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create temp file: %v", err)
+		}
+		cleanup = func() {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+
+		// Guard against gzip bombs by capping the uncompressed size.
+		n, err := io.Copy(tmpFile, io.LimitReader(gzReader, downloadMaxUncompressedSize+1))
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to write to temp file: %v", err)
+		}
+		if n > downloadMaxUncompressedSize {
+			cleanup()
+			return nil, nil, fmt.Errorf("uncompressed data is larger than DOWNLOAD_MAX_UNCOMPRESSED_SIZE_MB (%d MB)", downloadMaxUncompressedSize>>20)
+		}
+		_, err = tmpFile.Seek(0, 0)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("failed to seek temp file: %v", err)
+		}
+		f = &datasetFile{File: tmpFile, gzipped: true}
+	}
+
+	f.head = make([]byte, 4096)
+	n, err = f.ReadAt(f.head, 0)
+	if err != nil && err != io.EOF {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to read temp file: %v", err)
+	}
+	f.head = f.head[:n]
+	return f, cleanup, nil
+}
+
+var utf8BOM = []byte("\ufeff")
+
+// jsonStart returns the first byte of head that isn't white space.
+func jsonStart(head []byte) byte {
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, utf8BOM), " \t\r\n")
+	if len(head) == 0 {
+		return 0
+	}
+	return head[0]
+}
+
+func isJSON(head []byte) bool {
+	c := jsonStart(head)
+	return c == '{' || c == '['
+}
+
+func firstLine(head []byte) string {
+	line, _, _ := strings.Cut(string(head), "\n")
+	return line
+}
+
+// parseJSONRanges reads JSON objects in the upstream format, one after the
+// other or in an array.
+func parseJSONRanges(f *datasetFile, sink *rangeSink) error {
+	br := bufio.NewReader(f)
+	head := f.head
+	if bom, _ := br.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		br.Discard(len(utf8BOM))
+		head = head[len(utf8BOM):]
+	}
+
+	// Files with an object per line, which is what providers publish, are
+	// read line by line so a malformed line can be skipped. Anything else
+	// goes through a decoder, which gets past records with values of the
+	// wrong type but not past broken syntax.
+	if jsonStart(head) == '{' {
+		if line := bytes.TrimSpace([]byte(firstLine(head))); json.Valid(line) {
+			return parseJSONLines(br, sink)
+		}
+	}
+
+	sink.unit = "record"
+	decoder := json.NewDecoder(br)
+	if jsonStart(head) == '[' {
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to decode JSON: %v", err)
+		}
+	}
+	for n := int64(1); decoder.More(); n++ {
+		// Exports from a primary carry the priority it resolved overlaps
+		// with, upstream files don't.
+		var ipRange exportedRange
+		err := decoder.Decode(&ipRange)
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			if err := sink.skip(n, err); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to decode JSON record %d: %v", n, err)
+		}
+		if err := sink.add(n, ipRange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseJSONLines(br *bufio.Reader, sink *rangeSink) error {
+	sink.unit = "line"
+	for n := int64(1); ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read line %d: %v", n, err)
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var ipRange exportedRange
+			if jsonErr := json.Unmarshal(line, &ipRange); jsonErr != nil {
+				if err := sink.skip(n, jsonErr); err != nil {
+					return err
+				}
+			} else if err := sink.add(n, ipRange); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseDelimitedRanges reads CSV or TSV with a header row naming the columns
+// after the JSON fields. A network column (CIDR), as in the GeoLite2 CSV
+// files, may take the place of start_ip and end_ip. Unknown columns are
+// ignored.
+func parseDelimitedRanges(f *datasetFile, comma rune, sink *rangeSink) error {
+	reader := csv.NewReader(bufio.NewReader(f))
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = comma == '\t'
+	reader.ReuseRecord = true
+	sink.unit = "line"
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, string(utf8BOM))))
+		columns[name] = i
+	}
+	_, hasNetwork := columns["network"]
+	_, hasStart := columns["start_ip"]
+	_, hasEnd := columns["end_ip"]
+	if !hasNetwork && !(hasStart && hasEnd) {
+		return fmt.Errorf("the header has neither start_ip and end_ip nor network columns")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if perr, ok := err.(*csv.ParseError); ok {
+			// The reader goes on with the next line.
+			if err := sink.skip(int64(perr.StartLine), perr.Err); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		r, err := delimitedRange(columns, record)
+		if err != nil {
+			err = sink.skip(int64(line), err)
+		} else {
+			err = sink.add(int64(line), r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func delimitedRange(columns map[string]int, record []string) (exportedRange, error) {
+	get := func(column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var r exportedRange
+	if v := get("network"); v != "" {
+		network, err := parseCIDR(v)
+		if err != nil {
+			return r, err
+		}
+		start, end := networkRange(network)
+		r.StartIP, r.EndIP = net.IP(start).String(), net.IP(end).String()
+	} else {
+		r.StartIP, r.EndIP = get("start_ip"), get("end_ip")
+	}
+	r.Country = get("country")
+	r.CountryName = get("country_name")
+	r.Continent = get("continent")
+	r.ContinentName = get("continent_name")
+	r.ASN = get("asn")
+	r.ASName = get("as_name")
+	r.ASDomain = get("as_domain")
+	r.Source = get("source")
+	r.Timezone = get("timezone")
+	r.Currency = get("currency")
+	if v := get("countries"); v != "" {
+		r.Countries = strings.Split(v, ",")
+	}
+	if v := get("is_anycast"); v != "" {
+		var err error
+		r.IsAnycast, err = strconv.ParseBool(v)
+		if err != nil {
+			return r, fmt.Errorf("invalid is_anycast %q", v)
+		}
+	}
+	if v := get("priority"); v != "" {
+		priority, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return r, fmt.Errorf("invalid priority %q", v)
+		}
+		r.Priority = &priority
+	}
+	return r, nil
+}
+
+// errorBudget is a number of records, or a percentage of those read.
+type errorBudget struct {
+	count   int64
+	percent float64
+}
+
+func parseErrorBudget(v string) (errorBudget, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return errorBudget{percent: 1}, nil
+	}
+	if p, ok := strings.CutSuffix(v, "%"); ok {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errorBudget{}, fmt.Errorf("invalid DATA_ERROR_BUDGET %q, expected a number of records or a percentage", v)
+		}
+		return errorBudget{percent: percent}, nil
+	}
+	count, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || count < 0 {
+		return errorBudget{}, fmt.Errorf("invalid DATA_ERROR_BUDGET %q, expected a number of records or a percentage", v)
+	}
+	return errorBudget{count: count}, nil
+}
+
+func (b errorBudget) String() string {
+	if b.count == 0 && b.percent > 0 {
+		return strconv.FormatFloat(b.percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatInt(b.count, 10)
+}
+
+// recordError rejects a single record, which the load skips as long as
+// DATA_ERROR_BUDGET allows.
+type recordError struct {
+	err error
+}
+
+func (e *recordError) Error() string {
+	return e.err.Error()
+}
+
+// rangeSink receives what a parser reads. Ranges go to insert, and records
+// that can't be read, or that insert rejects with a recordError, are counted
+// against the error budget.
+type rangeSink struct {
+	insert func(exportedRange) error
+	budget errorBudget
+	// unit is what the parser numbers records by, such as "line".
+	unit    string
+	read    int64
+	skipped int64
+}
+
+// maxLoggedRecordErrors is how many skipped records a load logs.
+const maxLoggedRecordErrors = 10
+
+func (s *rangeSink) add(n int64, r exportedRange) error {
+	if err := s.insert(r); err != nil {
+		if rerr, ok := err.(*recordError); ok {
+			return s.skip(n, rerr.err)
+		}
+		return err
+	}
+	s.read++
+	return nil
+}
+
+// skip counts the record numbered n as invalid, failing once there are more
+// than the budget allows.
+func (s *rangeSink) skip(n int64, err error) error {
+	s.read++
+	s.skipped++
+	if s.skipped <= maxLoggedRecordErrors {
+		log.Printf("Warning: skipping %s %d: %v", s.unit, n, err)
+	}
+	if s.budget.percent == 0 && s.skipped > s.budget.count {
+		return fmt.Errorf("more than DATA_ERROR_BUDGET (%s) records are invalid, %s %d: %v", s.budget, s.unit, n, err)
+	}
+	return nil
+}
+
+// finish checks a percentage budget, which needs the number of records.
+func (s *rangeSink) finish() error {
+	if s.skipped > 0 {
+		log.Printf("Skipped %d of %d records", s.skipped, s.read)
+	}
+	if s.budget.percent > 0 && float64(s.skipped)*100 > s.budget.percent*float64(s.read) {
+		return fmt.Errorf("%d of %d records are invalid, more than DATA_ERROR_BUDGET (%s)", s.skipped, s.read, s.budget)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With PEERS set, a refresh first asks the other instances of the cluster for
+// their dataset versions and copies the day's dataset from the closest one
+// that has it, so a multi-region cluster downloads the upstream data once
+// rather than once per instance.
+
+var (
+	peers     []string
+	peerToken string
+	peerSplay time.Duration
+)
+
+// peerDataset is a dataset offered by a peer.
+type peerDataset struct {
+	peer    string
+	dataset Dataset
+	latency time.Duration
+}
+
+func loadPeerConfig() {
+	for _, peer := range strings.Split(os.Getenv("PEERS"), ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	peerToken = os.Getenv("PEER_TOKEN")
+	if peerToken == "" {
+		peerToken = adminToken
+	}
+	peerSplay = envDuration("PEER_REFRESH_SPLAY", 30*time.Minute)
+}
+
+// peerRefreshDelay spreads the scheduled refreshes of a cluster, so the first
+// instance to wake up downloads the data and the others find it on a peer.
+func peerRefreshDelay() time.Duration {
+	if len(peers) == 0 || peerSplay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(peerSplay)))
+}
+
+// closestPeerDataset asks every peer for its active dataset and returns the
+// one with at least version that answered fastest, or nil if none has it.
+func closestPeerDataset(version string) *peerDataset {
+	var mu sync.Mutex
+	var closest *peerDataset
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			start := time.Now()
+			d, err := remoteStatus(peer, peerToken)
+			if err != nil {
+				log.Printf("Error checking peer %s: %v", peer, err)
+				return
+			}
+			latency := time.Since(start)
+			if d.ID == 0 || d.Version < version {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if closest == nil || latency < closest.latency {
+				closest = &peerDataset{peer: peer, dataset: d, latency: latency}
+			}
+		}(peer)
+	}
+	wg.Wait()
+	return closest
+}
+
+// copyFromPeers copies the dataset for version from the closest peer that
+// has it. It returns false when no peer could provide it, in which case the
+// caller downloads the upstream data itself.
+func copyFromPeers(version string) bool {
+	if len(peers) == 0 {
+		return false
+	}
+
+	d := closestPeerDataset(version)
+	if d == nil {
+		log.Printf("No peer has dataset %s yet", version)
+		return false
+	}
+
+	err := copyRemoteDataset(d.peer, peerToken, d.dataset)
+	if err != nil {
+		log.Printf("Error copying dataset from peer %s: %v", d.peer, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Lookups made for legal or investigative work sometimes must leave no trace
+// of what was looked up. Marked with X-Do-Not-Persist: true or
+// ?persist=false, a request skips the access log, the audit log, the lookup
+// counters, analytics, API key usage and every cache, where the IP would
+// otherwise stay.
+// As it hides requests from the audit log, it must be allowed with
+// ALLOW_DO_NOT_PERSIST.
+
+const doNotPersistHeader = "X-Do-Not-Persist"
+
+var allowDoNotPersist bool
+
+type doNotPersistKey struct{}
+
+// wantsDoNotPersist reports whether the request is marked as not to be
+// persisted.
+func wantsDoNotPersist(r *http.Request) bool {
+	if v := r.Header.Get(doNotPersistHeader); v != "" {
+		b, err := strconv.ParseBool(v)
+		return err != nil || b
+	}
+	if v := r.URL.Query().Get("persist"); v != "" {
+		b, err := strconv.ParseBool(v)
+		return err != nil || !b
+	}
+	return false
+}
+
+// doNotPersistMiddleware marks the context of requests that must not be
+// persisted, and rejects them unless ALLOW_DO_NOT_PERSIST is set: answering
+// them like any other request would persist what the caller asked not to.
+// It must run inside requestIDMiddleware and outside accessLogMiddleware.
+func doNotPersistMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !wantsDoNotPersist(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowDoNotPersist {
+			writeError(w, r, http.StatusForbidden, "do_not_persist_disabled", "Do-not-persist requests aren't allowed on this server")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), doNotPersistKey{}, true)))
+	})
+}
+
+// doNotPersist reports whether nothing about the request of ctx may be kept.
+func doNotPersist(ctx context.Context) bool {
+	v, _ := ctx.Value(doNotPersistKey{}).(bool)
+	return v
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Staging and QA need the same answer for their test IPs whatever dataset is
+// loaded. PINNED_RESPONSES_FILE pins IPs or CIDRs to a fixed response, which
+// lookups return without consulting the dataset, the network lists or the
+// caches. Unlike an override, nothing of the dataset shows through:
+//
+//	- cidr: 203.0.113.7
+//	  country: DE
+//	  as_name: QA office
+//	- cidr: 198.51.100.0/24
+//	  country: US
+//	  is_vpn: true
+
+// pinnedResponse is an entry of PINNED_RESPONSES_FILE.
+type pinnedResponse struct {
+	CIDR          string `yaml:"cidr"`
+	Country       string `yaml:"country"`
+	CountryName   string `yaml:"country_name"`
+	Continent     string `yaml:"continent"`
+	ContinentName string `yaml:"continent_name"`
+	ASN           uint32 `yaml:"asn"`
+	ASName        string `yaml:"as_name"`
+	ASDomain      string `yaml:"as_domain"`
+	Org           string `yaml:"org"`
+	Timezone      string `yaml:"timezone"`
+	Currency      string `yaml:"currency"`
+	IsAnycast     bool   `yaml:"is_anycast"`
+	IsDatacenter  bool   `yaml:"is_datacenter"`
+	IsVPN         bool   `yaml:"is_vpn"`
+	IsTor         bool   `yaml:"is_tor"`
+	RiskScore     int    `yaml:"risk_score"`
+
+	network *net.IPNet
+}
+
+// pinnedResponses are sorted most specific first, so the first match wins.
+var pinnedResponses []*pinnedResponse
+
+func loadPinnedResponses(path string) ([]*pinnedResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var list []*pinnedResponse
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&list); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for i, p := range list {
+		if p.network, err = parseCIDR(p.CIDR); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+		p.Country = strings.ToUpper(strings.TrimSpace(p.Country))
+		p.Continent = strings.ToUpper(strings.TrimSpace(p.Continent))
+		if p.Country != "" && len(p.Country) != 2 {
+			return nil, fmt.Errorf("%s: entry %d: invalid country %q, expected a two letter code", path, i+1, p.Country)
+		}
+		if p.Continent != "" && len(p.Continent) != 2 {
+			return nil, fmt.Errorf("%s: entry %d: invalid continent %q, expected a two letter code", path, i+1, p.Continent)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		ones, _ := list[i].network.Mask.Size()
+		otherOnes, _ := list[j].network.Mask.Size()
+		return ones > otherOnes
+	})
+	return list, nil
+}
+
+// matchPinned returns the most specific pinned response containing ip, or
+// nil.
+func matchPinned(ip net.IP) *pinnedResponse {
+	for _, p := range pinnedResponses {
+		if p.network.Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
+// info returns the response pinned for ip. The fields derived from the
+// country alone, such as its name and is_eu, are filled in like for any
+// other answer.
+func (p *pinnedResponse) info(ip string) *IPInfo {
+	start, end := networkRange(p.network)
+	info := &IPInfo{
+		IP:            ip,
+		Country:       p.Country,
+		CountryName:   p.CountryName,
+		Continent:     p.Continent,
+		ContinentName: p.ContinentName,
+		ASN:           p.ASN,
+		ASName:        p.ASName,
+		ASDomain:      p.ASDomain,
+		Org:           p.Org,
+		Timezone:      p.Timezone,
+		Currency:      p.Currency,
+		IsAnycast:     p.IsAnycast,
+		IsDatacenter:  p.IsDatacenter,
+		IsVPN:         p.IsVPN,
+		IsTor:         p.IsTor,
+		RiskScore:     p.RiskScore,
+		Range:         newMatchedRange(start, end),
+		Confidence:    100,
+		Pinned:        true,
+	}
+	if info.CountryName == "" {
+		if c := lookupISOCountry(info.Country, ""); c != nil {
+			info.CountryName = c.Name
+		}
+	}
+	applyISOCodes(info)
+	applyResolution(info)
+	applyCountryFlags(info)
+	applyRules(info)
+	return info
+}
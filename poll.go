@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Upstreams that publish at irregular times are better polled than fetched
+// on a fixed schedule. With REFRESH_POLL_INTERVAL the upstream file is
+// checked with a HEAD request that often, and loaded as soon as its ETag or
+// Last-Modified differs from the one of the active dataset. The daily
+// schedule keeps running alongside.
+
+const refreshTriggerPoll = "poll"
+
+var refreshPollInterval time.Duration
+
+// polledValidator is the ETag or Last-Modified last loaded by a poll. It
+// takes over from the active dataset's, as a staged dataset waiting to be
+// promoted isn't active and must not be loaded again on every poll.
+var polledValidator string
+
+func loadPollConfig() {
+	refreshPollInterval = envDuration("REFRESH_POLL_INTERVAL", 0)
+}
+
+// startUpstreamPoller polls the upstream every REFRESH_POLL_INTERVAL.
+// Followers take their datasets from the primary and don't poll.
+func startUpstreamPoller() {
+	if refreshPollInterval <= 0 || isFollower() || dataURL == "" {
+		return
+	}
+	log.Printf("Polling %s every %s", dataURL, refreshPollInterval)
+	go func() {
+		warned := false
+		for range time.Tick(refreshPollInterval) {
+			validator, err := upstreamValidator()
+			if err != nil {
+				log.Printf("Error polling upstream: %v", err)
+				continue
+			}
+			if validator == "" {
+				if !warned {
+					log.Printf("Warning: %s sends neither ETag nor Last-Modified, polling can't tell when it changes", dataURL)
+					warned = true
+				}
+				continue
+			}
+			if err := refreshIfChanged(validator); err != nil {
+				log.Printf("Error during polled update: %v", err)
+			}
+		}
+	}()
+}
+
+// upstreamValidator returns the ETag or Last-Modified of the upstream file,
+// the way downloads record it, without downloading it.
+func upstreamValidator() (string, error) {
+	host := downloadHost(dataURL)
+	if err := checkRateLimit(host); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dataURL, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range dataHeader {
+		req.Header[name] = values
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if limited := rateLimitResponse(resp); limited != nil {
+		recordRateLimit(host, limited)
+		return "", limited
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	return resumeValidator(resp), nil
+}
+
+// refreshIfChanged loads the upstream data, or stages it with
+// REFRESH_REQUIRE_PROMOTION, unless validator is the one already loaded. A
+// refresh already running is left to finish; the next poll checks again.
+func refreshIfChanged(validator string) (err error) {
+	known := polledValidator
+	if p := activeProvenance.Load(); known == "" && p != nil {
+		known = p.UpstreamVersion
+	}
+	if validator == known || !beginRefresh(refreshTriggerPoll) {
+		return nil
+	}
+
+	defer func() { endRefresh(err) }()
+
+	log.Printf("Upstream changed (%s), updating...", validator)
+	date := time.Now().UTC().Format("2006-01-02")
+	if refreshRequirePromotion && activeDatasetID.Load() != 0 {
+		err = stageIPRanges(date)
+		if err == nil {
+			err = setLastUpdateDate(date)
+		}
+	} else {
+		err = reloadIPRanges(date)
+	}
+	if err != nil {
+		return err
+	}
+	polledValidator = validator
+	return nil
+}
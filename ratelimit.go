@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Providers that count requests answer 429, some 403, with a Retry-After
+// header when polled too often, and block accounts that keep polling anyway.
+// A rate limited download waits as long as the provider asks when that is
+// short enough, and otherwise fails. Either way the provider's host isn't
+// contacted again before the wait is over, across restarts and scheduler
+// runs, as the state is kept in the metadata table.
+
+const (
+	rateLimitKeyPrefix  = "rate_limit:"
+	rateLimitMinBackoff = time.Minute
+	rateLimitMaxBackoff = 24 * time.Hour
+)
+
+// downloadMaxRetryAfter is the longest wait a download sits out before
+// retrying. A provider asking for more fails the download.
+var downloadMaxRetryAfter time.Duration
+
+// RateLimit is the rate-limit state of an upstream host.
+type RateLimit struct {
+	Host string `json:"host"`
+	// Status is the status of the response that set the state: 429 or 403
+	// when rate limited, 200 when a successful response used up the quota.
+	Status int `json:"status"`
+	// Until is when the host may be contacted again.
+	Until time.Time `json:"until"`
+	// Hits counts the rate limited responses in a row. Without Retry-After
+	// the wait doubles with each.
+	Hits int `json:"hits,omitempty"`
+}
+
+// rateLimitError is a response telling the client to slow down. retryAfter
+// is 0 when the response didn't say for how long.
+type rateLimitError struct {
+	code       int
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("server returned %s", e.status)
+}
+
+// rateLimitResponse returns the rate-limit error of resp, or nil. A 403 only
+// counts with a Retry-After header, as it usually means bad credentials.
+func rateLimitResponse(resp *http.Response) *rateLimitError {
+	retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusForbidden && ok:
+	default:
+		return nil
+	}
+	return &rateLimitError{code: resp.StatusCode, status: resp.Status, retryAfter: retryAfter}
+}
+
+// parseRetryAfter parses a Retry-After header, either seconds or a date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// quotaReset returns when the quota a provider reports with
+// X-RateLimit-Remaining and X-RateLimit-Reset, or the RateLimit-* headers
+// without the prefix, is renewed, if it is used up. The reset is either
+// seconds from now or, when it is that large, a Unix time.
+func quotaReset(h http.Header) time.Time {
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		if h.Get(prefix+"Remaining") != "0" {
+			continue
+		}
+		reset, err := strconv.ParseInt(strings.TrimSpace(h.Get(prefix+"Reset")), 10, 64)
+		if err != nil || reset < 0 {
+			continue
+		}
+		if reset > 1e9 {
+			return time.Unix(reset, 0).UTC()
+		}
+		return time.Now().UTC().Add(time.Duration(reset) * time.Second)
+	}
+	return time.Time{}
+}
+
+func downloadHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+func loadRateLimit(host string) (*RateLimit, error) {
+	var value string
+	err := db.Load().QueryRow("SELECT value FROM metadata WHERE key = ?", rateLimitKeyPrefix+host).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load rate limit of %s: %v", host, err)
+	}
+	var limit RateLimit
+	if err := json.Unmarshal([]byte(value), &limit); err != nil {
+		return nil, fmt.Errorf("failed to load rate limit of %s: %v", host, err)
+	}
+	return &limit, nil
+}
+
+func saveRateLimit(limit RateLimit) error {
+	value, err := json.Marshal(limit)
+	if err != nil {
+		return err
+	}
+	_, err = db.Load().Exec("INSERT OR REPLACE INTO metadata (key, value) VALUES (?, ?)", rateLimitKeyPrefix+limit.Host, string(value))
+	if err != nil {
+		return fmt.Errorf("failed to save rate limit of %s: %v", limit.Host, err)
+	}
+	return nil
+}
+
+// checkRateLimit returns an error while host asked not to be contacted.
+func checkRateLimit(host string) error {
+	limit, err := loadRateLimit(host)
+	if err != nil {
+		return err
+	}
+	if limit != nil && time.Now().Before(limit.Until) {
+		return fmt.Errorf("rate limited by %s until %s", host, limit.Until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// recordRateLimit stores that host rate limited a download and returns how
+// long to wait before contacting it again.
+func recordRateLimit(host string, e *rateLimitError) time.Duration {
+	limit := RateLimit{Host: host, Status: e.code, Hits: 1}
+	if previous, err := loadRateLimit(host); err != nil {
+		log.Printf("Error loading rate limit: %v", err)
+	} else if previous != nil && previous.Hits > 0 {
+		limit.Hits = previous.Hits + 1
+	}
+
+	wait := e.retryAfter
+	if wait == 0 {
+		wait = rateLimitMaxBackoff
+		if limit.Hits <= 12 {
+			wait = min(rateLimitMinBackoff<<(limit.Hits-1), rateLimitMaxBackoff)
+		}
+	}
+	limit.Until = time.Now().UTC().Add(wait)
+	log.Printf("Rate limited by %s (%d), not contacting it again before %s", host, e.code, limit.Until.Format(time.RFC3339))
+	if err := saveRateLimit(limit); err != nil {
+		log.Printf("Error saving rate limit: %v", err)
+	}
+	return wait
+}
+
+// recordDownloadSuccess clears the rate-limit state of host, or keeps it
+// from being contacted before reset when the download used up the quota.
+func recordDownloadSuccess(host string, reset time.Time) {
+	var err error
+	if reset.After(time.Now()) {
+		log.Printf("Quota of %s is used up, not contacting it again before %s", host, reset.Format(time.RFC3339))
+		err = saveRateLimit(RateLimit{Host: host, Status: http.StatusOK, Until: reset})
+	} else {
+		_, err = db.Load().Exec("DELETE FROM metadata WHERE key = ?", rateLimitKeyPrefix+host)
+	}
+	if err != nil {
+		log.Printf("Error saving rate limit of %s: %v", host, err)
+	}
+}
+
+// listRateLimits returns the rate-limit state of every host that has one.
+func listRateLimits() ([]RateLimit, error) {
+	rows, err := db.Load().Query("SELECT value FROM metadata WHERE key LIKE ? ORDER BY key", rateLimitKeyPrefix+"%")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rate limits: %v", err)
+	}
+	defer rows.Close()
+	limits := []RateLimit{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("failed to list rate limits: %v", err)
+		}
+		var limit RateLimit
+		if json.Unmarshal([]byte(value), &limit) == nil {
+			limits = append(limits, limit)
+		}
+	}
+	return limits, rows.Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rdnsCacheSize = 100000
+
+var (
+	rdnsDefault bool
+	rdnsTimeout time.Duration
+	// rdnsCache holds the PTR result per IP, including empty results so
+	// addresses without a PTR record aren't queried on every request.
+	rdnsCache *ttlCache[string, string]
+)
+
+func initReverseDNS() {
+	rdnsDefault = envBool("RDNS_DEFAULT", false)
+	rdnsTimeout = envDuration("RDNS_TIMEOUT", time.Second)
+	rdnsCache = newTTLCache[string, string](envDuration("RDNS_CACHE_TTL", time.Hour), rdnsCacheSize)
+}
+
+// wantsReverseDNS reports whether the request asked for a PTR lookup, falling
+// back to the RDNS_DEFAULT setting.
+func wantsReverseDNS(r *http.Request) bool {
+	v := r.URL.Query().Get("rdns")
+	if v == "" {
+		return rdnsDefault
+	}
+	b, err := strconv.ParseBool(v)
+	return err == nil && b
+}
+
+// reverseLookup returns the first PTR name for ip, or "" if there is none or
+// the lookup doesn't complete within RDNS_TIMEOUT.
+func reverseLookup(ctx context.Context, ip string) string {
+	if hostname, ok := rdnsCache.Get(ip); ok {
+		return hostname
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rdnsTimeout)
+	defer cancel()
+
+	var hostname string
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err == nil && len(names) > 0 {
+		hostname = strings.TrimSuffix(names[0], ".")
+	}
+
+	// Don't cache timeouts caused by the caller going away or a slow
+	// resolver, only real answers (including NXDOMAIN).
+	if dnsErr, ok := err.(*net.DNSError); (err == nil || (ok && dnsErr.IsNotFound)) && !doNotPersist(ctx) {
+		rdnsCache.Set(ip, hostname)
+	}
+	return hostname
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	refreshTriggerStartup  = "startup"
+	refreshTriggerSchedule = "schedule"
+	refreshTriggerManual   = "manual"
+	refreshTriggerRepair   = "repair"
+	refreshTriggerRestore  = "restore"
+	refreshTriggerStage    = "stage"
+	refreshTriggerPromote  = "promote"
+)
+
+var errRefreshInProgress = errors.New("refresh already in progress")
+
+// RefreshStatus describes the running or most recent dataset refresh.
+type RefreshStatus struct {
+	InProgress     bool       `json:"in_progress"`
+	Trigger        string     `json:"trigger,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	LastFinishedAt *time.Time `json:"last_finished_at,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+var (
+	// refreshRunning makes sure only one refresh (startup, scheduled or
+	// manual) runs at a time. Overlapping loads would otherwise fight over
+	// the SQLite write lock.
+	refreshRunning atomic.Bool
+
+	refreshStatusMu sync.Mutex
+	refreshStatus   RefreshStatus
+)
+
+// beginRefresh claims the refresh slot, returning false when another refresh
+// is already running. A successful call must be followed by a deferred
+// endRefresh, so a reload that panics doesn't keep the slot forever.
+func beginRefresh(trigger string) bool {
+	if !refreshRunning.CompareAndSwap(false, true) {
+		return false
+	}
+
+	now := time.Now().UTC()
+	refreshStatusMu.Lock()
+	refreshStatus.InProgress = true
+	refreshStatus.Trigger = trigger
+	refreshStatus.StartedAt = &now
+	refreshStatusMu.Unlock()
+	return true
+}
+
+func endRefresh(err error) {
+	now := time.Now().UTC()
+	refreshStatusMu.Lock()
+	refreshStatus.InProgress = false
+	refreshStatus.LastFinishedAt = &now
+	refreshStatus.LastError = ""
+	if err != nil {
+		refreshStatus.LastError = err.Error()
+	}
+	refreshStatusMu.Unlock()
+
+	refreshRunning.Store(false)
+}
+
+func currentRefreshStatus() RefreshStatus {
+	refreshStatusMu.Lock()
+	defer refreshStatusMu.Unlock()
+	return refreshStatus
+}
+
+// refreshIfNeeded runs updateIPRangesIfNeeded and updates the network lists
+// unless a refresh is already in progress, in which case it returns
+// errRefreshInProgress.
+func refreshIfNeeded(trigger string) (err error) {
+	if !beginRefresh(trigger) {
+		return errRefreshInProgress
+	}
+	defer func() { endRefresh(err) }()
+	err = updateIPRangesIfNeeded()
+	updateNetworkLists(false)
+	return err
+}
+
+// forceRefresh is refreshIfNeeded loading the upstream data and the network
+// lists even if they were already loaded today.
+func forceRefresh(trigger string) (err error) {
+	if !beginRefresh(trigger) {
+		return errRefreshInProgress
+	}
+	defer func() { endRefresh(err) }()
+	err = reloadIPRanges(time.Now().UTC().Format("2006-01-02"))
+	updateNetworkLists(true)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import "encoding/json"
+
+// Free datasets have ranges only known down to the continent, or not even
+// that. Lookups say how far the answer goes with resolution, and write the
+// fields they don't have as null, rather than passing the range off as fully
+// attributed with empty strings.
+
+const (
+	resolutionCountry   = "country"
+	resolutionContinent = "continent"
+	resolutionNone      = "none"
+)
+
+// applyResolution sets the resolution of info from the fields it has.
+func applyResolution(info *IPInfo) {
+	switch {
+	case info.Unknown:
+		info.Resolution = resolutionNone
+	case info.Country != "":
+		info.Resolution = resolutionCountry
+	case info.Continent != "":
+		info.Resolution = resolutionContinent
+	default:
+		info.Resolution = resolutionNone
+	}
+}
+
+// MarshalJSON writes the country and continent of info as null when they
+// aren't known, and adds the fields of the hooks last.
+func (info IPInfo) MarshalJSON() ([]byte, error) {
+	type ipInfo IPInfo
+	// The fields shadowing those of ipInfo come first, in the order of
+	// IPInfo, which keeps the order of the keys.
+	b, err := json.Marshal(struct {
+		IP             string  `json:"ip"`
+		Country        *string `json:"country"`
+		CountryName    *string `json:"country_name"`
+		CountryAlpha3  string  `json:"country_alpha3,omitempty"`
+		CountryNumeric string  `json:"country_numeric,omitempty"`
+		Continent      *string `json:"continent"`
+		ContinentName  *string `json:"continent_name"`
+		ipInfo
+	}{
+		IP:             info.IP,
+		Country:        nullIfEmpty(info.Country),
+		CountryName:    nullIfEmpty(info.CountryName),
+		CountryAlpha3:  info.CountryAlpha3,
+		CountryNumeric: info.CountryNumeric,
+		Continent:      nullIfEmpty(info.Continent),
+		ContinentName:  nullIfEmpty(info.ContinentName),
+		ipInfo:         ipInfo(info),
+	})
+	if err != nil || len(info.HookFields) == 0 {
+		return b, err
+	}
+	return appendHookFields(b, info.HookFields)
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The rules of RULES_FILE turn a lookup into a decision, e.g. deny datacenter
+// IPs of some countries, so the policy lives in one place instead of in every
+// service that calls the API. Rules are tried in order and the first one that
+// matches sets the action and score of the answer:
+//
+//	default:
+//	  action: allow
+//	rules:
+//	  - name: sanctioned-datacenters
+//	    when:
+//	      country: [IR, KP]
+//	      is_datacenter: true
+//	    action: deny
+//	    score: 90
+
+// stringList is a YAML sequence of strings, or a single string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = stringList{node.Value}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// ruleCondition is the "when" of a rule. Every field that is set must match;
+// lists match when any of their values does.
+type ruleCondition struct {
+	Country      stringList `yaml:"country"`
+	NotCountry   stringList `yaml:"not_country"`
+	Continent    stringList `yaml:"continent"`
+	ASDomain     stringList `yaml:"as_domain"`
+	IsDatacenter *bool      `yaml:"is_datacenter"`
+	IsVPN        *bool      `yaml:"is_vpn"`
+	IsTor        *bool      `yaml:"is_tor"`
+	IsAnycast    *bool      `yaml:"is_anycast"`
+	IsEU         *bool      `yaml:"is_eu"`
+	IsSanctioned *bool      `yaml:"is_sanctioned"`
+	ThreatFeeds  stringList `yaml:"threat_feeds"`
+	Labels       stringList `yaml:"labels"`
+	MinRiskScore *int       `yaml:"min_risk_score"`
+}
+
+type ruleDefinition struct {
+	Name   string        `yaml:"name"`
+	When   ruleCondition `yaml:"when"`
+	Action string        `yaml:"action"`
+	Score  *int          `yaml:"score"`
+}
+
+type rulesFile struct {
+	Default struct {
+		Action string `yaml:"action"`
+		Score  *int   `yaml:"score"`
+	} `yaml:"default"`
+	Rules []ruleDefinition `yaml:"rules"`
+}
+
+// rule is a rule ready to be evaluated, with its country lists expanded.
+type rule struct {
+	ruleDefinition
+	countries    map[string]bool
+	notCountries map[string]bool
+}
+
+// ruleSet is the policy of RULES_FILE.
+type ruleSet struct {
+	rules         []*rule
+	defaultAction string
+	defaultScore  *int
+}
+
+var lookupRules *ruleSet
+
+// loadRules reads the rules of path. Countries may be given as codes or
+// COUNTRY_GROUPS names, so it must run after those are parsed.
+func loadRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var file rulesFile
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	set := &ruleSet{defaultAction: file.Default.Action, defaultScore: file.Default.Score}
+	if set.defaultAction == "" {
+		set.defaultAction = "allow"
+	}
+	if err := checkRuleScore(set.defaultScore); err != nil {
+		return nil, fmt.Errorf("%s: default: %v", path, err)
+	}
+	for i, def := range file.Rules {
+		if def.Name == "" {
+			def.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		r := &rule{ruleDefinition: def}
+		if r.Action == "" {
+			return nil, fmt.Errorf("%s: %s has no action", path, def.Name)
+		}
+		if err := checkRuleScore(r.Score); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, def.Name, err)
+		}
+		if r.countries, err = expandRuleCountries(def.When.Country); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, def.Name, err)
+		}
+		if r.notCountries, err = expandRuleCountries(def.When.NotCountry); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, def.Name, err)
+		}
+		set.rules = append(set.rules, r)
+	}
+	return set, nil
+}
+
+func checkRuleScore(score *int) error {
+	if score != nil && (*score < 0 || *score > 100) {
+		return fmt.Errorf("score %d is out of range, expected 0 to 100", *score)
+	}
+	return nil
+}
+
+func expandRuleCountries(list stringList) (map[string]bool, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return expandCountries(list)
+}
+
+// matches reports whether the lookup result info satisfies every condition
+// of the rule.
+func (r *rule) matches(info *IPInfo) bool {
+	w := r.When
+	if r.countries != nil && !r.countries[info.Country] {
+		return false
+	}
+	if r.notCountries != nil && r.notCountries[info.Country] {
+		return false
+	}
+	if len(w.Continent) > 0 && !containsFold(w.Continent, info.Continent) {
+		return false
+	}
+	if len(w.ASDomain) > 0 && !containsFold(w.ASDomain, info.ASDomain) {
+		return false
+	}
+	for _, flag := range []struct {
+		want *bool
+		got  bool
+	}{
+		{w.IsDatacenter, info.IsDatacenter},
+		{w.IsVPN, info.IsVPN},
+		{w.IsTor, info.IsTor},
+		{w.IsAnycast, info.IsAnycast},
+		{w.IsEU, info.IsEU},
+		{w.IsSanctioned, info.IsSanctioned},
+	} {
+		if flag.want != nil && *flag.want != flag.got {
+			return false
+		}
+	}
+	if len(w.ThreatFeeds) > 0 && !containsAny(w.ThreatFeeds, info.ThreatFeeds) {
+		return false
+	}
+	if len(w.Labels) > 0 && !containsAny(w.Labels, info.Labels) {
+		return false
+	}
+	if w.MinRiskScore != nil && info.RiskScore < *w.MinRiskScore {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if s != "" && strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(list []string, values []string) bool {
+	for _, v := range values {
+		if containsString(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRules sets the action and score of the first matching rule, or the
+// defaults. The score is the lookup's risk score unless the rule sets one.
+func applyRules(info *IPInfo) {
+	if lookupRules == nil {
+		return
+	}
+	action, score, name := lookupRules.defaultAction, lookupRules.defaultScore, ""
+	for _, r := range lookupRules.rules {
+		if r.matches(info) {
+			action, score, name = r.Action, r.Score, r.Name
+			break
+		}
+	}
+	info.Action = action
+	info.Rule = name
+	info.Score = new(int)
+	*info.Score = info.RiskScore
+	if score != nil {
+		*info.Score = *score
+	}
+}
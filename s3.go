@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Location is a bucket and key prefix of BACKUP_S3_URL. Uploads are signed
+// with AWS Signature Version 4 from the usual AWS_* variables, which is all a
+// single PUT needs, so the AWS SDK isn't pulled in for it.
+type s3Location struct {
+	bucket string
+	prefix string
+	// endpoint is set for S3 compatible stores like MinIO, which are
+	// addressed by path rather than by bucket host name.
+	endpoint string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+var s3Client = &http.Client{Timeout: time.Hour}
+
+// loadS3Location reads s3://bucket/prefix and the credentials.
+func loadS3Location(v string) (*s3Location, error) {
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid BACKUP_S3_URL %q, expected s3://bucket/prefix", v)
+	}
+	loc := &s3Location{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		endpoint:     strings.TrimSuffix(os.Getenv("BACKUP_S3_ENDPOINT"), "/"),
+		region:       os.Getenv("AWS_REGION"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if loc.region == "" {
+		loc.region = "us-east-1"
+	}
+	if loc.accessKey == "" || loc.secretKey == "" {
+		return nil, fmt.Errorf("BACKUP_S3_URL needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if loc.prefix != "" {
+		loc.prefix += "/"
+	}
+	return loc, nil
+}
+
+func (l *s3Location) url(name string) string {
+	return "s3://" + l.bucket + "/" + l.prefix + name
+}
+
+// objectURL is where the object name is PUT.
+func (l *s3Location) objectURL(name string) string {
+	key := l.prefix + name
+	if l.endpoint != "" {
+		return l.endpoint + "/" + l.bucket + "/" + key
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", l.bucket, l.region, key)
+}
+
+// put uploads the file at path as the object name.
+func (l *s3Location) put(ctx context.Context, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, l.objectURL(name), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+	l.sign(req, time.Now().UTC())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to req. The body isn't hashed, which
+// S3 allows over HTTPS.
+func (l *s3Location) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := map[string]string{"host": req.URL.Host, "x-amz-content-sha256": payload, "x-amz-date": amzDate}
+	if l.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", l.sessionToken)
+		headers = append(headers, "x-amz-security-token")
+		values["x-amz-security-token"] = l.sessionToken
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h + ":" + values[h] + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := day + "/" + l.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+l.secretKey), day)
+	key = hmacSHA256(key, l.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		l.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
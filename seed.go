@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// A seed snapshot shipped alongside the binary (SEED_DB_PATH) lets a fresh
+// deployment answer lookups before its first download finishes. It is either
+// a copy of data/ip_ranges.db or a gzipped file in the upstream format.
+
+var seedPath string
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+func isSQLiteFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(header, sqliteHeader), nil
+}
+
+// copySeedDatabase installs a SQLite seed as the database when there is none
+// yet. It must run before the database is opened.
+func copySeedDatabase() (bool, error) {
+	if seedPath == "" {
+		return false, nil
+	}
+	if _, err := os.Stat(dbFile); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	isSQLite, err := isSQLiteFile(seedPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read seed %s: %v", seedPath, err)
+	}
+	if !isSQLite {
+		return false, nil
+	}
+
+	src, err := os.Open(seedPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open seed %s: %v", seedPath, err)
+	}
+	defer src.Close()
+
+	// Copy next to the database and rename, so an interrupted copy never
+	// looks like a database.
+	tmp, err := os.CreateTemp(filepath.Dir(dbFile), "seed_*.db")
+	if err != nil {
+		return false, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		return false, fmt.Errorf("failed to copy seed %s: %v", seedPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to copy seed %s: %v", seedPath, err)
+	}
+	if err := os.Rename(tmp.Name(), dbFile); err != nil {
+		return false, fmt.Errorf("failed to install seed database: %v", err)
+	}
+
+	log.Printf("Seeded database from %s", seedPath)
+	return true, nil
+}
+
+// loadSeedSnapshot loads an upstream format seed when no dataset is active.
+// The dataset is versioned with the seed's modification date and the last
+// update date is left unset, so the next refresh still downloads.
+func loadSeedSnapshot() (bool, error) {
+	if seedPath == "" || activeDatasetID.Load() != 0 {
+		return false, nil
+	}
+	isSQLite, err := isSQLiteFile(seedPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read seed %s: %v", seedPath, err)
+	}
+	if isSQLite {
+		// Only installed into an empty data directory, see copySeedDatabase.
+		return false, nil
+	}
+
+	f, err := os.Open(seedPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open seed %s: %v", seedPath, err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat seed %s: %v", seedPath, err)
+	}
+
+	log.Printf("Loading seed snapshot %s...", seedPath)
+	err = loadIPRangesFile(fi.ModTime().UTC().Format("2006-01-02"), newProvenance(seedPath, ""), f, "", "")
+	if err != nil {
+		return false, fmt.Errorf("failed to load seed %s: %v", seedPath, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// GET /admin/selftest looks up canary IPs whose country is known for sure
+// and reports which answers still match, so a release pipeline can check the
+// data itself after a refresh rather than only that the server is up.
+
+// selftestNotFound is the expected country of canaries that must not be found.
+const selftestNotFound = "-"
+
+// Canary is an IP of SELFTEST_FILE and the country it must be found in.
+type Canary struct {
+	IP      string `json:"ip"`
+	Country string `json:"expected"`
+}
+
+// CanaryResult is the outcome of looking up a canary.
+type CanaryResult struct {
+	Canary
+	Actual string `json:"actual"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+var selftestCanaries []Canary
+
+func loadSelftestConfig() error {
+	path := os.Getenv("SELFTEST_FILE")
+	if path == "" {
+		return nil
+	}
+	canaries, err := loadCanaries(path)
+	if err != nil {
+		return err
+	}
+	selftestCanaries = canaries
+	return nil
+}
+
+// loadCanaries reads a file of canaries, an IP and a country code per line,
+// or - for IPs that must not be found. Blank lines and lines starting with #
+// are skipped.
+func loadCanaries(path string) ([]Canary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var canaries []Canary
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid canary on line %d of %s, expected an IP and a country code", n, path)
+		}
+		canaries = append(canaries, Canary{IP: fields[0], Country: strings.ToUpper(fields[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if len(canaries) == 0 {
+		return nil, fmt.Errorf("no canaries in %s", path)
+	}
+	return canaries, nil
+}
+
+// runSelftest looks up every canary in the active dataset. The lookups don't
+// count in the stats nor fill the caches.
+func runSelftest(ctx context.Context) []CanaryResult {
+	ctx = context.WithValue(ctx, doNotPersistKey{}, true)
+	results := make([]CanaryResult, len(selftestCanaries))
+	for i, c := range selftestCanaries {
+		res := CanaryResult{Canary: c}
+		info, err := lookupIP(ctx, c.IP)
+		switch {
+		case errors.Is(err, errNotFound):
+			res.Actual = selftestNotFound
+		case err != nil:
+			res.Error = err.Error()
+		default:
+			res.Actual = info.Country
+		}
+		res.Passed = res.Error == "" && res.Actual == c.Country
+		results[i] = res
+	}
+	return results
+}
+
+// selftestHandler answers 200 when every canary passed and 503 otherwise,
+// so pipelines can check the status code alone.
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	results := runSelftest(r.Context())
+	failed := 0
+	for _, res := range results {
+		if !res.Passed {
+			failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"passed":          failed == 0,
+		"canaries":        len(results),
+		"failed":          failed,
+		"dataset_version": datasetVersion(),
+		"results":         results,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// With SERVE_ONLY the database is managed outside the service, e.g. built in
+// CI and shipped with the image: nothing downloads data or schedules updates.
+// With DB_WATCH the database file is watched and reopened when another
+// process replaces it, so a new build is served without a restart.
+
+const refreshTriggerReopen = "reopen"
+
+// dbWatchDelay is how long the database file must stay unchanged before it
+// is reopened, so a file still being written isn't read half-way.
+const dbWatchDelay = time.Second
+
+// dbDrainTimeout bounds the wait for the queries still reading the replaced
+// file before it is closed.
+const dbDrainTimeout = 30 * time.Second
+
+var (
+	serveOnly bool
+	dbWatch   bool
+)
+
+func loadServeOnlyConfig() {
+	serveOnly = envBool("SERVE_ONLY", false)
+	dbWatch = envBool("DB_WATCH", false)
+}
+
+// updatesDisabled reports whether the datasets are managed outside the
+// service, which then never downloads them.
+func updatesDisabled() bool {
+	return serveOnly || dbReadOnly
+}
+
+// checkServeOnlyConfig rejects the settings that update the database when
+// updates are disabled.
+func checkServeOnlyConfig(forceUpdate bool) error {
+	if !updatesDisabled() {
+		return nil
+	}
+	switch {
+	case forceUpdate:
+		return fmt.Errorf("--force-update can't be used when updates are disabled")
+	case isFollower():
+		return fmt.Errorf("PRIMARY_URL can't be used when updates are disabled")
+	}
+	return nil
+}
+
+// rejectUpdates answers the endpoints that download data when updates are
+// disabled.
+func rejectUpdates(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if serveOnly {
+			writeError(w, r, http.StatusConflict, "serve_only", "Updates are disabled, the database is managed outside the service")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// startDatabaseWatcher reopens the database whenever another file is moved or
+// copied in its place. Writes to the file itself are ignored, as the service
+// makes them too. The directory is watched rather than the file, as renaming
+// another file over it ends the watch of the old one.
+func startDatabaseWatcher() error {
+	if !dbWatch {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", dbFile, err)
+	}
+	if err := watcher.Add(filepath.Dir(dbFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %v", dbFile, err)
+	}
+	log.Printf("Watching %s for changes", dbFile)
+
+	path := filepath.Clean(dbFile)
+	go func() {
+		timer := time.NewTimer(dbWatchDelay)
+		timer.Stop()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path || !event.Has(fsnotify.Create) {
+					continue
+				}
+				timer.Reset(dbWatchDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching %s: %v", dbFile, err)
+			case <-timer.C:
+				log.Printf("%s changed, reopening it", dbFile)
+				if err := reopenDatabase(); err != nil {
+					log.Printf("Error reopening %s: %v", dbFile, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// reopenDatabase makes lookups read the current database file and reloads
+// everything they keep in memory, like a restore does.
+func reopenDatabase() (err error) {
+	if !beginRefresh(refreshTriggerReopen) {
+		return errRefreshInProgress
+	}
+	defer func() { endRefresh(err) }()
+	err = reopenConnections()
+	if err == nil {
+		err = prepareDatabase()
+	}
+	if err == nil {
+		purgeNegativeCache()
+		purgeLastGoodCache()
+		log.Printf("Reopened %s, dataset %s is now active", dbFile, datasetVersion())
+	}
+	return err
+}
+
+// reopenConnections opens the current database file and makes every query
+// use it, as connections keep reading the file they were opened on even
+// once another one replaced it. The previous database is closed in the
+// background once the queries still reading it are done.
+func reopenConnections() error {
+	next, err := openDatabase(databaseDSN())
+	if err != nil {
+		return err
+	}
+	if err := next.Ping(); err != nil {
+		next.Close()
+		return fmt.Errorf("failed to open %s: %v", dbFile, err)
+	}
+	db.Store(next)
+	go closeDrained(sqliteStore.swapDatabase(next))
+	return nil
+}
+
+// closeDrained closes a replaced database once no query uses it anymore, or
+// after dbDrainTimeout.
+func closeDrained(prev *sqliteConn) {
+	deadline := time.Now().Add(dbDrainTimeout)
+	for prev.db.Stats().InUse > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := prev.close(); err != nil {
+		log.Printf("Error closing the previous %s: %v", dbFile, err)
+	}
+}
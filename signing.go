@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureAlgorithmHeader = "X-Signature-Algorithm"
+	datasetVersionHeader     = "X-Dataset-Version"
+
+	algorithmHMACSHA256 = "hmac-sha256"
+	algorithmEd25519    = "ed25519"
+)
+
+var (
+	signingAlgorithm  string
+	signingHMACKey    []byte
+	signingPrivateKey ed25519.PrivateKey
+)
+
+// unsignedPaths are responses that can't be buffered to sign them: streamed
+// lookups, enriched files and database backups. Batches sent as NDJSON
+// aren't signed either.
+var unsignedPaths = map[string]bool{
+	"/stream":       true,
+	"/enrich":       true,
+	"/admin/backup": true,
+}
+
+// loadSigningConfig reads SIGNING_HMAC_KEY or SIGNING_ED25519_KEY. The
+// Ed25519 key is the base64 encoded 32 byte seed or 64 byte private key.
+func loadSigningConfig() error {
+	hmacKey := os.Getenv("SIGNING_HMAC_KEY")
+	edKey := os.Getenv("SIGNING_ED25519_KEY")
+
+	switch {
+	case hmacKey != "" && edKey != "":
+		return fmt.Errorf("only one of SIGNING_HMAC_KEY and SIGNING_ED25519_KEY can be set")
+	case hmacKey != "":
+		signingAlgorithm = algorithmHMACSHA256
+		signingHMACKey = []byte(hmacKey)
+	case edKey != "":
+		raw, err := base64.StdEncoding.DecodeString(edKey)
+		if err != nil {
+			return fmt.Errorf("SIGNING_ED25519_KEY is not valid base64: %v", err)
+		}
+		switch len(raw) {
+		case ed25519.SeedSize:
+			signingPrivateKey = ed25519.NewKeyFromSeed(raw)
+		case ed25519.PrivateKeySize:
+			signingPrivateKey = ed25519.PrivateKey(raw)
+		default:
+			return fmt.Errorf("SIGNING_ED25519_KEY must decode to %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+		}
+		signingAlgorithm = algorithmEd25519
+	}
+	return nil
+}
+
+// signPayload signs the dataset version and body joined by a newline, so a
+// signature can't be replayed against a different dataset version.
+func signPayload(version string, body []byte) string {
+	payload := make([]byte, 0, len(version)+1+len(body))
+	payload = append(payload, version...)
+	payload = append(payload, '\n')
+	payload = append(payload, body...)
+
+	switch signingAlgorithm {
+	case algorithmEd25519:
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(signingPrivateKey, payload))
+	default:
+		mac := hmac.New(sha256.New, signingHMACKey)
+		mac.Write(payload)
+		return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+}
+
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header         { return b.header }
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// signingMiddleware buffers the response and adds a signature over the
+// dataset version and body.
+func signingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unsignedPaths[r.URL.Path] || isNDJSONBatch(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buf := &bufferedResponseWriter{header: w.Header()}
+		next.ServeHTTP(buf, r)
+		if buf.status == 0 {
+			buf.status = http.StatusOK
+		}
+
+		// Historical lookups set the version of the dataset they used.
+		version := w.Header().Get(datasetVersionHeader)
+		if version == "" {
+			version = datasetVersion()
+		}
+		w.Header().Set(datasetVersionHeader, version)
+		w.Header().Set(signatureAlgorithmHeader, signingAlgorithm)
+		w.Header().Set(signatureHeader, signPayload(version, buf.body.Bytes()))
+		w.WriteHeader(buf.status)
+		w.Write(buf.body.Bytes())
+	})
+}
+
+// signingKeyHandler publishes the Ed25519 public key consumers verify with.
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if signingAlgorithm != algorithmEd25519 {
+		writeError(w, r, http.StatusNotFound, "not_found", "No public signing key is configured")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"algorithm":  algorithmEd25519,
+		"public_key": base64.StdEncoding.EncodeToString(signingPrivateKey.Public().(ed25519.PublicKey)),
+	})
+}
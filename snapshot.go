@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// With LOOKUP_ENGINE=memory lookups of the active dataset are answered from
+// an immutable in-memory snapshot instead of SQLite. A refresh builds the
+// snapshot of the new dataset next to the current one and swaps a pointer:
+// lookups load the pointer once, so each sees one version throughout, and
+// the old snapshot is freed once the last lookup holding it is done. The
+// read path takes no locks, and a refresh never empties the caches lookups
+// depend on.
+
+const (
+	lookupEngineSQLite = "sqlite"
+	lookupEngineMemory = "memory"
+	lookupEngineBolt   = "bolt"
+)
+
+var (
+	lookupEngine = lookupEngineSQLite
+
+	// memorySnapshot is the snapshot of the active dataset, kept with the
+	// memory engine or FALLBACK_SNAPSHOT.
+	memorySnapshot atomic.Pointer[memoryRangeStore]
+)
+
+func loadLookupEngineConfig() error {
+	engine := os.Getenv("LOOKUP_ENGINE")
+	switch engine {
+	case "":
+	case lookupEngineSQLite, lookupEngineMemory, lookupEngineBolt:
+		lookupEngine = engine
+	default:
+		return fmt.Errorf("invalid LOOKUP_ENGINE %q, expected %s, %s or %s", engine, lookupEngineSQLite, lookupEngineMemory, lookupEngineBolt)
+	}
+	boltPath = os.Getenv("BOLT_PATH")
+	if boltPath == "" {
+		boltPath = filepath.Join(filepath.Dir(dbFile), "ip_ranges.bolt")
+	}
+	return nil
+}
+
+// activeSnapshot returns the snapshot lookups of the active dataset are
+// answered from, or nil when they go to SQLite.
+func activeSnapshot() *memoryRangeStore {
+	if lookupEngine != lookupEngineMemory {
+		return nil
+	}
+	return memorySnapshot.Load()
+}
+
+// refreshMemorySnapshot loads the dataset id into memory. The previous
+// snapshot is kept until the new one is complete, and also when loading
+// fails. With the memory engine it returns once the snapshot is in place,
+// for FALLBACK_SNAPSHOT it loads in the background.
+func refreshMemorySnapshot(id int64) error {
+	if id == 0 {
+		return nil
+	}
+	if lookupEngine == lookupEngineMemory {
+		return loadMemorySnapshot(id)
+	}
+	if fallbackSnapshotEnabled {
+		go func() {
+			if err := loadMemorySnapshot(id); err != nil {
+				log.Printf("Error loading fallback snapshot of dataset %d: %v", id, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func loadMemorySnapshot(id int64) error {
+	start := time.Now()
+	s, err := loadMemoryRangeStore(id)
+	if err != nil {
+		return fmt.Errorf("failed to load the snapshot of dataset %d: %v", id, err)
+	}
+	memorySnapshot.Store(s)
+	log.Printf("Loaded snapshot of dataset %d (%d ranges) in %s", id, s.ranges, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build !purego
+
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const sqliteDriverName = "sqlite3"
+
+// backupSQLite copies the database of src to the file at path with SQLite's
+// online backup API.
+func backupSQLite(ctx context.Context, src *sql.DB, path string) error {
+	dst, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return copySQLite(ctx, dst, src)
+}
+
+// restoreSQLite replaces the database of dst with the file at path.
+func restoreSQLite(ctx context.Context, dst *sql.DB, path string) error {
+	src, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copySQLite(ctx, dst, src)
+}
+
+// copySQLite copies every page of src to dst in one step, so the copy is
+// consistent even while src is being written to.
+func copySQLite(ctx context.Context, dst, src *sql.DB) error {
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			backup, err := d.(*sqlite3.SQLiteConn).Backup("main", s.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
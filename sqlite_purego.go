@@ -0,0 +1,59 @@
+//go:build purego
+
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"modernc.org/sqlite"
+)
+
+const sqliteDriverName = "sqlite"
+
+// backupConn and restoreConn are the backup API of modernc.org/sqlite's
+// connections.
+type backupConn interface {
+	NewBackup(dstURI string) (*sqlite.Backup, error)
+}
+
+type restoreConn interface {
+	NewRestore(srcURI string) (*sqlite.Backup, error)
+}
+
+// backupSQLite copies the database of src to the file at path with SQLite's
+// online backup API.
+func backupSQLite(ctx context.Context, src *sql.DB, path string) error {
+	return withSQLiteBackup(ctx, src, func(c interface{}) (*sqlite.Backup, error) {
+		return c.(backupConn).NewBackup(path)
+	})
+}
+
+// restoreSQLite replaces the database of dst with the file at path.
+func restoreSQLite(ctx context.Context, dst *sql.DB, path string) error {
+	return withSQLiteBackup(ctx, dst, func(c interface{}) (*sqlite.Backup, error) {
+		return c.(restoreConn).NewRestore(path)
+	})
+}
+
+// withSQLiteBackup copies every page in one step, so the copy is consistent
+// even while the source is being written to.
+func withSQLiteBackup(ctx context.Context, db *sql.DB, start func(interface{}) (*sqlite.Backup, error)) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(c interface{}) error {
+		backup, err := start(c)
+		if err != nil {
+			return err
+		}
+		if _, err := backup.Step(-1); err != nil {
+			backup.Finish()
+			return err
+		}
+		return backup.Finish()
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A refresh switches lookups to the new data as soon as it is loaded. Staging
+// loads it the same way but leaves it inactive, along with its diff against
+// the active dataset, until it is promoted, so a human can look at big
+// upstream changes before they reach production. There is at most one staged
+// dataset; staging again or refreshing replaces it.
+
+// StagedDataset is the staged dataset with what promoting it would change.
+type StagedDataset struct {
+	Dataset       Dataset      `json:"dataset"`
+	ActiveDataset *Dataset     `json:"active_dataset,omitempty"`
+	Diff          *DatasetDiff `json:"diff,omitempty"`
+}
+
+var refreshRequirePromotion bool
+
+var errNoStagedDataset = errors.New("no staged dataset")
+
+// stagedDatasetID returns the id of the staged dataset, or 0.
+func stagedDatasetID(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}) (int64, error) {
+	var id int64
+	err := q.QueryRow("SELECT CAST(value AS INTEGER) FROM metadata WHERE key = 'staged_dataset_id'").Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to load staged dataset: %v", err)
+	}
+	return id, nil
+}
+
+// stageIPRanges downloads the upstream data into a new dataset tagged with
+// version without activating it.
+func stageIPRanges(version string) error {
+	log.Println("Downloading new IP ranges data to stage...")
+	compressedFile, err := os.CreateTemp("", "ip_ranges_*.json.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(compressedFile.Name())
+	defer compressedFile.Close()
+
+	d, err := downloadFile(dataURL, dataHeader, compressedFile)
+	if err != nil {
+		return fmt.Errorf("failed to download data: %v", err)
+	}
+
+	log.Println("Staging new data...")
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = discardStagedDataset(tx, 0)
+	if err != nil {
+		return err
+	}
+	datasetID, err := insertDataset(tx, version, newProvenance(dataURL, d.validator), compressedFile, dataFormat, d.contentType)
+	if err != nil {
+		return err
+	}
+	diff, err := diffDatasets(tx, activeDatasetID.Load(), datasetID)
+	if err != nil {
+		return err
+	}
+	diffJSON, err := json.Marshal(diff)
+	if err != nil {
+		return fmt.Errorf("failed to encode dataset diff: %v", err)
+	}
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO metadata (key, value) VALUES ('staged_dataset_id', ?), ('staged_diff', ?)
+	`, datasetID, string(diffJSON))
+	if err != nil {
+		return fmt.Errorf("failed to set staged dataset: %v", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	staged, err := loadStagedDataset()
+	if err != nil {
+		return err
+	}
+	if diff != nil {
+		log.Printf("Staged dataset %d: %d ranges, %d added, %d removed and %d changed versus dataset %d",
+			datasetID, staged.Dataset.RowCount, diff.Added, diff.Removed, diff.Changed, diff.PreviousDatasetID)
+	} else {
+		log.Printf("Staged dataset %d: %d ranges", datasetID, staged.Dataset.RowCount)
+	}
+	sendWebhook("dataset.staged", staged)
+	return nil
+}
+
+// discardStagedDataset deletes the staged dataset unless it is keep, which is
+// being promoted, and clears the staging area either way.
+func discardStagedDataset(tx *sql.Tx, keep int64) error {
+	id, err := stagedDatasetID(tx)
+	if err != nil {
+		return err
+	}
+	if id != 0 && id != keep {
+		for _, table := range []string{"ip_ranges", "ip_ranges_v4", "conflicts", "datasets"} {
+			column := "dataset_id"
+			if table == "datasets" {
+				column = "id"
+			}
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, column), id)
+			if err != nil {
+				return fmt.Errorf("failed to delete staged dataset from %s: %v", table, err)
+			}
+		}
+	}
+	_, err = tx.Exec("DELETE FROM metadata WHERE key IN ('staged_dataset_id', 'staged_diff')")
+	if err != nil {
+		return fmt.Errorf("failed to clear staged dataset: %v", err)
+	}
+	return nil
+}
+
+func discardStaged() error {
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	err = discardStagedDataset(tx, 0)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadStagedDataset returns the staged dataset, or errNoStagedDataset.
+func loadStagedDataset() (*StagedDataset, error) {
+	id, err := stagedDatasetID(db.Load())
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, errNoStagedDataset
+	}
+
+	d, err := datasetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	staged := &StagedDataset{Dataset: *d}
+	if active := activeDatasetID.Load(); active != 0 {
+		staged.ActiveDataset, err = datasetByID(active)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var diffJSON string
+	err = db.Load().QueryRow("SELECT value FROM metadata WHERE key = 'staged_diff'").Scan(&diffJSON)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load staged diff: %v", err)
+	}
+	if diffJSON != "" {
+		if err := json.Unmarshal([]byte(diffJSON), &staged.Diff); err != nil {
+			return nil, fmt.Errorf("failed to decode staged diff: %v", err)
+		}
+	}
+	return staged, nil
+}
+
+// promoteDataset makes the staged dataset the active one, as a refresh would
+// have, and returns its id and its diff against the dataset it replaced.
+func promoteDataset() (int64, *DatasetDiff, error) {
+	id, err := stagedDatasetID(db.Load())
+	if err != nil {
+		return 0, nil, err
+	}
+	if id == 0 {
+		return 0, nil, errNoStagedDataset
+	}
+	var version string
+	err = db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", id).Scan(&version)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load dataset %d: %v", id, err)
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The active dataset may have been rolled back since staging, so the
+	// diff is computed again.
+	previousID := activeDatasetID.Load()
+	diff, err := recordDatasetDiff(tx, previousID, id)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Historical lookups take a dataset to be active from its loaded_at on.
+	_, err = tx.Exec("UPDATE datasets SET loaded_at = ? WHERE id = ?", time.Now().UTC().Unix(), id)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to update dataset %d: %v", id, err)
+	}
+	err = activateDataset(tx, id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	err = publishDataset(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	if diff != nil {
+		sendWebhook("dataset.changed", diff)
+	}
+	if err := detectWatchChanges(previousID, id); err != nil {
+		log.Printf("Error checking watches: %v", err)
+	}
+	if err := checkCoverageDrop(previousID, id); err != nil {
+		log.Printf("Error checking coverage: %v", err)
+	}
+	if err := setLastUpdateDate(version); err != nil {
+		return 0, nil, fmt.Errorf("failed to set last update date: %v", err)
+	}
+	if err := maintainDatabase(); err != nil {
+		log.Printf("Error maintaining database: %v", err)
+	}
+
+	log.Printf("Promoted staged dataset %d, it is now active.", id)
+	return id, diff, nil
+}
+
+// stageHandler loads the upstream data into the staging area in the
+// background.
+func stageHandler(w http.ResponseWriter, r *http.Request) {
+	if isFollower() {
+		writeError(w, r, http.StatusConflict, "follower", "Followers copy the primary's active dataset, stage it on the primary")
+		return
+	}
+	if !beginRefresh(refreshTriggerStage) {
+		writeError(w, r, http.StatusConflict, "refresh_in_progress", "A refresh is already in progress")
+		return
+	}
+
+	logRequest(r, "Staging requested")
+	go func() {
+		var err error
+		defer func() { endRefresh(err) }()
+		err = stageIPRanges(time.Now().UTC().Format("2006-01-02"))
+		if err != nil {
+			log.Printf("Error staging IP ranges: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "staging"})
+}
+
+func stagedHandler(w http.ResponseWriter, r *http.Request) {
+	staged, err := loadStagedDataset()
+	if err == errNoStagedDataset {
+		writeError(w, r, http.StatusNotFound, "no_staged_dataset", "No dataset is staged")
+		return
+	} else if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	json.NewEncoder(w).Encode(staged)
+}
+
+func discardStagedHandler(w http.ResponseWriter, r *http.Request) {
+	if !beginRefresh(refreshTriggerStage) {
+		writeError(w, r, http.StatusConflict, "refresh_in_progress", "A refresh is already in progress")
+		return
+	}
+	id, err := func() (id int64, err error) {
+		defer func() { endRefresh(err) }()
+		id, err = stagedDatasetID(db.Load())
+		if err == nil && id != 0 {
+			err = discardStaged()
+		}
+		return id, err
+	}()
+	if err == nil && id == 0 {
+		writeError(w, r, http.StatusNotFound, "no_staged_dataset", "No dataset is staged")
+		return
+	}
+	if err != nil {
+		logRequest(r, "Error discarding staged dataset: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	logRequest(r, "Discarded staged dataset %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if !beginRefresh(refreshTriggerPromote) {
+		writeError(w, r, http.StatusConflict, "refresh_in_progress", "A refresh is already in progress")
+		return
+	}
+	clearWriteDeadline(w)
+	id, diff, err := func() (id int64, diff *DatasetDiff, err error) {
+		defer func() {
+			if err == errNoStagedDataset {
+				endRefresh(nil)
+			} else {
+				endRefresh(err)
+			}
+		}()
+		return promoteDataset()
+	}()
+	if err == errNoStagedDataset {
+		writeError(w, r, http.StatusNotFound, "no_staged_dataset", "No dataset is staged")
+		return
+	}
+	if err != nil {
+		logRequest(r, "Promote error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	logRequest(r, "Promoted staged dataset %d", id)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_dataset_id": id,
+		"dataset_version":   datasetVersion(),
+		"diff":              diff,
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// LookupStats counts lookups since the process started.
+type LookupStats struct {
+	Total    int64 `json:"total"`
+	Found    int64 `json:"found"`
+	NotFound int64 `json:"not_found"`
+	Invalid  int64 `json:"invalid"`
+	Errors   int64 `json:"errors"`
+	// Degraded counts lookups the database failed, which were answered
+	// from the fallback snapshot or recent answers if possible.
+	Degraded int64 `json:"degraded"`
+	// OverBudget counts lookups that took longer than LOOKUP_BUDGET and
+	// were answered the same way.
+	OverBudget int64 `json:"over_budget"`
+	// ShortCircuited counts lookups answered the same way without querying
+	// the database, while the circuit breaker was open.
+	ShortCircuited int64 `json:"short_circuited"`
+}
+
+var (
+	startedAt = time.Now().UTC()
+
+	lookupsTotal    atomic.Int64
+	lookupsFound    atomic.Int64
+	lookupsNotFound atomic.Int64
+	lookupsInvalid  atomic.Int64
+	lookupsErrors   atomic.Int64
+)
+
+// recordLookup accounts for the outcome of a lookup of ip made by the request
+// r and adds it to the audit log.
+func recordLookup(r *http.Request, ip string, err error) {
+	if doNotPersist(r.Context()) {
+		return
+	}
+	lookupsTotal.Add(1)
+	switch {
+	case err == nil:
+		lookupsFound.Add(1)
+	case errors.Is(err, errNotFound):
+		lookupsNotFound.Add(1)
+	case errors.Is(err, errInvalidIP):
+		lookupsInvalid.Add(1)
+	default:
+		lookupsErrors.Add(1)
+	}
+
+	recordAudit(r, ip, err == nil)
+}
+
+func lookupStats() LookupStats {
+	return LookupStats{
+		Total:          lookupsTotal.Load(),
+		Found:          lookupsFound.Load(),
+		NotFound:       lookupsNotFound.Load(),
+		Invalid:        lookupsInvalid.Load(),
+		Errors:         lookupsErrors.Load(),
+		Degraded:       lookupsDegraded.Load(),
+		OverBudget:     lookupsOverBudget.Load(),
+		ShortCircuited: lookupsShortCircuited.Load(),
+	}
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"started_at": startedAt,
+		"lookups":    lookupStats(),
+		"breaker":    currentBreakerStatus(),
+		"countries":  currentCountryAnomalyStatus(),
+	})
+}
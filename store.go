@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// RangeRecord is a stored range with the attributes lookups return.
+type RangeRecord struct {
+	StartIP       []byte
+	EndIP         []byte
+	Country       string
+	CountryName   string
+	Continent     string
+	ContinentName string
+	ASName        string
+	ASDomain      string
+	IsAnycast     bool
+	Countries     []string
+	Timezone      string
+	Currency      string
+	// Source is the provider of the range, in datasets merged from several.
+	Source string
+}
+
+// RangeStore is the storage engine lookups are answered from. SQLite is the
+// system of record for every dataset; a RangeStore may serve lookups from it
+// directly or from its own copy of the active dataset.
+type RangeStore interface {
+	// Lookup returns the winning range of the dataset that contains ip,
+	// which is 4 bytes long for IPv4 and 16 for IPv6, or errNotFound. The
+	// range may be shared with other lookups and must not be modified.
+	Lookup(ctx context.Context, datasetID int64, ip []byte) (*RangeRecord, error)
+}
+
+// DatasetStore is a RangeStore answering from its own copy of the active
+// dataset, built from SQLite when the dataset is published. The copy holds
+// segments that don't overlap, so a lookup is a single seek.
+type DatasetStore interface {
+	RangeStore
+	// InsertBatch adds segments, sorted by start address, to the copy of
+	// the dataset being built.
+	InsertBatch(datasetID int64, segments []rangeSegment) error
+	// SwapDataset makes the copy of the dataset the one lookups are
+	// answered from and drops the others.
+	SwapDataset(datasetID int64, version string) error
+	// Dataset returns the ID and version of the dataset lookups are
+	// answered from, or 0.
+	Dataset() (int64, string)
+}
+
+// rangeSegment is a part of the address space of a dataset and the range
+// that wins in it.
+type rangeSegment struct {
+	start, end []byte
+	record     *RangeRecord
+}
+
+var rangeStore RangeStore
+
+// sqliteStore reads ranges straight from SQLite, for historical lookups and
+// the other queries that can't be served by another engine.
+var sqliteStore *sqliteRangeStore
+
+// openDatabase opens the SQLite database with the driver selected at build
+// time: mattn/go-sqlite3 by default, or the cgo-free modernc.org/sqlite when
+// built with the purego tag.
+func openDatabase(path string) (*sql.DB, error) {
+	db, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s with the %s driver: %v", path, sqliteDriverName, err)
+	}
+	return db, nil
+}
+
+// sqliteRangeStore answers lookups with an indexed query on ip_ranges.
+type sqliteRangeStore struct {
+	conn atomic.Pointer[sqliteConn]
+}
+
+// sqliteConn is a database and the lookup queries prepared on it, which are
+// replaced together when the database is reopened.
+type sqliteConn struct {
+	db *sql.DB
+	// stmt and stmtV4 are the lookup queries of IPv6 and IPv4, prepared on
+	// first use so they aren't parsed again on every lookup.
+	stmt   atomic.Pointer[sql.Stmt]
+	stmtV4 atomic.Pointer[sql.Stmt]
+}
+
+func newSQLiteRangeStore(db *sql.DB) *sqliteRangeStore {
+	s := &sqliteRangeStore{}
+	s.conn.Store(&sqliteConn{db: db})
+	return s
+}
+
+// swapDatabase makes lookups query db and returns the database they queried
+// before, which the caller closes.
+func (s *sqliteRangeStore) swapDatabase(db *sql.DB) *sqliteConn {
+	return s.conn.Swap(&sqliteConn{db: db})
+}
+
+// close closes the prepared lookup queries and the database.
+func (c *sqliteConn) close() error {
+	for _, stmt := range []*sql.Stmt{c.stmt.Load(), c.stmtV4.Load()} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return c.db.Close()
+}
+
+// sqliteLookupQuery finds IPv6 ranges with the index on the integer
+// addresses of ip_ranges, which narrows them down to those starting before
+// the address.
+const sqliteLookupQuery = `
+	SELECT start_ip, end_ip, country, country_name, continent, continent_name, as_name, as_domain, is_anycast, countries, timezone, currency, COALESCE(source, '')
+	FROM ip_ranges
+	WHERE dataset_id = ?1 AND is_ipv6 = 1 AND (start_hi, start_lo) <= (?2, ?3) AND (end_hi, end_lo) >= (?2, ?3)
+	ORDER BY priority, rowid
+	LIMIT 1
+`
+
+// sqliteLookupQueryV4 finds IPv4 ranges with the R*Tree ip_ranges_v4, which
+// only returns those containing the address, and joins them to their
+// attributes on their integer addresses. The CROSS JOIN keeps SQLite from
+// scanning ip_ranges first when it has no statistics yet. The start_ip and
+// end_ip columns of ip_ranges_v4 are still written for older servers, which
+// join on them.
+const sqliteLookupQueryV4 = `
+	SELECT r.start_ip, r.end_ip, r.country, r.country_name, r.continent, r.continent_name, r.as_name, r.as_domain, r.is_anycast, r.countries, r.timezone, r.currency, COALESCE(r.source, '')
+	FROM ip_ranges_v4 t
+	CROSS JOIN ip_ranges r ON r.dataset_id = t.dataset_id AND r.is_ipv6 = 0 AND r.start_hi = 0 AND r.start_lo = t.start_v4 + 2147483648 AND r.end_lo = t.end_v4 + 2147483648
+	WHERE t.dataset_id <= ?1 AND t.dataset_id_max >= ?1 AND t.start_v4 <= ?2 AND t.end_v4 >= ?2
+	ORDER BY r.priority, r.rowid
+	LIMIT 1
+`
+
+// v4Coordinate is the coordinate of an IPv4 address in ip_ranges_v4, whose
+// 32-bit coordinates are signed.
+func v4Coordinate(ip []byte) int64 {
+	return int64(binary.BigEndian.Uint32(ip)) - 1<<31
+}
+
+// ipIntegers returns the integer columns of an address of ip_ranges: an
+// IPv4 address as lo with a hi of 0, an IPv6 address as its two halves with
+// their top bit flipped, so that they compare as signed integers like the
+// addresses do.
+func ipIntegers(ip []byte) (hi, lo int64) {
+	if len(ip) == 4 {
+		return 0, int64(binary.BigEndian.Uint32(ip))
+	}
+	return int64(binary.BigEndian.Uint64(ip[:8]) ^ 1<<63), int64(binary.BigEndian.Uint64(ip[8:]) ^ 1<<63)
+}
+
+// fillRangeIntegers sets the integer columns of the ranges loaded before
+// they existed, a batch at a time.
+func fillRangeIntegers(tx *sql.Tx) error {
+	type addresses struct {
+		rowid      int64
+		start, end []byte
+	}
+	var last int64
+	for {
+		rows, err := tx.Query("SELECT rowid, start_ip, end_ip FROM ip_ranges WHERE rowid > ? ORDER BY rowid LIMIT 10000", last)
+		if err != nil {
+			return err
+		}
+		var batch []addresses
+		for rows.Next() {
+			var a addresses
+			if err := rows.Scan(&a.rowid, &a.start, &a.end); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, a := range batch {
+			if (len(a.start) != 4 && len(a.start) != 16) || len(a.end) != len(a.start) {
+				return fmt.Errorf("range %d has invalid addresses %x - %x", a.rowid, a.start, a.end)
+			}
+			startHi, startLo := ipIntegers(a.start)
+			endHi, endLo := ipIntegers(a.end)
+			_, err = tx.Exec("UPDATE ip_ranges SET start_hi = ?, start_lo = ?, end_hi = ?, end_lo = ? WHERE rowid = ?", startHi, startLo, endHi, endLo, a.rowid)
+			if err != nil {
+				return err
+			}
+		}
+		last = batch[len(batch)-1].rowid
+	}
+}
+
+// statement returns the prepared lookup query of the address family. Two
+// lookups racing to prepare it keep the first one.
+func (c *sqliteConn) statement(ctx context.Context, ipv6 bool) (*sql.Stmt, error) {
+	query, cached := sqliteLookupQueryV4, &c.stmtV4
+	if ipv6 {
+		query, cached = sqliteLookupQuery, &c.stmt
+	}
+	if stmt := cached.Load(); stmt != nil {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if !cached.CompareAndSwap(nil, stmt) {
+		stmt.Close()
+		return cached.Load(), nil
+	}
+	return stmt, nil
+}
+
+func (s *sqliteRangeStore) Lookup(ctx context.Context, datasetID int64, ip []byte) (*RangeRecord, error) {
+	ipv6 := len(ip) == 16
+	stmt, err := s.conn.Load().statement(ctx, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	var row *sql.Row
+	if ipv6 {
+		hi, lo := ipIntegers(ip)
+		row = stmt.QueryRowContext(ctx, datasetID, hi, lo)
+	} else {
+		row = stmt.QueryRowContext(ctx, datasetID, v4Coordinate(ip))
+	}
+	var r RangeRecord
+	var countries string
+	err = row.Scan(&r.StartIP, &r.EndIP, &r.Country, &r.CountryName, &r.Continent, &r.ContinentName, &r.ASName, &r.ASDomain, &r.IsAnycast, &countries, &r.Timezone, &r.Currency, &r.Source)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if countries != "" {
+		r.Countries = strings.Split(countries, ",")
+	}
+	return &r, nil
+}
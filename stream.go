@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Streaming lookups keep one connection open for long running enrichment,
+// like tailing a log, instead of paying for an HTTP request per IP. Clients
+// send IPs over a WebSocket, or as the body of a POST answered with
+// server-sent events, and get a result back for each.
+
+const streamMaxMessage = 64 << 10
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// streamLookup returns the result for one IP of a stream: the lookup result,
+// or a BatchError. Every lookup gets its own REQUEST_TIMEOUT.
+func streamLookup(w http.ResponseWriter, r *http.Request, ip string) interface{} {
+	ctx := r.Context()
+	if requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+	}
+	r = r.WithContext(ctx)
+
+	info, err := lookupForRequest(r, ip)
+	if err != nil {
+		_, code, message := lookupErrorCode(err)
+		return BatchError{IP: ip, Error: ErrorDetail{Code: code, Message: message}}
+	}
+	decorateInfo(w, r, info)
+	return visibleInfo(r, info)
+}
+
+// websocketStreamHandler reads text messages of whitespace separated IPs and
+// answers each IP with a message of its own. The connection is pinged every
+// half IDLE_TIMEOUT and closed when the client stops answering.
+func websocketStreamHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := streamUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already wrote the error response.
+		logRequest(r, "WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadLimit(streamMaxMessage)
+	if idleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		})
+
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(idleTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)) != nil {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		kind, msg, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logRequest(r, "WebSocket stream ended: %v", err)
+			}
+			return
+		}
+		if kind != websocket.TextMessage {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseUnsupportedData, "Expected text messages"), time.Now().Add(time.Second))
+			return
+		}
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		for _, ip := range strings.Fields(string(msg)) {
+			if writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if err := conn.WriteJSON(streamLookup(w, r, ip)); err != nil {
+				logRequest(r, "WebSocket stream ended: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// sseStreamHandler reads IPs from the request body, one per line, and sends
+// each result as a server-sent event as soon as its line has arrived.
+func sseStreamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		logRequest(r, "Failed to enable full duplex: %v", err)
+	}
+	// The stream lasts as long as the client keeps sending.
+	rc.SetReadDeadline(time.Time{})
+	clearWriteDeadline(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// The response starts with the first event. Writing it before reading
+	// the body would skip the 100 Continue clients may be waiting for.
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 4096), streamMaxMessage)
+	for scanner.Scan() {
+		ip := strings.TrimSpace(scanner.Text())
+		if ip == "" {
+			continue
+		}
+		b, err := json.Marshal(streamLookup(w, r, ip))
+		if err != nil {
+			logRequest(r, "Failed to encode stream result: %v", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		b, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{Code: "invalid_body", Message: "Lines must be shorter than 64KB", RequestID: requestID(r.Context())}})
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+	} else if err != nil {
+		logRequest(r, "Stream body error: %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogIPRegex = `\b(?:\d{1,3}\.){3}\d{1,3}\b`
+	maxSyslogMessageSize = 64 * 1024
+	syslogLookupTimeout  = time.Second
+)
+
+type syslogConfig struct {
+	listenAddrs []string
+	ipRegex     *regexp.Regexp
+	forwardAddr string
+}
+
+// loadSyslogConfig returns nil when SYSLOG_LISTEN_ADDR isn't set, i.e. the
+// listener is disabled.
+func loadSyslogConfig() (*syslogConfig, error) {
+	listen := os.Getenv("SYSLOG_LISTEN_ADDR")
+	if listen == "" {
+		return nil, nil
+	}
+
+	cfg := &syslogConfig{forwardAddr: os.Getenv("SYSLOG_FORWARD_ADDR")}
+	for _, addr := range strings.Split(listen, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := splitNetworkAddr(addr); err != nil {
+			return nil, fmt.Errorf("invalid SYSLOG_LISTEN_ADDR: %v", err)
+		}
+		cfg.listenAddrs = append(cfg.listenAddrs, addr)
+	}
+	if cfg.forwardAddr != "" {
+		if _, _, err := splitNetworkAddr(cfg.forwardAddr); err != nil {
+			return nil, fmt.Errorf("invalid SYSLOG_FORWARD_ADDR: %v", err)
+		}
+	}
+
+	pattern := os.Getenv("SYSLOG_IP_REGEX")
+	if pattern == "" {
+		pattern = defaultSyslogIPRegex
+	}
+	var err error
+	cfg.ipRegex, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SYSLOG_IP_REGEX: %v", err)
+	}
+
+	return cfg, nil
+}
+
+// splitNetworkAddr splits "udp://:5514" into its network and address.
+func splitNetworkAddr(addr string) (string, string, error) {
+	network, hostPort, ok := strings.Cut(addr, "://")
+	if !ok || (network != "tcp" && network != "udp") {
+		return "", "", fmt.Errorf("%q must look like tcp://host:port or udp://host:port", addr)
+	}
+	return network, hostPort, nil
+}
+
+// syslogForwarder writes enriched lines to the downstream sink, reconnecting
+// lazily after a write fails. Without a sink configured lines go to stdout.
+type syslogForwarder struct {
+	mu      sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func (f *syslogForwarder) forward(line string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.addr == "" {
+		fmt.Fprintln(os.Stdout, line)
+		return
+	}
+
+	if f.conn == nil {
+		conn, err := net.DialTimeout(f.network, f.addr, 5*time.Second)
+		if err != nil {
+			log.Printf("Error connecting to syslog sink %s://%s: %v", f.network, f.addr, err)
+			return
+		}
+		f.conn = conn
+	}
+
+	payload := line
+	if f.network == "tcp" {
+		// Newline framing (RFC 6587 non-transparent framing).
+		payload += "\n"
+	}
+	if _, err := io.WriteString(f.conn, payload); err != nil {
+		log.Printf("Error forwarding to syslog sink %s://%s: %v", f.network, f.addr, err)
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func startSyslogListeners(cfg *syslogConfig) error {
+	forwarder := &syslogForwarder{}
+	if cfg.forwardAddr != "" {
+		forwarder.network, forwarder.addr, _ = splitNetworkAddr(cfg.forwardAddr)
+	}
+
+	for _, addr := range cfg.listenAddrs {
+		network, hostPort, _ := splitNetworkAddr(addr)
+		switch network {
+		case "udp":
+			conn, err := net.ListenPacket("udp", hostPort)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %v", addr, err)
+			}
+			go serveSyslogUDP(conn, cfg, forwarder)
+		case "tcp":
+			listener, err := net.Listen("tcp", hostPort)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %v", addr, err)
+			}
+			go serveSyslogTCP(listener, cfg, forwarder)
+		}
+		log.Printf("Syslog listener is running on %s", addr)
+	}
+	return nil
+}
+
+func serveSyslogUDP(conn net.PacketConn, cfg *syslogConfig, forwarder *syslogForwarder) {
+	buf := make([]byte, maxSyslogMessageSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Error reading syslog datagram: %v", err)
+			continue
+		}
+		line := strings.TrimRight(string(buf[:n]), "\r\n")
+		forwarder.forward(enrichLogLine(line, cfg.ipRegex))
+	}
+}
+
+func serveSyslogTCP(listener net.Listener, cfg *syslogConfig, forwarder *syslogForwarder) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error accepting syslog connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			scanner.Buffer(make([]byte, 4096), maxSyslogMessageSize)
+			for scanner.Scan() {
+				line := strings.TrimRight(scanner.Text(), "\r")
+				forwarder.forward(enrichLogLine(line, cfg.ipRegex))
+			}
+			if err := scanner.Err(); err != nil {
+				log.Printf("Error reading syslog stream from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// enrichLogLine appends key=value geo fields for the IPs matched by re. Named
+// capture groups prefix the fields with the group name (src_country=...),
+// otherwise the first match is reported as geo_country=... The IP is taken
+// from the first capture group when there is one, or the whole match.
+func enrichLogLine(line string, re *regexp.Regexp) string {
+	var fields []string
+	names := re.SubexpNames()
+
+	add := func(prefix, ip string) {
+		ctx, cancel := context.WithTimeout(context.Background(), syslogLookupTimeout)
+		defer cancel()
+		info, err := lookupIP(ctx, ip)
+		if err != nil {
+			return
+		}
+		fields = append(fields,
+			logField(prefix+"_country", info.Country),
+			logField(prefix+"_country_name", info.CountryName),
+			logField(prefix+"_continent_name", info.ContinentName),
+		)
+	}
+
+	hasNamed := false
+	for _, name := range names {
+		if name != "" {
+			hasNamed = true
+			break
+		}
+	}
+
+	if hasNamed {
+		seen := map[string]bool{}
+		for _, match := range re.FindAllStringSubmatch(line, -1) {
+			for i, name := range names {
+				if name == "" || match[i] == "" || seen[name] {
+					continue
+				}
+				seen[name] = true
+				add(name, match[i])
+			}
+		}
+	} else if match := re.FindStringSubmatch(line); match != nil {
+		ip := match[0]
+		if len(match) > 1 {
+			ip = match[1]
+		}
+		add("geo", ip)
+	}
+
+	if len(fields) == 0 {
+		return line
+	}
+	return line + " " + strings.Join(fields, " ")
+}
+
+func logField(key, value string) string {
+	if value == "" || strings.ContainsAny(value, " \"=") {
+		value = strconv.Quote(value)
+	}
+	return key + "=" + value
+}
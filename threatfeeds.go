@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Threat feeds are blocklists of IPs, as plain text, CSV or STIX 2 served
+// from a file or a TAXII 2.1 collection. They are kept as network lists of
+// their own, and lookups return the names of the feeds listing the IP and a
+// risk score combining the feeds' weights, so one call answers both where an
+// IP is and how risky it is.
+
+const (
+	// threatFeedPrefix starts the network list kind of every feed.
+	threatFeedPrefix = "feed:"
+
+	defaultThreatFeedWeight = 50
+)
+
+var (
+	// threatFeedWeights is the weight of each feed, 1 to 100.
+	threatFeedWeights = map[string]int{}
+
+	// networkListHeader asks TAXII servers for STIX 2.1 objects while
+	// still accepting plain files.
+	networkListHeader = http.Header{
+		"Accept": {"application/taxii+json;version=2.1, application/stix+json;version=2.1;q=0.9, */*;q=0.8"},
+	}
+
+	stixIPPattern = regexp.MustCompile(`(ipv4-addr|ipv6-addr):value\s*=\s*'([^']+)'`)
+)
+
+// loadThreatFeedConfig reads THREAT_FEEDS, "name=url;other=url", and
+// THREAT_FEED_WEIGHTS, "name:90,other:40".
+func loadThreatFeedConfig() error {
+	for _, def := range strings.Split(os.Getenv("THREAT_FEEDS"), ";") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		name, feedURL, ok := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, ":,") {
+			return fmt.Errorf("invalid THREAT_FEEDS entry %q, expected name=url", def)
+		}
+		if u, err := url.Parse(strings.TrimSpace(feedURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid URL of threat feed %s, expected an http or https URL", name)
+		}
+		networkListURLs[threatFeedPrefix+name] = strings.TrimSpace(feedURL)
+		threatFeedWeights[name] = defaultThreatFeedWeight
+	}
+
+	for _, def := range strings.Split(os.Getenv("THREAT_FEED_WEIGHTS"), ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		name, v, _ := strings.Cut(def, ":")
+		weight, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || weight < 1 || weight > 100 {
+			return fmt.Errorf("invalid THREAT_FEED_WEIGHTS entry %q, expected name:weight with a weight of 1 to 100", def)
+		}
+		if _, ok := threatFeedWeights[name]; !ok {
+			return fmt.Errorf("invalid THREAT_FEED_WEIGHTS entry %q, %s isn't in THREAT_FEEDS", def, name)
+		}
+		threatFeedWeights[name] = weight
+	}
+	return nil
+}
+
+// applyThreatFeeds adds the feeds listing ip and the resulting risk score to
+// info. Weights are taken as independent probabilities of the IP being
+// malicious, so two feeds of 50 score 75 and a feed of 100 always scores 100.
+func applyThreatFeeds(info *IPInfo, ip []byte, lists *networkListSet) {
+	info.ThreatFeeds = nil
+	clean := 1.0
+	for _, name := range lists.feeds {
+		if lists.lists[threatFeedPrefix+name].contains(ip) {
+			info.ThreatFeeds = append(info.ThreatFeeds, name)
+			weight, ok := threatFeedWeights[name]
+			if !ok {
+				weight = defaultThreatFeedWeight
+			}
+			clean *= 1 - float64(weight)/100
+		}
+	}
+	info.RiskScore = int(math.Round(100 * (1 - clean)))
+}
+
+// isJSONObject reports whether the next non-space byte of br is a {.
+func isJSONObject(br *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil || len(b) < n {
+			return false
+		}
+		switch c := b[n-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{'
+		}
+	}
+}
+
+// stixObject holds the fields of STIX 2 objects that carry IPs: indicators
+// with a STIX pattern and ipv4-addr and ipv6-addr observables.
+type stixObject struct {
+	Type        string `json:"type"`
+	Pattern     string `json:"pattern"`
+	PatternType string `json:"pattern_type"`
+	ValidUntil  string `json:"valid_until"`
+	Revoked     bool   `json:"revoked"`
+	Value       string `json:"value"`
+}
+
+// parseSTIX reads the IPs of a STIX 2 bundle or a TAXII 2.1 envelope, both
+// of which list them under "objects". Revoked and expired indicators are
+// skipped.
+func parseSTIX(br *bufio.Reader) ([]ipInterval, int, error) {
+	var doc struct {
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.NewDecoder(br).Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse STIX: %v", err)
+	}
+
+	var intervals []ipInterval
+	skipped := 0
+	now := time.Now()
+	for _, obj := range doc.Objects {
+		var values []string
+		switch obj.Type {
+		case "indicator":
+			if obj.Revoked || (obj.PatternType != "" && obj.PatternType != "stix") {
+				continue
+			}
+			if until, err := time.Parse(time.RFC3339, obj.ValidUntil); err == nil && until.Before(now) {
+				continue
+			}
+			for _, m := range stixIPPattern.FindAllStringSubmatch(obj.Pattern, -1) {
+				values = append(values, m[2])
+			}
+		case "ipv4-addr", "ipv6-addr":
+			values = append(values, obj.Value)
+		}
+		for _, v := range values {
+			in, err := parseIPInterval(v)
+			if err != nil {
+				skipped++
+				continue
+			}
+			intervals = append(intervals, in)
+		}
+	}
+	if len(intervals) == 0 {
+		return nil, 0, fmt.Errorf("no IPs in the STIX objects, %d invalid values", skipped)
+	}
+	return intervals, skipped, nil
+}
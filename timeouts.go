@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Without timeouts a slow client (slow-loris) or a hung SQLite query pins a
+// goroutine and a connection forever.
+
+var (
+	requestTimeout    time.Duration
+	lookupBudget      time.Duration
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+)
+
+func loadTimeoutConfig() {
+	requestTimeout = envDuration("REQUEST_TIMEOUT", 10*time.Second)
+	lookupBudget = envDuration("LOOKUP_BUDGET", 0)
+	readHeaderTimeout = envDuration("READ_HEADER_TIMEOUT", 5*time.Second)
+	readTimeout = envDuration("READ_TIMEOUT", 30*time.Second)
+	writeTimeout = envDuration("WRITE_TIMEOUT", time.Minute)
+	idleTimeout = envDuration("IDLE_TIMEOUT", 2*time.Minute)
+	maxHeaderBytes = envInt("MAX_HEADER_BYTES", 64<<10)
+}
+
+var errOverBudget = errors.New("lookup exceeded LOOKUP_BUDGET")
+
+var lookupsOverBudget atomic.Int64
+
+// lookupWithinBudget looks up ip in store, but gives up on the query after
+// LOOKUP_BUDGET with errOverBudget. SQLite waiting on a lock doesn't always
+// notice its context is done, so the query is left to finish in the
+// background rather than waited for.
+func lookupWithinBudget(ctx context.Context, store RangeStore, datasetID int64, ip []byte) (*RangeRecord, error) {
+	if lookupBudget <= 0 {
+		return store.Lookup(ctx, datasetID, ip)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		r   *RangeRecord
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := store.Lookup(ctx, datasetID, ip)
+		done <- result{r, err}
+	}()
+
+	timer := time.NewTimer(lookupBudget)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.r, res.err
+	case <-timer.C:
+		if !doNotPersist(ctx) {
+			lookupsOverBudget.Add(1)
+		}
+		return nil, errOverBudget
+	}
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return trackServer(&http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+	})
+}
+
+// withTimeout gives the request a deadline of REQUEST_TIMEOUT, which the
+// database queries made for it inherit.
+func withTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 {
+			next(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// clearWriteDeadline lifts WRITE_TIMEOUT for responses that legitimately take
+// long, like dataset exports and CPU profiles.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The Tor Project publishes the exit relays it has seen within the last day.
+// Exits change by the hour, so the list is fetched on its own schedule rather
+// than with the daily dataset, and sets is_tor together with TOR_RANGES_URL.
+
+const defaultTorExitListURL = "https://check.torproject.org/exit-addresses"
+
+// TorExit is an exit relay address.
+type TorExit struct {
+	IP          string `json:"ip"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// LastSeen is when the Tor Project last saw traffic leave from the IP.
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+var (
+	torExitsEnabled  bool
+	torExitListURL   string
+	torExitsInterval time.Duration
+
+	// torExits is replaced as a whole, so lookups read it without locking.
+	torExits atomic.Pointer[torExitSet]
+)
+
+// torExitSet is an exit list and when it was fetched.
+type torExitSet struct {
+	exits     map[netip.Addr]bool
+	updatedAt time.Time
+}
+
+func loadTorExitConfig() {
+	torExitsEnabled = envBool("TOR_EXITS_ENABLED", false)
+	torExitListURL = os.Getenv("TOR_EXIT_LIST_URL")
+	if torExitListURL == "" {
+		torExitListURL = defaultTorExitListURL
+	}
+	torExitsInterval = envDuration("TOR_EXITS_INTERVAL", time.Hour)
+}
+
+func createTorExitsTables() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS tor_exits (
+			ip TEXT PRIMARY KEY,
+			fingerprint TEXT NOT NULL DEFAULT '',
+			last_seen INTEGER
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tor_exits table: %v", err)
+	}
+	_, err = db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS tor_exits_updates (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			url TEXT NOT NULL,
+			exits INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tor_exits_updates table: %v", err)
+	}
+	return nil
+}
+
+// loadTorExits reads the stored exits into memory.
+func loadTorExits() error {
+	var updatedAt int64
+	err := db.Load().QueryRow("SELECT updated_at FROM tor_exits_updates WHERE id = 1").Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to load Tor exits: %v", err)
+	}
+
+	rows, err := db.Load().Query("SELECT ip FROM tor_exits")
+	if err != nil {
+		return fmt.Errorf("failed to load Tor exits: %v", err)
+	}
+	defer rows.Close()
+	exits := map[netip.Addr]bool{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			return fmt.Errorf("failed to load Tor exits: %v", err)
+		}
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			exits[addr.Unmap()] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load Tor exits: %v", err)
+	}
+
+	torExits.Store(&torExitSet{exits: exits, updatedAt: time.Unix(updatedAt, 0).UTC()})
+	return nil
+}
+
+// isTorExit reports whether ip, in the length lookups use, is a known exit.
+func isTorExit(ip []byte) bool {
+	s := torExits.Load()
+	if s == nil {
+		return false
+	}
+	addr, _ := netip.AddrFromSlice(ip)
+	return s.exits[addr.Unmap()]
+}
+
+// torExitsUpdatedAt returns when the exit list was fetched, zero if never.
+func torExitsUpdatedAt() time.Time {
+	if s := torExits.Load(); s != nil {
+		return s.updatedAt
+	}
+	return time.Time{}
+}
+
+// startTorExitUpdater fetches the exit list every TOR_EXITS_INTERVAL, right
+// away when the stored one is older than that.
+func startTorExitUpdater() {
+	if !torExitsEnabled {
+		return
+	}
+	go func() {
+		wait := torExitsInterval - time.Since(torExitsUpdatedAt())
+		for {
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+			if err := updateTorExits(); err != nil {
+				log.Printf("Error updating Tor exits: %v", err)
+			}
+			wait = torExitsInterval
+		}
+	}()
+}
+
+func updateTorExits() error {
+	f, err := os.CreateTemp("", "tor_exits_*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := download(torExitListURL, nil, f); err != nil {
+		return fmt.Errorf("failed to download: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	exits, err := parseTorExitList(f)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM tor_exits"); err != nil {
+		return fmt.Errorf("failed to delete old exits: %v", err)
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO tor_exits (ip, fingerprint, last_seen) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+	for _, e := range exits {
+		var lastSeen interface{}
+		if e.LastSeen != nil {
+			lastSeen = e.LastSeen.Unix()
+		}
+		if _, err := stmt.Exec(e.IP, e.Fingerprint, lastSeen); err != nil {
+			return fmt.Errorf("failed to insert exit: %v", err)
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO tor_exits_updates (id, url, exits, updated_at) VALUES (1, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET url = excluded.url, exits = excluded.exits, updated_at = excluded.updated_at
+	`, torExitListURL, len(exits), now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record update: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	log.Printf("Loaded %d Tor exits", len(exits))
+	return loadTorExits()
+}
+
+// parseTorExitList reads the Tor Project's exit-addresses format, blocks of
+//
+//	ExitNode <fingerprint>
+//	ExitAddress <ip> <date> <time>
+//
+// or a plain list with one IP per line like torbulkexitlist.
+func parseTorExitList(r io.Reader) ([]TorExit, error) {
+	var exits []TorExit
+	fingerprint := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "ExitNode":
+			if len(fields) > 1 {
+				fingerprint = fields[1]
+			}
+		case "ExitAddress":
+			if len(fields) < 2 || net.ParseIP(fields[1]) == nil {
+				continue
+			}
+			e := TorExit{IP: net.ParseIP(fields[1]).String(), Fingerprint: fingerprint}
+			if len(fields) >= 4 {
+				if t, err := time.Parse("2006-01-02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+					e.LastSeen = &t
+				}
+			}
+			exits = append(exits, e)
+		default:
+			if ip := net.ParseIP(fields[0]); ip != nil {
+				exits = append(exits, TorExit{IP: ip.String()})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read list: %v", err)
+	}
+	if len(exits) == 0 {
+		return nil, fmt.Errorf("no exits in the list")
+	}
+	return exits, nil
+}
+
+// torExitsHandler lists the known exits as JSON, or with ?format=text one IP
+// per line for firewalls.
+func torExitsHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid format, expected json or text")
+		return
+	}
+
+	rows, err := db.Load().QueryContext(r.Context(), "SELECT ip, fingerprint, last_seen FROM tor_exits")
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	exits := []TorExit{}
+	for rows.Next() {
+		var e TorExit
+		var lastSeen sql.NullInt64
+		if err := rows.Scan(&e.IP, &e.Fingerprint, &lastSeen); err != nil {
+			logRequest(r, "Database query error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		if lastSeen.Valid {
+			t := time.Unix(lastSeen.Int64, 0).UTC()
+			e.LastSeen = &t
+		}
+		exits = append(exits, e)
+	}
+	if err := rows.Err(); err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	sort.Slice(exits, func(i, j int) bool {
+		a, b := lookupBytes(net.ParseIP(exits[i].IP)), lookupBytes(net.ParseIP(exits[j].IP))
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return string(a) < string(b)
+	})
+
+	updatedAt := torExitsUpdatedAt()
+	if !updatedAt.IsZero() {
+		w.Header().Set("Last-Modified", updatedAt.Format(http.TimeFormat))
+	}
+
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, e := range exits {
+			fmt.Fprintln(bw, e.IP)
+		}
+		bw.Flush()
+		return
+	}
+
+	resp := map[string]interface{}{
+		"count": len(exits),
+		"exits": exits,
+	}
+	if !updatedAt.IsZero() {
+		resp["updated_at"] = updatedAt
+	}
+	json.NewEncoder(w).Encode(resp)
+}
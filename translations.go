@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	translationCountry   = "country"
+	translationContinent = "continent"
+)
+
+// translations maps type -> code -> language -> localized name.
+var translations = map[string]map[string]map[string]string{}
+
+func createTranslationsTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS translations (
+			type TEXT,
+			code TEXT,
+			lang TEXT,
+			name TEXT,
+			PRIMARY KEY (type, code, lang)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create translations table: %v", err)
+	}
+	return nil
+}
+
+// importTranslations replaces the translations table with the contents of a
+// CSV file with a header row containing the columns type, code, lang and name:
+//
+//	type,code,lang,name
+//	country,DE,fr,Allemagne
+//	continent,EU,de,Europa
+func importTranslations(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header of %s: %v", path, err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"type", "code", "lang", "name"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("%s has no %s column", path, name)
+		}
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM translations")
+	if err != nil {
+		return fmt.Errorf("failed to clear existing translations: %v", err)
+	}
+
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO translations (type, code, lang, name) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %v", err)
+	}
+	defer stmt.Close()
+
+	count := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+
+		kind := strings.ToLower(record[columns["type"]])
+		if kind != translationCountry && kind != translationContinent {
+			return fmt.Errorf("invalid translation type %q in %s", kind, path)
+		}
+		code := strings.ToUpper(record[columns["code"]])
+		lang := strings.ToLower(record[columns["lang"]])
+
+		_, err = stmt.Exec(kind, code, lang, record[columns["name"]])
+		if err != nil {
+			return fmt.Errorf("failed to insert translation: %v", err)
+		}
+		count++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	log.Printf("Imported %d translations from %s", count, path)
+	return nil
+}
+
+// loadTranslations reads the translations table into memory.
+func loadTranslations() error {
+	rows, err := db.Load().Query("SELECT type, code, lang, name FROM translations")
+	if err != nil {
+		return fmt.Errorf("failed to query translations: %v", err)
+	}
+	defer rows.Close()
+
+	loaded := map[string]map[string]map[string]string{}
+	for rows.Next() {
+		var kind, code, lang, name string
+		if err := rows.Scan(&kind, &code, &lang, &name); err != nil {
+			return fmt.Errorf("failed to scan translation: %v", err)
+		}
+		if loaded[kind] == nil {
+			loaded[kind] = map[string]map[string]string{}
+		}
+		if loaded[kind][code] == nil {
+			loaded[kind][code] = map[string]string{}
+		}
+		loaded[kind][code][lang] = name
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read translations: %v", err)
+	}
+
+	translations = loaded
+	return nil
+}
+
+// preferredLanguages returns the languages requested via ?lang= or the
+// Accept-Language header, most preferred first.
+func preferredLanguages(r *http.Request) []string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return []string{strings.ToLower(lang)}
+	}
+
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	result := make([]string, 0, len(langs))
+	for _, l := range langs {
+		result = append(result, l.lang)
+	}
+	return result
+}
+
+// translate returns the localized name for code in the first language that
+// has a translation, falling back from regional tags (pt-br) to the base
+// language (pt).
+func translate(kind, code string, langs []string) (string, string, bool) {
+	names := translations[kind][strings.ToUpper(code)]
+	if len(names) == 0 {
+		return "", "", false
+	}
+	for _, lang := range langs {
+		if name, ok := names[lang]; ok {
+			return name, lang, true
+		}
+		if base, _, found := strings.Cut(lang, "-"); found {
+			if name, ok := names[base]; ok {
+				return name, base, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// localize replaces the country and continent names in info with the
+// caller's preferred language and sets Content-Language accordingly.
+func localize(w http.ResponseWriter, r *http.Request, info *IPInfo) {
+	if len(translations) == 0 {
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	langs := preferredLanguages(r)
+	if len(langs) == 0 {
+		return
+	}
+
+	var used string
+	if name, lang, ok := translate(translationCountry, info.Country, langs); ok {
+		info.CountryName = name
+		used = lang
+	}
+	if name, lang, ok := translate(translationContinent, info.Continent, langs); ok {
+		info.ContinentName = name
+		if used == "" {
+			used = lang
+		}
+	}
+	if used != "" {
+		w.Header().Set("Content-Language", used)
+	}
+}
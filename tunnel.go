@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+)
+
+// 6to4 (2002::/16) and Teredo (2001::/32) addresses carry the IPv4 address of
+// the client at the other end of the tunnel. The dataset attributes them to
+// the tunnel relays, so the embedded address is looked up instead, unless
+// RESOLVE_TUNNELED_IPV4 is false.
+
+const (
+	tunnel6to4   = "6to4"
+	tunnelTeredo = "teredo"
+)
+
+var (
+	prefix6to4   = netip.MustParsePrefix("2002::/16")
+	prefixTeredo = netip.MustParsePrefix("2001::/32")
+
+	resolveTunneledIPv4 bool
+)
+
+// TunnelInfo says which IPv4 address a tunnel address was resolved as.
+type TunnelInfo struct {
+	Type string `json:"type"`
+	IPv4 string `json:"ipv4"`
+}
+
+// tunneledIPv4 returns the IPv4 address embedded in a 6to4 or Teredo address
+// and the kind of tunnel.
+func tunneledIPv4(addr netip.Addr) (netip.Addr, string, bool) {
+	if !addr.Is6() {
+		return netip.Addr{}, "", false
+	}
+	b := addr.As16()
+	switch {
+	case prefix6to4.Contains(addr):
+		return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]}), tunnel6to4, true
+	case prefixTeredo.Contains(addr):
+		// The client address is stored inverted.
+		return netip.AddrFrom4([4]byte{^b[12], ^b[13], ^b[14], ^b[15]}), tunnelTeredo, true
+	}
+	return netip.Addr{}, "", false
+}
+
+// lookupTunneled looks up the IPv4 address embedded in addr. The range of a
+// 6to4 answer is that of the tunnel addresses embedding the IPv4 range; a
+// Teredo answer has none, as the addresses embedding an IPv4 range aren't
+// contiguous.
+func lookupTunneled(ctx context.Context, ipStr string, v4 netip.Addr, kind string) (*IPInfo, error) {
+	info, err := lookupIP(ctx, v4.String())
+	if err != nil {
+		return nil, err
+	}
+	info.IP = ipStr
+	info.Tunnel = &TunnelInfo{Type: kind, IPv4: v4.String()}
+	var r *MatchedRange
+	if kind == tunnel6to4 && info.Range != nil {
+		start, err1 := netip.ParseAddr(info.Range.StartIP)
+		end, err2 := netip.ParseAddr(info.Range.EndIP)
+		if err1 == nil && err2 == nil {
+			r = newMatchedRange(embed6to4(start, 0x00), embed6to4(end, 0xff))
+		}
+	}
+	info.Range = r
+	return info, nil
+}
+
+// embed6to4 returns the 6to4 address of v4, with fill in every byte after
+// it.
+func embed6to4(v4 netip.Addr, fill byte) []byte {
+	b := make([]byte, 16)
+	b[0], b[1] = 0x20, 0x02
+	a := v4.As4()
+	copy(b[2:6], a[:])
+	for i := 6; i < 16; i++ {
+		b[i] = fill
+	}
+	return b
+}
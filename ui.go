@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The admin dashboard is a single static page that talks to the JSON admin
+// API, so it is served without authentication and asks for the admin token
+// in the browser.
+//
+//go:embed ui
+var uiAssets embed.FS
+
+func uiHandler() http.Handler {
+	assets, err := fs.Sub(uiAssets, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(assets)))
+}
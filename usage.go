@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Usage of each API key is kept as daily totals of requests and response
+// bytes, for charging tenants back. Like the audit log it is written by a
+// background goroutine so requests never wait on SQLite.
+
+const usageQueueSize = 10000
+
+type usageEntry struct {
+	keyID int64
+	day   string
+	bytes int64
+}
+
+type Usage struct {
+	KeyID    int64  `json:"key_id"`
+	KeyName  string `json:"key_name"`
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+var usageQueue chan usageEntry
+
+func createUsageTable() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS api_key_usage (
+			key_id INTEGER NOT NULL,
+			day TEXT NOT NULL,
+			requests INTEGER NOT NULL DEFAULT 0,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (key_id, day)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create api_key_usage table: %v", err)
+	}
+	return nil
+}
+
+// loadTodaysUsage returns the requests made by each key today, so quotas
+// don't start over when the server restarts.
+func loadTodaysUsage() (map[int64]*apiKeyUsage, error) {
+	day := time.Now().UTC().Format("2006-01-02")
+	rows, err := db.Load().Query("SELECT key_id, requests FROM api_key_usage WHERE day = ?", day)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load API key usage: %v", err)
+	}
+	defer rows.Close()
+
+	used := map[int64]*apiKeyUsage{}
+	for rows.Next() {
+		u := &apiKeyUsage{day: day}
+		var id int64
+		if err := rows.Scan(&id, &u.count); err != nil {
+			return nil, fmt.Errorf("failed to load API key usage: %v", err)
+		}
+		used[id] = u
+	}
+	return used, rows.Err()
+}
+
+// startUsageWriter starts the goroutine that adds queued requests to the
+// daily totals, one transaction for whatever is queued at the time.
+func startUsageWriter() {
+	usageQueue = make(chan usageEntry, usageQueueSize)
+	go func() {
+		for entry := range usageQueue {
+			batch := []usageEntry{entry}
+			for len(usageQueue) > 0 {
+				batch = append(batch, <-usageQueue)
+			}
+			if err := writeUsage(batch); err != nil {
+				log.Printf("Error writing API key usage: %v", err)
+			}
+		}
+	}()
+}
+
+func writeUsage(entries []usageEntry) error {
+	type usageKey struct {
+		keyID int64
+		day   string
+	}
+	totals := map[usageKey]*Usage{}
+	for _, e := range entries {
+		k := usageKey{e.keyID, e.day}
+		if totals[k] == nil {
+			totals[k] = &Usage{}
+		}
+		totals[k].Requests++
+		totals[k].Bytes += e.bytes
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for k, u := range totals {
+		_, err = tx.Exec(`
+			INSERT INTO api_key_usage (key_id, day, requests, bytes) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key_id, day) DO UPDATE SET requests = requests + excluded.requests, bytes = bytes + excluded.bytes
+		`, k.keyID, k.day, u.Requests, u.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to update usage of key %d: %v", k.keyID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// recordUsage queues a request made with the key k that sent bytes of
+// response body.
+func recordUsage(k *APIKey, bytes int64) {
+	entry := usageEntry{keyID: k.ID, day: time.Now().UTC().Format("2006-01-02"), bytes: bytes}
+	select {
+	case usageQueue <- entry:
+	default:
+		log.Printf("Warning: Usage queue is full, dropping request of API key %d", k.ID)
+	}
+}
+
+// byteCounter counts the bytes of the response body.
+type byteCounter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (c *byteCounter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *byteCounter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(c.ResponseWriter).Hijack()
+}
+
+// parseDayParam accepts the same values as parseTimeParam and returns the
+// UTC day they fall on.
+func parseDayParam(v string) (string, error) {
+	t, err := parseTimeParam(v)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format("2006-01-02"), nil
+}
+
+// usageHandler lists the daily usage of the API keys, as JSON or with
+// ?format=csv as a spreadsheet-friendly export.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	query := `
+		SELECT u.key_id, COALESCE(k.name, ''), u.day, u.requests, u.bytes
+		FROM api_key_usage u LEFT JOIN api_keys k ON k.id = u.key_id
+		WHERE 1 = 1
+	`
+	var args []interface{}
+
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid format, expected json or csv")
+		return
+	}
+	if v := params.Get("key"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid key")
+			return
+		}
+		query += " AND u.key_id = ?"
+		args = append(args, id)
+	}
+	if v := params.Get("since"); v != "" {
+		day, err := parseDayParam(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid since")
+			return
+		}
+		query += " AND u.day >= ?"
+		args = append(args, day)
+	}
+	if v := params.Get("until"); v != "" {
+		day, err := parseDayParam(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid until")
+			return
+		}
+		query += " AND u.day < ?"
+		args = append(args, day)
+	}
+	query += " ORDER BY u.day, u.key_id"
+
+	rows, err := db.Load().Query(query, args...)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+	defer rows.Close()
+
+	usage := []Usage{}
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.KeyID, &u.KeyName, &u.Day, &u.Requests, &u.Bytes); err != nil {
+			logRequest(r, "Database query error: %v", err)
+			writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+			return
+		}
+		usage = append(usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"day", "key_id", "key_name", "requests", "bytes"})
+		for _, u := range usage {
+			cw.Write([]string{u.Day, strconv.FormatInt(u.KeyID, 10), u.KeyName, strconv.FormatInt(u.Requests, 10), strconv.FormatInt(u.Bytes, 10)})
+		}
+		cw.Flush()
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"usage": usage,
+	})
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --validate-config checks what a server needs to start and keep its data up
+// to date, without starting it or changing anything: every setting, then
+// whether the upstream data can be reached, the data directory written and
+// the database read, and whether authentication is set up. Each problem is
+// reported with what to do about it, and the exit status is 1 if any is an
+// error, so deployments can run it before rolling out a configuration.
+
+const (
+	diagnosticOK      = "ok"
+	diagnosticWarning = "warning"
+	diagnosticError   = "error"
+)
+
+// diagnostic is the outcome of a check of --validate-config.
+type diagnostic struct {
+	check   string
+	level   string
+	message string
+}
+
+func runConfigValidation(restorePath string, forceUpdate bool) int {
+	errs := loadConfig(restorePath, forceUpdate)
+	if _, err := loadKafkaConfig(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := loadSyslogConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	var diagnostics []diagnostic
+	for _, err := range errs {
+		diagnostics = append(diagnostics, diagnostic{"config", diagnosticError, err.Error()})
+	}
+	if len(errs) == 0 {
+		diagnostics = append(diagnostics, diagnostic{"config", diagnosticOK, "All settings are valid"})
+	}
+	diagnostics = append(diagnostics, checkDataSource())
+	diagnostics = append(diagnostics, checkDataDir())
+	diagnostics = append(diagnostics, checkDatabaseSchema())
+	diagnostics = append(diagnostics, checkAuthConfig()...)
+
+	status := 0
+	for _, d := range diagnostics {
+		fmt.Printf("%-8s %-9s %s\n", d.level, d.check, d.message)
+		if d.level == diagnosticError {
+			status = 1
+		}
+	}
+	return status
+}
+
+// checkDataSource checks that the data can be fetched from IP_DATA_URL, or
+// from the primary of a follower.
+func checkDataSource() diagnostic {
+	switch {
+	case updatesDisabled():
+		return diagnostic{"data_url", diagnosticOK, "Updates are disabled, the data isn't fetched"}
+	case isFollower():
+		d, err := remoteStatus(primaryURL, primaryToken)
+		if err != nil {
+			return diagnostic{"data_url", diagnosticError, fmt.Sprintf("Can't reach the primary %s: %v. Check PRIMARY_URL and PRIMARY_TOKEN", primaryURL, err)}
+		}
+		return diagnostic{"data_url", diagnosticOK, fmt.Sprintf("The primary %s serves dataset %d", primaryURL, d.ID)}
+	case dataURL == "" || downloadClient == nil:
+		return diagnostic{"data_url", diagnosticError, "Not checked, fix the configuration first"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, dataURL, nil)
+	if err != nil {
+		return diagnostic{"data_url", diagnosticError, fmt.Sprintf("Invalid IP_DATA_URL: %v", err)}
+	}
+	for name, values := range dataHeader {
+		req.Header[name] = values
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return diagnostic{"data_url", diagnosticError, fmt.Sprintf("Can't reach %s: %v. Check the URL, DNS, and DATA_PROXY_URL or HTTPS_PROXY", downloadHost(dataURL), err)}
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return diagnostic{"data_url", diagnosticOK, fmt.Sprintf("%s answered %s", downloadHost(dataURL), resp.Status)}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return diagnostic{"data_url", diagnosticError, fmt.Sprintf("%s answered %s. Check DATA_AUTH_TOKEN, DATA_BASIC_AUTH_USER or DATA_HEADERS", downloadHost(dataURL), resp.Status)}
+	case resp.StatusCode == http.StatusMethodNotAllowed:
+		// Some servers only answer GET, which would start a download.
+		return diagnostic{"data_url", diagnosticWarning, fmt.Sprintf("%s is reachable but doesn't answer HEAD, so the file wasn't checked", downloadHost(dataURL))}
+	}
+	return diagnostic{"data_url", diagnosticError, fmt.Sprintf("%s answered %s. Check IP_DATA_URL", downloadHost(dataURL), resp.Status)}
+}
+
+// checkDataDir checks that the database can be read, and unless it is
+// read-only, that it and its directory can be written.
+func checkDataDir() diagnostic {
+	if dbReadOnly {
+		f, err := os.Open(dbFile)
+		if err != nil {
+			return diagnostic{"data_dir", diagnosticError, fmt.Sprintf("DB_READ_ONLY is set but the database can't be read: %v", err)}
+		}
+		f.Close()
+		return diagnostic{"data_dir", diagnosticOK, fmt.Sprintf("%s is readable", dbFile)}
+	}
+
+	dir := filepath.Dir(dbFile)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		// The directory is created at startup, in the closest one that
+		// exists.
+		parent := filepath.Dir(dir)
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := checkWritableDir(parent); err != nil {
+			return diagnostic{"data_dir", diagnosticError, fmt.Sprintf("%s doesn't exist and can't be created: %v. Create it or set DATA_DIR", dir, err)}
+		}
+		return diagnostic{"data_dir", diagnosticOK, fmt.Sprintf("%s doesn't exist yet and will be created", dir)}
+	} else if err != nil {
+		return diagnostic{"data_dir", diagnosticError, fmt.Sprintf("Can't access %s: %v", dir, err)}
+	}
+	if err := checkWritableDir(dir); err != nil {
+		return diagnostic{"data_dir", diagnosticError, fmt.Sprintf("%s isn't writable: %v. Fix its permissions, or set DB_READ_ONLY=true to serve the database as is", dir, err)}
+	}
+	if f, err := os.OpenFile(dbFile, os.O_WRONLY, 0); err == nil {
+		f.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return diagnostic{"data_dir", diagnosticError, fmt.Sprintf("%s isn't writable: %v. Fix its permissions, or set DB_READ_ONLY=true to serve it as is", dbFile, err)}
+	}
+	return diagnostic{"data_dir", diagnosticOK, fmt.Sprintf("%s is writable", dir)}
+}
+
+// checkWritableDir creates and removes a file in dir, which is what SQLite
+// does with its journal.
+func checkWritableDir(dir string) error {
+	f, err := os.CreateTemp(dir, ".validate-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkDatabaseSchema checks that the database has the tables and columns
+// lookups query, and the latest schema version. A writable database that
+// lacks some is upgraded at startup, a read-only one can't be.
+func checkDatabaseSchema() diagnostic {
+	if _, err := os.Stat(dbFile); errors.Is(err, os.ErrNotExist) {
+		return diagnostic{"database", diagnosticOK, fmt.Sprintf("%s doesn't exist yet and will be created", dbFile)}
+	}
+	conn, err := openDatabase("file:" + dbFile + "?mode=ro")
+	if err != nil {
+		return diagnostic{"database", diagnosticError, err.Error()}
+	}
+	defer conn.Close()
+
+	var cookie int
+	if err := conn.QueryRow("PRAGMA schema_version").Scan(&cookie); err != nil {
+		return diagnostic{"database", diagnosticError, fmt.Sprintf("%s can't be read as a SQLite database: %v. Restore it from a backup or remove it", dbFile, err)}
+	}
+	var datasets int
+	err = conn.QueryRow("SELECT COUNT(*) FROM datasets").Scan(&datasets)
+	if err == nil {
+		_, err = conn.Exec("SELECT " + datasetColumns + " FROM datasets LIMIT 0")
+	}
+	if err == nil {
+		var stmt *sql.Stmt
+		for _, query := range []string{sqliteLookupQuery, sqliteLookupQueryV4} {
+			if stmt, err = conn.Prepare(query); err != nil {
+				break
+			}
+			stmt.Close()
+		}
+	}
+	var version int
+	if err == nil {
+		version, err = schemaVersion(conn)
+	}
+	latest := latestSchemaVersion()
+	switch {
+	case err != nil && dbReadOnly:
+		return diagnostic{"database", diagnosticError, fmt.Sprintf("The schema of %s is outdated or broken (%v). Open it once without DB_READ_ONLY to upgrade it", dbFile, err)}
+	case err != nil:
+		return diagnostic{"database", diagnosticWarning, fmt.Sprintf("The schema of %s is outdated (%v) and will be upgraded at startup", dbFile, err)}
+	case version < latest && dbReadOnly:
+		return diagnostic{"database", diagnosticError, fmt.Sprintf("The schema of %s is at version %d of %d. Open it once without DB_READ_ONLY to migrate it", dbFile, version, latest)}
+	case version < latest:
+		return diagnostic{"database", diagnosticWarning, fmt.Sprintf("The schema of %s is at version %d of %d and will be migrated at startup", dbFile, version, latest)}
+	case datasets == 0:
+		return diagnostic{"database", diagnosticOK, fmt.Sprintf("The schema of %s is up to date at version %d, no dataset is loaded yet", dbFile, version)}
+	}
+	return diagnostic{"database", diagnosticOK, fmt.Sprintf("The schema of %s is up to date at version %d, datasets loaded: %d", dbFile, version, datasets)}
+}
+
+// checkAuthConfig points out authentication set up in ways that are valid
+// but probably not intended.
+func checkAuthConfig() []diagnostic {
+	var diagnostics []diagnostic
+	switch {
+	case adminToken == "":
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, "ADMIN_TOKEN is not set, so the admin API is disabled"})
+	case len(adminToken) < 16:
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, "ADMIN_TOKEN is shorter than 16 characters, use a longer random token"})
+	case adminAddr == "":
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticOK, "The admin API is served on the public port, set ADMIN_ADDR to serve it separately"})
+	default:
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticOK, fmt.Sprintf("The admin API is served on %s", adminAddr)})
+	}
+
+	if dataHeader.Get("Authorization") != "" && strings.HasPrefix(dataURL, "http://") {
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, "IP_DATA_URL is plain HTTP, so its credentials are sent unencrypted"})
+	}
+
+	if clientCountryPolicy.enabled() && trustedProxies == nil {
+		diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, "CLIENT_COUNTRY_* is set without TRUSTED_PROXIES, so the policy applies to the address of the connection and ignores X-Forwarded-For. Set TRUSTED_PROXIES to the proxies in front of the service"})
+	}
+
+	if apiKeysRequired {
+		keys, err := countAPIKeys()
+		switch {
+		case err != nil:
+			diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, fmt.Sprintf("API_KEYS_REQUIRED is set but the API keys can't be counted: %v", err)})
+		case keys == 0:
+			diagnostics = append(diagnostics, diagnostic{"auth", diagnosticWarning, "API_KEYS_REQUIRED is set but there are no enabled API keys, so every lookup will be rejected. Create one with POST /admin/keys"})
+		default:
+			diagnostics = append(diagnostics, diagnostic{"auth", diagnosticOK, fmt.Sprintf("API keys are required, %d are enabled", keys)})
+		}
+	}
+	return diagnostics
+}
+
+// countAPIKeys counts the enabled API keys of the database, if it exists.
+func countAPIKeys() (int, error) {
+	if _, err := os.Stat(dbFile); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	conn, err := openDatabase("file:" + dbFile + "?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	var keys int
+	err = conn.QueryRow("SELECT COUNT(*) FROM api_keys WHERE NOT disabled").Scan(&keys)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return 0, nil
+	}
+	return keys, err
+}
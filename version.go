@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Answers only change when another dataset becomes active, so every
+// response says which dataset produced it and GET /version tells clients
+// holding cached answers whether they are still current. The version is the
+// date a dataset was loaded and repeats when several are loaded on the same
+// day; its id never does.
+
+const datasetIDHeader = "X-Dataset-Id"
+
+// VersionResponse is the answer of GET /version.
+type VersionResponse struct {
+	DatasetID       int64     `json:"dataset_id"`
+	DatasetVersion  string    `json:"dataset_version"`
+	LoadedAt        time.Time `json:"loaded_at"`
+	UpstreamVersion string    `json:"upstream_version,omitempty"`
+}
+
+// datasetVersionMiddleware adds the id and version of the active dataset to
+// every response. Historical lookups replace them with those of the dataset
+// they used.
+func datasetVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := activeDatasetID.Load(); id != 0 {
+			w.Header().Set(datasetIDHeader, strconv.FormatInt(id, 10))
+			w.Header().Set(datasetVersionHeader, datasetVersion())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// datasetETag is the entity tag of the answers of dataset id.
+func datasetETag(id int64) string {
+	return fmt.Sprintf(`"dataset-%d"`, id)
+}
+
+// versionHandler returns the active dataset, with an ETag clients can
+// revalidate with If-None-Match to learn cheaply that it hasn't changed.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	id := activeDatasetID.Load()
+	if id == 0 {
+		writeUnavailable(w, r, "No dataset loaded yet")
+		return
+	}
+	d, err := datasetSource(id)
+	if err != nil {
+		logRequest(r, "Database query error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+		return
+	}
+
+	etag := datasetETag(id)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == etag || tag == "W/"+etag || tag == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(VersionResponse{
+		DatasetID:       id,
+		DatasetVersion:  d.DatasetVersion,
+		LoadedAt:        d.LoadedAt,
+		UpstreamVersion: d.UpstreamVersion,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Right after a deploy none of the database is in the page cache, so the
+// first requests pay for reading it from disk. The warm-up pass reads it
+// ahead, before the server starts listening.
+
+var (
+	// warmupIndex reads the lookup index and rows of the active dataset.
+	warmupIndex bool
+	// warmupIPsFile lists hot IPs, one per line, that are looked up once.
+	warmupIPsFile string
+	warmupTimeout time.Duration
+)
+
+func loadWarmupConfig() {
+	warmupIndex = envBool("WARMUP", false)
+	warmupIPsFile = os.Getenv("WARMUP_IPS_FILE")
+	warmupTimeout = envDuration("WARMUP_TIMEOUT", time.Minute)
+}
+
+// warmUp runs the warm-up pass if one is configured. It gives up after
+// WARMUP_TIMEOUT, as a cold start is better than none.
+func warmUp() {
+	if !warmupIndex && warmupIPsFile == "" {
+		return
+	}
+	id := activeDatasetID.Load()
+	if id == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if warmupIndex {
+		err := warmUpIndex(ctx, id)
+		if err != nil {
+			log.Printf("Error warming up the index: %v", err)
+		}
+	}
+	if warmupIPsFile != "" {
+		n, err := warmUpIPs(ctx, warmupIPsFile)
+		if err != nil {
+			log.Printf("Error warming up from %s after %d IPs: %v", warmupIPsFile, n, err)
+		} else {
+			log.Printf("Warmed up %d IPs from %s", n, warmupIPsFile)
+		}
+	}
+	log.Printf("Warm-up finished in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// warmUpIndex reads every row of the dataset through the index lookups use,
+// which pulls both into the page cache.
+func warmUpIndex(ctx context.Context, datasetID int64) error {
+	var rows, size int64
+	err := db.Load().QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(country) + LENGTH(as_name)), 0)
+		FROM ip_ranges INDEXED BY idx_ip_range_dataset_int
+		WHERE dataset_id = ?
+	`, datasetID).Scan(&rows, &size)
+	if err != nil {
+		return err
+	}
+	log.Printf("Warmed up the index of dataset %d (%d ranges)", datasetID, rows)
+	return nil
+}
+
+// warmUpIPs looks up every IP in path, which also fills the caches of recent
+// and not found answers. Blank lines and lines starting with # are skipped.
+func warmUpIPs(ctx context.Context, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ctx = withoutCountryTraffic(ctx)
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ip := strings.TrimSpace(scanner.Text())
+		if ip == "" || strings.HasPrefix(ip, "#") {
+			continue
+		}
+		_, err := lookupIP(ctx, ip)
+		if ctx.Err() != nil {
+			return n, fmt.Errorf("stopped after WARMUP_TIMEOUT: %v", ctx.Err())
+		}
+		if err != nil && !errors.Is(err, errNotFound) && !errors.Is(err, errInvalidIP) {
+			return n, err
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
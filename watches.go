@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Watches are IPs and CIDRs, e.g. the ranges of partners, whose attribution
+// is compared after every refresh. When the country, continent or AS of any
+// part of a watched CIDR changes, the change is recorded and sent to the
+// webhook, so re-geolocated ranges are noticed before their users are.
+
+type Watch struct {
+	ID        int64     `json:"id"`
+	CIDR      string    `json:"cidr"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	network *net.IPNet
+}
+
+// WatchSegment is a part of a watched CIDR attributed to the same place by a
+// dataset. Parts in no range of the dataset have no segment.
+type WatchSegment struct {
+	StartIP   string `json:"start_ip"`
+	EndIP     string `json:"end_ip"`
+	Country   string `json:"country"`
+	Continent string `json:"continent"`
+	ASName    string `json:"as_name,omitempty"`
+	ASDomain  string `json:"as_domain,omitempty"`
+}
+
+// WatchChange is a change of a watch's attribution between two datasets.
+type WatchChange struct {
+	ID              int64          `json:"id"`
+	WatchID         int64          `json:"watch_id"`
+	CIDR            string         `json:"cidr"`
+	Name            string         `json:"name,omitempty"`
+	DatasetID       int64          `json:"dataset_id"`
+	Version         string         `json:"version"`
+	PreviousVersion string         `json:"previous_version"`
+	DetectedAt      time.Time      `json:"detected_at"`
+	Before          []WatchSegment `json:"before"`
+	After           []WatchSegment `json:"after"`
+}
+
+const defaultWatchChangesLimit = 100
+
+var errWatchNotFound = errors.New("watch not found")
+
+func createWatchesTables() error {
+	_, err := db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS watches (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			cidr TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create watches table: %v", err)
+	}
+	_, err = db.Load().Exec(`
+		CREATE TABLE IF NOT EXISTS watch_changes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			watch_id INTEGER NOT NULL,
+			dataset_id INTEGER NOT NULL,
+			version TEXT NOT NULL,
+			previous_version TEXT NOT NULL,
+			detected_at INTEGER NOT NULL,
+			before TEXT NOT NULL,
+			after TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create watch_changes table: %v", err)
+	}
+	_, err = db.Load().Exec("CREATE INDEX IF NOT EXISTS idx_watch_changes_watch ON watch_changes (watch_id)")
+	if err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+	return nil
+}
+
+func scanWatch(scan func(...interface{}) error) (*Watch, error) {
+	w := &Watch{}
+	var createdAt int64
+	if err := scan(&w.ID, &w.CIDR, &w.Name, &createdAt); err != nil {
+		return nil, err
+	}
+	w.CreatedAt = time.Unix(createdAt, 0).UTC()
+	var err error
+	_, w.network, err = net.ParseCIDR(w.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR %q of watch %d", w.CIDR, w.ID)
+	}
+	return w, nil
+}
+
+func listWatches() ([]*Watch, error) {
+	rows, err := db.Load().Query("SELECT id, cidr, name, created_at FROM watches ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watches: %v", err)
+	}
+	defer rows.Close()
+	watches := []*Watch{}
+	for rows.Next() {
+		w, err := scanWatch(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load watches: %v", err)
+		}
+		watches = append(watches, w)
+	}
+	return watches, rows.Err()
+}
+
+func getWatch(id int64) (*Watch, error) {
+	w, err := scanWatch(db.Load().QueryRow("SELECT id, cidr, name, created_at FROM watches WHERE id = ?", id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, errWatchNotFound
+	}
+	return w, err
+}
+
+// watchAttribution splits network into the segments the dataset attributes
+// to the same place. Between two consecutive range bounds the same ranges
+// cover every address, so a lookup at each bound finds the winner of the
+// whole segment, overlapping ranges included.
+func watchAttribution(ctx context.Context, datasetID int64, network *net.IPNet) ([]WatchSegment, error) {
+	start, end := networkRange(network)
+	startHi, startLo := ipIntegers(start)
+	endHi, endLo := ipIntegers(end)
+	rows, err := db.Load().QueryContext(ctx, `
+		SELECT start_ip, end_ip FROM ip_ranges
+		WHERE dataset_id = ? AND is_ipv6 = ? AND (start_hi, start_lo) <= (?, ?) AND (end_hi, end_lo) >= (?, ?)
+	`, datasetID, len(start) == 16, endHi, endLo, startHi, startLo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ranges of %s: %v", network, err)
+	}
+	defer rows.Close()
+
+	bounds := map[string][]byte{string(start): start}
+	for rows.Next() {
+		var rangeStart, rangeEnd []byte
+		if err := rows.Scan(&rangeStart, &rangeEnd); err != nil {
+			return nil, fmt.Errorf("failed to load ranges of %s: %v", network, err)
+		}
+		if bytes.Compare(rangeStart, start) > 0 {
+			bounds[string(rangeStart)] = rangeStart
+		}
+		if bytes.Compare(rangeEnd, end) < 0 {
+			if next, ok := ipAfter(rangeEnd); ok {
+				bounds[string(next)] = next
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load ranges of %s: %v", network, err)
+	}
+	points := make([][]byte, 0, len(bounds))
+	for _, b := range bounds {
+		points = append(points, b)
+	}
+	sort.Slice(points, func(i, j int) bool { return bytes.Compare(points[i], points[j]) < 0 })
+
+	store := sqliteStore
+	segments := []WatchSegment{}
+	contiguous := false
+	for i, p := range points {
+		segmentEnd := end
+		if i+1 < len(points) {
+			segmentEnd, _ = ipBefore(points[i+1])
+		}
+
+		r, err := store.Lookup(ctx, datasetID, p)
+		if errors.Is(err, errNotFound) {
+			contiguous = false
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %v", net.IP(p), err)
+		}
+		s := WatchSegment{
+			StartIP:   net.IP(p).String(),
+			EndIP:     net.IP(segmentEnd).String(),
+			Country:   r.Country,
+			Continent: r.Continent,
+			ASName:    r.ASName,
+			ASDomain:  r.ASDomain,
+		}
+		if n := len(segments); contiguous && sameWatchAttribution(segments[n-1], s) {
+			segments[n-1].EndIP = s.EndIP
+		} else {
+			segments = append(segments, s)
+		}
+		contiguous = true
+	}
+	return segments, nil
+}
+
+func sameWatchAttribution(a, b WatchSegment) bool {
+	return a.Country == b.Country && a.Continent == b.Continent && a.ASName == b.ASName && a.ASDomain == b.ASDomain
+}
+
+func sameWatchSegments(a, b []WatchSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// detectWatchChanges compares the attribution of every watch in the dataset
+// that was just activated with the one it replaced, records what changed and
+// sends a watch.changed webhook for each changed watch.
+func detectWatchChanges(previousID, datasetID int64) error {
+	if previousID == 0 {
+		return nil
+	}
+	watches, err := listWatches()
+	if err != nil || len(watches) == 0 {
+		return err
+	}
+
+	var version, previousVersion string
+	err = db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", datasetID).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("failed to load dataset %d: %v", datasetID, err)
+	}
+	err = db.Load().QueryRow("SELECT version FROM datasets WHERE id = ?", previousID).Scan(&previousVersion)
+	if err != nil {
+		return fmt.Errorf("failed to load dataset %d: %v", previousID, err)
+	}
+
+	ctx := context.Background()
+	changed := 0
+	for _, w := range watches {
+		before, err := watchAttribution(ctx, previousID, w.network)
+		if err != nil {
+			return err
+		}
+		after, err := watchAttribution(ctx, datasetID, w.network)
+		if err != nil {
+			return err
+		}
+		if sameWatchSegments(before, after) {
+			continue
+		}
+
+		c := WatchChange{
+			WatchID:         w.ID,
+			CIDR:            w.CIDR,
+			Name:            w.Name,
+			DatasetID:       datasetID,
+			Version:         version,
+			PreviousVersion: previousVersion,
+			DetectedAt:      time.Now().UTC(),
+			Before:          before,
+			After:           after,
+		}
+		beforeJSON, _ := json.Marshal(before)
+		afterJSON, _ := json.Marshal(after)
+		result, err := db.Load().Exec(`
+			INSERT INTO watch_changes (watch_id, dataset_id, version, previous_version, detected_at, before, after)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, c.WatchID, c.DatasetID, c.Version, c.PreviousVersion, c.DetectedAt.Unix(), string(beforeJSON), string(afterJSON))
+		if err != nil {
+			return fmt.Errorf("failed to record change of watch %d: %v", w.ID, err)
+		}
+		c.ID, _ = result.LastInsertId()
+		sendWebhook("watch.changed", c)
+		changed++
+	}
+	log.Printf("Dataset %d vs %d: %d of %d watches changed", datasetID, previousID, changed, len(watches))
+	return nil
+}
+
+// listWatchChanges returns the latest changes, of one watch when watchID
+// isn't 0, newest first.
+func listWatchChanges(ctx context.Context, watchID int64, limit int) ([]WatchChange, error) {
+	query := `
+		SELECT c.id, c.watch_id, w.cidr, w.name, c.dataset_id, c.version, c.previous_version, c.detected_at, c.before, c.after
+		FROM watch_changes c JOIN watches w ON w.id = c.watch_id
+	`
+	var args []interface{}
+	if watchID != 0 {
+		query += " WHERE c.watch_id = ?"
+		args = append(args, watchID)
+	}
+	query += " ORDER BY c.id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Load().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []WatchChange{}
+	for rows.Next() {
+		var c WatchChange
+		var detectedAt int64
+		var before, after string
+		err := rows.Scan(&c.ID, &c.WatchID, &c.CIDR, &c.Name, &c.DatasetID, &c.Version, &c.PreviousVersion, &detectedAt, &before, &after)
+		if err != nil {
+			return nil, err
+		}
+		c.DetectedAt = time.Unix(detectedAt, 0).UTC()
+		if err := json.Unmarshal([]byte(before), &c.Before); err != nil {
+			return nil, fmt.Errorf("invalid change %d: %v", c.ID, err)
+		}
+		if err := json.Unmarshal([]byte(after), &c.After); err != nil {
+			return nil, fmt.Errorf("invalid change %d: %v", c.ID, err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func watchID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "watch_not_found", "Watch not found")
+		return 0, false
+	}
+	return id, true
+}
+
+// writeWatchError maps errors of the watch handlers to a response.
+func writeWatchError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errWatchNotFound):
+		writeError(w, r, http.StatusNotFound, "watch_not_found", "Watch not found")
+	case err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed"):
+		writeError(w, r, http.StatusConflict, "watch_exists", "A watch for this CIDR already exists")
+	default:
+		logRequest(r, "Watch error: %v", err)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", "Internal server error")
+	}
+}
+
+func listWatchesHandler(w http.ResponseWriter, r *http.Request) {
+	watches, err := listWatches()
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"watches": watches})
+}
+
+// getWatchHandler shows a watch with its attribution in the active dataset
+// and its latest changes.
+func getWatchHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := watchID(w, r)
+	if !ok {
+		return
+	}
+	watch, err := getWatch(id)
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	attribution, err := watchAttribution(r.Context(), activeDatasetID.Load(), watch.network)
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	changes, err := listWatchChanges(r.Context(), id, defaultWatchChangesLimit)
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		*Watch
+		Attribution []WatchSegment `json:"attribution"`
+		Changes     []WatchChange  `json:"changes"`
+	}{watch, attribution, changes})
+}
+
+func createWatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CIDR string `json:"cidr"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Request body must be a JSON object")
+		return
+	}
+	network, err := parseCIDR(req.CIDR)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "Invalid watch: "+err.Error())
+		return
+	}
+
+	watch := &Watch{CIDR: network.String(), Name: strings.TrimSpace(req.Name), CreatedAt: time.Now().UTC(), network: network}
+	result, err := db.Load().Exec("INSERT INTO watches (cidr, name, created_at) VALUES (?, ?, ?)", watch.CIDR, watch.Name, watch.CreatedAt.Unix())
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	watch.ID, _ = result.LastInsertId()
+
+	logRequest(r, "Created watch %d for %s", watch.ID, watch.CIDR)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(watch)
+}
+
+func deleteWatchHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := watchID(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Load().Begin()
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("DELETE FROM watches WHERE id = ?", id)
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeWatchError(w, r, errWatchNotFound)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM watch_changes WHERE watch_id = ?", id); err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+
+	logRequest(r, "Deleted watch %d", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// watchChangesHandler lists the latest changes of every watch, newest first.
+func watchChangesHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultWatchChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, http.StatusBadRequest, "invalid_parameter", "Invalid limit")
+			return
+		}
+		limit = n
+	}
+	changes, err := listWatchChanges(r.Context(), 0, limit)
+	if err != nil {
+		writeWatchError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"changes": changes})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+var (
+	webhookURL    string
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+)
+
+// WebhookEvent is the body POSTed to WEBHOOK_URL.
+type WebhookEvent struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// sendWebhook posts the event to WEBHOOK_URL in the background. Delivery is
+// best effort: failures are logged and not retried.
+func sendWebhook(event string, data interface{}) {
+	if webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(WebhookEvent{Event: event, Timestamp: time.Now().UTC(), Data: data})
+	if err != nil {
+		log.Printf("Error encoding %s webhook: %v", event, err)
+		return
+	}
+
+	go func() {
+		if err := postWebhook(body); err != nil {
+			log.Printf("Error sending %s webhook: %v", event, err)
+		}
+	}()
+}
+
+func postWebhook(body []byte) error {
+	resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
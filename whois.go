@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rdapBootstrapIPv4 = "https://data.iana.org/rdap/ipv4.json"
+	rdapBootstrapIPv6 = "https://data.iana.org/rdap/ipv6.json"
+
+	rdapBootstrapTTL = 24 * time.Hour
+	whoisCacheSize   = 10000
+)
+
+type NetworkInfo struct {
+	Name       string `json:"name"`
+	Handle     string `json:"handle"`
+	StartIP    string `json:"start_ip"`
+	EndIP      string `json:"end_ip"`
+	Country    string `json:"country,omitempty"`
+	Org        string `json:"org,omitempty"`
+	AbuseName  string `json:"abuse_name,omitempty"`
+	AbuseEmail string `json:"abuse_email,omitempty"`
+	Source     string `json:"source"`
+}
+
+type WhoisResponse struct {
+	IP string `json:"ip"`
+	// Geo is the lookup of the IP, limited to the fields the API key may
+	// see, or nil when it isn't in the dataset.
+	Geo     interface{}  `json:"geo"`
+	Network *NetworkInfo `json:"network"`
+}
+
+var (
+	whoisEnabled bool
+	whoisCache   *ttlCache[string, *NetworkInfo]
+	whoisLimiter *rate.Limiter
+	rdapClient   = &http.Client{Timeout: 10 * time.Second}
+
+	rdapBootstrapMu sync.Mutex
+	// rdapServices maps a prefix from the IANA bootstrap files to the base
+	// URL of the RDAP service of the registry responsible for it.
+	rdapServices        map[*net.IPNet]string
+	rdapBootstrapLoaded time.Time
+)
+
+var errRDAPNotFound = errors.New("no RDAP service for address")
+
+func initWhois() {
+	whoisCache = newTTLCache[string, *NetworkInfo](envDuration("WHOIS_CACHE_TTL", 24*time.Hour), whoisCacheSize)
+	whoisLimiter = rate.NewLimiter(rate.Limit(envFloat("WHOIS_RATE_LIMIT", 1)), envInt("WHOIS_RATE_BURST", 5))
+}
+
+func whoisHandler(w http.ResponseWriter, r *http.Request) {
+	ipStr := mux.Vars(r)["ip"]
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		writeLookupError(w, r, errInvalidIP)
+		return
+	}
+
+	resp := WhoisResponse{IP: ipStr}
+
+	info, err := lookupIP(r.Context(), ipStr)
+	recordLookup(r, ipStr, err)
+	if errors.Is(err, errNotFound) {
+		info = nil
+	} else if err != nil {
+		writeLookupError(w, r, err)
+		return
+	}
+
+	network, ok := whoisCache.Get(ip.String())
+	if !ok {
+		if !whoisLimiter.Allow() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusTooManyRequests, "rate_limited", "Too many RDAP queries, try again later")
+			return
+		}
+
+		network, err = queryRDAP(r.Context(), ip)
+		if errors.Is(err, errRDAPNotFound) {
+			writeError(w, r, http.StatusNotFound, "not_found", "No registry is responsible for this address")
+			return
+		} else if err != nil {
+			logRequest(r, "RDAP query error: %v", err)
+			writeError(w, r, http.StatusBadGateway, "upstream_error", "RDAP query failed")
+			return
+		}
+		if !doNotPersist(r.Context()) {
+			whoisCache.Set(ip.String(), network)
+		}
+	}
+	resp.Network = network
+
+	if info != nil {
+		decorateInfo(w, r, info)
+		resp.Geo = visibleInfo(r, info)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// rdapBaseURL finds the RDAP service responsible for ip using the IANA
+// bootstrap registry, refreshing the registry once a day.
+func rdapBaseURL(ctx context.Context, ip net.IP) (string, error) {
+	rdapBootstrapMu.Lock()
+	defer rdapBootstrapMu.Unlock()
+
+	if rdapServices == nil || time.Since(rdapBootstrapLoaded) > rdapBootstrapTTL {
+		services := map[*net.IPNet]string{}
+		for _, url := range []string{rdapBootstrapIPv4, rdapBootstrapIPv6} {
+			if err := fetchRDAPBootstrap(ctx, url, services); err != nil {
+				return "", err
+			}
+		}
+		rdapServices = services
+		rdapBootstrapLoaded = time.Now()
+	}
+
+	var best *net.IPNet
+	for prefix := range rdapServices {
+		if !prefix.Contains(ip) {
+			continue
+		}
+		if best == nil {
+			best = prefix
+			continue
+		}
+		bestOnes, _ := best.Mask.Size()
+		ones, _ := prefix.Mask.Size()
+		if ones > bestOnes {
+			best = prefix
+		}
+	}
+	if best == nil {
+		return "", errRDAPNotFound
+	}
+	return rdapServices[best], nil
+}
+
+func fetchRDAPBootstrap(ctx context.Context, url string, services map[*net.IPNet]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rdapClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download RDAP bootstrap: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download RDAP bootstrap: %s", resp.Status)
+	}
+
+	var bootstrap struct {
+		Services [][][]string `json:"services"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&bootstrap); err != nil {
+		return fmt.Errorf("failed to decode RDAP bootstrap: %v", err)
+	}
+
+	for _, service := range bootstrap.Services {
+		if len(service) != 2 {
+			continue
+		}
+		var base string
+		for _, u := range service[1] {
+			// Prefer HTTPS, but take whatever is published.
+			if base == "" || strings.HasPrefix(u, "https://") {
+				base = u
+			}
+		}
+		if base == "" {
+			continue
+		}
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		for _, cidr := range service[0] {
+			_, prefix, err := net.ParseCIDR(cidr)
+			if err == nil {
+				services[prefix] = base
+			}
+		}
+	}
+	return nil
+}
+
+type rdapEntity struct {
+	Roles      []string        `json:"roles"`
+	VCardArray json.RawMessage `json:"vcardArray"`
+	Entities   []rdapEntity    `json:"entities"`
+}
+
+type rdapNetwork struct {
+	Handle       string       `json:"handle"`
+	Name         string       `json:"name"`
+	StartAddress string       `json:"startAddress"`
+	EndAddress   string       `json:"endAddress"`
+	Country      string       `json:"country"`
+	Port43       string       `json:"port43"`
+	Entities     []rdapEntity `json:"entities"`
+}
+
+func queryRDAP(ctx context.Context, ip net.IP) (*NetworkInfo, error) {
+	base, err := rdapBaseURL(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"ip/"+ip.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+
+	resp, err := rdapClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRDAPNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, base)
+	}
+
+	var network rdapNetwork
+	if err := json.NewDecoder(resp.Body).Decode(&network); err != nil {
+		return nil, fmt.Errorf("failed to decode RDAP response: %v", err)
+	}
+
+	info := &NetworkInfo{
+		Name:    network.Name,
+		Handle:  network.Handle,
+		StartIP: network.StartAddress,
+		EndIP:   network.EndAddress,
+		Country: network.Country,
+		Source:  strings.TrimSuffix(base, "/"),
+	}
+	walkRDAPEntities(network.Entities, info)
+	return info, nil
+}
+
+// walkRDAPEntities fills in the org and abuse contact from the (possibly
+// nested) entities attached to a network object.
+func walkRDAPEntities(entities []rdapEntity, info *NetworkInfo) {
+	for _, entity := range entities {
+		name, email := parseVCard(entity.VCardArray)
+		for _, role := range entity.Roles {
+			switch role {
+			case "registrant":
+				if info.Org == "" {
+					info.Org = name
+				}
+			case "abuse":
+				if info.AbuseEmail == "" {
+					info.AbuseName = name
+					info.AbuseEmail = email
+				}
+			}
+		}
+		walkRDAPEntities(entity.Entities, info)
+	}
+}
+
+// parseVCard extracts the formatted name and email from a jCard
+// (RFC 7095) array: ["vcard", [["fn", {}, "text", "Name"], ...]].
+func parseVCard(raw json.RawMessage) (string, string) {
+	var card []interface{}
+	if len(raw) == 0 || json.Unmarshal(raw, &card) != nil || len(card) != 2 {
+		return "", ""
+	}
+	properties, ok := card[1].([]interface{})
+	if !ok {
+		return "", ""
+	}
+
+	var name, email string
+	for _, p := range properties {
+		prop, ok := p.([]interface{})
+		if !ok || len(prop) < 4 {
+			continue
+		}
+		key, _ := prop[0].(string)
+		value, _ := prop[3].(string)
+		switch key {
+		case "fn":
+			name = value
+		case "email":
+			email = value
+		}
+	}
+	return name, email
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestWhoisHidesFieldsOfRestrictedKey checks that /whois shows a key limited
+// to some fields only those of the lookup, like /lookup does.
+func TestWhoisHidesFieldsOfRestrictedKey(t *testing.T) {
+	loadTestDataset(t, []testRange{
+		{netip.MustParseAddr("1.0.0.0"), netip.MustParseAddr("1.0.0.255"), "DE"},
+	})
+	initWhois()
+	// A cached network keeps the test from querying RDAP.
+	whoisCache.Set("1.0.0.1", &NetworkInfo{Name: "TEST-NET", Source: "rdap"})
+
+	r := httptest.NewRequest("GET", "/whois/1.0.0.1", nil)
+	r = mux.SetURLVars(r, map[string]string{"ip": "1.0.0.1"})
+	r = r.WithContext(context.WithValue(r.Context(), apiKeyCtxKey{}, &APIKey{Fields: []string{"country"}}))
+	w := httptest.NewRecorder()
+	whoisHandler(w, r)
+
+	var resp struct {
+		Geo     map[string]interface{} `json:"geo"`
+		Network *NetworkInfo           `json:"network"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if resp.Geo["country"] != "DE" {
+		t.Errorf("geo.country = %v, want DE", resp.Geo["country"])
+	}
+	for field := range resp.Geo {
+		if field != "ip" && field != "country" {
+			t.Errorf("geo has field %q the key can't see", field)
+		}
+	}
+	if resp.Network == nil || resp.Network.Name != "TEST-NET" {
+		t.Errorf("network = %+v, want the cached one", resp.Network)
+	}
+}